@@ -1,17 +1,22 @@
+// Decryptor recovers files of a drive without running the server. It can select files by tags or ids,
+// verify them or decrypt a single file to stdout. It prints a json report and exits with non-zero code,
+// if any file wasn't recovered
 package main
 
 import (
-	"bytes"
 	"crypto/sha256"
-	"encoding/json"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 	"sync"
 
 	"github.com/jessevdk/go-flags"
 	"github.com/minio/sio"
 	"github.com/pkg/errors"
 
+	"github.com/tags-drive/core/internal/storage/encryption"
 	"github.com/tags-drive/core/internal/storage/files"
 )
 
@@ -19,60 +24,134 @@ const (
 	workersCount = 5
 )
 
+// Exit codes
+const (
+	exitOK     = 0
+	exitFailed = 1 // some files weren't recovered
+	exitFatal  = 2 // invalid options or config files
+)
+
 type config struct {
-	PassPhrase string `long:"phrase" required:"true"`
+	// PassPhrase can be omitted, if the drive isn't encrypted
+	PassPhrase string `long:"phrase"`
+	// VaultPassPhrase is needed to decrypt files in the vault (if VAULT_PASS_PHRASE was set)
+	VaultPassPhrase string `long:"vault-phrase"`
 	//
 	FilesJSONFile string `long:"config-file" default:"./configs/files.json"`
+	TagsJSONFile  string `long:"tags-file" default:"./configs/tags.json"` // only for --tag-folders
 	//
 	OutputFolder string `short:"o" long:"output-folder" default:"./decrypted-files"`
 	// We don't need DataFolder field because there are valid paths to encrypted files in FilesJSONFile
 	// DataFolder string `long:"data-folder" default:"./data"`
+
+	// Selection
+
+	Expr         string `long:"expr" description:"tag expression, for example '1&(2|!3)'"`
+	IDs          []int  `long:"id" description:"id of a file (can be repeated)"`
+	IncludeTrash bool   `long:"include-trash" description:"recover files from the trash too"`
+
+	// Output
+
+	TagFolders bool   `long:"tag-folders" description:"put files into folders named after their first tag"`
+	Dedupe     bool   `long:"dedupe" description:"rename files with the same name instead of failing"`
+	VerifyOnly bool   `long:"verify" description:"only check that files can be decrypted"`
+	Stdout     bool   `long:"stdout" description:"write a single selected file to stdout"`
+	ReportFile string `long:"report" description:"path of the json report (stdout by default, stderr with --stdout)"`
 }
 
 type App struct {
 	config config
 
 	decodeKey [32]byte
+	vaultKey  [32]byte
+
+	// encrypted is true, if the drive is encrypted. It is set by Prepare
+	encrypted bool
+	// tags contains names of tags. It is filled by Prepare, if TagFolders is true
+	tags map[int]string
 }
 
-func NewApp() (*App, error) {
+func NewApp(args []string) (*App, error) {
 	app := new(App)
-	_, err := flags.Parse(&app.config)
+	_, err := flags.ParseArgs(&app.config, args)
 	if err != nil {
 		return nil, err
 	}
 
 	app.decodeKey = sha256.Sum256([]byte(app.config.PassPhrase))
+	if app.config.VaultPassPhrase != "" {
+		app.vaultKey = sha256.Sum256([]byte(app.config.VaultPassPhrase))
+	}
 
 	return app, nil
 }
 
-// Prepare creates OutputFolder and checks FilesJSONFile
+// Prepare checks options and FilesJSONFile and creates OutputFolder
 func (a *App) Prepare() error {
-	f, err := os.Open(a.config.FilesJSONFile)
+	if a.config.Stdout && (a.config.VerifyOnly || a.config.TagFolders) {
+		return errors.New("--stdout can't be used with --verify or --tag-folders")
+	}
+
+	state, err := encryption.DetectJSONFile(a.config.FilesJSONFile)
 	if err != nil {
-		return errors.Wrap(err, "invalid path to config file")
+		return errors.Wrap(err, "invalid config file")
+	}
+	a.encrypted = state == encryption.StateEncrypted
+
+	if a.encrypted && a.config.PassPhrase == "" {
+		return errors.New("drive is encrypted: --phrase is required")
 	}
-	f.Close()
 
-	err = os.MkdirAll(a.config.OutputFolder, 0666)
+	if a.config.TagFolders {
+		a.tags, err = a.readTags()
+		if err != nil {
+			return errors.Wrap(err, "can't read tags")
+		}
+	}
+
+	if a.config.VerifyOnly || a.config.Stdout {
+		return nil
+	}
+
+	err = os.MkdirAll(a.config.OutputFolder, 0700)
 	return errors.Wrap(err, "can't create output folder")
 }
 
-func (a *App) Decrypt() error {
+// Decrypt recovers selected files and returns a report. It returns an error only if files
+// can't be selected
+func (a *App) Decrypt() (*Report, error) {
 	filesList, err := a.getFilesList()
 	if err != nil {
-		return errors.Wrap(err, "invalid json file")
+		return nil, errors.Wrap(err, "invalid json file")
 	}
 
-	filesChan := make(chan files.File, 20)
+	report := newReport(a.mode())
 
-	// Fill filesChan
+	selected, err := a.selectFiles(filesList, report)
+	if err != nil {
+		return nil, err
+	}
+
+	if a.config.Stdout {
+		if len(selected) != 1 {
+			return nil, errors.Errorf("--stdout needs exactly one file, but %d files were selected", len(selected))
+		}
+
+		err := a.decryptFile(selected[0], os.Stdout)
+		report.add(newResult(selected[0], "", err))
+		return report, nil
+	}
+
+	tasks := a.planOutput(selected, report)
+
+	tasksChan := make(chan task, 20)
+
+	// Fill tasksChan
 	go func() {
-		for i := range filesList {
-			filesChan <- filesList[i]
+		for i := range tasks {
+			tasksChan <- tasks[i]
 		}
-		close(filesChan)
+		close(tasksChan)
 	}()
 
 	var wg sync.WaitGroup
@@ -81,91 +160,174 @@ func (a *App) Decrypt() error {
 		go func() {
 			defer wg.Done()
 
-			var err error
-			var path string
-			for file := range filesChan {
-				path = a.config.OutputFolder + "/" + file.Filename
-				err = a.decryptAndSaveFile(file.Origin, path)
+			for t := range tasksChan {
+				var err error
+				if a.config.VerifyOnly {
+					err = a.verifyFile(t.file)
+				} else {
+					err = a.decryptAndSaveFile(t.file, t.path)
+				}
+
 				if err != nil {
-					log.Printf("[ERR] can't decrypt file %s: %s\n", file.Filename, err)
+					log.Printf("[ERR] can't decrypt file %d (%s): %s\n", t.file.ID, t.file.Filename, err)
 				}
+				report.add(newResult(t.file, t.path, err))
 			}
 		}()
 	}
 
 	wg.Wait()
 
-	return nil
+	return report, nil
+}
+
+func (a *App) mode() string {
+	switch {
+	case a.config.Stdout:
+		return modeStdout
+	case a.config.VerifyOnly:
+		return modeVerify
+	default:
+		return modeDecrypt
+	}
+}
+
+// dataKey returns a key of a file. Files uploaded by old versions are encrypted with the master key
+func (a *App) dataKey(file files.File) ([32]byte, error) {
+	if file.Key == "" {
+		return a.decodeKey, nil
+	}
+
+	master := a.decodeKey
+	if file.VaultKey {
+		master = a.vaultKey
+	}
+
+	return encryption.UnwrapKey(file.Key, master)
+}
+
+// decryptFile writes the decrypted content of a file into w
+func (a *App) decryptFile(file files.File, w io.Writer) error {
+	return a.decryptBlob(file, file.Origin, w)
 }
 
-func (a *App) getFilesList() (res []files.File, err error) {
-	path := a.config.FilesJSONFile
-	f, err := os.Open(path)
+func (a *App) decryptBlob(file files.File, path string, w io.Writer) error {
+	src, err := os.Open(path)
 	if err != nil {
-		return res, err
+		return err
 	}
-	defer f.Close()
+	defer src.Close()
 
-	// Decrypt file
-	decryptedFile := new(bytes.Buffer)
+	if !a.encrypted {
+		_, err = io.Copy(w, src)
+		return err
+	}
 
-	_, err = sio.Decrypt(decryptedFile, f, sio.Config{
-		Key: a.decodeKey[:],
-	})
+	key, err := a.dataKey(file)
 	if err != nil {
-		return res, errors.Wrap(err, "can't decrypt file")
+		return err
 	}
 
-	// Decode json file
-	filesObj := make(map[int]files.File)
+	_, err = sio.Decrypt(w, src, sio.Config{
+		Key: key[:],
+	})
 
-	err = json.NewDecoder(decryptedFile).Decode(&filesObj)
+	return errors.Wrap(err, "can't decrypt file")
+}
+
+// verifyFile checks that a file and its preview can be decrypted. Missing preview isn't an error:
+// it isn't needed for recovery
+func (a *App) verifyFile(file files.File) error {
+	err := a.decryptBlob(file, file.Origin, ioutil.Discard)
 	if err != nil {
-		return res, err
+		return err
 	}
 
-	// Convert to array
-	res = make([]files.File, 0, len(filesObj))
-	for _, f := range filesObj {
-		res = append(res, f)
+	if file.Preview != "" {
+		err = a.decryptBlob(file, file.Preview, ioutil.Discard)
+		if err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "broken preview")
+		}
 	}
 
-	return res, nil
+	return nil
 }
 
-func (a *App) decryptAndSaveFile(encryptedFilePath, decryptedFilePath string) error {
-	encryptedFile, err := os.Open(encryptedFilePath)
+// decryptAndSaveFile decrypts a file with its own data key (or with the master key,
+// if the file was uploaded by an old version). The file at decryptedFilePath must not exist
+func (a *App) decryptAndSaveFile(file files.File, decryptedFilePath string) error {
+	err := os.MkdirAll(filepath.Dir(decryptedFilePath), 0700)
 	if err != nil {
 		return err
 	}
-	defer encryptedFile.Close()
 
-	decryptedFile, err := os.Create(decryptedFilePath)
+	decryptedFile, err := os.OpenFile(decryptedFilePath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
 	if err != nil {
 		return err
 	}
-	defer decryptedFile.Close()
 
-	_, err = sio.Decrypt(decryptedFile, encryptedFile, sio.Config{
-		Key: a.decodeKey[:],
-	})
+	err = a.decryptFile(file, decryptedFile)
+	decryptedFile.Close()
+	if err != nil {
+		// Don't leave a broken file
+		os.Remove(decryptedFilePath)
+	}
 
-	return errors.Wrap(err, "can't decrypt file")
+	return err
 }
 
-func main() {
-	app, err := NewApp()
+func run(args []string) int {
+	app, err := NewApp(args)
 	if err != nil {
-		log.Fatalln(err)
+		if flagsErr, ok := err.(*flags.Error); ok && flagsErr.Type == flags.ErrHelp {
+			return exitOK
+		}
+		return exitFatal
 	}
 
 	err = app.Prepare()
 	if err != nil {
-		log.Fatalln(err)
+		log.Println(err)
+		return exitFatal
+	}
+
+	report, err := app.Decrypt()
+	if err != nil {
+		log.Println(err)
+		return exitFatal
+	}
+
+	var reportWriter io.Writer = os.Stdout
+	if app.config.Stdout {
+		reportWriter = os.Stderr
+	}
+	if app.config.ReportFile != "" {
+		f, err := os.Create(app.config.ReportFile)
+		if err != nil {
+			log.Printf("can't create report file: %s\n", err)
+			return exitFatal
+		}
+		defer f.Close()
+		reportWriter = f
 	}
 
-	err = app.Decrypt()
+	err = report.write(reportWriter)
 	if err != nil {
-		log.Fatalln(err)
+		log.Printf("can't write report: %s\n", err)
+		return exitFatal
 	}
+
+	if report.Failed > 0 {
+		log.Printf("%d of %d files weren't recovered\n", report.Failed, report.Total)
+		return exitFailed
+	}
+
+	return exitOK
+}
+
+func main() {
+	// Log into stderr, so stdout can be used for a file or a report
+	log.SetOutput(os.Stderr)
+
+	os.Exit(run(os.Args[1:]))
 }
@@ -1,10 +1,21 @@
 package main
 
 import (
+	"bytes"
 	"crypto/sha256"
+	"encoding/json"
+	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 	"testing"
+
+	"github.com/minio/sio"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/tags-drive/core/internal/storage/encryption"
+	"github.com/tags-drive/core/internal/storage/files"
+	"github.com/tags-drive/core/internal/storage/tags"
 )
 
 const (
@@ -43,8 +54,225 @@ func TestDecryptor(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	err = app.Decrypt()
+	report, err := app.Decrypt()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Failed != 0 {
+		t.Fatalf("%d files weren't decrypted", report.Failed)
+	}
+}
+
+// testDrive is a drive created by tests
+type testDrive struct {
+	dir       string
+	encrypted bool
+	master    [32]byte
+
+	files map[int]files.File
+	tags  map[int]tags.Tag
+}
+
+func newTestDrive(t *testing.T, encrypted bool) *testDrive {
+	dir, err := ioutil.TempDir("", "decryptor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Mkdir(filepath.Join(dir, "data"), 0700)
+
+	return &testDrive{
+		dir:       dir,
+		encrypted: encrypted,
+		master:    sha256.Sum256([]byte(passphrase)),
+		files:     make(map[int]files.File),
+		tags: map[int]tags.Tag{
+			1: {ID: 1, Name: "photos"},
+			2: {ID: 2, Name: "docs/old"},
+		},
+	}
+}
+
+func (d *testDrive) addFile(t *testing.T, id int, filename, content string, tags []int, deleted bool) {
+	file := files.File{
+		ID:       id,
+		Filename: filename,
+		Origin:   filepath.Join(d.dir, "data", filename+string(rune('0'+id))),
+		Tags:     tags,
+		Deleted:  deleted,
+	}
+
+	data := []byte(content)
+	if d.encrypted {
+		key, wrapped, err := encryption.NewDataKey(d.master)
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.Key = wrapped
+
+		buff := new(bytes.Buffer)
+		sio.Encrypt(buff, bytes.NewReader(data), sio.Config{Key: key[:]})
+		data = buff.Bytes()
+	}
+
+	err := ioutil.WriteFile(file.Origin, data, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d.files[id] = file
+}
+
+func (d *testDrive) writeConfig(t *testing.T, name string, v interface{}) string {
+	data, _ := json.Marshal(v)
+	if d.encrypted {
+		buff := new(bytes.Buffer)
+		sio.Encrypt(buff, bytes.NewReader(data), sio.Config{Key: d.master[:]})
+		data = buff.Bytes()
+	}
+
+	path := filepath.Join(d.dir, name)
+	err := ioutil.WriteFile(path, data, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func (d *testDrive) newApp(t *testing.T, cnf config) *App {
+	cnf.FilesJSONFile = d.writeConfig(t, "files.json", d.files)
+	cnf.TagsJSONFile = d.writeConfig(t, "tags.json", d.tags)
+	cnf.OutputFolder = filepath.Join(d.dir, "output")
+	if d.encrypted {
+		cnf.PassPhrase = passphrase
+	}
+
+	return &App{
+		config:    cnf,
+		decodeKey: sha256.Sum256([]byte(cnf.PassPhrase)),
+	}
+}
+
+func (d *testDrive) run(t *testing.T, cnf config) *Report {
+	app := d.newApp(t, cnf)
+
+	err := app.Prepare()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := app.Decrypt()
 	if err != nil {
 		t.Fatal(err)
 	}
+
+	return report
+}
+
+func statuses(r *Report) map[int]string {
+	res := make(map[int]string)
+	for _, f := range r.Files {
+		res[f.ID] = f.Status
+	}
+	return res
+}
+
+func TestSelection(t *testing.T) {
+	for _, encrypted := range []bool{false, true} {
+		assert := assert.New(t)
+
+		d := newTestDrive(t, encrypted)
+		defer os.RemoveAll(d.dir)
+
+		d.addFile(t, 1, "a.jpg", "first", []int{1}, false)
+		d.addFile(t, 2, "b.txt", "second", []int{2}, false)
+		d.addFile(t, 3, "c.txt", "third", []int{1, 2}, false)
+		d.addFile(t, 4, "d.txt", "deleted", []int{1}, true)
+		d.files[5] = files.File{ID: 5, Filename: "enc:v1:AAAA", ClientEncrypted: true, Tags: []int{1}}
+
+		// Tag expression, trash is skipped
+		report := d.run(t, config{Expr: "1&!2", VerifyOnly: true})
+		assert.Equal(map[int]string{1: statusOK, 5: statusSkipped}, statuses(report), "encrypted: %t", encrypted)
+
+		// Trash is included
+		report = d.run(t, config{Expr: "1&!2", IncludeTrash: true, VerifyOnly: true})
+		assert.Equal(map[int]string{1: statusOK, 4: statusOK, 5: statusSkipped}, statuses(report))
+
+		// Ids. Unknown ids are failed
+		report = d.run(t, config{IDs: []int{2, 3, 10}, VerifyOnly: true})
+		assert.Equal(map[int]string{2: statusOK, 3: statusOK, 10: statusFailed}, statuses(report))
+		assert.Equal(1, report.Failed)
+
+		// Broken file
+		ioutil.WriteFile(d.files[2].Origin, []byte("broken"), 0600)
+		report = d.run(t, config{IDs: []int{2}, VerifyOnly: true})
+		if encrypted {
+			assert.Equal(map[int]string{2: statusFailed}, statuses(report))
+		}
+		_, err := os.Stat(filepath.Join(d.dir, "output"))
+		assert.True(os.IsNotExist(err), "--verify mustn't create output folder")
+	}
+}
+
+func TestOutput(t *testing.T) {
+	assert := assert.New(t)
+
+	d := newTestDrive(t, true)
+	defer os.RemoveAll(d.dir)
+
+	d.addFile(t, 1, "a.txt", "first", []int{2, 1}, false)
+	d.addFile(t, 2, "a.txt", "second", []int{1}, false)
+	d.addFile(t, 3, "b.txt", "third", nil, false)
+	d.addFile(t, 4, "c.txt", "fourth", []int{2}, false)
+
+	read := func(path string) string {
+		data, _ := ioutil.ReadFile(filepath.Join(d.dir, "output", path))
+		return string(data)
+	}
+
+	// Conflicting names fail without --dedupe
+	report := d.run(t, config{})
+	assert.Equal(map[int]string{1: statusOK, 2: statusFailed, 3: statusOK, 4: statusOK}, statuses(report))
+	assert.Equal("first", read("a.txt"))
+
+	// Existing files aren't overwritten
+	report = d.run(t, config{IDs: []int{2}, Dedupe: true})
+	assert.Equal(map[int]string{2: statusOK}, statuses(report))
+	assert.Equal("first", read("a.txt"))
+	assert.Equal("second", read("a (1).txt"))
+
+	os.RemoveAll(filepath.Join(d.dir, "output"))
+
+	// Tag folders
+	report = d.run(t, config{TagFolders: true, Dedupe: true})
+	assert.Equal(4, report.OK)
+	assert.Equal("first", read("photos/a.txt"))
+	assert.Equal("second", read("photos/a (1).txt"))
+	assert.Equal("third", read("untagged/b.txt"))
+	assert.Equal("fourth", read("docs_old/c.txt"))
+
+	// Stdout needs exactly one file
+	app := d.newApp(t, config{Stdout: true})
+	assert.Nil(app.Prepare())
+	_, err := app.Decrypt()
+	assert.NotNil(err)
+}
+
+func TestSanitizeName(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := []struct {
+		name string
+		res  string
+	}{
+		{"file.txt", "file.txt"},
+		{"../../etc/passwd", ".._.._etc_passwd"},
+		{"..", "def"},
+		{"a\x00b\nc", "abc"},
+		{"name. ", "name"},
+		{"", "def"},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(tt.res, sanitizeName(tt.name, "def"), tt.name)
+	}
 }
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/tags-drive/core/internal/storage/files"
+)
+
+// Modes
+const (
+	modeDecrypt = "decrypt"
+	modeVerify  = "verify"
+	modeStdout  = "stdout"
+)
+
+// Statuses of files
+const (
+	statusOK      = "ok"
+	statusSkipped = "skipped"
+	statusFailed  = "failed"
+)
+
+// Report is a machine-readable result of the decryptor
+type Report struct {
+	Mode    string `json:"mode"`
+	Total   int    `json:"total"`
+	OK      int    `json:"ok"`
+	Skipped int    `json:"skipped"`
+	Failed  int    `json:"failed"`
+
+	Files []Result `json:"files"`
+
+	mu sync.Mutex
+}
+
+// Result is a result of a single file
+type Result struct {
+	ID       int    `json:"id"`
+	Filename string `json:"filename,omitempty"`
+	Status   string `json:"status"`
+	// Path is a path of the decrypted file
+	Path string `json:"path,omitempty"`
+	// Reason is a reason of skipping
+	Reason string `json:"reason,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+func newReport(mode string) *Report {
+	return &Report{
+		Mode:  mode,
+		Files: []Result{},
+	}
+}
+
+func newResult(file files.File, path string, err error) Result {
+	if err != nil {
+		return failed(file, path, err)
+	}
+
+	return Result{ID: file.ID, Filename: file.Filename, Status: statusOK, Path: path}
+}
+
+func skipped(file files.File, reason string) Result {
+	return Result{ID: file.ID, Filename: file.Filename, Status: statusSkipped, Reason: reason}
+}
+
+func failed(file files.File, path string, err error) Result {
+	return Result{ID: file.ID, Filename: file.Filename, Status: statusFailed, Path: path, Error: err.Error()}
+}
+
+// add is safe for concurrent use
+func (r *Report) add(res Result) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.Files = append(r.Files, res)
+	r.Total++
+	switch res.Status {
+	case statusOK:
+		r.OK++
+	case statusSkipped:
+		r.Skipped++
+	case statusFailed:
+		r.Failed++
+	}
+}
+
+// write writes the report in json. Files are sorted by id
+func (r *Report) write(w io.Writer) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	sort.SliceStable(r.Files, func(i, j int) bool { return r.Files[i].ID < r.Files[j].ID })
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/minio/sio"
+	"github.com/pkg/errors"
+
+	"github.com/tags-drive/core/internal/storage/files"
+	"github.com/tags-drive/core/internal/storage/files/aggregation"
+	"github.com/tags-drive/core/internal/storage/tags"
+)
+
+// untaggedFolder is used by --tag-folders for files without tags
+const untaggedFolder = "untagged"
+
+type task struct {
+	file files.File
+	path string // empty for --verify
+}
+
+// readJSONFile decodes a json config file. The file is decrypted, if the drive is encrypted
+func (a *App) readJSONFile(path string, v interface{}) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if a.encrypted {
+		// Decrypt file
+		decryptedFile := new(bytes.Buffer)
+
+		_, err = sio.Decrypt(decryptedFile, f, sio.Config{
+			Key: a.decodeKey[:],
+		})
+		if err != nil {
+			return errors.Wrap(err, "can't decrypt file")
+		}
+		r = decryptedFile
+	}
+
+	return json.NewDecoder(r).Decode(v)
+}
+
+// getFilesList returns all files sorted by id
+func (a *App) getFilesList() ([]files.File, error) {
+	filesObj := make(map[int]files.File)
+
+	err := a.readJSONFile(a.config.FilesJSONFile, &filesObj)
+	if err != nil {
+		return nil, err
+	}
+
+	// Convert to array
+	res := make([]files.File, 0, len(filesObj))
+	for _, f := range filesObj {
+		res = append(res, f)
+	}
+
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+
+	return res, nil
+}
+
+// readTags returns names of tags. Missing file isn't an error: folders are named by tag ids
+func (a *App) readTags() (map[int]string, error) {
+	tagsObj := make(map[int]tags.Tag)
+
+	err := a.readJSONFile(a.config.TagsJSONFile, &tagsObj)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	res := make(map[int]string, len(tagsObj))
+	for id, t := range tagsObj {
+		res[id] = t.Name
+	}
+
+	return res, nil
+}
+
+// selectFiles returns files, which match --expr, --id and --include-trash. Files, which can't be
+// recovered (client-side encrypted files, vault files without --vault-phrase), are added into the report
+// as skipped. Unknown ids are added as failed
+func (a *App) selectFiles(list []files.File, report *Report) ([]files.File, error) {
+	expr, err := aggregation.ParseLogicalExpr(a.config.Expr)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid tag expression")
+	}
+
+	var ids map[int]bool
+	if len(a.config.IDs) > 0 {
+		ids = make(map[int]bool, len(a.config.IDs))
+		for _, id := range a.config.IDs {
+			ids[id] = true
+		}
+	}
+
+	var res []files.File
+	for _, file := range list {
+		if ids != nil && !ids[file.ID] {
+			continue
+		}
+		// The file exists, even if it doesn't match other options
+		delete(ids, file.ID)
+
+		if file.Deleted && !a.config.IncludeTrash {
+			continue
+		}
+		if expr != "" && !aggregation.IsGoodFile(expr, file.Tags) {
+			continue
+		}
+
+		switch {
+		case file.ClientEncrypted:
+			report.add(skipped(file, "file is encrypted by a client"))
+			continue
+		case a.encrypted && file.VaultKey && a.config.VaultPassPhrase == "":
+			report.add(skipped(file, "file is in the vault: --vault-phrase is required"))
+			continue
+		}
+
+		res = append(res, file)
+	}
+
+	// Remaining ids don't exist
+	missing := make([]int, 0, len(ids))
+	for id := range ids {
+		missing = append(missing, id)
+	}
+	sort.Ints(missing)
+	for _, id := range missing {
+		report.add(Result{ID: id, Status: statusFailed, Error: "file doesn't exist"})
+	}
+
+	return res, nil
+}
+
+// planOutput assigns output paths to files. Files with conflicting names are renamed (--dedupe)
+// or added into the report as failed. Existing files are never overwritten
+func (a *App) planOutput(list []files.File, report *Report) []task {
+	tasks := make([]task, 0, len(list))
+
+	if a.config.VerifyOnly {
+		for _, f := range list {
+			tasks = append(tasks, task{file: f})
+		}
+		return tasks
+	}
+
+	used := make(map[string]bool)
+	isFree := func(path string) bool {
+		if used[strings.ToLower(path)] {
+			return false
+		}
+		_, err := os.Lstat(path)
+		return os.IsNotExist(err)
+	}
+
+	for _, f := range list {
+		folder := a.config.OutputFolder
+		if a.config.TagFolders {
+			folder = filepath.Join(folder, a.tagFolder(f))
+		}
+
+		path := filepath.Join(folder, sanitizeName(f.Filename, fmt.Sprintf("file-%d", f.ID)))
+		if !isFree(path) {
+			if !a.config.Dedupe {
+				report.add(failed(f, path, errors.New("file with the same name already exists (use --dedupe)")))
+				continue
+			}
+
+			ext := filepath.Ext(path)
+			base := strings.TrimSuffix(path, ext)
+			for i := 1; !isFree(path); i++ {
+				path = fmt.Sprintf("%s (%d)%s", base, i, ext)
+			}
+		}
+
+		used[strings.ToLower(path)] = true
+		tasks = append(tasks, task{file: f, path: path})
+	}
+
+	return tasks
+}
+
+// tagFolder returns a name of a folder for a file: the name of its tag with the lowest id
+func (a *App) tagFolder(f files.File) string {
+	if len(f.Tags) == 0 {
+		return untaggedFolder
+	}
+
+	id := f.Tags[0]
+	for _, t := range f.Tags[1:] {
+		if t < id {
+			id = t
+		}
+	}
+
+	name, ok := a.tags[id]
+	if !ok {
+		name = fmt.Sprintf("tag-%d", id)
+	}
+
+	return sanitizeName(name, fmt.Sprintf("tag-%d", id))
+}
+
+// sanitizeName makes a name safe to use as a name of a file or a folder. It returns def,
+// if nothing is left
+func sanitizeName(name, def string) string {
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r < 0x20, r == 0x7f:
+			return -1
+		case strings.ContainsRune(`/\:*?"<>|`, r):
+			return '_'
+		default:
+			return r
+		}
+	}, name)
+
+	// Trailing dots and spaces are dropped by Windows
+	name = strings.TrimRight(strings.TrimSpace(name), ". ")
+	if name == "" {
+		return def
+	}
+
+	return name
+}
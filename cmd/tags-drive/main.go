@@ -3,9 +3,13 @@ package main
 import (
 	"crypto/sha256"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"net"
+	"net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strings"
 	"syscall"
 	"time"
@@ -15,6 +19,7 @@ import (
 	"github.com/pkg/errors"
 
 	"github.com/tags-drive/core/internal/storage/files"
+	"github.com/tags-drive/core/internal/storage/rekey"
 	"github.com/tags-drive/core/internal/storage/tags"
 	"github.com/tags-drive/core/internal/web"
 )
@@ -33,13 +38,86 @@ type config struct {
 	Login          string        `envconfig:"LOGIN" default:"user"`
 	Password       string        `envconfig:"PSWRD" default:"qwerty"`
 	SkipLogin      bool          `envconfig:"SKIP_LOGIN" default:"false"`     // Debug only
+	LegacyLogin    bool          `envconfig:"LEGACY_LOGIN" default:"false"`   // accept client hashes of passwords (deprecated)
 	MaxTokenLife   time.Duration `envconfig:"MAX_TOKEN_LIFE" default:"1440h"` // default is 60 days
+	IdleTokenLife  time.Duration `envconfig:"IDLE_TOKEN_LIFE" default:"168h"` // default is 7 days
 	AuthCookieName string        `default:"auth"`                             // name of cookie that contains token
+	CookieSameSite string        `envconfig:"COOKIE_SAME_SITE" default:"lax"` // strict, lax or none
+	CookiePath     string        `envconfig:"COOKIE_PATH" default:"/"`
+	CookieDomain   string        `envconfig:"COOKIE_DOMAIN"`
+	TrustedOrigins []string      `envconfig:"CSRF_TRUSTED_ORIGINS"` // other origins of the drive (for example, behind a proxy)
+
+	// TLS
+
+	CertFile           string `envconfig:"TLS_CERT_FILE" default:"./ssl/cert.cert"`
+	KeyFile            string `envconfig:"TLS_KEY_FILE" default:"./ssl/key.key"`
+	ClientCAFile       string `envconfig:"TLS_CLIENT_CA_FILE"` // empty means client certificates aren't used
+	ClientCertRequired bool   `envconfig:"TLS_CLIENT_CERT_REQUIRED" default:"false"`
+	HTTPRedirectPort   string `envconfig:"HTTP_REDIRECT_PORT"` // for example, ":80"
+
+	// Brute-force protection
+
+	MaxLoginFailures int           `envconfig:"LOGIN_MAX_FAILURES" default:"10"` // failures in a row before a ban
+	LoginBanDuration time.Duration `envconfig:"LOGIN_BAN_DURATION" default:"1h"`
+
+	// Audit log
+
+	AuditLog         bool  `envconfig:"AUDIT_LOG" default:"true"`
+	AuditMaxFileSize int64 `envconfig:"AUDIT_MAX_FILE_SIZE" default:"10"` // in MB
+	AuditMaxFiles    int   `envconfig:"AUDIT_MAX_FILES" default:"10"`     // 0 means rotated logs aren't removed
+
+	// Reverse proxy
+
+	TrustedProxies    []string     `envconfig:"TRUSTED_PROXIES"` // IPs or CIDRs of reverse proxies
+	TrustedProxyNets  []*net.IPNet `ignored:"true"`
+	BasePath          string       `envconfig:"BASE_PATH"`           // for example, "/drive"
+	ForwardAuthHeader string       `envconfig:"FORWARD_AUTH_HEADER"` // for example, "Remote-User"
+
+	// OpenID Connect
+
+	OIDCIssuer       string   `envconfig:"OIDC_ISSUER"` // empty means login via OIDC is disabled
+	OIDCClientID     string   `envconfig:"OIDC_CLIENT_ID"`
+	OIDCClientSecret string   `envconfig:"OIDC_CLIENT_SECRET"`
+	OIDCRedirectURL  string   `envconfig:"OIDC_REDIRECT_URL"` // https://{drive}/api/login/oidc/callback
+	OIDCScopes       []string `envconfig:"OIDC_SCOPES" default:"openid,profile,email"`
+	OIDCLoginClaim   string   `envconfig:"OIDC_LOGIN_CLAIM" default:"preferred_username"`
+	OIDCRoleClaim    string   `envconfig:"OIDC_ROLE_CLAIM" default:"groups"`
+	OIDCRoleMapping  string   `envconfig:"OIDC_ROLE_MAPPING"` // for example, "drive-admins=admin,staff=viewer"
+	OIDCDefaultRole  string   `envconfig:"OIDC_DEFAULT_ROLE"` // empty means users without mapped groups can't log in
+
+	// Content origin
+
+	ContentOrigin    string        `envconfig:"CONTENT_ORIGIN"` // public origin of uploaded files
+	ContentPort      string        `envconfig:"CONTENT_PORT"`   // port of the content server, empty means files are served on PORT
+	ContentTokenLife time.Duration `envconfig:"CONTENT_TOKEN_LIFE" default:"5m"`
 
 	// Storage
 
-	Encrypt    bool     `envconfig:"ENCRYPT" default:"false"`
-	PassPhrase [32]byte `ignored:"true"` // sha256 sum of "PASS_PHRASE" env variable
+	Encrypt        bool     `envconfig:"ENCRYPT" default:"false"`
+	PassPhrase     [32]byte `ignored:"true"`               // sha256 sum of the passphrase
+	PassPhraseFile string   `envconfig:"PASS_PHRASE_FILE"` // file with the passphrase (instead of "PASS_PHRASE")
+
+	// ClientEncryption means files are encrypted by clients (zero-knowledge mode)
+	ClientEncryption bool   `envconfig:"CLIENT_ENCRYPTION" default:"false"`
+	ClientParamsFile string `default:"./configs/client-encryption.json"` // params of client-side encryption
+
+	// Vault
+
+	VaultTag         int           `envconfig:"VAULT_TAG" default:"0"` // 0 means there's no vault
+	VaultPassword    string        `envconfig:"VAULT_PASSWORD"`
+	VaultIdleTimeout time.Duration `envconfig:"VAULT_IDLE_TIMEOUT" default:"5m"`
+	VaultEncrypt     bool          `ignored:"true"` // is "VAULT_PASS_PHRASE" set
+	VaultPassPhrase  [32]byte      `ignored:"true"` // sha256 sum of "VAULT_PASS_PHRASE" env variable
+
+	// TagACLRule is "all" (a file is visible, if all its restricted tags can be read) or "any"
+	TagACLRule string `envconfig:"TAG_ACL_RULE" default:"all"`
+
+	// Sealed means the drive starts without the key. Storages are opened after POST /api/unseal
+	// or right away, if the passphrase is passed with a file or a systemd credential
+	Sealed bool `envconfig:"SEALED" default:"false"`
+
+	// unsealPhrase is used to unseal the drive on startup
+	unsealPhrase []byte
 
 	StorageType string `envconfig:"STORAGE_TYPE" default:"json"`
 
@@ -49,12 +127,24 @@ type config struct {
 	FilesJSONFile  string `default:"./configs/files.json"`  // for files
 	TagsJSONFile   string `default:"./configs/tags.json"`   // for tags
 	TokensJSONFile string `default:"./configs/tokens.json"` // for tokens
+	UsersJSONFile  string `default:"./configs/users.json"`  // for users
+	//
+	APITokensJSONFile string `default:"./configs/api_tokens.json"` // for personal API tokens
+	TwoFactorJSONFile string `default:"./configs/2fa.json"`        // for TOTP secrets
+	SharesJSONFile    string `default:"./configs/shares.json"`     // for share links
+	DropsJSONFile     string `default:"./configs/drops.json"`      // for drop links
+	BansJSONFile      string `default:"./configs/bans.json"`       // for bans of the auth limiter
+	AuditFolder       string `default:"./configs/audit"`           // for the audit log
+
+	RekeyJournalFile string `default:"./configs/rekey.journal"` // progress of "tags-drive rekey"
 }
 
 type App struct {
 	config config
 
-	server      web.ServerInterface
+	server       web.ServerInterface
+	sealedServer *web.SealedServer // nil, if the drive isn't sealed
+
 	fileStorage files.FileStorageInterface
 	tagStorage  tags.TagStorageInterface
 
@@ -68,48 +158,272 @@ func PrepareNewApp() (*App, error) {
 		os.Setenv("LOGIN", "CLEARED")
 		os.Setenv("PSWRD", "CLEARED")
 		os.Setenv("PASS_PHRASE", "CLEARED")
+		os.Setenv("VAULT_PASSWORD", "CLEARED")
+		os.Setenv("VAULT_PASS_PHRASE", "CLEARED")
+		os.Setenv("OIDC_CLIENT_SECRET", "CLEARED")
 	}()
 
+	cnf, err := parseConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	if cnf.VaultTag != 0 && cnf.VaultPassword == "" {
+		return nil, errors.New("wrong env config: VAULT_PASSWORD can't be empty with VAULT_TAG")
+	}
+
+	if cnf.VaultEncrypt && (!cnf.Encrypt || cnf.VaultTag == 0) {
+		return nil, errors.New("wrong env config: VAULT_PASS_PHRASE can be used only with ENCRYPT=true and VAULT_TAG")
+	}
+
+	if !files.TagRule(cnf.TagACLRule).IsValid() {
+		return nil, errors.New("wrong env config: TAG_ACL_RULE must be all or any")
+	}
+
+	if rekey.InProgress(cnf.RekeyJournalFile) {
+		return nil, errors.New("rekey or conversion wasn't finished: run the same command again")
+	}
+
+	app := &App{config: cnf}
+
+	app.logger = clog.NewProdLogger()
+	if app.config.Debug {
+		app.logger = clog.NewDevLogger()
+	}
+
+	if cnf.Sealed {
+		app.sealedServer, err = web.NewSealedServer(app.webConfig(), app, app.logger)
+		if err != nil {
+			return nil, errors.Wrap(err, "can't create sealed web server")
+		}
+		app.server = app.sealedServer
+
+		if cnf.unsealPhrase != nil {
+			err = app.sealedServer.Unseal(cnf.unsealPhrase)
+			wipe(cnf.unsealPhrase)
+			app.config.unsealPhrase = nil
+			if err != nil {
+				return nil, errors.Wrap(err, "can't unseal the drive")
+			}
+		}
+
+		return app, nil
+	}
+
+	err = app.initStorages()
+	if err != nil {
+		return nil, errors.Wrap(err, "can't init services")
+	}
+
+	app.server, err = app.newWebServer()
+	if err != nil {
+		return nil, errors.Wrap(err, "can't init services")
+	}
+
+	return app, nil
+}
+
+// parseConfig parses env vars and checks them
+func parseConfig() (config, error) {
 	var cnf config
 	err := envconfig.Process("", &cnf)
 	if err != nil {
-		return nil, errors.Wrap(err, "can't parse Config")
+		return config{}, errors.Wrap(err, "can't parse Config")
 	}
 
 	cnf.Version = version
-	phrase := os.Getenv("PASS_PHRASE")
-	cnf.PassPhrase = sha256.Sum256([]byte(phrase))
 
 	// Checks
 	if len(cnf.Port) > 0 && cnf.Port[0] != ':' {
 		cnf.Port = ":" + cnf.Port
 	}
 
-	if cnf.Encrypt && phrase == "" {
-		return nil, errors.New("wrong env config: PASS_PHRASE can't be empty with ENCRYPT=true")
+	if cnf.HTTPRedirectPort != "" && cnf.HTTPRedirectPort[0] != ':' {
+		cnf.HTTPRedirectPort = ":" + cnf.HTTPRedirectPort
+	}
+
+	if !cnf.IsTLS && (cnf.ClientCAFile != "" || cnf.HTTPRedirectPort != "") {
+		return config{}, errors.New("wrong env config: TLS_CLIENT_CA_FILE and HTTP_REDIRECT_PORT can be used only with TLS=true")
+	}
+
+	if cnf.ClientCertRequired && cnf.ClientCAFile == "" {
+		return config{}, errors.New("wrong env config: TLS_CLIENT_CERT_REQUIRED can be used only with TLS_CLIENT_CA_FILE")
+	}
+
+	if cnf.ContentPort != "" {
+		if cnf.ContentPort[0] != ':' {
+			cnf.ContentPort = ":" + cnf.ContentPort
+		}
+
+		origin, err := url.Parse(cnf.ContentOrigin)
+		if err != nil || origin.Scheme == "" || origin.Host == "" {
+			return config{}, errors.New("wrong env config: CONTENT_ORIGIN must be a valid origin (scheme://host[:port]) with CONTENT_PORT")
+		}
+		cnf.ContentOrigin = strings.TrimSuffix(cnf.ContentOrigin, "/")
+
+		if cnf.ContentTokenLife < time.Second {
+			return config{}, errors.New("wrong env config: CONTENT_TOKEN_LIFE must be at least 1s")
+		}
+	}
+
+	cnf.CookieSameSite = strings.ToLower(cnf.CookieSameSite)
+	switch cnf.CookieSameSite {
+	case "strict", "lax":
+	case "none":
+		if !cnf.IsTLS {
+			return config{}, errors.New("wrong env config: COOKIE_SAME_SITE=none can be used only with TLS=true")
+		}
+	default:
+		return config{}, errors.New("wrong env config: COOKIE_SAME_SITE must be strict, lax or none")
+	}
+
+	for i, origin := range cnf.TrustedOrigins {
+		u, err := url.Parse(strings.TrimSpace(origin))
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return config{}, errors.Errorf("wrong env config: invalid origin in CSRF_TRUSTED_ORIGINS: \"%s\"", origin)
+		}
+		cnf.TrustedOrigins[i] = strings.ToLower(u.Scheme + "://" + u.Host)
+	}
+
+	for _, proxy := range cnf.TrustedProxies {
+		proxy = strings.TrimSpace(proxy)
+		if !strings.Contains(proxy, "/") {
+			// A single address
+			if ip := net.ParseIP(proxy); ip != nil && ip.To4() != nil {
+				proxy += "/32"
+			} else {
+				proxy += "/128"
+			}
+		}
+
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return config{}, errors.Errorf("wrong env config: invalid address in TRUSTED_PROXIES: \"%s\"", proxy)
+		}
+		cnf.TrustedProxyNets = append(cnf.TrustedProxyNets, network)
+	}
+
+	if cnf.MaxLoginFailures <= 0 || cnf.LoginBanDuration <= 0 {
+		return config{}, errors.New("wrong env config: LOGIN_MAX_FAILURES and LOGIN_BAN_DURATION must be positive")
+	}
+
+	if cnf.AuditMaxFileSize <= 0 || cnf.AuditMaxFiles < 0 {
+		return config{}, errors.New("wrong env config: AUDIT_MAX_FILE_SIZE must be positive, AUDIT_MAX_FILES can't be negative")
+	}
+
+	if cnf.ForwardAuthHeader != "" && len(cnf.TrustedProxyNets) == 0 {
+		return config{}, errors.New("wrong env config: FORWARD_AUTH_HEADER can be used only with TRUSTED_PROXIES")
+	}
+
+	cnf.BasePath = strings.TrimSuffix(cnf.BasePath, "/")
+	if cnf.BasePath != "" {
+		if !strings.HasPrefix(cnf.BasePath, "/") || strings.ContainsAny(cnf.BasePath, "?#") {
+			return config{}, errors.New("wrong env config: BASE_PATH must be a path, for example \"/drive\"")
+		}
+		// The auth cookie isn't needed on other paths
+		if cnf.CookiePath == "/" {
+			cnf.CookiePath = cnf.BasePath
+		}
+	}
+
+	if cnf.OIDCIssuer != "" {
+		if cnf.OIDCClientID == "" || cnf.OIDCRedirectURL == "" {
+			return config{}, errors.New("wrong env config: OIDC_CLIENT_ID and OIDC_REDIRECT_URL can't be empty with OIDC_ISSUER")
+		}
+		u, err := url.Parse(cnf.OIDCRedirectURL)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return config{}, errors.New("wrong env config: OIDC_REDIRECT_URL must be an absolute URL")
+		}
+	}
+
+	if cnf.ClientEncryption && cnf.Encrypt {
+		return config{}, errors.New("wrong env config: CLIENT_ENCRYPTION=true can't be used with ENCRYPT=true")
 	}
 
 	if cnf.SkipLogin && !cnf.Debug {
-		return nil, errors.New("wrong env config: SkipLogin can't be true in Production mode")
+		return config{}, errors.New("wrong env config: SkipLogin can't be true in Production mode")
 	}
 
-	app := &App{config: cnf}
+	if cnf.Sealed {
+		if !cnf.Encrypt {
+			return config{}, errors.New("wrong env config: SEALED=true can be used only with ENCRYPT=true")
+		}
+		if os.Getenv("PASS_PHRASE") != "" {
+			return config{}, errors.New("wrong env config: PASS_PHRASE can't be used with SEALED=true, " +
+				"use PASS_PHRASE_FILE or POST /api/unseal")
+		}
+	}
 
-	err = app.initServices()
+	if vaultPhrase := os.Getenv("VAULT_PASS_PHRASE"); vaultPhrase != "" {
+		cnf.VaultEncrypt = true
+		cnf.VaultPassPhrase = sha256.Sum256([]byte(vaultPhrase))
+	}
+
+	phrase, err := readPassPhrase(cnf.PassPhraseFile)
 	if err != nil {
-		return nil, errors.Wrap(err, "can't init services")
+		return config{}, errors.Wrap(err, "can't read passphrase")
 	}
 
-	return app, nil
+	// All checks must be above: the config of a sealed drive is returned here
+	if cnf.Sealed {
+		// The key will be computed on unsealing
+		if len(phrase) != 0 {
+			cnf.unsealPhrase = phrase
+		}
+		return cnf, nil
+	}
+
+	cnf.PassPhrase = sha256.Sum256(phrase)
+	wipe(phrase)
+
+	if cnf.Encrypt && len(phrase) == 0 {
+		return config{}, errors.New("wrong env config: PASS_PHRASE can't be empty with ENCRYPT=true")
+	}
+
+	return cnf, nil
 }
 
-// initServices inits storages and server
-func (app *App) initServices() error {
-	app.logger = clog.NewProdLogger()
-	if app.config.Debug {
-		app.logger = clog.NewDevLogger()
+// readPassPhrase returns the passphrase. Sources (in order of priority):
+//   - file from PASS_PHRASE_FILE env var
+//   - "pass_phrase" systemd credential ($CREDENTIALS_DIRECTORY/pass_phrase)
+//   - PASS_PHRASE env var
+func readPassPhrase(file string) ([]byte, error) {
+	if file == "" {
+		if dir := os.Getenv("CREDENTIALS_DIRECTORY"); dir != "" {
+			path := filepath.Join(dir, "pass_phrase")
+			if _, err := os.Stat(path); err == nil {
+				file = path
+			}
+		}
+	}
+
+	if file == "" {
+		return []byte(os.Getenv("PASS_PHRASE")), nil
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	// Trim trailing newlines
+	n := len(data)
+	for n > 0 && (data[n-1] == '\n' || data[n-1] == '\r') {
+		n--
 	}
 
+	return data[:n], nil
+}
+
+// wipe overwrites the slice with zeros
+func wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// initStorages inits file and tag storages
+func (app *App) initStorages() error {
 	var err error
 
 	// File storage
@@ -121,6 +435,11 @@ func (app *App) initServices() error {
 		FilesJSONFile:       app.config.FilesJSONFile,
 		Encrypt:             app.config.Encrypt,
 		PassPhrase:          app.config.PassPhrase,
+		ClientEncryption:    app.config.ClientEncryption,
+		VaultTag:            app.config.VaultTag,
+		VaultEncrypt:        app.config.VaultEncrypt,
+		VaultPassPhrase:     app.config.VaultPassPhrase,
+		TagRule:             files.TagRule(app.config.TagACLRule),
 	}
 	app.fileStorage, err = files.NewFileStorage(fileStorageConfig, app.logger)
 	if err != nil {
@@ -137,30 +456,126 @@ func (app *App) initServices() error {
 	}
 	app.tagStorage, err = tags.NewTagStorage(tagStorageConfig, app.logger)
 	if err != nil {
+		app.fileStorage.Shutdown()
+		app.fileStorage = nil
 		return errors.Wrap(err, "can't create new TagStorage")
 	}
 
-	// Web server
-	serverConfig := web.Config{
-		Debug:          app.config.Debug,
-		DataFolder:     app.config.DataFolder,
-		Port:           app.config.Port,
-		IsTLS:          app.config.IsTLS,
-		Login:          app.config.Login,
-		Password:       app.config.Password,
-		SkipLogin:      app.config.SkipLogin,
-		AuthCookieName: app.config.AuthCookieName,
-		MaxTokenLife:   app.config.MaxTokenLife,
-		TokensJSONFile: app.config.TokensJSONFile,
-		Encrypt:        app.config.Encrypt,
-		PassPhrase:     app.config.PassPhrase,
-		Version:        app.config.Version,
-	}
-	app.server, err = web.NewWebServer(serverConfig, app.fileStorage, app.tagStorage, app.logger)
+	return nil
+}
+
+// newWebServer creates a server over inited storages
+func (app *App) newWebServer() (*web.Server, error) {
+	server, err := web.NewWebServer(app.webConfig(), app.fileStorage, app.tagStorage, app.logger)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't init WebServer")
+	}
+	// The password is used only to create the first admin
+	app.config.Password = ""
+
+	return server, nil
+}
+
+func (app *App) webConfig() web.Config {
+	return web.Config{
+		Debug:              app.config.Debug,
+		DataFolder:         app.config.DataFolder,
+		Port:               app.config.Port,
+		IsTLS:              app.config.IsTLS,
+		CertFile:           app.config.CertFile,
+		KeyFile:            app.config.KeyFile,
+		ClientCAFile:       app.config.ClientCAFile,
+		ClientCertRequired: app.config.ClientCertRequired,
+		HTTPRedirectPort:   app.config.HTTPRedirectPort,
+		Login:              app.config.Login,
+		Password:           app.config.Password,
+		SkipLogin:          app.config.SkipLogin,
+		LegacyLogin:        app.config.LegacyLogin,
+		AuthCookieName:     app.config.AuthCookieName,
+		CookieSameSite:     app.config.CookieSameSite,
+		CookiePath:         app.config.CookiePath,
+		CookieDomain:       app.config.CookieDomain,
+		TrustedOrigins:     app.config.TrustedOrigins,
+		TrustedProxies:     app.config.TrustedProxyNets,
+		BasePath:           app.config.BasePath,
+		ForwardAuthHeader:  app.config.ForwardAuthHeader,
+		MaxTokenLife:       app.config.MaxTokenLife,
+		IdleTokenLife:      app.config.IdleTokenLife,
+		TokensJSONFile:     app.config.TokensJSONFile,
+		UsersJSONFile:      app.config.UsersJSONFile,
+		APITokensJSONFile:  app.config.APITokensJSONFile,
+		TwoFactorJSONFile:  app.config.TwoFactorJSONFile,
+		SharesJSONFile:     app.config.SharesJSONFile,
+		DropsJSONFile:      app.config.DropsJSONFile,
+		BansJSONFile:       app.config.BansJSONFile,
+		MaxLoginFailures:   app.config.MaxLoginFailures,
+		LoginBanDuration:   app.config.LoginBanDuration,
+		AuditFolder:        app.auditFolder(),
+		AuditMaxFileSize:   app.config.AuditMaxFileSize << 20,
+		AuditMaxFiles:      app.config.AuditMaxFiles,
+		OIDCIssuer:         app.config.OIDCIssuer,
+		OIDCClientID:       app.config.OIDCClientID,
+		OIDCClientSecret:   app.config.OIDCClientSecret,
+		OIDCRedirectURL:    app.config.OIDCRedirectURL,
+		OIDCScopes:         app.config.OIDCScopes,
+		OIDCLoginClaim:     app.config.OIDCLoginClaim,
+		OIDCRoleClaim:      app.config.OIDCRoleClaim,
+		OIDCRoleMapping:    app.config.OIDCRoleMapping,
+		OIDCDefaultRole:    app.config.OIDCDefaultRole,
+		Encrypt:            app.config.Encrypt,
+		PassPhrase:         app.config.PassPhrase,
+		ClientEncryption:   app.config.ClientEncryption,
+		ClientParamsFile:   app.config.ClientParamsFile,
+		VaultTag:           app.config.VaultTag,
+		VaultPassword:      app.config.VaultPassword,
+		VaultIdleTimeout:   app.config.VaultIdleTimeout,
+		ContentOrigin:      app.config.ContentOrigin,
+		ContentPort:        app.config.ContentPort,
+		ContentTokenLife:   app.config.ContentTokenLife,
+		Version:            app.config.Version,
+	}
+}
+
+// Unseal inits storages with the key derived from the passphrase. It implements web.Unsealer
+func (app *App) Unseal(passPhrase []byte) (*web.Server, error) {
+	app.config.PassPhrase = sha256.Sum256(passPhrase)
+
+	err := app.initStorages()
+	if err != nil {
+		app.config.PassPhrase = [32]byte{}
+		return nil, err
+	}
+
+	server, err := app.newWebServer()
+	if err != nil {
+		app.Seal()
+		return nil, err
+	}
+
+	app.fileStorage.StartBackgroundServices()
+
+	return server, nil
+}
+
+// Seal shutdowns storages and wipes the key. It implements web.Unsealer
+func (app *App) Seal() error {
+	app.logger.Debugln("shutdown FileStorage")
+	err := app.fileStorage.Shutdown()
+	if err != nil {
+		app.logger.Warnf("can't shutdown FileStorage gracefully: %s\n", err)
+	}
+
+	app.logger.Debugln("shutdown TagStorage")
+	err = app.tagStorage.Shutdown()
 	if err != nil {
-		return errors.Wrap(err, "can't init WebServer")
+		app.logger.Warnf("can't shutdown TagStorage gracefully: %s\n", err)
 	}
 
+	// Storages keep copies of the key in their configs, so drop them too
+	app.fileStorage = nil
+	app.tagStorage = nil
+	app.config.PassPhrase = [32]byte{}
+
 	return nil
 }
 
@@ -193,6 +608,12 @@ func (app *App) Start() error {
 			app.logger.Warnf("can't shutdown server gracefully: %s\n", err)
 		}
 
+		if app.config.Sealed {
+			// Storages were shut down on sealing
+			close(shutdowned)
+			return
+		}
+
 		app.logger.Debugln("shutdown FileStorage")
 		err = app.fileStorage.Shutdown()
 		if err != nil {
@@ -208,7 +629,9 @@ func (app *App) Start() error {
 		close(shutdowned)
 	}()
 
-	app.fileStorage.StartBackgroundServices()
+	if !app.config.Sealed {
+		app.fileStorage.StartBackgroundServices()
+	}
 
 	if err := app.server.Start(); err != nil {
 		app.logger.Errorf("server error: %s\n", err)
@@ -222,6 +645,14 @@ func (app *App) Start() error {
 	return nil
 }
 
+// auditFolder returns a folder of the audit log or an empty string, if the audit log is disabled
+func (app *App) auditFolder() string {
+	if !app.config.AuditLog {
+		return ""
+	}
+	return app.config.AuditFolder
+}
+
 func (app *App) printConfig() {
 	s := "Config:\n"
 
@@ -233,16 +664,30 @@ func (app *App) printConfig() {
 		//
 		{"Port", app.config.Port},
 		{"TLS", app.config.IsTLS},
+		{"ClientCAFile", app.config.ClientCAFile},
+		{"HTTPRedirectPort", app.config.HTTPRedirectPort},
 		{"Login", app.config.Login},
-		{"Password", strings.Repeat("*", len(app.config.Password))},
 		{"SkipLogin", app.config.SkipLogin},
+		{"LegacyLogin", app.config.LegacyLogin},
+		{"CookieSameSite", app.config.CookieSameSite},
+		{"BasePath", app.config.BasePath},
+		{"TrustedProxies", app.config.TrustedProxies},
+		{"OIDCIssuer", app.config.OIDCIssuer},
+		{"AuditLog", app.config.AuditLog},
+		{"ContentOrigin", app.config.ContentOrigin},
+		{"ContentPort", app.config.ContentPort},
 		//
 		{"StorageType", app.config.StorageType},
 		{"Encrypt", app.config.Encrypt},
+		{"Sealed", app.config.Sealed},
+		{"ClientEncryption", app.config.ClientEncryption},
+		{"VaultTag", app.config.VaultTag},
+		{"VaultEncrypt", app.config.VaultEncrypt},
+		{"TagACLRule", app.config.TagACLRule},
 	}
 
 	for _, v := range vars {
-		s += fmt.Sprintf("  * %-11s %v\n", v.name, v.v)
+		s += fmt.Sprintf("  * %-16s %v\n", v.name, v.v)
 	}
 
 	app.logger.WriteString(s)
@@ -252,6 +697,26 @@ func main() {
 	log.SetFlags(0)
 	log.Printf("Tags Drive %s - https://github.com/tags-drive\n", version)
 
+	if len(os.Args) > 1 {
+		var err error
+
+		switch os.Args[1] {
+		case "rekey":
+			err = runRekey()
+		case "encrypt":
+			err = runConvert(true)
+		case "decrypt":
+			err = runConvert(false)
+		default:
+			err = errors.Errorf("unknown command \"%s\"", os.Args[1])
+		}
+
+		if err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+
 	app, err := PrepareNewApp()
 	if err != nil {
 		log.Fatalln(err)
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/sha256"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// setEnv sets env variables and returns a function, which unsets them
+func setEnv(vars map[string]string) (reset func()) {
+	for k, v := range vars {
+		os.Setenv(k, v)
+	}
+	return func() {
+		for k := range vars {
+			os.Unsetenv(k)
+		}
+	}
+}
+
+func TestParseConfigSealed(t *testing.T) {
+	tests := []struct {
+		name  string
+		env   map[string]string
+		valid bool
+	}{
+		{
+			name:  "sealed",
+			env:   map[string]string{"SEALED": "true", "ENCRYPT": "true"},
+			valid: true,
+		},
+		{
+			name: "sealed without encryption",
+			env:  map[string]string{"SEALED": "true"},
+		},
+		{
+			name: "sealed with PASS_PHRASE",
+			env:  map[string]string{"SEALED": "true", "ENCRYPT": "true", "PASS_PHRASE": "phrase"},
+		},
+		{
+			name: "sealed with SKIP_LOGIN",
+			env:  map[string]string{"SEALED": "true", "ENCRYPT": "true", "SKIP_LOGIN": "true"},
+		},
+		{
+			name:  "sealed with SKIP_LOGIN in debug mode",
+			env:   map[string]string{"SEALED": "true", "ENCRYPT": "true", "SKIP_LOGIN": "true", "DBG": "true"},
+			valid: true,
+		},
+		{
+			name: "sealed with CLIENT_ENCRYPTION",
+			env:  map[string]string{"SEALED": "true", "ENCRYPT": "true", "CLIENT_ENCRYPTION": "true"},
+		},
+	}
+
+	// The vault key must be set before unsealing
+	reset := setEnv(map[string]string{"SEALED": "true", "ENCRYPT": "true", "VAULT_PASS_PHRASE": "vault"})
+	cnf, err := parseConfig()
+	reset()
+	if assert.Nil(t, err) {
+		assert.True(t, cnf.VaultEncrypt)
+		assert.Equal(t, sha256.Sum256([]byte("vault")), cnf.VaultPassPhrase)
+	}
+
+	for _, tt := range tests {
+		reset := setEnv(tt.env)
+		cnf, err := parseConfig()
+		reset()
+
+		if !tt.valid {
+			assert.NotNil(t, err, tt.name)
+			continue
+		}
+		if assert.Nil(t, err, tt.name) {
+			assert.True(t, cnf.Sealed, tt.name)
+			assert.Equal(t, [32]byte{}, cnf.PassPhrase, tt.name)
+		}
+	}
+}
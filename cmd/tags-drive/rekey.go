@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/sha256"
+	"log"
+	"os"
+	"path/filepath"
+
+	clog "github.com/ShoshinNikita/log/v2"
+	"github.com/pkg/errors"
+
+	"github.com/tags-drive/core/internal/storage/encryption"
+	"github.com/tags-drive/core/internal/storage/rekey"
+)
+
+// runRekey re-encrypts all files with a new passphrase (NEW_PASS_PHRASE env var).
+// It uses the same config as the server. The server must be stopped.
+//
+// If the command was interrupted, it has to be run again with the same passphrases
+func runRekey() error {
+	defer func() {
+		// Reset sensitive env vars
+		os.Setenv("PASS_PHRASE", "CLEARED")
+		os.Setenv("NEW_PASS_PHRASE", "CLEARED")
+		os.Setenv("VAULT_PASS_PHRASE", "CLEARED")
+	}()
+
+	// The drive must be stopped, so there's nothing to unseal
+	os.Setenv("SEALED", "false")
+
+	cnf, err := parseConfig()
+	if err != nil {
+		return err
+	}
+
+	if !cnf.Encrypt {
+		return errors.New("rekey is available only with ENCRYPT=true")
+	}
+
+	newPhrase := os.Getenv("NEW_PASS_PHRASE")
+	if newPhrase == "" {
+		return errors.New("wrong env config: NEW_PASS_PHRASE can't be empty")
+	}
+
+	err = encryption.CheckMarker(cnf.DataFolder, true)
+	if err != nil && err != encryption.ErrNoMarker {
+		return err
+	}
+
+	oldKey := rekey.Key{Encrypt: true, PassPhrase: cnf.PassPhrase}
+	newKey := rekey.Key{Encrypt: true, PassPhrase: sha256.Sum256([]byte(newPhrase))}
+
+	err = runRekeyer(cnf, oldKey, newKey)
+	if err != nil {
+		return errors.Wrap(err, "rekey failed")
+	}
+
+	log.Println("rekey is finished. Don't forget to update PASS_PHRASE")
+
+	return nil
+}
+
+// runConvert encrypts a plain drive (if encrypt is true) or decrypts an encrypted one.
+// PASS_PHRASE can't be empty. ENCRYPT env var is ignored.
+//
+// If the command was interrupted, it has to be run again
+func runConvert(encrypt bool) error {
+	defer func() {
+		// Reset sensitive env vars
+		os.Setenv("PASS_PHRASE", "CLEARED")
+		os.Setenv("VAULT_PASS_PHRASE", "CLEARED")
+	}()
+
+	// Current values of ENCRYPT and SEALED don't matter
+	os.Setenv("ENCRYPT", "false")
+	os.Setenv("SEALED", "false")
+
+	cnf, err := parseConfig()
+	if err != nil {
+		return err
+	}
+
+	if cnf.PassPhrase == sha256.Sum256(nil) {
+		return errors.New("wrong env config: PASS_PHRASE can't be empty")
+	}
+
+	target := encryption.StateOf(encrypt)
+
+	if !rekey.InProgress(cnf.RekeyJournalFile) {
+		state, err := encryption.ReadMarker(cnf.DataFolder)
+		if err == encryption.ErrNoMarker {
+			// The drive was created by an old version
+			state, err = encryption.DetectJSONFile(cnf.FilesJSONFile)
+		}
+		if err != nil {
+			return errors.Wrap(err, "can't get the current encryption state")
+		}
+
+		if state == target {
+			return errors.Errorf("drive is already %s", target)
+		}
+	}
+
+	var (
+		plainKey = rekey.Key{Encrypt: false}
+		key      = rekey.Key{Encrypt: true, PassPhrase: cnf.PassPhrase}
+	)
+
+	oldKey, newKey := key, plainKey
+	if encrypt {
+		oldKey, newKey = plainKey, key
+	}
+
+	// Remove the marker: the drive is in an intermediate state until the end of the conversion
+	err = os.Remove(filepath.Join(cnf.DataFolder, encryption.MarkerFilename))
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "can't remove encryption marker")
+	}
+
+	err = runRekeyer(cnf, oldKey, newKey)
+	if err != nil {
+		return errors.Wrap(err, "conversion failed")
+	}
+
+	err = encryption.WriteMarker(cnf.DataFolder, target)
+	if err != nil {
+		return errors.Wrap(err, "can't write encryption marker")
+	}
+
+	log.Printf("drive is %s now. Don't forget to set ENCRYPT=%t\n", target, encrypt)
+
+	return nil
+}
+
+// runRekeyer converts all files of the drive
+func runRekeyer(cnf config, oldKey, newKey rekey.Key) error {
+	logger := clog.NewProdLogger()
+	if cnf.Debug {
+		logger = clog.NewDevLogger()
+	}
+
+	rekeyConfig := rekey.Config{
+		Folders: []string{cnf.DataFolder, cnf.ResizedImagesFolder},
+		Files: []string{
+			cnf.TagsJSONFile,
+			cnf.TokensJSONFile,
+			cnf.UsersJSONFile,
+			cnf.APITokensJSONFile,
+			cnf.TwoFactorJSONFile,
+			cnf.SharesJSONFile,
+			cnf.DropsJSONFile,
+			cnf.BansJSONFile,
+		},
+		// Logs are converted even if the audit log is disabled now
+		LogFolders:    []string{cnf.AuditFolder},
+		FilesJSONFile: cnf.FilesJSONFile,
+		JournalFile:   cnf.RekeyJournalFile,
+		Old:           oldKey,
+		New:           newKey,
+		Vault:         rekey.Key{Encrypt: cnf.VaultEncrypt, PassPhrase: cnf.VaultPassPhrase},
+	}
+
+	logger.Infoln("start conversion")
+
+	return rekey.NewRekeyer(rekeyConfig, logger).Run()
+}
@@ -17,7 +17,7 @@ require (
 	github.com/pkg/errors v0.8.1
 	github.com/stretchr/testify v1.3.0
 	github.com/xlab/handysort v0.0.0-20150421192137-fb3537ed64a1 // indirect
-	golang.org/x/crypto v0.0.0-20190411191339-88737f569e3a // indirect
-	golang.org/x/image v0.0.0-20190417020941-4e30a6eb7d9a // indirect
+	golang.org/x/crypto v0.0.0-20190411191339-88737f569e3a
+	golang.org/x/image v0.0.0-20190417020941-4e30a6eb7d9a
 	golang.org/x/sys v0.0.0-20190416152802-12500544f89f // indirect
 )
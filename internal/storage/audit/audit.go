@@ -0,0 +1,437 @@
+// Package audit keeps an append-only log of security events
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	clog "github.com/ShoshinNikita/log/v2"
+	"github.com/minio/sio"
+	"github.com/pkg/errors"
+)
+
+const (
+	currentLog = "audit.log"
+	// rotated logs are named "audit-{time}.log", so they are sorted by time
+	rotatedPrefix = "audit-"
+	rotatedSuffix = ".log"
+	rotatedTime   = "20060102T150405.000000000"
+
+	// maxLineSize is a max size of an encoded event
+	maxLineSize = 1 << 20
+)
+
+var errDecode = errors.New("can't decode line")
+
+type Audit struct {
+	config Config
+
+	file  *os.File
+	size  int64
+	mutex *sync.Mutex
+
+	now func() time.Time
+
+	logger *clog.Logger
+}
+
+// NewAudit creates new Audit and opens the current log
+func NewAudit(cnf Config, lg *clog.Logger) (*Audit, error) {
+	if cnf.MaxFileSize <= 0 {
+		return nil, errors.New("max file size must be positive")
+	}
+
+	err := os.MkdirAll(cnf.Folder, 0700)
+	if err != nil {
+		return nil, errors.Wrapf(err, "can't create folder %s", cnf.Folder)
+	}
+
+	a := &Audit{
+		config: cnf,
+		mutex:  new(sync.Mutex),
+		now:    time.Now,
+		logger: lg,
+	}
+
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// open opens the current log in append-only mode
+func (a *Audit) open() error {
+	path := filepath.Join(a.config.Folder, currentLog)
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "can't open file %s", path)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return errors.Wrapf(err, "can't check file %s", path)
+	}
+
+	a.file = f
+	a.size = info.Size()
+	return nil
+}
+
+func (a *Audit) Log(e Event) {
+	if e.Time.IsZero() {
+		e.Time = a.now()
+	}
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		a.logger.Errorf("can't encode audit event: %s\n", err)
+		return
+	}
+
+	line, err := encodeLine(data, a.key())
+	if err != nil {
+		a.logger.Errorf("can't encrypt audit event: %s\n", err)
+		return
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.file == nil {
+		a.logger.Errorf("audit log is closed, event wasn't saved: %s\n", data)
+		return
+	}
+
+	if a.size > 0 && a.size+int64(len(line)) > a.config.MaxFileSize {
+		if err := a.rotate(); err != nil {
+			// Keep writing into the current log
+			a.logger.Errorf("can't rotate audit log: %s\n", err)
+		}
+	}
+
+	n, err := a.file.Write(line)
+	a.size += int64(n)
+	if err != nil {
+		a.logger.Errorf("can't write audit event: %s\n", err)
+	}
+}
+
+func (a *Audit) key() Key {
+	return Key{Encrypt: a.config.Encrypt, PassPhrase: a.config.PassPhrase}
+}
+
+// rotate renames the current log and opens a new one. It must be called under the lock
+func (a *Audit) rotate() error {
+	current := filepath.Join(a.config.Folder, currentLog)
+	rotated := filepath.Join(a.config.Folder, rotatedPrefix+a.now().UTC().Format(rotatedTime)+rotatedSuffix)
+
+	err := a.file.Sync()
+	if err != nil {
+		return errors.Wrap(err, "can't sync the current log")
+	}
+	err = os.Rename(current, rotated)
+	if err != nil {
+		return errors.Wrap(err, "can't rename the current log")
+	}
+	a.file.Close()
+	a.file = nil
+
+	if err := a.open(); err != nil {
+		return err
+	}
+
+	a.logger.Infof("audit log was rotated to %s\n", rotated)
+
+	if a.config.MaxFiles <= 0 {
+		return nil
+	}
+
+	paths, err := rotatedLogs(a.config.Folder)
+	if err != nil {
+		return err
+	}
+	for len(paths) > a.config.MaxFiles {
+		if err := os.Remove(paths[0]); err != nil {
+			return errors.Wrapf(err, "can't remove old log %s", paths[0])
+		}
+		a.logger.Infof("old audit log %s was removed\n", paths[0])
+		paths = paths[1:]
+	}
+
+	return nil
+}
+
+// rotatedLogs returns paths of rotated logs. The oldest logs are first
+func rotatedLogs(folder string) ([]string, error) {
+	infos, err := ioutil.ReadDir(folder)
+	if err != nil {
+		return nil, errors.Wrapf(err, "can't read folder %s", folder)
+	}
+
+	var paths []string
+	for _, info := range infos {
+		name := info.Name()
+		if !info.IsDir() && strings.HasPrefix(name, rotatedPrefix) && strings.HasSuffix(name, rotatedSuffix) {
+			paths = append(paths, filepath.Join(folder, name))
+		}
+	}
+	sort.Strings(paths)
+
+	return paths, nil
+}
+
+// LogFiles returns paths of all logs in a folder. The oldest logs are first
+func LogFiles(folder string) ([]string, error) {
+	paths, err := rotatedLogs(folder)
+	if err != nil {
+		return nil, err
+	}
+
+	current := filepath.Join(folder, currentLog)
+	if _, err := os.Stat(current); err == nil {
+		paths = append(paths, current)
+	}
+
+	return paths, nil
+}
+
+func (a *Audit) Query(f Filter) ([]Event, error) {
+	var events []Event
+	err := a.read(f, func(e Event) error {
+		events = append(events, e)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The newest events are first
+	for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
+		events[i], events[j] = events[j], events[i]
+	}
+	if f.Limit > 0 && len(events) > f.Limit {
+		events = events[:f.Limit]
+	}
+	if events == nil {
+		events = []Event{}
+	}
+
+	return events, nil
+}
+
+func (a *Audit) Export(w io.Writer, f Filter) error {
+	enc := json.NewEncoder(w)
+	return a.read(f, func(e Event) error {
+		return enc.Encode(e)
+	})
+}
+
+// read calls fn for every event matching the filter. The oldest events are first
+func (a *Audit) read(f Filter, fn func(Event) error) error {
+	a.mutex.Lock()
+	paths, err := LogFiles(a.config.Folder)
+	// Events written after the call aren't read
+	currentSize := a.size
+	a.mutex.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	for _, path := range paths {
+		limit := int64(-1)
+		if filepath.Base(path) == currentLog {
+			limit = currentSize
+		}
+
+		err := a.readFile(path, limit, f, fn)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readFile reads first limit bytes of a log. -1 means the whole file is read
+func (a *Audit) readFile(path string, limit int64, f Filter, fn func(Event) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// The log was removed after rotation
+			return nil
+		}
+		return errors.Wrapf(err, "can't open file %s", path)
+	}
+	defer file.Close()
+
+	var r io.Reader = file
+	if limit >= 0 {
+		r = io.LimitReader(file, limit)
+	}
+
+	return scanLines(r, func(n int, line []byte) error {
+		data, err := decodeLine(line, a.key())
+		if err != nil {
+			// The line could be broken by a crash. Other events are still valid
+			a.logger.Warnf("can't read line %d of audit log %s: %s\n", n, path, err)
+			return nil
+		}
+
+		var e Event
+		if err := json.Unmarshal(data, &e); err != nil {
+			a.logger.Warnf("can't decode line %d of audit log %s: %s\n", n, path, err)
+			return nil
+		}
+
+		if !f.match(e) {
+			return nil
+		}
+		return fn(e)
+	})
+}
+
+// match returns true, if an event matches the filter
+func (f Filter) match(e Event) bool {
+	switch {
+	case !f.From.IsZero() && e.Time.Before(f.From),
+		!f.To.IsZero() && !e.Time.Before(f.To),
+		f.User != "" && !strings.EqualFold(f.User, e.User),
+		f.Action != "" && f.Action != e.Action,
+		f.IP != "" && f.IP != e.IP:
+		return false
+	}
+
+	if f.Target != 0 {
+		for _, id := range e.Targets {
+			if id == f.Target {
+				return true
+			}
+		}
+		return false
+	}
+
+	return true
+}
+
+func (a *Audit) Shutdown() error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.file == nil {
+		return nil
+	}
+
+	err := a.file.Sync()
+	a.file.Close()
+	a.file = nil
+
+	return err
+}
+
+// scanLines calls fn for every non-empty line. Lines are numbered from 1
+func scanLines(r io.Reader, fn func(n int, line []byte) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxLineSize)
+
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		if err := fn(n, line); err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
+
+// encodeLine returns a line of a log with a new line character. Encrypted events are encoded with base64
+func encodeLine(data []byte, key Key) ([]byte, error) {
+	if key.Encrypt {
+		buff := bytes.NewBuffer([]byte{})
+		_, err := sio.Encrypt(buff, bytes.NewReader(data), sio.Config{Key: key.PassPhrase[:]})
+		if err != nil {
+			return nil, err
+		}
+
+		data = make([]byte, base64.StdEncoding.EncodedLen(buff.Len()))
+		base64.StdEncoding.Encode(data, buff.Bytes())
+	}
+
+	return append(data, '\n'), nil
+}
+
+// decodeLine returns an event encoded by encodeLine
+func decodeLine(line []byte, key Key) ([]byte, error) {
+	if !key.Encrypt {
+		if !json.Valid(line) {
+			return nil, errDecode
+		}
+		return line, nil
+	}
+
+	data := make([]byte, base64.StdEncoding.DecodedLen(len(line)))
+	n, err := base64.StdEncoding.Decode(data, line)
+	if err != nil {
+		return nil, errDecode
+	}
+
+	buff := bytes.NewBuffer([]byte{})
+	_, err = sio.Decrypt(buff, bytes.NewReader(data[:n]), sio.Config{Key: key.PassPhrase[:]})
+	if err != nil {
+		return nil, errDecode
+	}
+
+	return buff.Bytes(), nil
+}
+
+// Convert reads a log according to oldKey and writes it into dst according to newKey.
+// It is used to re-encrypt logs with a new passphrase
+func Convert(dst io.Writer, src io.Reader, oldKey, newKey Key) error {
+	return scanLines(src, func(n int, line []byte) error {
+		data, err := decodeLine(line, oldKey)
+		if err != nil {
+			return errors.Wrapf(err, "line %d", n)
+		}
+
+		line, err = encodeLine(data, newKey)
+		if err != nil {
+			return err
+		}
+
+		_, err = dst.Write(line)
+		return err
+	})
+}
+
+// IsEncodedWith returns true, if all lines of a log can be decoded with the key
+func IsEncodedWith(path string, key Key) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	err = scanLines(f, func(_ int, line []byte) error {
+		_, err := decodeLine(line, key)
+		return err
+	})
+	return err == nil
+}
@@ -0,0 +1,197 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	clog "github.com/ShoshinNikita/log/v2"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/tags-drive/core/internal/storage/encryption/encryptiontest"
+)
+
+func newTestConfig(t *testing.T, encrypt bool) (cnf Config, clean func()) {
+	path, clean := encryptiontest.TempFile(t, "audit")
+
+	cnf = Config{
+		Folder:      path,
+		Encrypt:     encrypt,
+		PassPhrase:  encryptiontest.Key,
+		MaxFileSize: 1 << 20,
+	}
+	return cnf, clean
+}
+
+func newTestAudit(t *testing.T, cnf Config, now *time.Time) *Audit {
+	a, err := NewAudit(cnf, clog.NewProdLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.now = func() time.Time {
+		*now = now.Add(time.Second)
+		return *now
+	}
+	return a
+}
+
+func TestQuery(t *testing.T) {
+	assert := assert.New(t)
+
+	cnf, clean := newTestConfig(t, false)
+	defer clean()
+
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	a := newTestAudit(t, cnf, &now)
+
+	a.Log(Event{Action: ActionLogin, UserID: 1, User: "admin", IP: "10.0.0.1"})
+	a.Log(Event{Action: ActionLoginFailed, User: "Bob", IP: "10.0.0.2", Details: "wrong password"})
+	a.Log(Event{Action: ActionUpload, UserID: 1, User: "admin", IP: "10.0.0.1", Targets: []int{1, 2}})
+	a.Log(Event{Action: ActionDelete, UserID: 1, User: "admin", IP: "10.0.0.1", Targets: []int{2}})
+	start := now
+
+	tests := []struct {
+		filter  Filter
+		actions []Action
+	}{
+		{Filter{}, []Action{ActionDelete, ActionUpload, ActionLoginFailed, ActionLogin}},
+		{Filter{Limit: 2}, []Action{ActionDelete, ActionUpload}},
+		{Filter{User: "bob"}, []Action{ActionLoginFailed}},
+		{Filter{Action: ActionUpload}, []Action{ActionUpload}},
+		{Filter{IP: "10.0.0.1", Target: 2}, []Action{ActionDelete, ActionUpload}},
+		{Filter{Target: 1}, []Action{ActionUpload}},
+		{Filter{From: start.Add(-time.Second)}, []Action{ActionDelete, ActionUpload}},
+		{Filter{To: start.Add(-time.Second)}, []Action{ActionLoginFailed, ActionLogin}},
+		{Filter{User: "nobody"}, []Action{}},
+	}
+
+	for i, tt := range tests {
+		events, err := a.Query(tt.filter)
+		if !assert.Nil(err, "test %d", i) {
+			continue
+		}
+
+		actions := []Action{}
+		for _, e := range events {
+			actions = append(actions, e.Action)
+		}
+		assert.Equal(tt.actions, actions, "test %d", i)
+	}
+
+	// Export
+	buff := bytes.NewBuffer(nil)
+	assert.Nil(a.Export(buff, Filter{User: "admin"}))
+
+	var exported []Event
+	scanner := bufio.NewScanner(buff)
+	for scanner.Scan() {
+		var e Event
+		assert.Nil(json.Unmarshal(scanner.Bytes(), &e))
+		exported = append(exported, e)
+	}
+	if assert.Len(exported, 3) {
+		assert.Equal(ActionLogin, exported[0].Action)
+		assert.Equal([]int{2}, exported[2].Targets)
+	}
+
+	// Events are kept after a restart
+	assert.Nil(a.Shutdown())
+	a = newTestAudit(t, cnf, &now)
+	events, err := a.Query(Filter{})
+	assert.Nil(err)
+	assert.Len(events, 4)
+}
+
+func TestRotation(t *testing.T) {
+	assert := assert.New(t)
+
+	cnf, clean := newTestConfig(t, false)
+	defer clean()
+	cnf.MaxFileSize = 300
+	cnf.MaxFiles = 2
+
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	a := newTestAudit(t, cnf, &now)
+
+	for i := 1; i <= 20; i++ {
+		a.Log(Event{Action: ActionDownload, UserID: 1, User: "admin", IP: "127.0.0.1", Targets: []int{i}})
+	}
+
+	paths, err := LogFiles(cnf.Folder)
+	assert.Nil(err)
+	assert.Len(paths, cnf.MaxFiles+1)
+	assert.Equal(currentLog, filepath.Base(paths[len(paths)-1]))
+
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if assert.Nil(err) {
+			assert.True(info.Size() <= cnf.MaxFileSize, "%s is too large", path)
+		}
+	}
+
+	// Old events were removed, the latest ones are read from all logs
+	events, err := a.Query(Filter{})
+	assert.Nil(err)
+	if assert.NotEmpty(events) {
+		assert.Equal([]int{20}, events[0].Targets)
+		assert.True(len(events) < 20)
+		for i := 1; i < len(events); i++ {
+			assert.Equal(events[i-1].Targets[0]-1, events[i].Targets[0])
+		}
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	assert := assert.New(t)
+
+	cnf, clean := newTestConfig(t, true)
+	defer clean()
+
+	now := time.Now()
+	a := newTestAudit(t, cnf, &now)
+	a.Log(Event{Action: ActionLogin, UserID: 1, User: "secret-user", IP: "127.0.0.1"})
+	a.Log(Event{Action: ActionLogout, UserID: 1, User: "secret-user", IP: "127.0.0.1"})
+
+	path := filepath.Join(cnf.Folder, currentLog)
+	data, err := ioutil.ReadFile(path)
+	assert.Nil(err)
+	assert.False(strings.Contains(string(data), "secret-user"))
+	assert.Equal(2, strings.Count(string(data), "\n"))
+
+	events, err := a.Query(Filter{User: "secret-user"})
+	assert.Nil(err)
+	assert.Len(events, 2)
+
+	oldKey := Key{Encrypt: true, PassPhrase: cnf.PassPhrase}
+	newKey := Key{Encrypt: true, PassPhrase: [32]byte{4, 5, 6}}
+	assert.True(IsEncodedWith(path, oldKey))
+	assert.False(IsEncodedWith(path, newKey))
+	assert.False(IsEncodedWith(path, Key{}))
+
+	// Re-encryption
+	for _, key := range []Key{newKey, {}} {
+		buff := bytes.NewBuffer(nil)
+		src, err := os.Open(path)
+		if !assert.Nil(err) {
+			return
+		}
+		err = Convert(buff, src, oldKey, key)
+		src.Close()
+		assert.Nil(err)
+
+		converted := filepath.Join(cnf.Folder, "converted.log")
+		assert.Nil(ioutil.WriteFile(converted, buff.Bytes(), 0600))
+		assert.True(IsEncodedWith(converted, key))
+		assert.False(IsEncodedWith(converted, oldKey))
+	}
+
+	// Wrong key
+	err = Convert(ioutil.Discard, bytes.NewReader(data), newKey, oldKey)
+	assert.NotNil(err)
+}
@@ -0,0 +1,116 @@
+package audit
+
+import (
+	"io"
+	"time"
+)
+
+type Config struct {
+	Debug bool
+
+	// Folder contains the current log and rotated ones
+	Folder string
+
+	Encrypt    bool
+	PassPhrase [32]byte
+
+	// MaxFileSize is a size of the current log, after which it is rotated
+	MaxFileSize int64
+	// MaxFiles is a number of rotated logs, which are kept. 0 means old logs aren't removed
+	MaxFiles int
+}
+
+// Key describes how lines of a log are stored. If Encrypt is false, lines are stored as is
+type Key struct {
+	Encrypt    bool
+	PassPhrase [32]byte
+}
+
+// Action is a type of an event
+type Action string
+
+// Actions
+const (
+	ActionLogin       Action = "login"
+	ActionLoginFailed Action = "login_failed"
+	ActionLogout      Action = "logout"
+
+	ActionUpload   Action = "upload"
+	ActionDownload Action = "download"
+	ActionArchive  Action = "archive"
+	ActionDelete   Action = "delete"
+	ActionRecover  Action = "recover"
+	// ActionFileChange is a change of a filename or a description
+	ActionFileChange Action = "file_change"
+	// ActionFileTags is a change of tags of files
+	ActionFileTags Action = "file_tags"
+	// ActionAccept is an acceptance of files uploaded via drop links
+	ActionAccept Action = "accept"
+
+	ActionTagAdd    Action = "tag_add"
+	ActionTagChange Action = "tag_change"
+	ActionTagDelete Action = "tag_delete"
+	// ActionTagACL is a change of an ACL of a tag
+	ActionTagACL Action = "tag_acl"
+
+	ActionPasswordChange Action = "password_change"
+	ActionTwoFactor      Action = "2fa_change"
+	ActionSessionDelete  Action = "session_delete"
+	ActionTokenAdd       Action = "token_add"
+	ActionTokenDelete    Action = "token_delete"
+	ActionVaultUnlock    Action = "vault_unlock"
+
+	ActionUserAdd    Action = "user_add"
+	ActionUserChange Action = "user_change"
+	ActionUserDelete Action = "user_delete"
+	ActionBanDelete  Action = "ban_delete"
+
+	ActionShareAdd    Action = "share_add"
+	ActionShareDelete Action = "share_delete"
+	ActionDropAdd     Action = "drop_add"
+	ActionDropDelete  Action = "drop_delete"
+	// ActionConfigChange is a change of the drive settings (for example, params of client-side encryption)
+	ActionConfigChange Action = "config_change"
+	ActionSeal         Action = "seal"
+	ActionAuditExport  Action = "audit_export"
+)
+
+type Event struct {
+	Time   time.Time `json:"time"`
+	Action Action    `json:"action"`
+	// UserID is 0, if the user is unknown (for example, after a failed login)
+	UserID int    `json:"userID,omitempty"`
+	User   string `json:"user,omitempty"`
+	IP     string `json:"ip"`
+	// Targets are ids of files, tags, users, tokens, shares or drop links. Their type depends on Action
+	Targets []int  `json:"targets,omitempty"`
+	Details string `json:"details,omitempty"`
+}
+
+// Filter selects events. Zero fields match all events
+type Filter struct {
+	From   time.Time
+	To     time.Time
+	User   string
+	Action Action
+	IP     string
+	Target int
+	// Limit is a max number of events returned by Query
+	Limit int
+}
+
+// AuditInterface provides methods for writing and reading of the audit log
+type AuditInterface interface {
+	// Log appends an event. Errors are logged, so a broken audit log doesn't break requests
+	Log(e Event)
+
+	// Query returns events matching the filter. The newest events are first
+	Query(f Filter) ([]Event, error)
+
+	// Export writes events matching the filter as JSON lines. The oldest events are first.
+	// Limit is ignored
+	Export(w io.Writer, f Filter) error
+
+	// Shutdown closes the current log
+	Shutdown() error
+}
@@ -0,0 +1,24 @@
+// Package encryptiontest provides helpers for tests of stores, which keep their data in encrypted json files
+package encryptiontest
+
+import (
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Key is a key of encrypted files in tests
+var Key = sha256.Sum256([]byte("test"))
+
+// TempFile returns a path of a file with passed name in a new temporary directory and a function,
+// which removes the directory. The file isn't created
+func TempFile(t *testing.T, name string) (path string, clean func()) {
+	dir, err := ioutil.TempDir("", "tags-drive")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return filepath.Join(dir, name), func() { os.RemoveAll(dir) }
+}
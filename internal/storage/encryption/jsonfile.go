@@ -0,0 +1,73 @@
+package encryption
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+
+	"github.com/minio/sio"
+	"github.com/pkg/errors"
+)
+
+// JSONFile is a json file, which is encrypted with Key, if Encrypt is true. Stores of the drive
+// (users, API tokens, shares and so on) keep their data in such files
+type JSONFile struct {
+	Path    string
+	Encrypt bool
+	Key     [KeySize]byte
+	// Indent makes the file readable. It is used in Debug mode
+	Indent bool
+}
+
+// Read decodes the file into v. exists is false, if the file doesn't exist
+func (f JSONFile) Read(v interface{}) (exists bool, err error) {
+	data, err := ioutil.ReadFile(f.Path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, errors.Wrapf(err, "can't open file %s", f.Path)
+	}
+
+	if f.Encrypt {
+		buff := bytes.NewBuffer([]byte{})
+		_, err = sio.Decrypt(buff, bytes.NewReader(data), sio.Config{Key: f.Key[:]})
+		if err != nil {
+			return true, errors.Wrapf(err, "can't decrypt file %s", f.Path)
+		}
+		data = buff.Bytes()
+	}
+
+	if err := json.Unmarshal(data, v); err != nil {
+		return true, errors.Wrapf(err, "can't decode file %s", f.Path)
+	}
+	return true, nil
+}
+
+// Write encodes v and rewrites the file
+func (f JSONFile) Write(v interface{}) error {
+	buff := bytes.NewBuffer([]byte{})
+	enc := json.NewEncoder(buff)
+	if f.Indent {
+		enc.SetIndent("", "  ")
+	}
+	if err := enc.Encode(v); err != nil {
+		return errors.Wrapf(err, "can't encode file %s", f.Path)
+	}
+
+	data := buff.Bytes()
+	if f.Encrypt {
+		encrypted := bytes.NewBuffer([]byte{})
+		_, err := sio.Encrypt(encrypted, buff, sio.Config{Key: f.Key[:]})
+		if err != nil {
+			return errors.Wrapf(err, "can't encrypt file %s", f.Path)
+		}
+		data = encrypted.Bytes()
+	}
+
+	if err := ioutil.WriteFile(f.Path, data, 0600); err != nil {
+		return errors.Wrapf(err, "can't write '%s'", f.Path)
+	}
+	return nil
+}
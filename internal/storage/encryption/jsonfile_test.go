@@ -0,0 +1,51 @@
+package encryption
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/tags-drive/core/internal/storage/encryption/encryptiontest"
+)
+
+func TestJSONFile(t *testing.T) {
+	type item struct {
+		ID   int    `json:"id"`
+		Name string `json:"name"`
+	}
+
+	for _, encrypt := range []bool{false, true} {
+		assert := assert.New(t)
+
+		path, clean := encryptiontest.TempFile(t, "items.json")
+		file := JSONFile{Path: path, Encrypt: encrypt, Key: encryptiontest.Key, Indent: true}
+
+		var list []item
+		exists, err := file.Read(&list)
+		assert.Nil(err)
+		assert.False(exists)
+
+		original := []item{{ID: 1, Name: "first"}, {ID: 2, Name: "second"}}
+		assert.Nil(file.Write(original))
+
+		exists, err = file.Read(&list)
+		assert.Nil(err)
+		assert.True(exists)
+		assert.Equal(original, list)
+
+		data, err := ioutil.ReadFile(path)
+		assert.Nil(err)
+		assert.Equal(encrypt, !json.Valid(data), "encrypt: %t", encrypt)
+
+		if encrypt {
+			file.Key = sha256.Sum256([]byte("wrong key"))
+			_, err = file.Read(&list)
+			assert.NotNil(err)
+		}
+
+		clean()
+	}
+}
@@ -0,0 +1,74 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+
+	"github.com/minio/sio"
+	"github.com/pkg/errors"
+)
+
+// KeySize is a size of master and data keys
+const KeySize = 32
+
+// Errors
+var (
+	ErrBadWrappedKey = errors.New("wrapped key is invalid")
+)
+
+// GenerateKey returns a new random data key
+func GenerateKey() ([KeySize]byte, error) {
+	var key [KeySize]byte
+	_, err := io.ReadFull(rand.Reader, key[:])
+	return key, err
+}
+
+// WrapKey encrypts a data key with the master key. Result is base64 encoded
+func WrapKey(key, master [KeySize]byte) (string, error) {
+	buff := new(bytes.Buffer)
+	_, err := sio.Encrypt(buff, bytes.NewReader(key[:]), sio.Config{Key: master[:]})
+	if err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(buff.Bytes()), nil
+}
+
+// UnwrapKey decrypts a data key wrapped by WrapKey
+func UnwrapKey(wrapped string, master [KeySize]byte) ([KeySize]byte, error) {
+	var key [KeySize]byte
+
+	data, err := base64.StdEncoding.DecodeString(wrapped)
+	if err != nil {
+		return key, ErrBadWrappedKey
+	}
+
+	buff := new(bytes.Buffer)
+	_, err = sio.Decrypt(buff, bytes.NewReader(data), sio.Config{Key: master[:]})
+	if err != nil {
+		return key, errors.Wrap(err, "can't unwrap key")
+	}
+	if buff.Len() != KeySize {
+		return key, ErrBadWrappedKey
+	}
+
+	copy(key[:], buff.Bytes())
+	return key, nil
+}
+
+// NewDataKey generates a data key and wraps it with the master key
+func NewDataKey(master [KeySize]byte) (key [KeySize]byte, wrapped string, err error) {
+	key, err = GenerateKey()
+	if err != nil {
+		return key, "", errors.Wrap(err, "can't generate a key")
+	}
+
+	wrapped, err = WrapKey(key, master)
+	if err != nil {
+		return key, "", errors.Wrap(err, "can't wrap a key")
+	}
+
+	return key, wrapped, nil
+}
@@ -0,0 +1,37 @@
+package encryption
+
+import (
+	"crypto/sha256"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWrapKey(t *testing.T) {
+	assert := assert.New(t)
+
+	master := sha256.Sum256([]byte("master"))
+
+	key, wrapped, err := NewDataKey(master)
+	if !assert.Nil(err) {
+		return
+	}
+	assert.NotEqual([KeySize]byte{}, key)
+
+	unwrapped, err := UnwrapKey(wrapped, master)
+	assert.Nil(err)
+	assert.Equal(key, unwrapped)
+
+	// Wrong master key
+	_, err = UnwrapKey(wrapped, sha256.Sum256([]byte("another")))
+	assert.NotNil(err)
+
+	// Broken key
+	_, err = UnwrapKey("!"+wrapped, master)
+	assert.Equal(ErrBadWrappedKey, err)
+
+	// Keys are unique
+	anotherKey, anotherWrapped, _ := NewDataKey(master)
+	assert.NotEqual(key, anotherKey)
+	assert.NotEqual(wrapped, anotherWrapped)
+}
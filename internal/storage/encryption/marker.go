@@ -0,0 +1,110 @@
+// Package encryption contains helpers shared by all storages, which encrypt data
+package encryption
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/minio/sio"
+	"github.com/pkg/errors"
+)
+
+// MarkerFilename is a name of a file in DataFolder, which records the encryption state of the drive
+const MarkerFilename = ".encryption"
+
+// Errors
+var (
+	ErrNoMarker       = errors.New("there's no encryption marker")
+	ErrUnknownState   = errors.New("unknown encryption state")
+	ErrStateMismatch  = errors.New("encryption state of the drive doesn't match the config")
+	ErrUnknownContent = errors.New("can't detect encryption state of a file")
+)
+
+type State string
+
+const (
+	StatePlain     State = "plain"
+	StateEncrypted State = "encrypted"
+)
+
+// StateOf converts Encrypt config field into State
+func StateOf(encrypt bool) State {
+	if encrypt {
+		return StateEncrypted
+	}
+	return StatePlain
+}
+
+// ReadMarker returns the state recorded in the folder. It returns ErrNoMarker if there's no marker
+func ReadMarker(folder string) (State, error) {
+	data, err := ioutil.ReadFile(filepath.Join(folder, MarkerFilename))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", ErrNoMarker
+		}
+		return "", err
+	}
+
+	state := State(strings.TrimSpace(string(data)))
+	switch state {
+	case StatePlain, StateEncrypted:
+		return state, nil
+	default:
+		return "", ErrUnknownState
+	}
+}
+
+// WriteMarker records the state in the folder
+func WriteMarker(folder string, state State) error {
+	path := filepath.Join(folder, MarkerFilename)
+	tempPath := path + ".tmp"
+
+	err := ioutil.WriteFile(tempPath, []byte(string(state)+"\n"), 0666)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tempPath, path)
+}
+
+// CheckMarker returns an error if the state recorded in the folder differs from the config.
+// If there's no marker, CheckMarker returns ErrNoMarker
+func CheckMarker(folder string, encrypt bool) error {
+	state, err := ReadMarker(folder)
+	if err != nil {
+		return err
+	}
+
+	if state != StateOf(encrypt) {
+		return errors.Wrapf(ErrStateMismatch, "drive is %s, but ENCRYPT=%t", state, encrypt)
+	}
+
+	return nil
+}
+
+// DetectJSONFile guesses the state of a json file. Plain json file starts with '{', '[' or 'n' (null).
+// Encrypted file starts with a version of DARE format (0x10 or 0x20)
+func DetectJSONFile(path string) (State, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	b := make([]byte, 1)
+	if _, err := io.ReadFull(f, b); err != nil {
+		return "", ErrUnknownContent
+	}
+
+	switch b[0] {
+	case '{', '[', 'n':
+		return StatePlain, nil
+	case sio.Version10, sio.Version20:
+		return StateEncrypted, nil
+	default:
+		return "", ErrUnknownContent
+	}
+}
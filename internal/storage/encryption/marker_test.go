@@ -0,0 +1,76 @@
+package encryption
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/minio/sio"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMarker(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "marker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	_, err = ReadMarker(dir)
+	assert.Equal(ErrNoMarker, err)
+	assert.Equal(ErrNoMarker, CheckMarker(dir, true))
+
+	assert.Nil(WriteMarker(dir, StateEncrypted))
+	state, err := ReadMarker(dir)
+	assert.Nil(err)
+	assert.Equal(StateEncrypted, state)
+	assert.Nil(CheckMarker(dir, true))
+	assert.NotNil(CheckMarker(dir, false))
+
+	assert.Nil(WriteMarker(dir, StatePlain))
+	assert.Nil(CheckMarker(dir, false))
+	assert.NotNil(CheckMarker(dir, true))
+
+	ioutil.WriteFile(filepath.Join(dir, MarkerFilename), []byte("something"), 0600)
+	_, err = ReadMarker(dir)
+	assert.Equal(ErrUnknownState, err)
+}
+
+func TestDetectJSONFile(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "detect")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	encrypted := new(bytes.Buffer)
+	sio.Encrypt(encrypted, bytes.NewReader([]byte("{}")), sio.Config{Key: make([]byte, 32)})
+
+	tests := []struct {
+		content []byte
+		state   State
+		err     error
+	}{
+		{[]byte(`{"1": {}}`), StatePlain, nil},
+		{[]byte(`[]`), StatePlain, nil},
+		{[]byte("null\n"), StatePlain, nil},
+		{encrypted.Bytes(), StateEncrypted, nil},
+		{[]byte(""), "", ErrUnknownContent},
+		{[]byte("abc"), "", ErrUnknownContent},
+	}
+
+	path := filepath.Join(dir, "files.json")
+	for i, tt := range tests {
+		ioutil.WriteFile(path, tt.content, 0600)
+
+		state, err := DetectJSONFile(path)
+		assert.Equal(tt.err, err, "test #%d", i)
+		assert.Equal(tt.state, state, "test #%d", i)
+	}
+}
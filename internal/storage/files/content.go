@@ -0,0 +1,124 @@
+package files
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+
+	"github.com/minio/sio"
+	"github.com/pkg/errors"
+)
+
+// Sizes of packages of encrypted files (see github.com/minio/sio)
+const (
+	encryptedPayloadSize = 1 << 16
+	encryptedPackageSize = encryptedPayloadSize + 32 // header and tag
+)
+
+// Content is the content of a file, which supports seeking. It must be closed
+type Content interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+func (fs FileStorage) OpenContent(file File) (Content, error) {
+	path := fs.config.DataFolder + "/" + strconv.FormatInt(int64(file.ID), 10)
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't open file")
+	}
+
+	if !fs.config.Encrypt {
+		return f, nil
+	}
+
+	key, err := fs.DataKey(file)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	content, err := newDecryptSeeker(f, key)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return content, nil
+}
+
+// decryptSeeker decrypts a file from any offset. A file is encrypted in packages with sequence numbers,
+// so decryption starts from the package with the offset
+type decryptSeeker struct {
+	f   *os.File
+	key [32]byte
+
+	size   int64
+	offset int64
+	// r reads from offset. It is nil after seeking
+	r io.Reader
+}
+
+func newDecryptSeeker(f *os.File, key [32]byte) (*decryptSeeker, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, errors.Wrap(err, "can't get size of file")
+	}
+
+	size, err := sio.DecryptedSize(uint64(info.Size()))
+	if err != nil {
+		return nil, errors.Wrap(err, "can't get size of decrypted file")
+	}
+
+	return &decryptSeeker{f: f, key: key, size: int64(size)}, nil
+}
+
+func (d *decryptSeeker) Read(p []byte) (int, error) {
+	if d.offset >= d.size {
+		return 0, io.EOF
+	}
+
+	if d.r == nil {
+		pkg := d.offset / encryptedPayloadSize
+		_, err := d.f.Seek(pkg*encryptedPackageSize, io.SeekStart)
+		if err != nil {
+			return 0, errors.Wrap(err, "can't seek file")
+		}
+
+		r, err := sio.DecryptReader(d.f, sio.Config{Key: d.key[:], SequenceNumber: uint32(pkg)})
+		if err != nil {
+			return 0, err
+		}
+		_, err = io.CopyN(ioutil.Discard, r, d.offset%encryptedPayloadSize)
+		if err != nil {
+			return 0, errors.Wrap(err, "can't decrypt file")
+		}
+		d.r = r
+	}
+
+	n, err := d.r.Read(p)
+	d.offset += int64(n)
+	return n, err
+}
+
+func (d *decryptSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += d.offset
+	case io.SeekEnd:
+		offset += d.size
+	}
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+
+	if offset != d.offset {
+		d.offset = offset
+		d.r = nil
+	}
+	return offset, nil
+}
+
+func (d *decryptSeeker) Close() error {
+	return d.f.Close()
+}
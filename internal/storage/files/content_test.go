@@ -0,0 +1,75 @@
+package files
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/minio/sio"
+)
+
+func TestDecryptSeeker(t *testing.T) {
+	key := [32]byte{1, 2, 3}
+	// 3 full packages and a part of the 4th one
+	data := make([]byte, encryptedPayloadSize*3+1000)
+	rand.Read(data)
+
+	f, err := ioutil.TempFile("", "content")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	_, err = sio.Encrypt(f, bytes.NewReader(data), sio.Config{Key: key[:]})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := newDecryptSeeker(f, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer content.Close()
+
+	if size, _ := content.Seek(0, io.SeekEnd); size != int64(len(data)) {
+		t.Fatalf("Wrong size. Want: %d Got: %d", len(data), size)
+	}
+
+	tests := []struct {
+		offset int64
+		length int
+	}{
+		{offset: 0, length: len(data)},
+		{offset: 10, length: 100},
+		{offset: encryptedPayloadSize - 10, length: 20},
+		{offset: encryptedPayloadSize * 2, length: encryptedPayloadSize + 1000},
+		{offset: int64(len(data)) - 1, length: 1},
+	}
+
+	for i, tt := range tests {
+		_, err := content.Seek(tt.offset, io.SeekStart)
+		if err != nil {
+			t.Errorf("Test #%d. Can't seek: %s", i, err)
+			continue
+		}
+
+		buff := make([]byte, tt.length)
+		_, err = io.ReadFull(content, buff)
+		if err != nil {
+			t.Errorf("Test #%d. Can't read: %s", i, err)
+			continue
+		}
+		if !bytes.Equal(data[tt.offset:tt.offset+int64(tt.length)], buff) {
+			t.Errorf("Test #%d. Wrong content", i)
+		}
+	}
+
+	// End of file
+	content.Seek(0, io.SeekEnd)
+	if n, err := content.Read(make([]byte, 10)); n != 0 || err != io.EOF {
+		t.Errorf("Want EOF at the end of file. Got: %d, %v", n, err)
+	}
+}
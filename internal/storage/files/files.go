@@ -3,7 +3,9 @@ package files
 import (
 	"archive/zip"
 	"bytes"
+	"encoding/base64"
 	"io"
+	"io/ioutil"
 	"mime/multipart"
 	"os"
 	"path/filepath"
@@ -15,9 +17,12 @@ import (
 	"github.com/minio/sio"
 	"github.com/pkg/errors"
 
+	"github.com/tags-drive/core/internal/storage/encryption"
 	"github.com/tags-drive/core/internal/storage/files/aggregation"
 	"github.com/tags-drive/core/internal/storage/files/extensions"
+	"github.com/tags-drive/core/internal/storage/files/metadata"
 	"github.com/tags-drive/core/internal/storage/files/resizing"
+	"github.com/tags-drive/core/pkg/clientcrypto"
 )
 
 const (
@@ -30,6 +35,12 @@ var (
 	ErrAlreadyExist      = errors.New("file already exists")
 	ErrFileDeletedAgain  = errors.New("file can't be deleted again")
 	ErrOffsetOutOfBounds = errors.New("offset is out of bounds")
+	ErrNoPreview         = errors.New("file has no preview")
+
+	ErrClientEncryptionDisabled = errors.New("client-side encryption is disabled")
+	ErrFieldNotEncrypted        = errors.New("field of client-encrypted file must be encrypted")
+	ErrClientEncryptedFile      = errors.New("file is encrypted by a client")
+	ErrNoVaultKey               = errors.New("file is encrypted with the vault key, but the key isn't set")
 )
 
 // storage is an internal storage for files metadata
@@ -46,7 +57,19 @@ type storage interface {
 	getFiles(expr aggregation.LogicalExpr, search string, isRegexp bool) (files []File)
 
 	// add adds a file
-	addFile(filename string, fileType extensions.Ext, tags []int, size int64, addTime time.Time) (id int)
+	//     key - data key wrapped by the master key (empty, if files aren't encrypted)
+	//     drop - id of the drop link (0 means the file was uploaded by a user). Files from drop links are pending
+	addFile(filename string, fileType extensions.Ext, tags []int, size int64, addTime time.Time, key string, uploader, drop int) (id int)
+
+	// addEncryptedFile adds a file encrypted by a client. ID, Origin and Preview are set by storage
+	//     withPreview - has the file a preview
+	addEncryptedFile(file File, withPreview bool) (id int)
+
+	// updateFileKey updates a wrapped data key of a file
+	updateFileKey(id int, key string, vaultKey bool) (File, error)
+
+	// acceptFile marks a pending file accepted
+	acceptFile(id int) (File, error)
 
 	// renameFile renames a file
 	renameFile(id int, newName string) (File, error)
@@ -88,6 +111,8 @@ type FileStorage struct {
 
 	storage storage
 	logger  *clog.Logger
+
+	shutdowned chan struct{}
 }
 
 // NewFileStorage creates new FileStorage
@@ -105,9 +130,16 @@ func NewFileStorage(cnf Config, lg *clog.Logger) (*FileStorage, error) {
 		config:  cnf,
 		storage: st,
 		logger:  lg,
+
+		shutdowned: make(chan struct{}),
+	}
+
+	err := checkEncryptionState(cnf)
+	if err != nil {
+		return nil, err
 	}
 
-	err := fs.storage.init()
+	err = fs.storage.init()
 	if err != nil {
 		return nil, errors.Wrapf(err, "can't init files storage")
 	}
@@ -115,11 +147,43 @@ func NewFileStorage(cnf Config, lg *clog.Logger) (*FileStorage, error) {
 	return fs, nil
 }
 
+// checkEncryptionState compares the encryption state of the drive with the config.
+// If there's no marker (new drive or drive created by an old version), the state is detected
+// by FilesJSONFile and the marker is created
+func checkEncryptionState(cnf Config) error {
+	const hint = "use \"tags-drive encrypt\" or \"tags-drive decrypt\" to convert the drive"
+
+	err := encryption.CheckMarker(cnf.DataFolder, cnf.Encrypt)
+	if err == nil {
+		return nil
+	}
+	if err != encryption.ErrNoMarker {
+		return errors.Wrap(err, hint)
+	}
+
+	state, err := encryption.DetectJSONFile(cnf.FilesJSONFile)
+	switch {
+	case os.IsNotExist(err):
+		// New drive
+	case err != nil:
+		return errors.Wrapf(err, "can't detect encryption state of %s", cnf.FilesJSONFile)
+	case state != encryption.StateOf(cnf.Encrypt):
+		return errors.Wrapf(encryption.ErrStateMismatch, "drive is %s, but ENCRYPT=%t: %s", state, cnf.Encrypt, hint)
+	}
+
+	err = os.MkdirAll(cnf.DataFolder, 0666)
+	if err != nil {
+		return errors.Wrapf(err, "can't create a folder %s", cnf.DataFolder)
+	}
+
+	return encryption.WriteMarker(cnf.DataFolder, encryption.StateOf(cnf.Encrypt))
+}
+
 func (fs FileStorage) StartBackgroundServices() {
 	go fs.scheduleDeleting()
 }
 
-func (fs FileStorage) Get(expr string, s FilesSortMode, search string, isRegexp bool, offset, count int) ([]File, error) {
+func (fs FileStorage) Get(access Access, expr string, s FilesSortMode, search string, isRegexp bool, offset, count int) ([]File, error) {
 	parsedExpr, err := aggregation.ParseLogicalExpr(expr)
 	if err != nil {
 		return []File{}, err
@@ -127,6 +191,15 @@ func (fs FileStorage) Get(expr string, s FilesSortMode, search string, isRegexp
 
 	search = strings.ToLower(search)
 	files := fs.storage.getFiles(parsedExpr, search, isRegexp)
+
+	// Remove unavailable files
+	availableFiles := files[:0]
+	for _, f := range files {
+		if fs.CanAccess(f, access) {
+			availableFiles = append(availableFiles, f)
+		}
+	}
+	files = availableFiles
 	if len(files) == 0 && offset == 0 {
 		// We don't return error, when there're no files and offset isn't set
 		return []File{}, nil
@@ -149,12 +222,186 @@ func (fs FileStorage) GetFile(id int) (File, error) {
 	return fs.storage.getFile(id)
 }
 
-func (fs FileStorage) GetRecent(number int) []File {
-	files, _ := fs.Get("", SortByTimeDesc, "", false, 0, number)
+// CanAccess checks whether a file is in the vault, is pending or has restricted tags
+func (fs FileStorage) CanAccess(file File, access Access) bool {
+	if file.Pending && !access.Review {
+		return false
+	}
+
+	if !allowedByTags(file, access.RestrictedTags, fs.config.TagRule) {
+		return false
+	}
+
+	if fs.config.VaultTag == 0 || access.VaultUnlocked {
+		return true
+	}
+
+	return !inVault(file, fs.config.VaultTag)
+}
+
+// CanChange checks whether a file is available and the client can write all its restricted tags
+func (fs FileStorage) CanChange(file File, access Access) bool {
+	return fs.CanAccess(file, access) && allowedByTags(file, access.WritableTags, TagRuleAll)
+}
+
+// allowedByTags checks restricted tags of a file according to a rule
+func allowedByTags(file File, restricted map[int]bool, rule TagRule) bool {
+	var total, allowed int
+	for _, id := range file.Tags {
+		isAllowed, ok := restricted[id]
+		if !ok {
+			continue
+		}
+
+		total++
+		if isAllowed {
+			allowed++
+		}
+	}
+
+	if total == 0 {
+		return true
+	}
+	if rule == TagRuleAny {
+		return allowed > 0
+	}
+	return allowed == total
+}
+
+func inVault(file File, vaultTag int) bool {
+	for _, id := range file.Tags {
+		if id == vaultTag {
+			return true
+		}
+	}
+	return false
+}
+
+// DataKey returns a key, which was used to encrypt the file and its preview.
+// Files uploaded by old versions are encrypted with the master key
+func (fs FileStorage) DataKey(file File) ([32]byte, error) {
+	if file.ClientEncrypted {
+		return [32]byte{}, ErrClientEncryptedFile
+	}
+
+	if file.VaultKey {
+		if !fs.config.VaultEncrypt {
+			return [32]byte{}, ErrNoVaultKey
+		}
+		return encryption.UnwrapKey(file.Key, fs.config.VaultPassPhrase)
+	}
+
+	if file.Key == "" {
+		return fs.config.PassPhrase, nil
+	}
+
+	return encryption.UnwrapKey(file.Key, fs.config.PassPhrase)
+}
+
+func (fs FileStorage) GetRecent(access Access, number int) []File {
+	files, _ := fs.Get(access, "", SortByTimeDesc, "", false, 0, number)
 	return files
 }
 
-func (fs FileStorage) Archive(ids []int) (body io.Reader, err error) {
+// Export returns the content of a file, which is ready to leave the server: it is decrypted and changed
+// according to opts. Stored file isn't changed. cleaned is true, if metadata was removed. Body must be closed
+func (fs FileStorage) Export(file File, opts ExportOptions) (body io.ReadCloser, cleaned bool, err error) {
+	path := fs.config.DataFolder + "/" + strconv.FormatInt(int64(file.ID), 10)
+	f, r, err := fs.openDecrypted(file, path)
+	if err != nil {
+		return nil, false, err
+	}
+
+	ext := filepath.Ext(file.Filename)
+	watermark := opts.Watermark != nil && file.Type.PreviewType == extensions.PreviewTypeImage
+	strip := opts.StripMetadata && metadata.IsSupported(ext)
+
+	// Content of client-side encrypted files can't be changed
+	if file.ClientEncrypted || (!watermark && !strip) {
+		return readCloser{Reader: r, Closer: f}, false, nil
+	}
+
+	defer f.Close()
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, false, errors.Wrap(err, "can't read file")
+	}
+
+	if watermark {
+		data, err = opts.Watermark(file, data)
+		if err != nil {
+			return nil, false, errors.Wrap(err, "can't add watermark")
+		}
+	} else {
+		data, err = metadata.Strip(data, ext)
+		if err != nil {
+			return nil, false, errors.Wrap(err, "can't remove metadata")
+		}
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(data)), true, nil
+}
+
+func (fs FileStorage) ExportPreview(file File, opts ExportOptions) (body io.ReadCloser, err error) {
+	if file.Preview == "" {
+		return nil, ErrNoPreview
+	}
+
+	path := fs.config.ResizedImagesFolder + "/" + strconv.FormatInt(int64(file.ID), 10)
+	f, r, err := fs.openDecrypted(file, path)
+	if err != nil {
+		return nil, err
+	}
+
+	// Previews don't have metadata
+	if opts.Watermark == nil {
+		return readCloser{Reader: r, Closer: f}, nil
+	}
+
+	defer f.Close()
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't read preview")
+	}
+
+	data, err = opts.Watermark(file, data)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't add watermark")
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+// openDecrypted opens a file or a preview and returns a reader of its decrypted content. f must be closed
+func (fs FileStorage) openDecrypted(file File, path string) (f *os.File, r io.Reader, err error) {
+	f, err = os.Open(path)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "can't open file")
+	}
+
+	r = f
+	if fs.config.Encrypt {
+		key, err := fs.DataKey(file)
+		if err == nil {
+			r, err = sio.DecryptReader(f, sio.Config{Key: key[:]})
+		}
+		if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+	}
+
+	return f, r, nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+func (fs FileStorage) Archive(access Access, ids []int, opts ExportOptions) (body io.Reader, cleaned []int, err error) {
 	buff := bytes.NewBuffer([]byte(""))
 
 	zipWriter := zip.NewWriter(buff)
@@ -162,61 +409,92 @@ func (fs FileStorage) Archive(ids []int) (body io.Reader, err error) {
 
 	for _, id := range ids {
 		fileInfo, err := fs.storage.getFile(id)
-		if err != nil {
-			// Skip non-existent file
+		if err != nil || !fs.CanAccess(fileInfo, access) {
+			// Skip non-existent and hidden files
 			continue
 		}
 
-		path := fs.config.DataFolder + "/" + strconv.FormatInt(int64(id), 10)
-		f, err := os.Open(path)
-		if err != nil {
-			fs.logger.Errorf("can't load file \"%s\"\n", fileInfo.Filename)
-			continue
-		}
-		stat, err := f.Stat()
+		// Export the file before creating of a header, so the archive doesn't contain broken files
+		f, isCleaned, err := fs.Export(fileInfo, opts)
 		if err != nil {
-			fs.logger.Errorf("can't load file \"%s\"\n", fileInfo.Filename)
+			fs.logger.Errorf("can't load file \"%s\": %s\n", fileInfo.Filename, err)
 			continue
 		}
 
-		header, _ := zip.FileInfoHeader(stat)
-		header.Name = fileInfo.Filename // Set right filename
-		header.Method = zip.Deflate
-
-		wr, err := zipWriter.CreateHeader(header)
-		if err != nil {
-			fs.logger.Errorf("can't load file \"%s\"\n", fileInfo.Filename)
-			f.Close()
-			continue
+		header := &zip.FileHeader{
+			Name:     fileInfo.Filename, // Set right filename
+			Method:   zip.Deflate,
+			Modified: fileInfo.AddTime,
+		}
+		if fileInfo.ClientEncrypted {
+			// Filename is encrypted. A client has to decrypt the file and its name
+			header.Name = strconv.Itoa(fileInfo.ID) + ".encrypted"
 		}
 
-		if fs.config.Encrypt {
-			_, err = sio.Decrypt(wr, f, sio.Config{Key: fs.config.PassPhrase[:]})
-		} else {
+		wr, err := zipWriter.CreateHeader(header)
+		if err == nil {
 			_, err = io.Copy(wr, f)
 		}
+		f.Close()
 
 		if err != nil {
-			fs.logger.Errorf("can't load file \"%s\"\n", fileInfo.Filename)
+			fs.logger.Errorf("can't load file \"%s\": %s\n", fileInfo.Filename, err)
+			continue
 		}
 
-		f.Close()
+		if isCleaned {
+			cleaned = append(cleaned, fileInfo.ID)
+		}
 	}
 
-	return buff, nil
+	return buff, cleaned, nil
+}
+
+func (fs FileStorage) Upload(f *multipart.FileHeader, tags []int, uploader int) (int, error) {
+	return fs.upload(f, tags, uploader, 0)
 }
 
-func (fs FileStorage) Upload(f *multipart.FileHeader, tags []int) (err error) {
+func (fs FileStorage) UploadForReview(f *multipart.FileHeader, tags []int, drop int) (int, error) {
+	return fs.upload(f, tags, 0, drop)
+}
+
+// upload saves a file. drop is an id of the drop link (0 means the file is uploaded by a user)
+func (fs FileStorage) upload(f *multipart.FileHeader, tags []int, uploader, drop int) (id int, err error) {
 	file, err := f.Open()
 	if err != nil {
-		return errors.Wrap(err, "can't open a file")
+		return 0, errors.Wrap(err, "can't open a file")
 	}
 	defer file.Close()
 
 	ext := filepath.Ext(f.Filename)
 	fileType := extensions.GetExt(ext)
 
-	newFileID := fs.storage.addFile(f.Filename, fileType, tags, f.Size, time.Now())
+	// Every file is encrypted with its own key. The key is stored in the file record
+	// wrapped by the master key
+	var (
+		dataKey    [32]byte
+		wrappedKey string
+	)
+	toVault := fs.config.VaultEncrypt && inVault(File{Tags: tags}, fs.config.VaultTag)
+	if fs.config.Encrypt {
+		master := fs.config.PassPhrase
+		if toVault {
+			master = fs.config.VaultPassPhrase
+		}
+
+		dataKey, wrappedKey, err = encryption.NewDataKey(master)
+		if err != nil {
+			return 0, errors.Wrap(err, "can't create a data key")
+		}
+	}
+
+	var newFileID int
+	if fs.config.Encrypt && toVault {
+		newFileID = fs.storage.addFile(f.Filename, fileType, tags, f.Size, time.Now(), "", uploader, drop)
+		fs.storage.updateFileKey(newFileID, wrappedKey, true)
+	} else {
+		newFileID = fs.storage.addFile(f.Filename, fileType, tags, f.Size, time.Now(), wrappedKey, uploader, drop)
+	}
 
 	// If we will get a major error, we will have to panic to delete record in file storage
 	defer func() {
@@ -225,9 +503,10 @@ func (fs FileStorage) Upload(f *multipart.FileHeader, tags []int) (err error) {
 			// We can only log this error
 			e := fs.storage.deleteFileForce(newFileID)
 			if e != nil {
-				fs.logger.Errorf("can't delete record in file storage after error in Upload function: %s\n", e)
+				fs.logger.Errorf("can't delete record in file storage after error in upload function: %s\n", e)
 			}
 
+			id = 0
 			e, ok := r.(error)
 			if !ok {
 				err = errors.New("unexpected error")
@@ -248,7 +527,7 @@ func (fs FileStorage) Upload(f *multipart.FileHeader, tags []int) (err error) {
 		fileReader := io.TeeReader(file, imageReader)
 
 		// Save an original image
-		err = fs.copyToFile(fileReader, originPath)
+		err = fs.copyToFile(fileReader, originPath, dataKey)
 		if err != nil {
 			panic(err)
 		}
@@ -270,23 +549,24 @@ func (fs FileStorage) Upload(f *multipart.FileHeader, tags []int) (err error) {
 			fs.logger.Errorf("can't encode a resized image %s: %s\n", f.Filename, err)
 			break
 		}
-		err = fs.copyToFile(r, previewPath)
+		err = fs.copyToFile(r, previewPath, dataKey)
 		if err != nil {
 			fs.logger.Errorf("can't save a resized image %s: %s\n", f.Filename, err)
 		}
 	default:
 		// Save a file
-		err := fs.copyToFile(file, originPath)
+		err := fs.copyToFile(file, originPath, dataKey)
 		if err != nil {
 			panic(err)
 		}
 	}
 
-	return nil
+	return newFileID, nil
 }
 
-// copyToFile copies data from src to new created file
-func (fs FileStorage) copyToFile(src io.Reader, path string) error {
+// copyToFile copies data from src to new created file. If encryption is enabled,
+// data is encrypted with passed key
+func (fs FileStorage) copyToFile(src io.Reader, path string, key [32]byte) error {
 	// We trunc file, if it already exists
 	newFile, err := os.Create(path)
 	if err != nil {
@@ -295,7 +575,7 @@ func (fs FileStorage) copyToFile(src io.Reader, path string) error {
 
 	// Write file
 	if fs.config.Encrypt {
-		_, err = sio.Encrypt(newFile, src, sio.Config{Key: fs.config.PassPhrase[:]})
+		_, err = sio.Encrypt(newFile, src, sio.Config{Key: key[:]})
 	} else {
 		_, err = io.Copy(newFile, src)
 	}
@@ -311,8 +591,90 @@ func (fs FileStorage) copyToFile(src io.Reader, path string) error {
 	return nil
 }
 
+// UploadEncrypted saves a file encrypted by a client. Content and preview are saved as is
+func (fs FileStorage) UploadEncrypted(f EncryptedFile, tags []int, uploader int) (File, error) {
+	if !fs.config.ClientEncryption {
+		return File{}, ErrClientEncryptionDisabled
+	}
+
+	if !clientcrypto.IsEncryptedField(f.Filename) || !clientcrypto.IsEncryptedField(f.Description) {
+		return File{}, ErrFieldNotEncrypted
+	}
+	if _, err := base64.StdEncoding.DecodeString(f.Key); err != nil || f.Key == "" {
+		return File{}, errors.New("wrapped key is invalid")
+	}
+
+	if tags == nil {
+		tags = []int{}
+	}
+
+	info := File{
+		Filename:        f.Filename,
+		Type:            extensions.GetExt(f.Ext),
+		Key:             f.Key,
+		ClientEncrypted: true,
+		Tags:            tags,
+		Description:     f.Description,
+		Size:            f.Content.Size,
+		AddTime:         time.Now(),
+		Uploader:        uploader,
+	}
+
+	id := fs.storage.addEncryptedFile(info, f.Preview != nil)
+	info, _ = fs.storage.getFile(id)
+
+	// Content is already encrypted, so it is saved without server-side encryption
+	save := func(h *multipart.FileHeader, path string) error {
+		src, err := h.Open()
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+
+		dst, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+
+		_, err = io.Copy(dst, src)
+		if closeErr := dst.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(path)
+		}
+		return err
+	}
+
+	err := save(f.Content, info.Origin)
+	if err != nil {
+		if e := fs.storage.deleteFileForce(id); e != nil {
+			fs.logger.Errorf("can't delete record in file storage after error in UploadEncrypted function: %s\n", e)
+		}
+		return File{}, errors.Wrap(err, "can't save a file")
+	}
+
+	if f.Preview != nil {
+		err = save(f.Preview, info.Preview)
+		if err != nil {
+			// Only log error
+			fs.logger.Errorf("can't save a preview of file %d: %s\n", id, err)
+		}
+	}
+
+	return info, nil
+}
+
+func (fs FileStorage) Accept(id int) (File, error) {
+	return fs.storage.acceptFile(id)
+}
+
 // Rename renames a file
 func (fs FileStorage) Rename(id int, newName string) (File, error) {
+	if err := fs.checkEncryptedField(id, newName); err != nil {
+		return File{}, err
+	}
+
 	file, err := fs.storage.renameFile(id, newName)
 	if err != nil {
 		return File{}, errors.Wrap(err, "can't rename file in a storage")
@@ -323,13 +685,39 @@ func (fs FileStorage) Rename(id int, newName string) (File, error) {
 }
 
 func (fs FileStorage) ChangeTags(id int, tags []int) (File, error) {
-	return fs.storage.updateFileTags(id, tags)
+	file, err := fs.storage.updateFileTags(id, tags)
+	if err != nil {
+		return file, err
+	}
+
+	fs.updateVaultKeys([]int{id})
+
+	return fs.storage.getFile(id)
 }
 
 func (fs FileStorage) ChangeDescription(id int, newDescription string) (File, error) {
+	if err := fs.checkEncryptedField(id, newDescription); err != nil {
+		return File{}, err
+	}
+
 	return fs.storage.updateFileDescription(id, newDescription)
 }
 
+// checkEncryptedField returns ErrFieldNotEncrypted, if a new value of a field of
+// a client-encrypted file isn't encrypted
+func (fs FileStorage) checkEncryptedField(id int, value string) error {
+	file, err := fs.storage.getFile(id)
+	if err != nil {
+		return err
+	}
+
+	if file.ClientEncrypted && !clientcrypto.IsEncryptedField(value) {
+		return ErrFieldNotEncrypted
+	}
+
+	return nil
+}
+
 func (fs FileStorage) Delete(id int) error {
 	return fs.storage.deleteFile(id)
 }
@@ -365,14 +753,76 @@ func (fs FileStorage) DeleteForce(id int) error {
 
 func (fs FileStorage) AddTagsToFiles(filesIDs, tagsIDs []int) {
 	fs.storage.addTagsToFiles(filesIDs, tagsIDs)
+	fs.updateVaultKeys(filesIDs)
 }
 
 func (fs FileStorage) RemoveTagsFromFiles(filesIDs, tagsIDs []int) {
 	fs.storage.removeTagsFromFiles(filesIDs, tagsIDs)
+	fs.updateVaultKeys(filesIDs)
 }
 
 func (fs FileStorage) DeleteTagFromFiles(tagID int) {
+	var ids []int
+	if tagID == fs.config.VaultTag {
+		// All files leave the vault
+		for _, f := range fs.storage.getFiles(aggregation.LogicalExpr(""), "", false) {
+			if f.VaultKey {
+				ids = append(ids, f.ID)
+			}
+		}
+	}
+
 	fs.storage.deleteTagFromFiles(tagID)
+	fs.updateVaultKeys(ids)
+}
+
+// updateVaultKeys rewraps data keys of files, which were moved into the vault or out of it.
+// Files in the vault use the vault key, other files use the master key.
+// Errors are only logged: a file stays available with the old key
+func (fs FileStorage) updateVaultKeys(ids []int) {
+	if !fs.config.Encrypt || !fs.config.VaultEncrypt {
+		return
+	}
+
+	for _, id := range ids {
+		file, err := fs.storage.getFile(id)
+		if err != nil || file.ClientEncrypted {
+			continue
+		}
+
+		toVault := inVault(file, fs.config.VaultTag)
+		if toVault == file.VaultKey {
+			continue
+		}
+
+		if file.Key == "" {
+			// The file was uploaded by an old version and is encrypted with the master key
+			fs.logger.Warnf("file %d is encrypted with the master key: its key can't be moved into the vault\n", id)
+			continue
+		}
+
+		dataKey, err := fs.DataKey(file)
+		if err != nil {
+			fs.logger.Errorf("can't unwrap key of file %d: %s\n", id, err)
+			continue
+		}
+
+		master := fs.config.PassPhrase
+		if toVault {
+			master = fs.config.VaultPassPhrase
+		}
+
+		wrapped, err := encryption.WrapKey(dataKey, master)
+		if err != nil {
+			fs.logger.Errorf("can't wrap key of file %d: %s\n", id, err)
+			continue
+		}
+
+		_, err = fs.storage.updateFileKey(id, wrapped, toVault)
+		if err != nil {
+			fs.logger.Errorf("can't update key of file %d: %s\n", id, err)
+		}
+	}
 }
 
 // scheduleDeleting deletes files with expired TimeToDelete
@@ -380,7 +830,7 @@ func (fs FileStorage) DeleteTagFromFiles(tagID int) {
 func (fs FileStorage) scheduleDeleting() {
 	ticker := time.NewTicker(time.Hour * 12)
 
-	for ; true; <-ticker.C {
+	for {
 		fs.logger.Debugln("delete old files")
 
 		var err error
@@ -393,6 +843,13 @@ func (fs FileStorage) scheduleDeleting() {
 				fs.logger.Debugf("file \"%s\" was successfully deleted\n", file.Filename)
 			}
 		}
+
+		select {
+		case <-ticker.C:
+		case <-fs.shutdowned:
+			ticker.Stop()
+			return
+		}
 	}
 }
 
@@ -401,5 +858,7 @@ func (fs FileStorage) Recover(id int) {
 }
 
 func (fs FileStorage) Shutdown() error {
+	close(fs.shutdowned)
+
 	return fs.storage.shutdown()
 }
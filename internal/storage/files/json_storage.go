@@ -260,12 +260,16 @@ func (jfs jsonFileStorage) getFiles(parsedExpr aggregation.LogicalExpr, search s
 // addFile adds an element into js.files and call js.write()
 // It also defines FileInfo.Origin and FileInfo.Preview (if file is image) as
 // `jfs.config.DataFolder + "/" + id` and `jfs.config.ResizedImagesFolder + "/" + id`
-func (jfs *jsonFileStorage) addFile(filename string, fileType extensions.Ext, tags []int, size int64, addTime time.Time) (id int) {
+func (jfs *jsonFileStorage) addFile(filename string, fileType extensions.Ext, tags []int, size int64, addTime time.Time, key string, uploader, drop int) (id int) {
 	fileInfo := File{Filename: filename,
-		Type:    fileType,
-		Tags:    tags,
-		Size:    size,
-		AddTime: addTime,
+		Type:     fileType,
+		Tags:     tags,
+		Size:     size,
+		AddTime:  addTime,
+		Key:      key,
+		Uploader: uploader,
+		Drop:     drop,
+		Pending:  drop != 0,
 	}
 
 	// We need a special var for thread safety
@@ -295,6 +299,26 @@ func (jfs *jsonFileStorage) addFile(filename string, fileType extensions.Ext, ta
 	return fileID
 }
 
+func (jfs *jsonFileStorage) addEncryptedFile(fileInfo File, withPreview bool) (id int) {
+	jfs.mutex.Lock()
+	defer jfs.mutex.Unlock()
+
+	jfs.maxID++
+	fileInfo.ID = jfs.maxID
+
+	fileInfo.Origin = jfs.config.DataFolder + "/" + strconv.FormatInt(int64(fileInfo.ID), 10)
+	fileInfo.Preview = ""
+	if withPreview {
+		fileInfo.Preview = jfs.config.ResizedImagesFolder + "/" + strconv.FormatInt(int64(fileInfo.ID), 10)
+	}
+
+	jfs.files[fileInfo.ID] = fileInfo
+
+	atomic.AddUint32(jfs.changes, 1)
+
+	return fileInfo.ID
+}
+
 // renameFile renames a file
 func (jfs *jsonFileStorage) renameFile(id int, newName string) (File, error) {
 	if !jfs.checkFile(id) {
@@ -334,6 +358,45 @@ func (jfs *jsonFileStorage) updateFileTags(id int, changedTagsID []int) (File, e
 	return f, nil
 }
 
+func (jfs *jsonFileStorage) updateFileKey(id int, key string, vaultKey bool) (File, error) {
+	if !jfs.checkFile(id) {
+		return File{}, ErrFileIsNotExist
+	}
+
+	jfs.mutex.Lock()
+	defer jfs.mutex.Unlock()
+
+	f := jfs.files[id]
+	f.Key = key
+	f.VaultKey = vaultKey
+	jfs.files[id] = f
+
+	atomic.AddUint32(jfs.changes, 1)
+
+	return f, nil
+}
+
+func (jfs *jsonFileStorage) acceptFile(id int) (File, error) {
+	if !jfs.checkFile(id) {
+		return File{}, ErrFileIsNotExist
+	}
+
+	jfs.mutex.Lock()
+	defer jfs.mutex.Unlock()
+
+	f := jfs.files[id]
+	if !f.Pending {
+		return f, nil
+	}
+
+	f.Pending = false
+	jfs.files[id] = f
+
+	atomic.AddUint32(jfs.changes, 1)
+
+	return f, nil
+}
+
 func (jfs *jsonFileStorage) updateFileDescription(id int, newDesc string) (File, error) {
 	if !jfs.checkFile(id) {
 		return File{}, ErrFileIsNotExist
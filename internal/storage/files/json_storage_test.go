@@ -90,7 +90,7 @@ func addDefaultFiles(storage *jsonFileStorage) {
 	now := time.Now()
 
 	for _, f := range files {
-		storage.addFile(f.filename, extensions.Ext{}, f.tags, 0, now)
+		storage.addFile(f.filename, extensions.Ext{}, f.tags, 0, now, "", 0, 0)
 	}
 }
 
@@ -306,7 +306,7 @@ func TestGetFiles(t *testing.T) {
 
 	now := time.Now()
 	for _, f := range files {
-		storage.addFile(f.filename, extensions.Ext{}, []int{}, 0, now)
+		storage.addFile(f.filename, extensions.Ext{}, []int{}, 0, now, "", 0, 0)
 	}
 
 	requests := []struct {
@@ -348,3 +348,108 @@ func TestGetFiles(t *testing.T) {
 
 	removeConfigFile(storage.config.FilesJSONFile)
 }
+
+func TestAcceptFile(t *testing.T) {
+	// The storage isn't saved on disk
+	storage := newStorage()
+	fs := FileStorage{storage: storage}
+	now := time.Now()
+
+	userFileID := storage.addFile("user.txt", extensions.Ext{}, []int{}, 0, now, "", 1, 0)
+	dropFileID := storage.addFile("drop.txt", extensions.Ext{}, []int{}, 0, now, "", 0, 3)
+
+	userFile, _ := storage.getFile(userFileID)
+	if userFile.Pending || !fs.CanAccess(userFile, Access{}) {
+		t.Errorf("file uploaded by a user must be available: %+v", userFile)
+	}
+
+	dropFile, _ := storage.getFile(dropFileID)
+	if !dropFile.Pending || dropFile.Drop != 3 {
+		t.Errorf("file uploaded via a drop link must be pending: %+v", dropFile)
+	}
+	if fs.CanAccess(dropFile, Access{VaultUnlocked: true}) || !fs.CanAccess(dropFile, Access{Review: true}) {
+		t.Errorf("pending file must be available only for reviewers")
+	}
+
+	dropFile, err := fs.Accept(dropFileID)
+	if err != nil || dropFile.Pending || !fs.CanAccess(dropFile, Access{}) {
+		t.Errorf("accepted file must be available: %+v, error: %v", dropFile, err)
+	}
+
+	if _, err := fs.Accept(100); err != ErrFileIsNotExist {
+		t.Errorf("Want: %v\nGet: %v", ErrFileIsNotExist, err)
+	}
+}
+
+func TestCanAccessRestrictedTags(t *testing.T) {
+	// Tags 1 and 2 are restricted, the client can read only tag 1. Tag 3 isn't restricted
+	access := Access{RestrictedTags: map[int]bool{1: true, 2: false}}
+
+	tests := []struct {
+		tags []int
+		all  bool
+		any  bool
+	}{
+		{tags: []int{}, all: true, any: true},
+		{tags: []int{3}, all: true, any: true},
+		{tags: []int{1, 3}, all: true, any: true},
+		{tags: []int{2, 3}, all: false, any: false},
+		{tags: []int{1, 2}, all: false, any: true},
+	}
+
+	for i, tt := range tests {
+		file := File{ID: i + 1, Tags: tt.tags}
+
+		for rule, answer := range map[TagRule]bool{TagRuleAll: tt.all, TagRuleAny: tt.any} {
+			fs := FileStorage{config: Config{TagRule: rule}}
+			if res := fs.CanAccess(file, access); res != answer {
+				t.Errorf("Test #%d (rule %s). Want: %v Got: %v", i, rule, answer, res)
+			}
+			// All files are available, if the client can read all tags
+			if !fs.CanAccess(file, Access{}) {
+				t.Errorf("Test #%d (rule %s). File must be available without restrictions", i, rule)
+			}
+		}
+	}
+}
+
+func TestCanChangeRestrictedTags(t *testing.T) {
+	// Tags 1 and 2 are restricted. The client can read both tags, but can write only tag 1
+	access := Access{
+		RestrictedTags: map[int]bool{1: true, 2: true},
+		WritableTags:   map[int]bool{1: true, 2: false},
+	}
+
+	tests := []struct {
+		tags   []int
+		answer bool
+	}{
+		{tags: []int{}, answer: true},
+		{tags: []int{3}, answer: true},
+		{tags: []int{1, 3}, answer: true},
+		{tags: []int{2, 3}, answer: false},
+		{tags: []int{1, 2}, answer: false},
+	}
+
+	for i, tt := range tests {
+		file := File{ID: i + 1, Tags: tt.tags}
+
+		// All restricted tags must be writable regardless of the rule
+		for _, rule := range []TagRule{TagRuleAll, TagRuleAny} {
+			fs := FileStorage{config: Config{TagRule: rule}}
+			if !fs.CanAccess(file, access) {
+				t.Errorf("Test #%d (rule %s). File must be available for reading", i, rule)
+			}
+			if res := fs.CanChange(file, access); res != tt.answer {
+				t.Errorf("Test #%d (rule %s). Want: %v Got: %v", i, rule, tt.answer, res)
+			}
+		}
+	}
+
+	// Files, which can't be read, can't be changed
+	fs := FileStorage{config: Config{TagRule: TagRuleAll}}
+	file := File{ID: 1, Tags: []int{1}}
+	if fs.CanChange(file, Access{RestrictedTags: map[int]bool{1: false}, WritableTags: map[int]bool{1: true}}) {
+		t.Errorf("File without read access must not be changeable")
+	}
+}
@@ -0,0 +1,346 @@
+// Package metadata removes metadata (EXIF, GPS, XMP, IPTC, comments) from images.
+//
+// JPEG and PNG files are cleaned without re-encoding, if they don't need rotation. EXIF orientation
+// is applied to pixels before metadata is removed, so the image looks the same. TIFF files are
+// always re-encoded, because metadata is stored in the same structure as pixels
+package metadata
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"strings"
+
+	"github.com/disintegration/imaging"
+	"github.com/pkg/errors"
+	"golang.org/x/image/tiff"
+)
+
+const jpegQuality = 95
+
+// Errors
+var (
+	ErrUnsupportedFormat = errors.New("unsupported format")
+	ErrBadImage          = errors.New("invalid image")
+)
+
+type format int
+
+const (
+	formatUnsupported format = iota
+	formatJPEG
+	formatPNG
+	formatTIFF
+)
+
+func getFormat(ext string) format {
+	switch strings.ToLower(ext) {
+	case ".jpg", ".jpeg":
+		return formatJPEG
+	case ".png":
+		return formatPNG
+	case ".tif", ".tiff":
+		return formatTIFF
+	default:
+		return formatUnsupported
+	}
+}
+
+// IsSupported returns true, if metadata can be removed from files with passed extension
+func IsSupported(ext string) bool {
+	return getFormat(ext) != formatUnsupported
+}
+
+// Strip returns a copy of an image without metadata. ext is an extension of the file (for example, ".jpg")
+func Strip(data []byte, ext string) ([]byte, error) {
+	switch getFormat(ext) {
+	case formatJPEG:
+		return stripJPEG(data)
+	case formatPNG:
+		return stripPNG(data)
+	case formatTIFF:
+		return stripTIFF(data)
+	default:
+		return nil, ErrUnsupportedFormat
+	}
+}
+
+// JPEG
+
+const (
+	markerSOI   = 0xd8
+	markerEOI   = 0xd9
+	markerSOS   = 0xda
+	markerAPP0  = 0xe0
+	markerAPP1  = 0xe1
+	markerAPP2  = 0xe2
+	markerAPP14 = 0xee
+	markerAPP15 = 0xef
+	markerCOM   = 0xfe
+)
+
+// stripJPEG removes APPn segments and comments. JFIF (APP0), ICC profile (APP2) and Adobe (APP14)
+// segments are kept: they are needed to show colors correctly
+func stripJPEG(data []byte) ([]byte, error) {
+	if len(data) < 4 || data[0] != 0xff || data[1] != markerSOI {
+		return nil, ErrBadImage
+	}
+
+	res := bytes.NewBuffer(make([]byte, 0, len(data)))
+	res.Write(data[:2])
+
+	orient := orientationUnspecified
+	for i := 2; ; {
+		if i+2 > len(data) || data[i] != 0xff {
+			return nil, ErrBadImage
+		}
+
+		marker := data[i+1]
+		if marker == 0xff {
+			// Fill byte
+			i++
+			continue
+		}
+		if marker == markerEOI {
+			// Data after the end of the image (for example, a video of a "motion photo") is dropped
+			res.Write(data[i : i+2])
+			break
+		}
+
+		if i+4 > len(data) {
+			return nil, ErrBadImage
+		}
+
+		size := int(binary.BigEndian.Uint16(data[i+2:]))
+		end := i + 2 + size
+		if size < 2 || end > len(data) {
+			return nil, ErrBadImage
+		}
+		segment := data[i+4 : end]
+
+		keep := true
+		switch {
+		case marker == markerAPP0:
+			keep = bytes.HasPrefix(segment, []byte("JFIF\x00"))
+		case marker == markerAPP1:
+			if bytes.HasPrefix(segment, []byte("Exif\x00\x00")) && orient == orientationUnspecified {
+				orient = readOrientation(segment[6:])
+			}
+			keep = false
+		case marker == markerAPP2:
+			keep = bytes.HasPrefix(segment, []byte("ICC_PROFILE\x00"))
+		case marker == markerAPP14:
+			keep = bytes.HasPrefix(segment, []byte("Adobe"))
+		case marker > markerAPP2 && marker <= markerAPP15, marker == markerCOM:
+			keep = false
+		}
+
+		if keep {
+			res.Write(data[i:end])
+		}
+
+		i = end
+
+		if marker == markerSOS {
+			// Copy entropy-coded data. It ends with a marker, which isn't a stuffed byte (0xff00)
+			// or a restart marker (0xffd0-0xffd7)
+			for i+1 < len(data) && !(data[i] == 0xff && data[i+1] != 0 && (data[i+1] < 0xd0 || data[i+1] > 0xd7)) {
+				i++
+			}
+			res.Write(data[end:i])
+		}
+	}
+
+	if orient <= orientationNormal {
+		return res.Bytes(), nil
+	}
+
+	// Apply the orientation. Metadata isn't written by the encoder
+	img, err := imaging.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, errors.Wrap(ErrBadImage, err.Error())
+	}
+
+	buff := new(bytes.Buffer)
+	err = imaging.Encode(buff, fixOrientation(img, orient), imaging.JPEG, imaging.JPEGQuality(jpegQuality))
+	if err != nil {
+		return nil, errors.Wrap(err, "can't encode image")
+	}
+
+	return buff.Bytes(), nil
+}
+
+// PNG
+
+var pngHeader = []byte("\x89PNG\r\n\x1a\n")
+
+// pngMetadataChunks contain text, time and EXIF
+var pngMetadataChunks = map[string]bool{
+	"tEXt": true,
+	"zTXt": true,
+	"iTXt": true,
+	"eXIf": true,
+	"tIME": true,
+}
+
+func stripPNG(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, pngHeader) {
+		return nil, ErrBadImage
+	}
+
+	res := bytes.NewBuffer(make([]byte, 0, len(data)))
+	res.Write(pngHeader)
+
+	orient := orientationUnspecified
+	for i := len(pngHeader); i < len(data); {
+		// length (4) + type (4) + data + crc (4)
+		if i+12 > len(data) {
+			return nil, ErrBadImage
+		}
+
+		size := int(binary.BigEndian.Uint32(data[i:]))
+		end := i + 12 + size
+		if end > len(data) {
+			return nil, ErrBadImage
+		}
+
+		chunkType := string(data[i+4 : i+8])
+		chunk := data[i+8 : i+8+size]
+
+		if chunkType == "eXIf" && crc32.ChecksumIEEE(data[i+4:i+8+size]) == binary.BigEndian.Uint32(data[i+8+size:]) {
+			orient = readOrientation(chunk)
+		}
+
+		if !pngMetadataChunks[chunkType] {
+			res.Write(data[i:end])
+		}
+
+		i = end
+		if chunkType == "IEND" {
+			break
+		}
+	}
+
+	if orient <= orientationNormal {
+		return res.Bytes(), nil
+	}
+
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, errors.Wrap(ErrBadImage, err.Error())
+	}
+
+	buff := new(bytes.Buffer)
+	err = png.Encode(buff, fixOrientation(img, orient))
+	if err != nil {
+		return nil, errors.Wrap(err, "can't encode image")
+	}
+
+	return buff.Bytes(), nil
+}
+
+// TIFF
+
+func stripTIFF(data []byte) ([]byte, error) {
+	orient := readOrientation(data)
+
+	img, err := tiff.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, errors.Wrap(ErrBadImage, err.Error())
+	}
+
+	buff := new(bytes.Buffer)
+	err = tiff.Encode(buff, fixOrientation(img, orient), &tiff.Options{Compression: tiff.Deflate})
+	if err != nil {
+		return nil, errors.Wrap(err, "can't encode image")
+	}
+
+	return buff.Bytes(), nil
+}
+
+// Orientation
+
+type orientation int
+
+// EXIF orientations
+const (
+	orientationUnspecified orientation = 0
+	orientationNormal      orientation = 1
+	orientationFlipH       orientation = 2
+	orientationRotate180   orientation = 3
+	orientationFlipV       orientation = 4
+	orientationTranspose   orientation = 5
+	orientationRotate270   orientation = 6
+	orientationTransverse  orientation = 7
+	orientationRotate90    orientation = 8
+)
+
+// readOrientation reads the orientation tag from the first IFD of TIFF structure (EXIF uses it too).
+// It returns orientationUnspecified, if the tag isn't found or data is invalid
+func readOrientation(data []byte) orientation {
+	const orientationTag = 0x0112
+
+	if len(data) < 8 {
+		return orientationUnspecified
+	}
+
+	var order binary.ByteOrder
+	switch string(data[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return orientationUnspecified
+	}
+
+	offset := int(order.Uint32(data[4:]))
+	if offset < 8 || offset+2 > len(data) {
+		return orientationUnspecified
+	}
+
+	count := int(order.Uint16(data[offset:]))
+	for i := 0; i < count; i++ {
+		// tag (2) + type (2) + count (4) + value (4)
+		entry := offset + 2 + i*12
+		if entry+12 > len(data) {
+			return orientationUnspecified
+		}
+
+		if order.Uint16(data[entry:]) != orientationTag {
+			continue
+		}
+
+		value := orientation(order.Uint16(data[entry+8:]))
+		if value < orientationNormal || value > orientationRotate90 {
+			return orientationUnspecified
+		}
+		return value
+	}
+
+	return orientationUnspecified
+}
+
+// fixOrientation transforms an image according to the orientation
+func fixOrientation(img image.Image, o orientation) image.Image {
+	switch o {
+	case orientationFlipH:
+		return imaging.FlipH(img)
+	case orientationFlipV:
+		return imaging.FlipV(img)
+	case orientationRotate90:
+		return imaging.Rotate90(img)
+	case orientationRotate180:
+		return imaging.Rotate180(img)
+	case orientationRotate270:
+		return imaging.Rotate270(img)
+	case orientationTranspose:
+		return imaging.Transpose(img)
+	case orientationTransverse:
+		return imaging.Transverse(img)
+	default:
+		return img
+	}
+}
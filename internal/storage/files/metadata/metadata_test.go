@@ -0,0 +1,216 @@
+package metadata
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/image/tiff"
+)
+
+const secret = "GPS 55.7558N 37.6173E"
+
+// newImage returns an image 40x20
+func newImage() image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, 40, 20))
+	for x := 0; x < 40; x++ {
+		for y := 0; y < 20; y++ {
+			img.Set(x, y, color.RGBA{uint8(x * 6), uint8(y * 12), 100, 255})
+		}
+	}
+	return img
+}
+
+// newExif returns EXIF (TIFF structure) with the orientation tag and the secret
+func newExif(o orientation) []byte {
+	buff := new(bytes.Buffer)
+	buff.WriteString("II*\x00")
+	binary.Write(buff, binary.LittleEndian, uint32(8)) // offset of IFD
+	binary.Write(buff, binary.LittleEndian, uint16(1)) // number of entries
+	// tag, type (SHORT), count, value
+	binary.Write(buff, binary.LittleEndian, []uint16{0x0112, 3})
+	binary.Write(buff, binary.LittleEndian, uint32(1))
+	binary.Write(buff, binary.LittleEndian, []uint16{uint16(o), 0})
+	binary.Write(buff, binary.LittleEndian, uint32(0)) // no next IFD
+	buff.WriteString(secret)
+	return buff.Bytes()
+}
+
+func newJPEG(t *testing.T, o orientation, withTrailer bool) []byte {
+	buff := new(bytes.Buffer)
+	if err := jpeg.Encode(buff, newImage(), nil); err != nil {
+		t.Fatal(err)
+	}
+	data := buff.Bytes()
+
+	segment := func(marker byte, content []byte) []byte {
+		res := []byte{0xff, marker, 0, 0}
+		binary.BigEndian.PutUint16(res[2:], uint16(len(content)+2))
+		return append(res, content...)
+	}
+
+	res := append([]byte{}, data[:2]...)
+	res = append(res, segment(markerAPP1, append([]byte("Exif\x00\x00"), newExif(o)...))...)
+	res = append(res, segment(markerAPP1, []byte("http://ns.adobe.com/xap/1.0/\x00"+secret))...)
+	res = append(res, segment(markerCOM, []byte(secret))...)
+	res = append(res, data[2:]...)
+	if withTrailer {
+		// Trailer after the end of the image
+		res = append(res, []byte(secret)...)
+	}
+
+	return res
+}
+
+func newPNG(t *testing.T, o orientation) []byte {
+	buff := new(bytes.Buffer)
+	if err := png.Encode(buff, newImage()); err != nil {
+		t.Fatal(err)
+	}
+	data := buff.Bytes()
+
+	chunk := func(chunkType string, content []byte) []byte {
+		res := make([]byte, 4)
+		binary.BigEndian.PutUint32(res, uint32(len(content)))
+		res = append(res, chunkType...)
+		res = append(res, content...)
+		crc := make([]byte, 4)
+		binary.BigEndian.PutUint32(crc, crc32.ChecksumIEEE(res[4:]))
+		return append(res, crc...)
+	}
+
+	// Insert chunks after IHDR (header (8) + IHDR chunk (25))
+	res := append([]byte{}, data[:33]...)
+	res = append(res, chunk("eXIf", newExif(o))...)
+	res = append(res, chunk("tEXt", []byte("Comment\x00"+secret))...)
+	res = append(res, data[33:]...)
+
+	return res
+}
+
+func TestJPEG(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := []struct {
+		o           orientation
+		withTrailer bool
+	}{
+		{orientationUnspecified, false},
+		{orientationNormal, true},
+		{orientationRotate270, false},
+		{orientationRotate270, true},
+	}
+
+	for _, tt := range tests {
+		o := tt.o
+		data := newJPEG(t, o, tt.withTrailer)
+		assert.Contains(string(data), secret)
+
+		res, err := Strip(data, ".JPG")
+		if !assert.Nil(err) {
+			continue
+		}
+		assert.NotContains(string(res), secret)
+		assert.NotContains(string(res), "Exif")
+
+		img, err := jpeg.Decode(bytes.NewReader(res))
+		if !assert.Nil(err) {
+			continue
+		}
+
+		if o == orientationRotate270 {
+			// Rotated
+			assert.Equal(image.Rect(0, 0, 20, 40), img.Bounds())
+		} else {
+			assert.Equal(image.Rect(0, 0, 40, 20), img.Bounds())
+			// Image data isn't changed
+			original, _ := jpeg.Decode(bytes.NewReader(data))
+			assert.Equal(original, img)
+		}
+	}
+}
+
+func TestPNG(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, o := range []orientation{orientationNormal, orientationRotate90} {
+		data := newPNG(t, o)
+		assert.Contains(string(data), secret)
+
+		res, err := Strip(data, ".png")
+		if !assert.Nil(err) {
+			continue
+		}
+		assert.NotContains(string(res), secret)
+		assert.NotContains(string(res), "eXIf")
+
+		img, err := png.Decode(bytes.NewReader(res))
+		if !assert.Nil(err) {
+			continue
+		}
+
+		if o == orientationRotate90 {
+			assert.Equal(image.Rect(0, 0, 20, 40), img.Bounds())
+		} else {
+			assert.Equal(image.Rect(0, 0, 40, 20), img.Bounds())
+		}
+	}
+}
+
+func TestTIFF(t *testing.T) {
+	assert := assert.New(t)
+
+	buff := new(bytes.Buffer)
+	if err := tiff.Encode(buff, newImage(), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := Strip(buff.Bytes(), ".tiff")
+	if !assert.Nil(err) {
+		return
+	}
+
+	img, err := tiff.Decode(bytes.NewReader(res))
+	if assert.Nil(err) {
+		assert.Equal(image.Rect(0, 0, 40, 20), img.Bounds())
+	}
+}
+
+func TestErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.False(IsSupported(".gif"))
+	assert.True(IsSupported(".jpeg"))
+
+	_, err := Strip([]byte("GIF89a"), ".gif")
+	assert.Equal(ErrUnsupportedFormat, err)
+
+	_, err = Strip([]byte("not an image"), ".jpg")
+	assert.Equal(ErrBadImage, err)
+
+	_, err = Strip([]byte("not an image"), ".png")
+	assert.Equal(ErrBadImage, err)
+
+	// Truncated file
+	data := newJPEG(t, orientationNormal, false)
+	_, err = Strip(data[:30], ".jpg")
+	assert.Equal(ErrBadImage, err)
+}
+
+func TestReadOrientation(t *testing.T) {
+	assert := assert.New(t)
+
+	for o := orientationNormal; o <= orientationRotate90; o++ {
+		assert.Equal(o, readOrientation(newExif(o)))
+	}
+
+	assert.Equal(orientationUnspecified, readOrientation(newExif(9)))
+	assert.Equal(orientationUnspecified, readOrientation([]byte("II*\x00\xff\xff\xff\xff")))
+	assert.Equal(orientationUnspecified, readOrientation(nil))
+}
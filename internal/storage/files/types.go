@@ -19,6 +19,61 @@ type Config struct {
 
 	Encrypt    bool
 	PassPhrase [32]byte
+
+	// ClientEncryption allows to upload files encrypted by clients (see pkg/clientcrypto)
+	ClientEncryption bool
+
+	// VaultTag is an id of the vault tag (0 means there's no vault). Files with this tag
+	// are hidden until the vault is unlocked
+	VaultTag int
+	// VaultEncrypt means data keys of files in the vault are wrapped by VaultPassPhrase
+	// instead of the master key
+	VaultEncrypt    bool
+	VaultPassPhrase [32]byte
+
+	// TagRule defines when a file with several restricted tags is available
+	TagRule TagRule
+}
+
+// TagRule defines when a file with restricted tags is available
+type TagRule string
+
+// Tag rules
+const (
+	// TagRuleAll means a client must be able to read all restricted tags of a file
+	TagRuleAll TagRule = "all"
+	// TagRuleAny means a client must be able to read at least one restricted tag of a file
+	TagRuleAny TagRule = "any"
+)
+
+// IsValid returns true, if r is a known rule
+func (r TagRule) IsValid() bool {
+	return r == TagRuleAll || r == TagRuleAny
+}
+
+// Access describes which files can be shown to a client
+type Access struct {
+	// VaultUnlocked is true, if the client has unlocked the vault
+	VaultUnlocked bool
+	// Review is true, if the client can see and accept files uploaded via drop links
+	Review bool
+	// RestrictedTags maps ids of tags with ACLs to true, if the client can read the tag. Files with restricted
+	// tags are available according to Config.TagRule. nil means the client can read all tags
+	RestrictedTags map[int]bool
+	// WritableTags maps ids of tags with ACLs to true, if the client can write the tag. Files with restricted
+	// tags can be changed only if all of them are writable. nil means the client can write all tags
+	WritableTags map[int]bool
+}
+
+// ExportOptions describes changes of files, which leave the server (archives, downloads). Stored files
+// aren't changed
+type ExportOptions struct {
+	// StripMetadata removes EXIF (including GPS) and other metadata from JPEG, PNG and TIFF images.
+	// Orientation is applied before
+	StripMetadata bool
+	// Watermark changes the content of images, if it isn't nil. It gets the decrypted content of the file
+	// or its preview and returns the new content. Metadata is considered to be removed
+	Watermark func(file File, data []byte) ([]byte, error)
 }
 
 // FileStorageInterface provides methods for interactions with files
@@ -26,20 +81,44 @@ type FileStorageInterface interface {
 	// Start starts all background services
 	StartBackgroundServices()
 
-	// Get returns all "good" sorted files
+	// Get returns all "good" sorted files, which are available with passed access
 	//
 	// If expr isn't valid, Get returns ErrBadExpessionSyntax
 	// count must be greater than 0, else all files will be returned ([offset:])
-	Get(expr string, s FilesSortMode, search string, isRegexp bool, offset, count int) ([]File, error)
-	// GetFile returns a file with passed id
+	Get(access Access, expr string, s FilesSortMode, search string, isRegexp bool, offset, count int) ([]File, error)
+	// GetFile returns a file with passed id. Access must be checked with CanAccess
 	GetFile(id int) (File, error)
-	// GetRecent returns the last uploaded files
-	GetRecent(number int) []File
-	// ArchiveFiles archives passed files and returns io.Reader with archive
-	Archive(fileIDs []int) (io.Reader, error)
-
-	// UploadFile uploads a new file
-	Upload(file *multipart.FileHeader, tags []int) error
+	// GetRecent returns the last uploaded files, which are available with passed access
+	GetRecent(access Access, number int) []File
+	// ArchiveFiles archives passed files and returns io.Reader with archive. Unavailable files are skipped.
+	// cleaned contains ids of files, which metadata was removed
+	Archive(access Access, fileIDs []int, opts ExportOptions) (body io.Reader, cleaned []int, err error)
+	// Export returns the content of a file, which is ready to leave the server. Access must be checked with CanAccess
+	Export(file File, opts ExportOptions) (body io.ReadCloser, cleaned bool, err error)
+	// ExportPreview returns the content of the preview of an image like Export. It returns ErrNoPreview,
+	// if the file has no preview
+	ExportPreview(file File, opts ExportOptions) (body io.ReadCloser, err error)
+	// OpenContent returns the original content of a file, which supports seeking (for streaming of media).
+	// Access must be checked with CanAccess
+	OpenContent(file File) (Content, error)
+	// CanAccess returns true, if a file is available with passed access
+	CanAccess(file File, access Access) bool
+	// CanChange returns true, if a file is available with passed access and all its restricted tags are writable
+	CanChange(file File, access Access) bool
+	// DataKey returns a key, which can be used to decrypt the file and its preview.
+	// It can be handed off without exposing the master key
+	DataKey(file File) ([32]byte, error)
+
+	// UploadFile uploads a new file and returns its id. uploader is an id of the user, who uploads the file
+	Upload(file *multipart.FileHeader, tags []int, uploader int) (int, error)
+	// UploadForReview uploads a file via a drop link. The file is pending until it is accepted with Accept
+	UploadForReview(file *multipart.FileHeader, tags []int, drop int) (int, error)
+	// UploadEncrypted uploads a file encrypted by a client. It returns ErrClientEncryptionDisabled,
+	// if client-side encryption is disabled
+	UploadEncrypted(file EncryptedFile, tags []int, uploader int) (File, error)
+
+	// Accept accepts a pending file, so it becomes available for all users
+	Accept(fileID int) (updatedFile File, err error)
 
 	// Rename renames a file
 	Rename(fileID int, newName string) (updatedFile File, err error)
@@ -74,16 +153,44 @@ type File struct {
 	Type     extensions.Ext `json:"type"`
 	Origin   string         `json:"origin"`            // Origin is a path to a file (params.DataFolder/filename)
 	Preview  string         `json:"preview,omitempty"` // Preview is a path to a resized image (only if Type.FileType == FileTypeImage)
+	Key      string         `json:"key,omitempty"`     // Key is a data key wrapped by the master key (only if files are encrypted)
+	// ClientEncrypted is true, if the file was encrypted by a client. Content, preview, filename and description
+	// are encrypted with the data key, Key is wrapped by the client master key
+	ClientEncrypted bool `json:"clientEncrypted,omitempty"`
+	// VaultKey is true, if Key is wrapped by the vault key
+	VaultKey bool `json:"vaultKey,omitempty"`
 	//
 	Tags        []int     `json:"tags"`
 	Description string    `json:"description"`
 	Size        int64     `json:"size"`
 	AddTime     time.Time `json:"addTime"`
+	// Uploader is an id of the user, who uploaded the file. It is 0 for files uploaded by old versions
+	Uploader int `json:"uploader,omitempty"`
+	// Drop is an id of the drop link, which was used to upload the file
+	Drop int `json:"drop,omitempty"`
+	// Pending is true, if the file was uploaded via a drop link and isn't accepted yet.
+	// Pending files are available only for reviewers (see Access.Review)
+	Pending bool `json:"pending,omitempty"`
 	//
 	Deleted      bool      `json:"deleted"`
 	TimeToDelete time.Time `json:"timeToDelete"`
 }
 
+// EncryptedFile is a file encrypted by a client. All fields except Ext must be encrypted
+// in format of pkg/clientcrypto
+type EncryptedFile struct {
+	Content *multipart.FileHeader
+	Preview *multipart.FileHeader // can be nil
+
+	Filename    string
+	Description string
+	Key         string // data key wrapped by the client master key
+
+	// Ext is an optional plain extension of the file (with leading dot). It is used to show
+	// a right icon and a preview. Clients, which don't want to reveal a type, can leave it empty
+	Ext string
+}
+
 type FilesSortMode int
 
 const (
@@ -0,0 +1,152 @@
+package rekey
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/minio/sio"
+	"github.com/pkg/errors"
+
+	"github.com/tags-drive/core/internal/storage/encryption"
+	"github.com/tags-drive/core/internal/storage/files"
+)
+
+// loadDataKeys reads FilesJSONFile and fills r.dataKeys. FilesJSONFile can be already converted,
+// if the previous run was interrupted
+func (r *Rekeyer) loadDataKeys(j *journal) error {
+	path := r.config.FilesJSONFile
+	if path == "" {
+		return nil
+	}
+
+	key := r.config.Old
+	if j.isDone(path) || (j.isPending(path) && r.isConverted(path)) {
+		key = r.config.New
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	filesList, err := readFilesJSON(f, key)
+	if err == errDecrypt {
+		return ErrWrongOldKey
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, file := range filesList {
+		// Keys of client-encrypted files are wrapped by a client key
+		if file.Key == "" || !key.Encrypt || file.ClientEncrypted {
+			continue
+		}
+
+		master := key.PassPhrase
+		if file.VaultKey {
+			if !r.config.Vault.Encrypt {
+				if !r.config.New.Encrypt {
+					// The blob must be decrypted
+					return ErrNoVaultKey
+				}
+
+				r.vaultBlobs[filepath.Clean(file.Origin)] = true
+				if file.Preview != "" {
+					r.vaultBlobs[filepath.Clean(file.Preview)] = true
+				}
+				continue
+			}
+			master = r.config.Vault.PassPhrase
+		}
+
+		dataKey, err := encryption.UnwrapKey(file.Key, master)
+		if err != nil {
+			return errors.Wrapf(err, "can't unwrap key of file %d", file.ID)
+		}
+
+		r.dataKeys[filepath.Clean(file.Origin)] = dataKey
+		if file.Preview != "" {
+			r.dataKeys[filepath.Clean(file.Preview)] = dataKey
+		}
+	}
+
+	return nil
+}
+
+// convertFilesJSON rewraps data keys with the new master key. If the drive is decrypted,
+// data keys are removed
+func (r *Rekeyer) convertFilesJSON(dst io.Writer, src io.Reader) error {
+	filesList, err := readFilesJSON(src, r.config.Old)
+	if err != nil {
+		return err
+	}
+
+	for id, file := range filesList {
+		if file.Key == "" || file.ClientEncrypted {
+			continue
+		}
+
+		if file.VaultKey {
+			// Key is wrapped by the vault key, so it stays the same while the drive is encrypted
+			if !r.config.New.Encrypt {
+				file.Key = ""
+				file.VaultKey = false
+				filesList[id] = file
+			}
+			continue
+		}
+
+		dataKey, err := encryption.UnwrapKey(file.Key, r.config.Old.PassPhrase)
+		if err != nil {
+			return errors.Wrapf(err, "can't unwrap key of file %d", file.ID)
+		}
+
+		file.Key = ""
+		if r.config.New.Encrypt {
+			file.Key, err = encryption.WrapKey(dataKey, r.config.New.PassPhrase)
+			if err != nil {
+				return errors.Wrapf(err, "can't wrap key of file %d", file.ID)
+			}
+		}
+
+		filesList[id] = file
+	}
+
+	buff := new(bytes.Buffer)
+	err = json.NewEncoder(buff).Encode(filesList)
+	if err != nil {
+		return err
+	}
+
+	return convert(dst, buff, Key{Encrypt: false}, r.config.New)
+}
+
+func readFilesJSON(r io.Reader, key Key) (map[int]files.File, error) {
+	if key.Encrypt {
+		buff := new(bytes.Buffer)
+		_, err := sio.Decrypt(buff, r, sio.Config{Key: key.PassPhrase[:]})
+		if err != nil {
+			if _, ok := err.(sio.Error); ok {
+				return nil, errDecrypt
+			}
+			return nil, err
+		}
+		r = buff
+	}
+
+	filesList := make(map[int]files.File)
+	err := json.NewDecoder(r).Decode(&filesList)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't decode files list")
+	}
+
+	return filesList, nil
+}
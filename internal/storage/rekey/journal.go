@@ -0,0 +1,164 @@
+package rekey
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const journalHeader = "tags-drive rekey journal v1"
+
+// journal is an append-only list of re-encrypted files. Every record is synced on disk
+// before the next file is processed
+//
+// Format:
+//
+//	tags-drive rekey journal v1 <fingerprint>
+//	~ <path>
+//	<path>
+//	...
+//
+// "~ <path>" means that the original file is about to be replaced. "<path>" means that
+// the file was converted
+type journal struct {
+	f       *os.File
+	done    map[string]struct{}
+	pending map[string]struct{}
+}
+
+const pendingPrefix = "~ "
+
+// fingerprint identifies a pair of keys without revealing them. It protects from resuming
+// an operation with another passphrase
+func fingerprint(oldKey, newKey Key) string {
+	hash := sha256.New()
+	hash.Write([]byte(journalHeader))
+	for _, k := range []Key{oldKey, newKey} {
+		if k.Encrypt {
+			hash.Write([]byte{1})
+			hash.Write(k.PassPhrase[:])
+		} else {
+			hash.Write([]byte{0})
+		}
+	}
+	return hex.EncodeToString(hash.Sum(nil))[:16]
+}
+
+// openJournal opens an existing journal or creates a new one
+func openJournal(path, fingerprint string) (*journal, error) {
+	j := &journal{
+		done:    make(map[string]struct{}),
+		pending: make(map[string]struct{}),
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0666)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		f, err = os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0666)
+		if err != nil {
+			return nil, err
+		}
+		j.f = f
+
+		err = j.append(journalHeader + " " + fingerprint)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+
+		return j, nil
+	}
+
+	j.f = f
+
+	s := bufio.NewScanner(f)
+	if !s.Scan() {
+		f.Close()
+		return nil, errUnknownFormat
+	}
+
+	header := strings.TrimPrefix(s.Text(), journalHeader+" ")
+	if header == s.Text() {
+		f.Close()
+		return nil, errUnknownFormat
+	}
+	if header != fingerprint {
+		f.Close()
+		return nil, ErrAlienJournal
+	}
+
+	for s.Scan() {
+		line := s.Text()
+		switch {
+		case line == "":
+			continue
+		case strings.HasPrefix(line, pendingPrefix):
+			j.pending[strings.TrimPrefix(line, pendingPrefix)] = struct{}{}
+		default:
+			j.done[line] = struct{}{}
+		}
+	}
+	if err := s.Err(); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return j, nil
+}
+
+func (j *journal) isDone(path string) bool {
+	_, ok := j.done[path]
+	return ok
+}
+
+func (j *journal) isPending(path string) bool {
+	_, ok := j.pending[path]
+	return ok
+}
+
+func (j *journal) len() int {
+	return len(j.done)
+}
+
+func (j *journal) markDone(path string) error {
+	err := j.append(path)
+	if err != nil {
+		return err
+	}
+
+	j.done[path] = struct{}{}
+	return nil
+}
+
+func (j *journal) markPending(path string) error {
+	err := j.append(pendingPrefix + path)
+	if err != nil {
+		return err
+	}
+
+	j.pending[path] = struct{}{}
+	return nil
+}
+
+func (j *journal) append(line string) error {
+	_, err := fmt.Fprintln(j.f, line)
+	if err != nil {
+		return err
+	}
+
+	return j.f.Sync()
+}
+
+// close can be called several times
+func (j *journal) close() {
+	if j.f != nil {
+		j.f.Close()
+		j.f = nil
+	}
+}
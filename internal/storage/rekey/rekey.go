@@ -0,0 +1,411 @@
+// Package rekey re-encrypts all files of a drive with a new passphrase.
+// It also can encrypt a plain drive or decrypt an encrypted one
+package rekey
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	clog "github.com/ShoshinNikita/log/v2"
+	"github.com/minio/sio"
+	"github.com/pkg/errors"
+
+	"github.com/tags-drive/core/internal/storage/audit"
+)
+
+// tempSuffix is added to a file while it is being re-encrypted
+const tempSuffix = ".rekey-tmp"
+
+// Errors
+var (
+	ErrWrongOldKey   = errors.New("file can't be decrypted neither with old key nor with new one")
+	ErrVerification  = errors.New("some files weren't converted")
+	ErrAlienJournal  = errors.New("journal belongs to another rekey operation")
+	ErrSameKey       = errors.New("new key must differ from the old one")
+	ErrNothingToDo   = errors.New("there are no files to re-encrypt")
+	ErrNoVaultKey    = errors.New("drive has files in the vault, but the vault key isn't set")
+	errUnknownFormat = errors.New("unknown journal format")
+)
+
+type Config struct {
+	// Folders contains encrypted blobs (DataFolder, ResizedImagesFolder). Subfolders are skipped
+	Folders []string
+	// Files are standalone encrypted files (tags.json, tokens.json and so on)
+	Files []string
+	// LogFolders contain audit logs. Every line of a log is encrypted separately
+	LogFolders []string
+	// FilesJSONFile contains data keys of blobs. Blobs with own keys aren't re-encrypted:
+	// only their keys are rewrapped with the new master key
+	FilesJSONFile string
+
+	// JournalFile keeps the list of already re-encrypted files
+	JournalFile string
+
+	Old Key
+	New Key
+
+	// Vault wraps data keys of files in the vault. These keys aren't changed by Rekeyer,
+	// but they are needed to decrypt the drive
+	Vault Key
+}
+
+// Key describes how files are stored. If Encrypt is false, files are stored as is
+type Key struct {
+	Encrypt    bool
+	PassPhrase [32]byte
+}
+
+// Rekeyer re-encrypts files. It is resumable: if it was interrupted, the next call of Run
+// continues with files which aren't in the journal yet
+type Rekeyer struct {
+	config Config
+
+	// dataKeys contains keys of blobs encrypted with own data keys (path: key)
+	dataKeys map[string][32]byte
+	// vaultBlobs contains blobs with data keys wrapped by the vault key, when the vault key isn't set.
+	// They are left as is
+	vaultBlobs map[string]bool
+	// logs contains paths of audit logs
+	logs map[string]bool
+
+	logger *clog.Logger
+}
+
+// NewRekeyer creates new Rekeyer
+func NewRekeyer(cnf Config, lg *clog.Logger) *Rekeyer {
+	return &Rekeyer{
+		config:     cnf,
+		dataKeys:   make(map[string][32]byte),
+		vaultBlobs: make(map[string]bool),
+		logs:       make(map[string]bool),
+		logger:     lg,
+	}
+}
+
+// InProgress returns true if there's an unfinished rekey operation
+func InProgress(journalFile string) bool {
+	_, err := os.Stat(journalFile)
+	return err == nil
+}
+
+// Run re-encrypts all files, checks them and removes the journal
+func (r *Rekeyer) Run() error {
+	if r.config.Old == r.config.New || (!r.config.Old.Encrypt && !r.config.New.Encrypt) {
+		return ErrSameKey
+	}
+
+	paths, err := r.listFiles()
+	if err != nil {
+		return err
+	}
+	if len(paths) == 0 {
+		return ErrNothingToDo
+	}
+
+	j, err := openJournal(r.config.JournalFile, fingerprint(r.config.Old, r.config.New))
+	if err != nil {
+		return errors.Wrap(err, "can't open journal")
+	}
+	defer j.close()
+
+	if done := j.len(); done > 0 {
+		r.logger.Infof("resume rekey: %d of %d files are already re-encrypted\n", done, len(paths))
+	}
+
+	err = r.loadDataKeys(j)
+	if err == ErrNoVaultKey {
+		return err
+	}
+	if err != nil {
+		return errors.Wrapf(err, "can't load data keys from %s", r.config.FilesJSONFile)
+	}
+
+	for i, path := range paths {
+		if j.isDone(path) || r.vaultBlobs[path] {
+			continue
+		}
+
+		oldKey, newKey := r.keysFor(path)
+		if oldKey == newKey {
+			// Blob with own data key. Its key will be rewrapped in FilesJSONFile
+			continue
+		}
+
+		err := r.rekeyFile(j, path)
+		if err != nil {
+			return errors.Wrapf(err, "can't re-encrypt %s", path)
+		}
+
+		err = j.markDone(path)
+		if err != nil {
+			return errors.Wrap(err, "can't update journal")
+		}
+
+		r.logger.Debugf("[%d/%d] %s was re-encrypted\n", i+1, len(paths), path)
+	}
+
+	r.logger.Infoln("check re-encrypted files")
+
+	if err := r.verify(paths); err != nil {
+		// Keep the journal. The next run will check files again
+		return err
+	}
+
+	j.close()
+	err = os.Remove(r.config.JournalFile)
+	if err != nil {
+		return errors.Wrap(err, "can't remove journal")
+	}
+
+	r.logger.Infof("%d files were re-encrypted\n", len(paths))
+
+	return nil
+}
+
+// keysFor returns the current and the target keys of a file
+func (r *Rekeyer) keysFor(path string) (oldKey, newKey Key) {
+	dataKey, ok := r.dataKeys[path]
+	if !ok {
+		return r.config.Old, r.config.New
+	}
+
+	oldKey = Key{Encrypt: true, PassPhrase: dataKey}
+	if r.config.New.Encrypt {
+		// Blob isn't changed
+		return oldKey, oldKey
+	}
+
+	return oldKey, Key{Encrypt: false}
+}
+
+// listFiles returns paths of all files, which have to be re-encrypted.
+// It also removes temporary files left by an interrupted run
+func (r *Rekeyer) listFiles() ([]string, error) {
+	var paths []string
+
+	for _, folder := range r.config.Folders {
+		infos, err := ioutil.ReadDir(folder)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, errors.Wrapf(err, "can't read folder %s", folder)
+		}
+
+		for _, info := range infos {
+			path := filepath.Join(folder, info.Name())
+
+			switch {
+			case info.IsDir(), strings.HasPrefix(info.Name(), "."):
+				continue
+			case strings.HasSuffix(info.Name(), tempSuffix):
+				r.logger.Debugf("remove temporary file %s\n", path)
+				os.Remove(path)
+				continue
+			}
+
+			paths = append(paths, path)
+		}
+	}
+
+	for _, folder := range r.config.LogFolders {
+		if _, err := os.Stat(folder); os.IsNotExist(err) {
+			continue
+		}
+
+		logs, err := audit.LogFiles(folder)
+		if err != nil {
+			return nil, err
+		}
+		for _, path := range logs {
+			os.Remove(path + tempSuffix)
+			r.logs[path] = true
+		}
+		paths = append(paths, logs...)
+	}
+
+	// FilesJSONFile must be the last one: keys of blobs are rewrapped after blobs were decrypted
+	files := r.config.Files
+	if r.config.FilesJSONFile != "" {
+		files = append(files[:len(files):len(files)], r.config.FilesJSONFile)
+	}
+
+	for _, path := range files {
+		os.Remove(path + tempSuffix)
+
+		if _, err := os.Stat(path); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, errors.Wrapf(err, "can't check file %s", path)
+		}
+
+		paths = append(paths, path)
+	}
+
+	return paths, nil
+}
+
+// rekeyFile re-encrypts a file. The new version is written into a temporary file,
+// which replaces the original one only after it was fully written and synced
+//
+// Renaming is surrounded by journal records: j.markPending() and j.markDone() (called in Run)
+func (r *Rekeyer) rekeyFile(j *journal, path string) error {
+	// The previous run could be interrupted after renaming, but before updating the journal
+	if j.isPending(path) && r.isConverted(path) {
+		r.logger.Debugf("%s is already converted\n", path)
+		return nil
+	}
+
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tempPath := path + tempSuffix
+	dst, err := os.OpenFile(tempPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return errors.Wrap(err, "can't create a temporary file")
+	}
+
+	switch {
+	case path == r.config.FilesJSONFile:
+		err = r.convertFilesJSON(dst, src)
+	case r.logs[path]:
+		err = audit.Convert(dst, src, audit.Key(r.config.Old), audit.Key(r.config.New))
+	default:
+		oldKey, newKey := r.keysFor(path)
+		err = convert(dst, src, oldKey, newKey)
+	}
+	if err == nil {
+		err = dst.Sync()
+	}
+	dst.Close()
+
+	if err != nil {
+		os.Remove(tempPath)
+
+		if err == errDecrypt {
+			return ErrWrongOldKey
+		}
+		return err
+	}
+
+	src.Close()
+
+	err = j.markPending(path)
+	if err != nil {
+		os.Remove(tempPath)
+		return errors.Wrap(err, "can't update journal")
+	}
+
+	err = os.Rename(tempPath, path)
+	if err != nil {
+		os.Remove(tempPath)
+		return errors.Wrap(err, "can't replace the original file")
+	}
+
+	return syncDir(filepath.Dir(path))
+}
+
+// isConverted returns true if a file is stored according to the new key
+func (r *Rekeyer) isConverted(path string) bool {
+	if r.logs[path] {
+		return audit.IsEncodedWith(path, audit.Key(r.config.New))
+	}
+
+	oldKey, newKey := r.keysFor(path)
+	if newKey.Encrypt {
+		return isEncryptedWith(path, newKey.PassPhrase)
+	}
+
+	// We can't check a plain file. But we can check that it isn't encrypted anymore
+	return !isEncryptedWith(path, oldKey.PassPhrase)
+}
+
+// verify checks that every file can be decrypted with the new key.
+// If files were decrypted, verify checks that they can't be decrypted with the old key anymore
+func (r *Rekeyer) verify(paths []string) error {
+	bad := 0
+	for _, path := range paths {
+		if r.vaultBlobs[path] {
+			continue
+		}
+
+		if !r.isConverted(path) {
+			r.logger.Errorf("%s wasn't converted\n", path)
+			bad++
+		}
+	}
+
+	if bad > 0 {
+		return errors.Wrapf(ErrVerification, "%d of %d files are broken", bad, len(paths))
+	}
+
+	return nil
+}
+
+var errDecrypt = errors.New("can't decrypt file")
+
+// convert reads src according to oldKey and writes it into dst according to newKey
+func convert(dst io.Writer, src io.Reader, oldKey, newKey Key) error {
+	var w io.WriteCloser = nopCloser{dst}
+	if newKey.Encrypt {
+		// sio closes dst if it implements io.Closer. We have to sync dst before closing
+		var err error
+		w, err = sio.EncryptWriter(nopCloser{dst}, sio.Config{Key: newKey.PassPhrase[:]})
+		if err != nil {
+			return err
+		}
+	}
+
+	var err error
+	if oldKey.Encrypt {
+		_, err = sio.Decrypt(w, src, sio.Config{Key: oldKey.PassPhrase[:]})
+		if _, ok := err.(sio.Error); ok {
+			return errDecrypt
+		}
+	} else {
+		_, err = io.Copy(w, src)
+	}
+	if err != nil {
+		return err
+	}
+
+	return w.Close()
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
+// isEncryptedWith returns true if a file can be decrypted with passed key
+func isEncryptedWith(path string, key [32]byte) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	_, err = sio.Decrypt(ioutil.Discard, f, sio.Config{Key: key[:]})
+	return err == nil
+}
+
+// syncDir flushes a rename on disk
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	// Some file systems don't support fsync for folders. We can ignore such error
+	dir.Sync()
+	return nil
+}
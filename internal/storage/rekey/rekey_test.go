@@ -0,0 +1,454 @@
+package rekey
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	clog "github.com/ShoshinNikita/log/v2"
+	"github.com/minio/sio"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/tags-drive/core/internal/storage/audit"
+	"github.com/tags-drive/core/internal/storage/encryption"
+	"github.com/tags-drive/core/internal/storage/files"
+)
+
+var (
+	oldKey = Key{Encrypt: true, PassPhrase: sha256.Sum256([]byte("old"))}
+	newKey = Key{Encrypt: true, PassPhrase: sha256.Sum256([]byte("new"))}
+	noKey  = Key{Encrypt: false}
+)
+
+func writeEncrypted(t *testing.T, path string, data []byte, key Key) {
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if !key.Encrypt {
+		f.Write(data)
+		return
+	}
+
+	_, err = sio.Encrypt(f, bytes.NewReader(data), sio.Config{Key: key.PassPhrase[:]})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readDecrypted(t *testing.T, path string, key Key) []byte {
+	if !key.Encrypt {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	buff := new(bytes.Buffer)
+	_, err = sio.Decrypt(buff, f, sio.Config{Key: key.PassPhrase[:]})
+	if err != nil {
+		t.Fatalf("can't decrypt %s: %s", path, err)
+	}
+	return buff.Bytes()
+}
+
+// prepareDrive creates a drive with 3 blobs, 1 preview, tags.json and files.json.
+// If from.Encrypt is true, there's also a blob with own data key (see checkEnvelope)
+func prepareDrive(t *testing.T, from, to Key) (cnf Config, content map[string][]byte, cleanup func()) {
+	dir, err := ioutil.TempDir("", "rekey")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := filepath.Join(dir, "data")
+	resized := filepath.Join(data, "resized")
+	os.MkdirAll(resized, 0700)
+
+	content = map[string][]byte{
+		filepath.Join(data, "1"):        []byte("first file"),
+		filepath.Join(data, "2"):        bytes.Repeat([]byte("second file"), 10000),
+		filepath.Join(data, "3"):        []byte("third file"),
+		filepath.Join(resized, "1"):     []byte("preview"),
+		filepath.Join(dir, "tags.json"): []byte(`{"1":{"id":1,"name":"tag","color":"#ffffff"}}`),
+	}
+	for path, c := range content {
+		writeEncrypted(t, path, c, from)
+	}
+
+	filesList := map[int]files.File{
+		1: {ID: 1, Filename: "1.jpg", Origin: filepath.Join(data, "1"), Preview: filepath.Join(resized, "1")},
+		2: {ID: 2, Filename: "2.txt", Origin: filepath.Join(data, "2")},
+		3: {ID: 3, Filename: "3.txt", Origin: filepath.Join(data, "3")},
+	}
+	if from.Encrypt {
+		_, wrapped, err := encryption.NewDataKey(from.PassPhrase)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dataKey, _ := encryption.UnwrapKey(wrapped, from.PassPhrase)
+
+		filesList[4] = files.File{ID: 4, Filename: "4.txt", Origin: data + "/4", Key: wrapped}
+		writeEncrypted(t, filepath.Join(data, "4"), envelopeContent, Key{Encrypt: true, PassPhrase: dataKey})
+	}
+
+	buff := new(bytes.Buffer)
+	json.NewEncoder(buff).Encode(filesList)
+	writeEncrypted(t, filepath.Join(dir, "files.json"), buff.Bytes(), from)
+
+	cnf = Config{
+		Folders:       []string{data, resized},
+		Files:         []string{filepath.Join(dir, "tags.json"), filepath.Join(dir, "tokens.json")},
+		FilesJSONFile: filepath.Join(dir, "files.json"),
+		JournalFile:   filepath.Join(dir, "rekey.journal"),
+		Old:           from,
+		New:           to,
+	}
+
+	return cnf, content, func() { os.RemoveAll(dir) }
+}
+
+var envelopeContent = []byte("file with own key")
+
+// checkFilesJSON checks files.json and the blob with own data key
+func checkFilesJSON(t *testing.T, cnf Config, blobBefore []byte) {
+	assert := assert.New(t)
+
+	data := readDecrypted(t, cnf.FilesJSONFile, cnf.New)
+	filesList := make(map[int]files.File)
+	if !assert.Nil(json.Unmarshal(data, &filesList)) {
+		return
+	}
+	assert.Len(filesList, 3+boolToInt(cnf.Old.Encrypt))
+	assert.Equal("1.jpg", filesList[1].Filename)
+
+	if !cnf.Old.Encrypt {
+		return
+	}
+
+	path := filepath.Join(cnf.Folders[0], "4")
+	file := filesList[4]
+
+	if !cnf.New.Encrypt {
+		assert.Equal("", file.Key)
+		assert.Equal(envelopeContent, readDecrypted(t, path, cnf.New))
+		return
+	}
+
+	// Blob must be the same, key must be rewrapped
+	blobAfter, _ := ioutil.ReadFile(path)
+	assert.Equal(blobBefore, blobAfter)
+
+	dataKey, err := encryption.UnwrapKey(file.Key, cnf.New.PassPhrase)
+	if !assert.Nil(err) {
+		return
+	}
+	assert.Equal(envelopeContent, readDecrypted(t, path, Key{Encrypt: true, PassPhrase: dataKey}))
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func TestRekey(t *testing.T) {
+	assert := assert.New(t)
+
+	cnf, content, cleanup := prepareDrive(t, oldKey, newKey)
+	defer cleanup()
+
+	blob, _ := ioutil.ReadFile(filepath.Join(cnf.Folders[0], "4"))
+
+	err := NewRekeyer(cnf, clog.NewProdLogger()).Run()
+	if !assert.Nil(err) {
+		return
+	}
+
+	for path, c := range content {
+		assert.Equal(c, readDecrypted(t, path, newKey))
+	}
+	checkFilesJSON(t, cnf, blob)
+	assert.False(InProgress(cnf.JournalFile))
+}
+
+func TestRekeyResume(t *testing.T) {
+	assert := assert.New(t)
+
+	cnf, content, cleanup := prepareDrive(t, oldKey, newKey)
+	defer cleanup()
+
+	data := cnf.Folders[0]
+
+	// Emulate an interrupted run:
+	//   - "1" was re-encrypted and recorded in the journal
+	//   - "2" was renamed, but the journal wasn't updated
+	//   - "3" has a half-written temporary file
+	j, err := openJournal(cnf.JournalFile, fingerprint(oldKey, newKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeEncrypted(t, filepath.Join(data, "1"), content[filepath.Join(data, "1")], newKey)
+	j.markDone(filepath.Join(data, "1"))
+	j.close()
+
+	j, _ = openJournal(cnf.JournalFile, fingerprint(oldKey, newKey))
+	j.markPending(filepath.Join(data, "2"))
+	j.close()
+	writeEncrypted(t, filepath.Join(data, "2"), content[filepath.Join(data, "2")], newKey)
+	ioutil.WriteFile(filepath.Join(data, "3"+tempSuffix), []byte("garbage"), 0600)
+
+	assert.True(InProgress(cnf.JournalFile))
+
+	blob, _ := ioutil.ReadFile(filepath.Join(cnf.Folders[0], "4"))
+
+	err = NewRekeyer(cnf, clog.NewProdLogger()).Run()
+	if !assert.Nil(err) {
+		return
+	}
+
+	for path, c := range content {
+		assert.Equal(c, readDecrypted(t, path, newKey))
+	}
+	checkFilesJSON(t, cnf, blob)
+
+	_, err = os.Stat(filepath.Join(data, "3"+tempSuffix))
+	assert.True(os.IsNotExist(err))
+	assert.False(InProgress(cnf.JournalFile))
+}
+
+func TestRekeyAlienJournal(t *testing.T) {
+	assert := assert.New(t)
+
+	cnf, _, cleanup := prepareDrive(t, oldKey, newKey)
+	defer cleanup()
+
+	another := Key{Encrypt: true, PassPhrase: sha256.Sum256([]byte("another"))}
+	j, err := openJournal(cnf.JournalFile, fingerprint(oldKey, another))
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.close()
+
+	err = NewRekeyer(cnf, clog.NewProdLogger()).Run()
+	assert.Contains(err.Error(), ErrAlienJournal.Error())
+}
+
+func TestRekeyWrongKey(t *testing.T) {
+	assert := assert.New(t)
+
+	cnf, _, cleanup := prepareDrive(t, oldKey, newKey)
+	defer cleanup()
+
+	cnf.Old = Key{Encrypt: true, PassPhrase: sha256.Sum256([]byte("wrong"))}
+
+	err := NewRekeyer(cnf, clog.NewProdLogger()).Run()
+	if assert.NotNil(err) {
+		assert.Contains(err.Error(), ErrWrongOldKey.Error())
+	}
+
+	// Nothing was changed, so the run can be repeated with the right key
+	cnf.Old = oldKey
+	os.Remove(cnf.JournalFile)
+	assert.Nil(NewRekeyer(cnf, clog.NewProdLogger()).Run())
+}
+
+func TestConvert(t *testing.T) {
+	tests := []struct {
+		name     string
+		from, to Key
+	}{
+		{"encrypt", noKey, newKey},
+		{"decrypt", oldKey, noKey},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			cnf, content, cleanup := prepareDrive(t, tt.from, tt.to)
+			defer cleanup()
+
+			blob, _ := ioutil.ReadFile(filepath.Join(cnf.Folders[0], "4"))
+
+			err := NewRekeyer(cnf, clog.NewProdLogger()).Run()
+			if !assert.Nil(err) {
+				return
+			}
+
+			for path, c := range content {
+				assert.Equal(c, readDecrypted(t, path, tt.to))
+			}
+			checkFilesJSON(t, cnf, blob)
+			assert.False(InProgress(cnf.JournalFile))
+
+			// Nothing to convert
+			cnf.Old = tt.to
+			cnf.New = tt.to
+			assert.Equal(ErrSameKey, NewRekeyer(cnf, clog.NewProdLogger()).Run())
+		})
+	}
+}
+
+func TestRekeyAuditLogs(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, to := range []Key{newKey, noKey} {
+		cnf, _, cleanup := prepareDrive(t, oldKey, to)
+		defer cleanup()
+
+		auditConfig := audit.Config{
+			Folder:      filepath.Join(filepath.Dir(cnf.JournalFile), "audit"),
+			Encrypt:     true,
+			PassPhrase:  oldKey.PassPhrase,
+			MaxFileSize: 500,
+		}
+		cnf.LogFolders = []string{auditConfig.Folder}
+
+		a, err := audit.NewAudit(auditConfig, clog.NewProdLogger())
+		if !assert.Nil(err) {
+			return
+		}
+		for i := 0; i < 10; i++ {
+			a.Log(audit.Event{Action: audit.ActionDownload, User: "user", IP: "127.0.0.1", Targets: []int{i}})
+		}
+		a.Shutdown()
+
+		logs, _ := audit.LogFiles(auditConfig.Folder)
+		assert.True(len(logs) > 1)
+
+		err = NewRekeyer(cnf, clog.NewProdLogger()).Run()
+		if !assert.Nil(err) {
+			return
+		}
+
+		auditConfig.Encrypt = to.Encrypt
+		auditConfig.PassPhrase = to.PassPhrase
+		a, err = audit.NewAudit(auditConfig, clog.NewProdLogger())
+		if !assert.Nil(err) {
+			return
+		}
+		events, err := a.Query(audit.Filter{})
+		assert.Nil(err)
+		assert.Len(events, 10)
+		a.Shutdown()
+	}
+}
+
+func TestDecryptResume(t *testing.T) {
+	assert := assert.New(t)
+
+	cnf, content, cleanup := prepareDrive(t, oldKey, noKey)
+	defer cleanup()
+
+	// "1" was renamed, but the journal wasn't updated
+	path := filepath.Join(cnf.Folders[0], "1")
+	j, err := openJournal(cnf.JournalFile, fingerprint(oldKey, noKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.markPending(path)
+	j.close()
+	writeEncrypted(t, path, content[path], noKey)
+
+	err = NewRekeyer(cnf, clog.NewProdLogger()).Run()
+	if !assert.Nil(err) {
+		return
+	}
+
+	for path, c := range content {
+		assert.Equal(c, readDecrypted(t, path, noKey))
+	}
+	checkFilesJSON(t, cnf, nil)
+}
+
+// addVaultFile adds a blob "5" with a data key wrapped by the vault key
+func addVaultFile(t *testing.T, cnf Config, vault Key) {
+	filesList := make(map[int]files.File)
+	json.Unmarshal(readDecrypted(t, cnf.FilesJSONFile, cnf.Old), &filesList)
+
+	dataKey, wrapped, err := encryption.NewDataKey(vault.PassPhrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(cnf.Folders[0], "5")
+	filesList[5] = files.File{ID: 5, Filename: "5.txt", Origin: path, Key: wrapped, VaultKey: true}
+	writeEncrypted(t, path, vaultContent, Key{Encrypt: true, PassPhrase: dataKey})
+
+	buff := new(bytes.Buffer)
+	json.NewEncoder(buff).Encode(filesList)
+	writeEncrypted(t, cnf.FilesJSONFile, buff.Bytes(), cnf.Old)
+}
+
+var vaultContent = []byte("file in the vault")
+
+func TestRekeyVault(t *testing.T) {
+	vault := Key{Encrypt: true, PassPhrase: sha256.Sum256([]byte("vault"))}
+
+	t.Run("rekey", func(t *testing.T) {
+		assert := assert.New(t)
+
+		cnf, _, cleanup := prepareDrive(t, oldKey, newKey)
+		defer cleanup()
+		addVaultFile(t, cnf, vault)
+
+		path := filepath.Join(cnf.Folders[0], "5")
+		blob, _ := ioutil.ReadFile(path)
+
+		// The vault key isn't needed to change the master key
+		err := NewRekeyer(cnf, clog.NewProdLogger()).Run()
+		if !assert.Nil(err) {
+			return
+		}
+
+		filesList := make(map[int]files.File)
+		json.Unmarshal(readDecrypted(t, cnf.FilesJSONFile, newKey), &filesList)
+		assert.True(filesList[5].VaultKey)
+
+		dataKey, err := encryption.UnwrapKey(filesList[5].Key, vault.PassPhrase)
+		if !assert.Nil(err) {
+			return
+		}
+		blobAfter, _ := ioutil.ReadFile(path)
+		assert.Equal(blob, blobAfter)
+		assert.Equal(vaultContent, readDecrypted(t, path, Key{Encrypt: true, PassPhrase: dataKey}))
+	})
+
+	t.Run("decrypt", func(t *testing.T) {
+		assert := assert.New(t)
+
+		cnf, _, cleanup := prepareDrive(t, oldKey, noKey)
+		defer cleanup()
+		addVaultFile(t, cnf, vault)
+
+		err := NewRekeyer(cnf, clog.NewProdLogger()).Run()
+		assert.Equal(ErrNoVaultKey, err)
+
+		os.Remove(cnf.JournalFile)
+		cnf.Vault = vault
+		err = NewRekeyer(cnf, clog.NewProdLogger()).Run()
+		if !assert.Nil(err) {
+			return
+		}
+
+		filesList := make(map[int]files.File)
+		json.Unmarshal(readDecrypted(t, cnf.FilesJSONFile, noKey), &filesList)
+		assert.False(filesList[5].VaultKey)
+		assert.Equal("", filesList[5].Key)
+		assert.Equal(vaultContent, readDecrypted(t, filepath.Join(cnf.Folders[0], "5"), noKey))
+	})
+}
@@ -123,7 +123,12 @@ func (jts jsonTagStorage) getAll() Tags {
 	jts.mutex.RLock()
 	defer jts.mutex.RUnlock()
 
-	return jts.tags
+	// Tags are checked on every request, so the map is copied to avoid concurrent access
+	res := make(Tags, len(jts.tags))
+	for id, tag := range jts.tags {
+		res[id] = tag
+	}
+	return res
 }
 
 func (jts *jsonTagStorage) addTag(tag Tag) {
@@ -175,6 +180,25 @@ func (jts *jsonTagStorage) updateTag(id int, newName, newColor string) (Tag, err
 	return tag, nil
 }
 
+func (jts *jsonTagStorage) updateACL(id int, acl *ACL) (Tag, error) {
+	jts.mutex.Lock()
+
+	tag, ok := jts.tags[id]
+	if !ok {
+		jts.mutex.Unlock()
+		return Tag{}, errors.New("tag doesn't exist")
+	}
+
+	tag.ACL = acl
+	jts.tags[id] = tag
+
+	jts.mutex.Unlock()
+
+	jts.write()
+
+	return tag, nil
+}
+
 func (jts *jsonTagStorage) deleteTag(id int) {
 	jts.mutex.Lock()
 	// We can skip files.DeleteTag(id), if tag doesn't exist
@@ -266,3 +266,74 @@ func TestUpdate(t *testing.T) {
 
 	removeConfigFile(testStorage.config.TagsJSONFile)
 }
+
+func TestUpdateACL(t *testing.T) {
+	testStorage := newStorage()
+	testStorage.init()
+
+	testStorage.addTag(Tag{Name: "private", Color: "#ffffff"})
+
+	acl := &ACL{Owner: 2, Users: []UserPermission{{UserID: 3, Permission: PermissionRead}}}
+	tag, err := testStorage.updateACL(1, acl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tag.ACL != acl || testStorage.getAll()[1].ACL != acl {
+		t.Errorf("ACL wasn't set: %v", tag)
+	}
+
+	tag, err = testStorage.updateACL(1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tag.ACL != nil || testStorage.getAll()[1].ACL != nil {
+		t.Errorf("ACL wasn't removed: %v", tag)
+	}
+
+	if _, err := testStorage.updateACL(2, acl); err == nil {
+		t.Errorf("ACL of non-existent tag was set")
+	}
+
+	removeConfigFile(testStorage.config.TagsJSONFile)
+}
+
+func TestACLAllows(t *testing.T) {
+	acl := ACL{
+		Owner: 1,
+		Users: []UserPermission{
+			{UserID: 2, Permission: PermissionRead},
+			{UserID: 3, Permission: PermissionWrite},
+		},
+		Roles: []RolePermission{
+			{Role: "editor", Permission: PermissionRead},
+		},
+	}
+
+	// Users with id >= 10 are editors
+	hasRole := func(userID int) func(string) bool {
+		return func(role string) bool { return role == "editor" && userID >= 10 }
+	}
+
+	tests := []struct {
+		userID   int
+		required Permission
+		answer   bool
+	}{
+		{1, PermissionWrite, true},
+		{2, PermissionRead, true},
+		{2, PermissionWrite, false},
+		{3, PermissionRead, true},
+		{3, PermissionWrite, true},
+		{4, PermissionRead, false},
+		{10, PermissionRead, true},
+		{10, PermissionWrite, false},
+		// Anonymous users
+		{0, PermissionRead, false},
+	}
+
+	for i, tt := range tests {
+		if res := acl.Allows(tt.userID, hasRole(tt.userID), tt.required); res != tt.answer {
+			t.Errorf("Test #%d. Want: %v Got: %v", i, tt.answer, res)
+		}
+	}
+}
@@ -18,6 +18,9 @@ type storage interface {
 	// updateTag updates name and color of tag with id == tagID
 	updateTag(id int, newName, newColor string) (Tag, error)
 
+	// updateACL updates ACL of tag with id == tagID
+	updateACL(id int, acl *ACL) (Tag, error)
+
 	// deleteTag deletes a tag
 	deleteTag(id int)
 
@@ -80,6 +83,10 @@ func (ts TagStorage) Change(id int, newName, newColor string) (Tag, error) {
 	return ts.storage.updateTag(id, newName, newColor)
 }
 
+func (ts TagStorage) ChangeACL(id int, acl *ACL) (Tag, error) {
+	return ts.storage.updateACL(id, acl)
+}
+
 func (ts TagStorage) Delete(id int) {
 	ts.storage.deleteTag(id)
 }
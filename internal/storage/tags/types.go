@@ -25,6 +25,9 @@ type TagStorageInterface interface {
 	// If pass empty newName (or newColor), field Name (or Color) won't be changed.
 	Change(id int, newName, newColor string) (updatedTag Tag, err error)
 
+	// ChangeACL sets an ACL of a tag with passed id. nil acl removes all restrictions
+	ChangeACL(id int, acl *ACL) (updatedTag Tag, err error)
+
 	// Delete deletes a tag with passed id
 	Delete(id int)
 
@@ -43,4 +46,67 @@ type Tag struct {
 	ID    int    `json:"id"`
 	Name  string `json:"name"`
 	Color string `json:"color"`
+	// ACL is nil, if the tag isn't restricted
+	ACL *ACL `json:"acl,omitempty"`
+}
+
+// Permission defines what a user can do with a restricted tag
+type Permission string
+
+// Permissions
+const (
+	// PermissionRead allows to see the tag and files with it
+	PermissionRead Permission = "read"
+	// PermissionWrite also allows to change the tag and to add it to files or remove from them
+	PermissionWrite Permission = "write"
+)
+
+// IsValid returns true, if p is a known permission
+func (p Permission) IsValid() bool {
+	return p == PermissionRead || p == PermissionWrite
+}
+
+// includes returns true, if p includes the required permission
+func (p Permission) includes(required Permission) bool {
+	return p == PermissionWrite || p == required
+}
+
+// ACL restricts access to a tag and to files with it
+type ACL struct {
+	// Owner can read, write the tag and change the ACL
+	Owner int `json:"owner"`
+	// Users are permissions of single users
+	Users []UserPermission `json:"users"`
+	// Roles are permissions of all users with a role (or a higher one)
+	Roles []RolePermission `json:"roles"`
+}
+
+type UserPermission struct {
+	UserID     int        `json:"userID"`
+	Permission Permission `json:"permission"`
+}
+
+type RolePermission struct {
+	Role       string     `json:"role"`
+	Permission Permission `json:"permission"`
+}
+
+// Allows returns true, if a user has the required permission. hasRole must return true, if the user
+// has passed role or a higher one
+func (acl ACL) Allows(userID int, hasRole func(role string) bool, required Permission) bool {
+	if userID != 0 && userID == acl.Owner {
+		return true
+	}
+
+	for _, p := range acl.Users {
+		if userID != 0 && p.UserID == userID && p.Permission.includes(required) {
+			return true
+		}
+	}
+	for _, p := range acl.Roles {
+		if p.Permission.includes(required) && hasRole(p.Role) {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,164 @@
+package web
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/tags-drive/core/internal/storage/audit"
+	"github.com/tags-drive/core/internal/web/users"
+)
+
+// Limits of GET /api/audit
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+// auditEvent writes an event of the current user into the audit log
+func (s Server) auditEvent(r *http.Request, action audit.Action, details string, targets ...int) {
+	s.auditUserEvent(r, s.user(r), action, details, targets...)
+}
+
+// auditUserEvent writes an event of a user into the audit log. It is used, when the request
+// has no user yet (for example, during login)
+func (s Server) auditUserEvent(r *http.Request, user users.User, action audit.Action, details string, targets ...int) {
+	if s.audit == nil {
+		return
+	}
+
+	s.audit.Log(audit.Event{
+		Action:  action,
+		UserID:  user.ID,
+		User:    user.Login,
+		IP:      remoteIP(r),
+		Targets: targets,
+		Details: details,
+	})
+}
+
+// auditDataMiddleware logs downloads of original files. Path is "{id}" or "resized/{id}".
+// Previews aren't logged
+func (s Server) auditDataMiddleware(h http.Handler) http.Handler {
+	if s.audit == nil {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.URL.Path)
+		// Players request a file by parts. Only the first part is logged
+		rng := r.Header.Get("Range")
+		if err == nil && (rng == "" || strings.HasPrefix(rng, "bytes=0-")) {
+			if _, err := s.fileStorage.GetFile(id); err == nil {
+				details := ""
+				if r.FormValue(cleanParam) == "true" {
+					details = "clean"
+				}
+				s.auditEvent(r, audit.ActionDownload, details, id)
+			}
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// parseAuditFilter parses params of GET /api/audit and GET /api/audit/export
+func parseAuditFilter(r *http.Request) (audit.Filter, error) {
+	f := audit.Filter{
+		User:   r.FormValue("user"),
+		Action: audit.Action(r.FormValue("action")),
+		IP:     r.FormValue("ip"),
+		Limit:  defaultAuditLimit,
+	}
+
+	var err error
+	if from := r.FormValue("from"); from != "" {
+		f.From, err = time.Parse(time.RFC3339, from)
+		if err != nil {
+			return f, errors.New("from must be in RFC 3339 format")
+		}
+	}
+	if to := r.FormValue("to"); to != "" {
+		f.To, err = time.Parse(time.RFC3339, to)
+		if err != nil {
+			return f, errors.New("to must be in RFC 3339 format")
+		}
+	}
+	if target := r.FormValue("target"); target != "" {
+		f.Target, err = strconv.Atoi(target)
+		if err != nil {
+			return f, errors.New("target isn't valid")
+		}
+	}
+	if limit := r.FormValue("limit"); limit != "" {
+		f.Limit, err = strconv.Atoi(limit)
+		if err != nil || f.Limit <= 0 || f.Limit > maxAuditLimit {
+			return f, errors.Errorf("limit must be in range [1, %d]", maxAuditLimit)
+		}
+	}
+
+	return f, nil
+}
+
+// GET /api/audit
+//
+// Params:
+//   - from (optional): time in RFC 3339 format
+//   - to (optional): time in RFC 3339 format (exclusive)
+//   - user (optional): login of a user
+//   - action (optional): type of events
+//   - ip (optional): address of a client
+//   - target (optional): id of a file, a tag, a user or a token
+//   - limit (optional): max number of events (default is 100, max is 1000)
+//
+// Response: json array of events. The newest events are first
+//
+func (s Server) returnAuditEvents(w http.ResponseWriter, r *http.Request) {
+	f, err := parseAuditFilter(r)
+	if err != nil {
+		s.processError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	events, err := s.audit.Query(f)
+	if err != nil {
+		s.processError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	if s.config.Debug {
+		enc.SetIndent("", "  ")
+	}
+	enc.Encode(events)
+}
+
+// GET /api/audit/export
+//
+// Params: the same as GET /api/audit, except limit
+//
+// Response: events in JSON lines format. The oldest events are first
+//
+func (s Server) exportAuditEvents(w http.ResponseWriter, r *http.Request) {
+	f, err := parseAuditFilter(r)
+	if err != nil {
+		s.processError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.auditEvent(r, audit.ActionAuditExport, "")
+
+	filename := "audit-" + time.Now().Format("2006-01-02") + ".jsonl"
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+
+	err = s.audit.Export(w, f)
+	if err != nil {
+		// Headers are already sent
+		s.logger.Errorf("can't export audit log: %s\n", err)
+	}
+}
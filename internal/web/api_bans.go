@@ -0,0 +1,97 @@
+package web
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/tags-drive/core/internal/storage/audit"
+	"github.com/tags-drive/core/internal/web/limiter"
+)
+
+// Keys of the auth limiter
+const (
+	ipKeyPrefix      = "ip:"
+	accountKeyPrefix = "account:"
+	shareKeyPrefix   = "share:"
+)
+
+// ipKey returns a key of the client address for the auth limiter
+func ipKey(r *http.Request) string {
+	return ipKeyPrefix + remoteIP(r)
+}
+
+// accountKey returns a key of an account for the auth limiter. Failures are counted even
+// for unknown accounts, so the response doesn't tell whether an account exists
+func accountKey(login string) string {
+	return accountKeyPrefix + strings.ToLower(strings.TrimSpace(login))
+}
+
+// shareKey returns a key of a share for the auth limiter
+func shareKey(id int) string {
+	return shareKeyPrefix + strconv.Itoa(id)
+}
+
+// tooManyRequests writes 429 status code with Retry-After header
+func tooManyRequests(w http.ResponseWriter, wait time.Duration) {
+	seconds := int((wait + time.Second - 1) / time.Second)
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(w, "too many auth requests, retry after "+strconv.Itoa(seconds)+"s", http.StatusTooManyRequests)
+}
+
+// errThrottled is returned, when a response with 429 status code was written by authAllowed
+var errThrottled = errors.New("too many auth requests")
+
+// authAllowed checks keys with the auth limiter. It writes 429 status code, if the client has to wait
+func (s Server) authAllowed(w http.ResponseWriter, r *http.Request, keys ...string) bool {
+	wait := s.authLimiter.Check(keys...)
+	if wait <= 0 {
+		return true
+	}
+
+	s.logger.Infof("%s was throttled for %s\n", r.RemoteAddr, wait)
+	tooManyRequests(w, wait)
+	return false
+}
+
+// GET /api/bans
+//
+// Params: -
+//
+// Response: json array of active bans. A key is "ip:{address}" or "account:{login}"
+//
+func (s Server) returnBans(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	if s.config.Debug {
+		enc.SetIndent("", "  ")
+	}
+	enc.Encode(s.authLimiter.GetBans())
+}
+
+// DELETE /api/bans
+//
+// Params:
+//   - key: key of a ban
+//
+// Response: -
+//
+func (s Server) deleteBan(w http.ResponseWriter, r *http.Request) {
+	key := r.FormValue("key")
+
+	err := s.authLimiter.Unban(key)
+	if err != nil {
+		if err == limiter.ErrBanNotExist {
+			s.processError(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		s.processError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	s.logger.Warnf("%s removed the ban of %s\n", s.user(r).Login, key)
+	s.auditEvent(r, audit.ActionBanDelete, key)
+}
@@ -0,0 +1,326 @@
+package web
+
+import (
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/tags-drive/core/internal/storage/audit"
+	"github.com/tags-drive/core/internal/storage/tags"
+	"github.com/tags-drive/core/internal/web/drops"
+	"github.com/tags-drive/core/internal/web/users"
+)
+
+// dropFormOverhead is added to the max size of a request to a drop link. It is enough for
+// multipart headers of all files
+const dropFormOverhead = 1 << 20 // 1MB
+
+// dropErrorCode returns a status code of an error returned by drops.DropsInterface
+func dropErrorCode(err error) int {
+	switch err {
+	case drops.ErrDropNotExist:
+		return http.StatusNotFound
+	case drops.ErrInvalidLimit, drops.ErrExpired, drops.ErrInvalidType:
+		return http.StatusBadRequest
+	case drops.ErrNoUploadsLeft:
+		return http.StatusGone
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// openDrop returns a drop link from the path of a request. It writes an error, if the link doesn't exist
+// or its creator was deleted or disabled
+func (s Server) openDrop(w http.ResponseWriter, r *http.Request) (drops.Drop, bool) {
+	drop, err := s.drops.GetBySlug(mux.Vars(r)["slug"])
+	if err == nil {
+		user, e := s.users.Get(drop.UserID)
+		if e != nil || user.Disabled {
+			err = drops.ErrDropNotExist
+		}
+	}
+	if err != nil {
+		s.processError(w, err.Error(), dropErrorCode(err))
+		return drops.Drop{}, false
+	}
+
+	return drop, true
+}
+
+// GET /api/drops
+//
+// Params:
+//   - all: return drop links of all users (only for admins)
+//
+// Response: json array of drop links
+//
+func (s Server) returnDrops(w http.ResponseWriter, r *http.Request) {
+	user := s.user(r)
+
+	userID := user.ID
+	if r.FormValue("all") == "true" {
+		if user.Role != users.RoleAdmin {
+			s.processError(w, "not enough rights: admin role is needed", http.StatusForbidden)
+			return
+		}
+		userID = 0
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	if s.config.Debug {
+		enc.SetIndent("", "  ")
+	}
+	enc.Encode(s.drops.GetAll(userID))
+}
+
+// POST /api/drops
+//
+// Params:
+//   - name: name of a drop link (optional)
+//   - tags: list of tags, which are added to uploaded files, separated by comma (`tags=1,2,3`)
+//   - max_size: max size of a file in MB (max is 10240)
+//   - max_files: max number of uploaded files (max is 1000)
+//   - types: allowed extensions separated by comma (`types=.pdf,.jpg`). All types are allowed, if it's empty
+//   - expires: expiry time in RFC 3339 format
+//
+// Response: json object of the drop link
+//
+func (s Server) addDrop(w http.ResponseWriter, r *http.Request) {
+	if s.config.ClientEncryption {
+		s.processError(w, "drive uses client-side encryption: files can't be uploaded via drop links", http.StatusBadRequest)
+		return
+	}
+
+	drop := drops.Drop{
+		UserID: s.user(r).ID,
+		Name:   r.FormValue("name"),
+	}
+
+	if strIDs := r.FormValue("tags"); strIDs != "" {
+		for _, strID := range strings.Split(strIDs, ",") {
+			id, err := strconv.Atoi(strID)
+			if err != nil {
+				s.processError(w, "tag id \""+strID+"\" isn't valid", http.StatusBadRequest)
+				return
+			}
+			if !s.isTagAvailable(r, id, tags.PermissionRead) {
+				s.processError(w, "tag with id \""+strID+"\" doesn't exist", http.StatusNotFound)
+				return
+			}
+			if !s.isTagAvailable(r, id, tags.PermissionWrite) {
+				s.processError(w, "not enough rights: write permission for tag \""+strID+"\" is needed", http.StatusForbidden)
+				return
+			}
+			drop.Tags = append(drop.Tags, id)
+		}
+	}
+
+	maxSize, err := strconv.ParseInt(r.FormValue("max_size"), 10, 64)
+	if err != nil {
+		s.processError(w, "max_size must be a number", http.StatusBadRequest)
+		return
+	}
+	// Check the size before the shift to avoid overflow
+	if maxSize > drops.MaxFileSizeLimit>>20 {
+		s.processError(w, drops.ErrInvalidLimit.Error(), http.StatusBadRequest)
+		return
+	}
+	drop.MaxFileSize = maxSize << 20
+
+	drop.MaxFiles, err = strconv.Atoi(r.FormValue("max_files"))
+	if err != nil {
+		s.processError(w, "max_files must be a number", http.StatusBadRequest)
+		return
+	}
+
+	if types := r.FormValue("types"); types != "" {
+		drop.AllowedTypes = strings.Split(types, ",")
+	}
+
+	drop.Expires, err = time.Parse(time.RFC3339, r.FormValue("expires"))
+	if err != nil {
+		s.processError(w, "expires must be in RFC 3339 format", http.StatusBadRequest)
+		return
+	}
+
+	drop, err = s.drops.Create(drop)
+	if err != nil {
+		s.processError(w, err.Error(), dropErrorCode(err))
+		return
+	}
+
+	s.logger.Warnf("%s created drop link %d\n", s.user(r).Login, drop.ID)
+	details := ""
+	if len(drop.Tags) > 0 {
+		details = "tags: " + joinInts(drop.Tags)
+	}
+	s.auditEvent(r, audit.ActionDropAdd, details, drop.ID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	enc := json.NewEncoder(w)
+	if s.config.Debug {
+		enc.SetIndent("", "  ")
+	}
+	enc.Encode(drop)
+}
+
+// DELETE /api/drops
+//
+// Revokes a drop link. Uploaded files aren't deleted. Admins can revoke links of all users
+//
+// Params:
+//   - id: id of a drop link
+//
+// Response: -
+//
+func (s Server) deleteDrop(w http.ResponseWriter, r *http.Request) {
+	user := s.user(r)
+
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		s.processError(w, "drop link id isn't valid", http.StatusBadRequest)
+		return
+	}
+
+	drop, err := s.drops.Get(id)
+	if err != nil || (drop.UserID != user.ID && user.Role != users.RoleAdmin) {
+		s.processError(w, drops.ErrDropNotExist.Error(), http.StatusNotFound)
+		return
+	}
+
+	err = s.drops.Delete(id)
+	if err != nil {
+		s.processError(w, err.Error(), dropErrorCode(err))
+		return
+	}
+
+	s.logger.Warnf("%s revoked drop link %d\n", user.Login, drop.ID)
+	s.auditEvent(r, audit.ActionDropDelete, "", drop.ID)
+}
+
+// GET /api/drop/{slug}
+//
+// Available without auth
+//
+// Params:
+//   - slug: slug of a drop link
+//
+// Response: json object with name, limits, allowed types and expiry time of the drop link
+//
+func (s Server) returnDrop(w http.ResponseWriter, r *http.Request) {
+	drop, ok := s.openDrop(w, r)
+	if !ok {
+		return
+	}
+
+	resp := struct {
+		Name         string    `json:"name"`
+		MaxFileSize  int64     `json:"maxFileSize"`
+		FilesLeft    int       `json:"filesLeft"`
+		AllowedTypes []string  `json:"allowedTypes"`
+		Expires      time.Time `json:"expires"`
+	}{
+		Name:         drop.Name,
+		MaxFileSize:  drop.MaxFileSize,
+		FilesLeft:    drop.FilesLeft(),
+		AllowedTypes: drop.AllowedTypes,
+		Expires:      drop.Expires,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "private, no-store")
+	enc := json.NewEncoder(w)
+	if s.config.Debug {
+		enc.SetIndent("", "  ")
+	}
+	enc.Encode(resp)
+}
+
+// POST /api/drop/{slug}
+//
+// Available without auth. Body must be "multipart/form-data". Uploaded files get tags of the drop link
+// and are pending until they are accepted with POST /api/files/accept
+//
+// Params:
+//   - slug: slug of a drop link
+//   - files: uploaded files
+//
+// Response: json array (like POST /api/files). 410 status code means the upload limit is reached
+//
+func (s Server) uploadToDrop(w http.ResponseWriter, r *http.Request) {
+	drop, ok := s.openDrop(w, r)
+	if !ok {
+		return
+	}
+	if s.config.ClientEncryption {
+		s.processError(w, "drive uses client-side encryption", http.StatusBadRequest)
+		return
+	}
+	if drop.FilesLeft() == 0 {
+		s.processError(w, drops.ErrNoUploadsLeft.Error(), http.StatusGone)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, drop.MaxFileSize*int64(drop.FilesLeft())+dropFormOverhead)
+	err := r.ParseMultipartForm(maxSize)
+	if err != nil {
+		s.processError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Files are uploaded one by one, so the limit of the link is checked before every file
+	headers := r.MultipartForm.File["files"]
+	responses := make([]multiplyResponse, 0, len(headers))
+	for _, header := range headers {
+		id, err := s.uploadDropFile(drop, header)
+		if err != nil {
+			responses = append(responses, multiplyResponse{
+				Filename: header.Filename,
+				IsError:  true,
+				Error:    err.Error(),
+			})
+			continue
+		}
+
+		responses = append(responses, multiplyResponse{Filename: header.Filename, Status: "uploaded"})
+		s.auditUserEvent(r, users.User{}, audit.ActionUpload, "drop "+strconv.Itoa(drop.ID), id)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	if s.config.Debug {
+		enc.SetIndent("", "  ")
+	}
+	enc.Encode(responses)
+}
+
+// uploadDropFile checks a file and uploads it for review
+func (s Server) uploadDropFile(drop drops.Drop, header *multipart.FileHeader) (int, error) {
+	if !drop.IsAllowed(header.Filename) {
+		return 0, drops.ErrTypeNotAllowed
+	}
+	if header.Size > drop.MaxFileSize {
+		return 0, drops.ErrFileTooLarge
+	}
+
+	// The upload is counted before, so concurrent requests can't exceed the limit
+	if err := s.drops.CountUpload(drop.ID); err != nil {
+		return 0, err
+	}
+
+	id, err := s.fileStorage.UploadForReview(header, drop.Tags, drop.ID)
+	if err != nil {
+		s.logger.Errorf("can't load a file %s via drop link %d: %s\n", header.Filename, drop.ID, err)
+		if err := s.drops.UncountUpload(drop.ID); err != nil {
+			s.logger.Errorf("can't uncount a failed upload of drop link %d: %s\n", drop.ID, err)
+		}
+		return 0, err
+	}
+	return id, nil
+}
@@ -0,0 +1,42 @@
+package web
+
+import (
+	"mime/multipart"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+
+	filesPck "github.com/tags-drive/core/internal/storage/files"
+	"github.com/tags-drive/core/internal/web/drops"
+)
+
+// failingStorage fails all uploads
+type failingStorage struct {
+	filesPck.FileStorageInterface
+}
+
+func (failingStorage) UploadForReview(*multipart.FileHeader, []int, int) (int, error) {
+	return 0, errors.New("no space left on device")
+}
+
+func TestUploadDropFileFailure(t *testing.T) {
+	assert := assert.New(t)
+
+	s, clean := newTestServer(t)
+	defer clean()
+	s.fileStorage = failingStorage{}
+
+	drop, err := s.drops.Create(drops.Drop{UserID: 1, MaxFileSize: 100, MaxFiles: 1, Expires: time.Now().Add(time.Hour)})
+	assert.Nil(err)
+
+	header := &multipart.FileHeader{Filename: "file.txt", Size: 10}
+	_, err = s.uploadDropFile(drop, header)
+	assert.NotNil(err)
+
+	// The failed upload doesn't use the only file of the link
+	drop, _ = s.drops.Get(drop.ID)
+	assert.Equal(0, drop.Uploads)
+	assert.Equal(1, drop.FilesLeft())
+}
@@ -0,0 +1,171 @@
+package web
+
+import (
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/tags-drive/core/internal/storage/audit"
+	"github.com/tags-drive/core/internal/storage/files"
+	tagsPck "github.com/tags-drive/core/internal/storage/tags"
+	"github.com/tags-drive/core/pkg/clientcrypto"
+)
+
+// GET /api/client-encryption
+//
+// Response: json object with params of client-side encryption (see pkg/clientcrypto)
+//
+func (s Server) returnClientParams(w http.ResponseWriter, r *http.Request) {
+	if !s.config.ClientEncryption {
+		s.processError(w, files.ErrClientEncryptionDisabled.Error(), http.StatusNotFound)
+		return
+	}
+
+	s.clientParamsMutex.Lock()
+	data, err := ioutil.ReadFile(s.config.ClientParamsFile)
+	s.clientParamsMutex.Unlock()
+	if err != nil {
+		if os.IsNotExist(err) {
+			s.processError(w, "params aren't set", http.StatusNotFound)
+			return
+		}
+		s.processError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// POST /api/client-encryption
+//
+// Params are set only once: they can't be changed without re-encryption of all files
+//
+// Params:
+//   - params: json object with params of client-side encryption
+//
+// Response: -
+//
+func (s Server) setClientParams(w http.ResponseWriter, r *http.Request) {
+	if !s.config.ClientEncryption {
+		s.processError(w, files.ErrClientEncryptionDisabled.Error(), http.StatusNotFound)
+		return
+	}
+
+	var params clientcrypto.Params
+	err := json.NewDecoder(strings.NewReader(r.FormValue("params"))).Decode(&params)
+	if err != nil {
+		s.processError(w, "invalid params: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := params.Validate(); err != nil {
+		s.processError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.clientParamsMutex.Lock()
+	defer s.clientParamsMutex.Unlock()
+
+	if _, err := os.Stat(s.config.ClientParamsFile); err == nil {
+		s.processError(w, "params are already set", http.StatusConflict)
+		return
+	}
+
+	data, err := json.Marshal(params)
+	if err != nil {
+		s.processError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	tempPath := s.config.ClientParamsFile + ".tmp"
+	err = ioutil.WriteFile(tempPath, data, 0666)
+	if err == nil {
+		err = os.Rename(tempPath, s.config.ClientParamsFile)
+	}
+	if err != nil {
+		s.processError(w, errors.Wrap(err, "can't save params").Error(), http.StatusInternalServerError)
+		return
+	}
+
+	s.logger.Infoln("params of client-side encryption were set")
+	s.auditEvent(r, audit.ActionConfigChange, "client-side encryption params")
+}
+
+// POST /api/files/encrypted
+//
+// Body must be "multipart/form-data". All fields must be encrypted in format of pkg/clientcrypto
+//
+// Params:
+//   - file: encrypted content of a file
+//   - preview: encrypted preview (optional)
+//   - filename: encrypted filename
+//   - description: encrypted description
+//   - key: data key wrapped by the client master key
+//   - ext: plain extension of the file (optional, for example ".jpg")
+//   - tags: list of tags, separated by comma (`tags=1,2,3`)
+//
+// Response: uploaded file
+//
+func (s Server) uploadEncrypted(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseMultipartForm(maxSize)
+	if err != nil {
+		switch err {
+		case http.ErrNotMultipart:
+			s.processError(w, err.Error(), http.StatusBadRequest)
+		default:
+			s.processError(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	getHeader := func(name string) *multipart.FileHeader {
+		if headers := r.MultipartForm.File[name]; len(headers) > 0 {
+			return headers[0]
+		}
+		return nil
+	}
+
+	file := files.EncryptedFile{
+		Content:     getHeader("file"),
+		Preview:     getHeader("preview"),
+		Filename:    r.FormValue("filename"),
+		Description: r.FormValue("description"),
+		Key:         r.FormValue("key"),
+		Ext:         r.FormValue("ext"),
+	}
+	if file.Content == nil {
+		s.processError(w, "file can't be empty", http.StatusBadRequest)
+		return
+	}
+
+	var tags []int
+	for _, strID := range strings.Split(r.FormValue("tags"), ",") {
+		if id, err := strconv.Atoi(strID); err == nil && s.isTagAvailable(r, id, tagsPck.PermissionWrite) {
+			tags = append(tags, id)
+		}
+	}
+
+	uploadedFile, err := s.fileStorage.UploadEncrypted(file, tags, s.user(r).ID)
+	if err != nil {
+		code := http.StatusInternalServerError
+		if err == files.ErrFieldNotEncrypted || err == files.ErrClientEncryptionDisabled {
+			code = http.StatusBadRequest
+		}
+		s.processError(w, err.Error(), code)
+		return
+	}
+	// Filename is encrypted
+	s.auditEvent(r, audit.ActionUpload, "encrypted", uploadedFile.ID)
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	if s.config.Debug {
+		enc.SetIndent("", "  ")
+	}
+	enc.Encode(uploadedFile)
+}
@@ -10,9 +10,12 @@ import (
 	"strings"
 
 	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
 
+	"github.com/tags-drive/core/internal/storage/audit"
 	filesPck "github.com/tags-drive/core/internal/storage/files"
 	"github.com/tags-drive/core/internal/storage/files/aggregation"
+	tagsPck "github.com/tags-drive/core/internal/storage/tags"
 )
 
 const (
@@ -22,6 +25,8 @@ const (
 	maxSize = 10 << 20 // 10MB
 )
 
+var errNoWritePermission = errors.New("not enough rights: file has restricted tags without write permission")
+
 // multiplyResponse is used as a response by POST /api/files and DELETE /api/files
 type multiplyResponse struct {
 	Filename string `json:"filename"`
@@ -59,6 +64,9 @@ func (s Server) returnSingleFile(w http.ResponseWriter, r *http.Request) {
 	}
 
 	file, err := s.fileStorage.GetFile(id)
+	if err == nil && !s.fileStorage.CanAccess(file, s.access(r)) {
+		err = filesPck.ErrFileIsNotExist
+	}
 	if err != nil {
 		if err == filesPck.ErrFileIsNotExist {
 			s.processError(w, "file doesn't exist", http.StatusNotFound)
@@ -164,7 +172,7 @@ func (s Server) returnFiles(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	files, err := s.fileStorage.Get(expr, sortMode, search, isRegexp, offset, count)
+	files, err := s.fileStorage.Get(s.access(r), expr, sortMode, search, isRegexp, offset, count)
 	if err != nil {
 		if err == filesPck.ErrOffsetOutOfBounds {
 			w.WriteHeader(http.StatusNoContent)
@@ -203,7 +211,7 @@ func (s Server) returnRecentFiles(w http.ResponseWriter, r *http.Request) {
 		return int(n)
 	}()
 
-	files := s.fileStorage.GetRecent(number)
+	files := s.fileStorage.GetRecent(s.access(r), number)
 
 	w.Header().Set("Content-Type", "application/json")
 	enc := json.NewEncoder(w)
@@ -217,8 +225,9 @@ func (s Server) returnRecentFiles(w http.ResponseWriter, r *http.Request) {
 //
 // Params:
 //   - ids: list of ids of files for downloading separated by comma `ids=1,2,54,9`
+//   - clean: remove metadata (EXIF, GPS) from JPEG, PNG and TIFF images (`clean=true`)
 //
-// Response: zip archive
+// Response: zip archive. Header "X-Cleaned-Files" contains ids of cleaned files separated by comma
 //
 func (s Server) downloadFiles(w http.ResponseWriter, r *http.Request) {
 	r.ParseForm()
@@ -233,12 +242,23 @@ func (s Server) downloadFiles(w http.ResponseWriter, r *http.Request) {
 		return
 	}()
 
-	body, err := s.fileStorage.Archive(ids)
+	opts := filesPck.ExportOptions{
+		StripMetadata: r.FormValue(cleanParam) == "true",
+	}
+
+	body, cleaned, err := s.fileStorage.Archive(s.access(r), ids, opts)
 	if err != nil {
 		s.processError(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	details := ""
+	if opts.StripMetadata {
+		details = "clean"
+		setCleanedHeader(w, cleaned...)
+	}
+	s.auditEvent(r, audit.ActionArchive, details, ids...)
+
 	w.Header().Set("Content-Type", "application/zip")
 	if _, err := io.Copy(w, body); err != nil {
 		s.logger.Errorf("can't copy zip file to response body: %s\n", err)
@@ -255,6 +275,11 @@ func (s Server) downloadFiles(w http.ResponseWriter, r *http.Request) {
 // Response: json array
 //
 func (s Server) upload(w http.ResponseWriter, r *http.Request) {
+	if s.config.ClientEncryption {
+		s.processError(w, "drive uses client-side encryption: use POST /api/files/encrypted", http.StatusBadRequest)
+		return
+	}
+
 	tags := func() []int {
 		t := r.FormValue("tags")
 		if t == "" {
@@ -262,13 +287,15 @@ func (s Server) upload(w http.ResponseWriter, r *http.Request) {
 		}
 
 		res := []int{}
-		for _, s := range strings.Split(t, ",") {
-			if id, err := strconv.Atoi(s); err == nil {
+		for _, strID := range strings.Split(t, ",") {
+			// Add only tags, which the user can write
+			if id, err := strconv.Atoi(strID); err == nil && s.isTagAvailable(r, id, tagsPck.PermissionWrite) {
 				res = append(res, id)
 			}
 		}
 		return res
 	}()
+	uploader := s.user(r).ID
 
 	err := r.ParseMultipartForm(maxSize)
 	if err != nil {
@@ -309,7 +336,7 @@ func (s Server) upload(w http.ResponseWriter, r *http.Request) {
 				continue
 			}
 
-			err := s.fileStorage.Upload(header, tags)
+			id, err := s.fileStorage.Upload(header, tags, uploader)
 			var resp multiplyResponse
 			if err != nil {
 				resp = multiplyResponse{
@@ -320,6 +347,7 @@ func (s Server) upload(w http.ResponseWriter, r *http.Request) {
 				s.logger.Errorf("can't load a file %s: %s\n", header.Filename, err)
 			} else {
 				resp = multiplyResponse{Filename: header.Filename, Status: "uploaded"}
+				s.auditEvent(r, audit.ActionUpload, header.Filename, id)
 			}
 
 			responsesChan <- resp
@@ -362,6 +390,9 @@ func (s Server) recoverFile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	ids = s.writableFiles(r, ids)
+	s.auditEvent(r, audit.ActionRecover, "", ids...)
+
 	idsChan := make(chan interface{}, 5)
 	go func() {
 		for i := range ids {
@@ -381,6 +412,76 @@ func (s Server) recoverFile(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// GET /api/files/pending
+//
+// Returns files uploaded via drop links, which aren't accepted yet. The newest files are first
+//
+// Response: same as `GET /api/files`
+//
+func (s Server) returnPendingFiles(w http.ResponseWriter, r *http.Request) {
+	files, err := s.fileStorage.Get(s.access(r), "", filesPck.SortByTimeDesc, "", false, 0, 0)
+	if err != nil {
+		s.processError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	pending := make([]filesPck.File, 0)
+	for _, file := range files {
+		if file.Pending {
+			pending = append(pending, file)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	if s.config.Debug {
+		enc.SetIndent("", "  ")
+	}
+	enc.Encode(pending)
+}
+
+// POST /api/files/accept
+//
+// Accepts files uploaded via drop links. Accepted files become available for all users
+//
+// Params:
+//   - ids: list ids of pending files separated by comma `ids=1,2,54,9`
+//
+// Response: -
+//
+func (s Server) acceptFiles(w http.ResponseWriter, r *http.Request) {
+	var ids []int
+	for _, strID := range strings.Split(r.FormValue("ids"), ",") {
+		id, err := strconv.Atoi(strID)
+		if err == nil {
+			ids = append(ids, id)
+		}
+	}
+
+	if len(ids) == 0 {
+		s.processError(w, "list of ids of files for accepting can't be empty", http.StatusBadRequest)
+		return
+	}
+
+	accepted := make([]int, 0, len(ids))
+	for _, id := range s.writableFiles(r, ids) {
+		file, err := s.fileStorage.GetFile(id)
+		if err != nil || !file.Pending {
+			continue
+		}
+
+		if _, err := s.fileStorage.Accept(id); err != nil {
+			s.logger.Errorf("can't accept file %d: %s\n", id, err)
+			continue
+		}
+		accepted = append(accepted, id)
+	}
+
+	if len(accepted) > 0 {
+		s.auditEvent(r, audit.ActionAccept, "", accepted...)
+	}
+}
+
 // PUT /api/file/{id}/name
 //
 // Params:
@@ -403,12 +504,26 @@ func (s Server) changeFilename(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !s.isFileAvailable(r, id) {
+		s.processError(w, "file doesn't exist", http.StatusNotFound)
+		return
+	}
+	if !s.isFileWritable(r, id) {
+		s.processError(w, errNoWritePermission.Error(), http.StatusForbidden)
+		return
+	}
+
 	// We can skip checking of invalid characters, because Go will return an error
 	updatedFile, err := s.fileStorage.Rename(id, newName)
 	if err != nil {
+		if err == filesPck.ErrFieldNotEncrypted {
+			s.processError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 		s.processError(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	s.auditEvent(r, audit.ActionFileChange, "name", id)
 
 	w.Header().Set("Content-Type", "application/json")
 	enc := json.NewEncoder(w)
@@ -434,6 +549,11 @@ func (s Server) changeFileTags(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !s.isFileAvailable(r, fileID) {
+		s.processError(w, "file doesn't exist", http.StatusNotFound)
+		return
+	}
+
 	tags := func() []int {
 		t := r.FormValue("tags")
 		if t == "" {
@@ -451,16 +571,25 @@ func (s Server) changeFileTags(w http.ResponseWriter, r *http.Request) {
 
 	var goodTags []int
 	for _, id := range tags {
-		if s.tagStorage.Check(id) {
+		if s.isTagAvailable(r, id, tagsPck.PermissionWrite) {
 			goodTags = append(goodTags, id)
 		}
 	}
+	// Tags, which the user can't write, can't be removed
+	if file, err := s.fileStorage.GetFile(fileID); err == nil {
+		for _, id := range file.Tags {
+			if s.tagStorage.Check(id) && !s.isTagAvailable(r, id, tagsPck.PermissionWrite) {
+				goodTags = append(goodTags, id)
+			}
+		}
+	}
 
 	updatedFile, err := s.fileStorage.ChangeTags(fileID, goodTags)
 	if err != nil {
 		s.processError(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	s.auditEvent(r, audit.ActionFileTags, "tags: "+joinInts(goodTags), fileID)
 
 	w.Header().Set("Content-Type", "application/json")
 	enc := json.NewEncoder(w)
@@ -486,11 +615,25 @@ func (s Server) changeFileDescription(w http.ResponseWriter, r *http.Request) {
 	}
 	newDescription := r.FormValue("description")
 
+	if !s.isFileAvailable(r, id) {
+		s.processError(w, "file doesn't exist", http.StatusNotFound)
+		return
+	}
+	if !s.isFileWritable(r, id) {
+		s.processError(w, errNoWritePermission.Error(), http.StatusForbidden)
+		return
+	}
+
 	updatedFile, err := s.fileStorage.ChangeDescription(id, newDescription)
 	if err != nil {
+		if err == filesPck.ErrFieldNotEncrypted {
+			s.processError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 		s.processError(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	s.auditEvent(r, audit.ActionFileChange, "description", id)
 
 	w.Header().Set("Content-Type", "application/json")
 	enc := json.NewEncoder(w)
@@ -524,15 +667,17 @@ func (s Server) addTagsToFiles(w http.ResponseWriter, r *http.Request) {
 		strIDs := r.FormValue("tags")
 		for _, strID := range strings.Split(strIDs, ",") {
 			id, err := strconv.Atoi(strID)
-			// Add only valid tags
-			if err == nil && s.tagStorage.Check(id) {
+			// Add only tags, which the user can write
+			if err == nil && s.isTagAvailable(r, id, tagsPck.PermissionWrite) {
 				res = append(res, int(id))
 			}
 		}
 		return res
 	}()
 
+	filesIDs = s.availableFiles(r, filesIDs)
 	s.fileStorage.AddTagsToFiles(filesIDs, tagsIDs)
+	s.auditEvent(r, audit.ActionFileTags, "added: "+joinInts(tagsIDs), filesIDs...)
 }
 
 // DELETE /api/files/tags
@@ -559,15 +704,17 @@ func (s Server) removeTagsFromFiles(w http.ResponseWriter, r *http.Request) {
 		strIDs := r.FormValue("tags")
 		for _, strID := range strings.Split(strIDs, ",") {
 			id, err := strconv.Atoi(strID)
-			// Add only valid tags
-			if err == nil && s.tagStorage.Check(id) {
+			// Add only tags, which the user can write
+			if err == nil && s.isTagAvailable(r, id, tagsPck.PermissionWrite) {
 				res = append(res, int(id))
 			}
 		}
 		return res
 	}()
 
+	filesIDs = s.availableFiles(r, filesIDs)
 	s.fileStorage.RemoveTagsFromFiles(filesIDs, tagsIDs)
+	s.auditEvent(r, audit.ActionFileTags, "removed: "+joinInts(tagsIDs), filesIDs...)
 }
 
 // DELETE /api/files
@@ -624,11 +771,15 @@ func (s Server) deleteFile(w http.ResponseWriter, r *http.Request) {
 		respStatus = "added into trash"
 	)
 
+	auditDetails := ""
 	if force {
 		deleteFunc = s.fileStorage.DeleteForce
 		respStatus = "deleted"
+		auditDetails = "force"
 	}
 
+	access := s.access(r)
+
 	runPool(5, filesIDsChan, func(data <-chan interface{}) {
 		for d := range data {
 			id, ok := d.(int)
@@ -638,6 +789,12 @@ func (s Server) deleteFile(w http.ResponseWriter, r *http.Request) {
 
 			// Check file
 			file, err := s.fileStorage.GetFile(id)
+			if err == nil && !s.fileStorage.CanAccess(file, access) {
+				err = filesPck.ErrFileIsNotExist
+			}
+			if err == nil && !s.fileStorage.CanChange(file, access) {
+				err = errNoWritePermission
+			}
 			if err != nil {
 				msg := err.Error()
 				if err == filesPck.ErrFileIsNotExist {
@@ -670,6 +827,7 @@ func (s Server) deleteFile(w http.ResponseWriter, r *http.Request) {
 					Filename: file.Filename,
 					Status:   respStatus,
 				}
+				s.auditEvent(r, audit.ActionDelete, auditDetails, id)
 			}
 
 			responsesChan <- resp
@@ -0,0 +1,86 @@
+package web
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/tags-drive/core/internal/storage/audit"
+	"github.com/tags-drive/core/internal/web/auth"
+)
+
+// GET /api/sessions
+//
+// Params: -
+//
+// Response: json array of active sessions of the current user. The session of the request has "current" field
+//
+func (s Server) returnSessions(w http.ResponseWriter, r *http.Request) {
+	current, _ := s.authService.GetSession(s.session(r))
+
+	type session struct {
+		auth.Session
+		Current bool `json:"current"`
+	}
+
+	sessions := s.authService.GetSessions(s.user(r).ID)
+	resp := make([]session, 0, len(sessions))
+	for _, sess := range sessions {
+		resp = append(resp, session{Session: sess, Current: sess.ID == current.ID})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	if s.config.Debug {
+		enc.SetIndent("", "  ")
+	}
+	enc.Encode(resp)
+}
+
+// DELETE /api/sessions
+//
+// Revokes sessions of the current user
+//
+// Params:
+//   - id: id of a session
+//   - all: true – revoke all sessions except the current one (id is ignored)
+//
+// Response: -
+//
+func (s Server) deleteSessions(w http.ResponseWriter, r *http.Request) {
+	user := s.user(r)
+	token := s.session(r)
+
+	if r.FormValue("all") == "true" {
+		s.authService.DeleteUserTokens(user.ID, token)
+		s.logger.Warnf("%s revoked all other sessions of \"%s\"\n", r.RemoteAddr, user.Login)
+		s.auditEvent(r, audit.ActionSessionDelete, "all")
+		return
+	}
+
+	id := r.FormValue("id")
+	if id == "" {
+		s.processError(w, "session id can't be empty", http.StatusBadRequest)
+		return
+	}
+
+	err := s.authService.DeleteSession(user.ID, id)
+	if err != nil {
+		if err == auth.ErrSessionNotExist {
+			s.processError(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		s.processError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.auditEvent(r, audit.ActionSessionDelete, id)
+
+	if current, ok := s.authService.GetSession(token); !ok || current.ID == id {
+		// The current session was revoked
+		if s.vault != nil {
+			s.vault.Lock(token)
+		}
+		http.SetCookie(w, s.authCookie(r, "", time.Time{}))
+	}
+
+	s.logger.Warnf("%s revoked session %s of \"%s\"\n", r.RemoteAddr, id, user.Login)
+}
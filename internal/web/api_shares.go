@@ -0,0 +1,846 @@
+package web
+
+import (
+	"image"
+	"image/png"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+
+	"github.com/tags-drive/core/internal/storage/audit"
+	filesPck "github.com/tags-drive/core/internal/storage/files"
+	"github.com/tags-drive/core/internal/storage/files/aggregation"
+	"github.com/tags-drive/core/internal/storage/files/extensions"
+	"github.com/tags-drive/core/internal/web/shares"
+	"github.com/tags-drive/core/internal/web/users"
+	"github.com/tags-drive/core/internal/web/watermark"
+)
+
+// shareCookiePrefix is a prefix of cookies with grants of shares. The slug of a share is appended
+const shareCookiePrefix = "share_"
+
+// shareStreamCookie is a name of the cookie with a key of a stream. Its path is the path of a stream
+const shareStreamCookie = "share_stream"
+
+// shareAccess returns an access used for anonymous users: files in the vault are never shared,
+// restricted tags are checked with permissions of the creator of a share
+func (s Server) shareAccess(share shares.Share) filesPck.Access {
+	creator, err := s.users.Get(share.UserID)
+	if err != nil {
+		// A deleted user can't read restricted tags
+		creator = users.User{}
+	}
+	read, _ := s.restrictedTags(creator)
+	return filesPck.Access{RestrictedTags: read}
+}
+
+// shareErrorCode returns a status code of an error returned by shares.SharesInterface
+func shareErrorCode(err error) int {
+	switch err {
+	case shares.ErrShareNotExist:
+		return http.StatusNotFound
+	case shares.ErrNoTarget, shares.ErrInvalidMode, shares.ErrExpired, shares.ErrInvalidLimit, shares.ErrWrongPassword,
+		watermark.ErrNoMark, watermark.ErrTextTooLong, watermark.ErrInvalidPosition, watermark.ErrInvalidOpacity,
+		watermark.ErrInvalidScale:
+		return http.StatusBadRequest
+	case shares.ErrNoDownloadsLeft:
+		return http.StatusGone
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// sharedFile is a file shown to anonymous users. It doesn't contain tags, keys and paths
+type sharedFile struct {
+	ID          int            `json:"id"`
+	Filename    string         `json:"filename"`
+	Type        extensions.Ext `json:"type"`
+	Description string         `json:"description"`
+	Size        int64          `json:"size"`
+	AddTime     time.Time      `json:"addTime"`
+	// Preview is true, if the file has a preview
+	Preview bool `json:"preview"`
+}
+
+func newSharedFile(file filesPck.File) sharedFile {
+	return sharedFile{
+		ID:          file.ID,
+		Filename:    file.Filename,
+		Type:        file.Type,
+		Description: file.Description,
+		Size:        file.Size,
+		AddTime:     file.AddTime,
+		Preview:     file.Preview != "",
+	}
+}
+
+// shareFiles returns files of a share, which are available for anonymous users. Deleted files,
+// files in the vault and files encrypted by clients are skipped
+func (s Server) shareFiles(share shares.Share) ([]filesPck.File, error) {
+	var list []filesPck.File
+	if share.Expr != "" {
+		var err error
+		list, err = s.fileStorage.Get(s.shareAccess(share), share.Expr, filesPck.SortByNameAsc, "", false, 0, 0)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		access := s.shareAccess(share)
+		for _, id := range share.FileIDs {
+			file, err := s.fileStorage.GetFile(id)
+			if err == nil && s.fileStorage.CanAccess(file, access) {
+				list = append(list, file)
+			}
+		}
+	}
+
+	res := make([]filesPck.File, 0, len(list))
+	for _, file := range list {
+		if !file.Deleted && !file.ClientEncrypted {
+			res = append(res, file)
+		}
+	}
+	return res, nil
+}
+
+// shareFile returns a file of a share. ok is false, if the file isn't shared
+func (s Server) shareFile(share shares.Share, id int) (file filesPck.File, ok bool) {
+	list, err := s.shareFiles(share)
+	if err != nil {
+		return filesPck.File{}, false
+	}
+
+	for _, file := range list {
+		if file.ID == id {
+			return file, true
+		}
+	}
+	return filesPck.File{}, false
+}
+
+// isShareActive returns false, if the creator of a share was deleted or disabled
+func (s Server) isShareActive(share shares.Share) bool {
+	user, err := s.users.Get(share.UserID)
+	return err == nil && !user.Disabled
+}
+
+// openShare returns a share from the path of a request. It writes an error, if the share doesn't exist
+// or the client hasn't entered the password
+func (s Server) openShare(w http.ResponseWriter, r *http.Request) (shares.Share, bool) {
+	slug := mux.Vars(r)["slug"]
+
+	share, err := s.shares.GetBySlug(slug)
+	if err == nil && !s.isShareActive(share) {
+		err = shares.ErrShareNotExist
+	}
+	if err != nil {
+		s.processError(w, err.Error(), shareErrorCode(err))
+		return shares.Share{}, false
+	}
+
+	var grant string
+	if c, err := r.Cookie(shareCookiePrefix + slug); err == nil {
+		grant = c.Value
+	}
+	if !s.shares.CheckGrant(share, grant) {
+		s.processError(w, "password is required", http.StatusUnauthorized)
+		return shares.Share{}, false
+	}
+
+	return share, true
+}
+
+// canShareFile returns false, if the share has a watermark, but it can't be added to the image.
+// Such images mustn't leave the drive
+func canShareFile(share shares.Share, file filesPck.File) bool {
+	if share.Watermark == nil || file.Type.PreviewType != extensions.PreviewTypeImage {
+		return true
+	}
+	return watermark.IsSupported(filepath.Ext(file.Filename))
+}
+
+// shareExportOptions returns options of files downloaded via a share. preview must be true for previews
+func (s Server) shareExportOptions(share shares.Share, preview bool) filesPck.ExportOptions {
+	opts := filesPck.ExportOptions{
+		StripMetadata: share.StripMetadata,
+	}
+	if share.Watermark != nil {
+		opts.Watermark = func(file filesPck.File, data []byte) ([]byte, error) {
+			return s.addWatermark(share, file, data, preview)
+		}
+	}
+	return opts
+}
+
+// addWatermark adds the watermark of a share to an image or its preview. Results are cached per share
+func (s Server) addWatermark(share shares.Share, file filesPck.File, data []byte, preview bool) ([]byte, error) {
+	key := watermark.Key{ShareID: share.ID, FileID: file.ID, Preview: preview}
+	if res, ok := s.watermarks.Get(key); ok {
+		return res, nil
+	}
+
+	mark, err := s.watermarkMark(*share.Watermark)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := watermark.Process(data, filepath.Ext(file.Filename), mark, *share.Watermark)
+	if err != nil {
+		return nil, err
+	}
+
+	s.watermarks.Add(key, res)
+	return res, nil
+}
+
+// watermarkMark returns an image of a watermark: the rendered text or the PNG file
+func (s Server) watermarkMark(opts watermark.Options) (image.Image, error) {
+	if opts.Text != "" {
+		return watermark.Text(opts.Text), nil
+	}
+
+	file, err := s.fileStorage.GetFile(opts.ImageID)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't load image of watermark")
+	}
+
+	body, _, err := s.fileStorage.Export(file, filesPck.ExportOptions{})
+	if err != nil {
+		return nil, errors.Wrap(err, "can't load image of watermark")
+	}
+	defer body.Close()
+
+	mark, err := png.Decode(body)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't decode image of watermark")
+	}
+	return mark, nil
+}
+
+// parseWatermark returns options of a watermark from a request. It returns nil, if neither
+// watermark_text nor watermark_image is set
+func (s Server) parseWatermark(r *http.Request) (*watermark.Options, error) {
+	opts := &watermark.Options{
+		Text:     strings.TrimSpace(r.FormValue("watermark_text")),
+		Position: watermark.Position(r.FormValue("watermark_position")),
+		Opacity:  0.5,
+		Scale:    0.25,
+	}
+	if opts.Position == "" {
+		opts.Position = watermark.PositionBottomRight
+	}
+
+	if v := r.FormValue("watermark_image"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, errors.New("watermark_image must be a file id")
+		}
+		// Users can use only files they can see
+		file, err := s.fileStorage.GetFile(id)
+		if err != nil || !s.fileStorage.CanAccess(file, s.access(r)) {
+			return nil, errors.New("file with id \"" + v + "\" doesn't exist")
+		}
+		if strings.ToLower(filepath.Ext(file.Filename)) != ".png" || file.ClientEncrypted {
+			return nil, errors.New("watermark_image must be a PNG image")
+		}
+		opts.ImageID = id
+	}
+
+	if opts.Text == "" && opts.ImageID == 0 {
+		return nil, nil
+	}
+
+	for param, value := range map[string]*float64{"watermark_opacity": &opts.Opacity, "watermark_scale": &opts.Scale} {
+		if v := r.FormValue(param); v != "" {
+			var err error
+			*value, err = strconv.ParseFloat(v, 64)
+			if err != nil {
+				return nil, errors.New(param + " must be a number")
+			}
+		}
+	}
+
+	return opts, nil
+}
+
+// GET /api/shares
+//
+// Params:
+//   - all: return shares of all users (only for admins)
+//
+// Response: json array of shares
+//
+func (s Server) returnShares(w http.ResponseWriter, r *http.Request) {
+	user := s.user(r)
+
+	userID := user.ID
+	if r.FormValue("all") == "true" {
+		if user.Role != users.RoleAdmin {
+			s.processError(w, "not enough rights: admin role is needed", http.StatusForbidden)
+			return
+		}
+		userID = 0
+	}
+
+	list := s.shares.GetAll(userID)
+	for i := range list {
+		list[i].PasswordHash = ""
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	if s.config.Debug {
+		enc.SetIndent("", "  ")
+	}
+	enc.Encode(list)
+}
+
+// POST /api/shares
+//
+// Either files or expr must be set
+//
+// Params:
+//   - name: name of a share (optional)
+//   - files: list of ids of files, separated by comma (`files=1,2,3`)
+//   - expr: logical expression of tags. New files matching the expression are shared too
+//   - mode: preview (default) or download
+//   - password: password of a share (optional, TLS is required, except Debug mode)
+//   - max_downloads: max number of downloads (0 or empty means downloads aren't limited)
+//   - expires: expiry time in RFC 3339 format (share doesn't expire, if it's empty)
+//   - clean: remove metadata (EXIF, GPS) from downloaded images (`clean=true`)
+//   - watermark_text: text of a watermark, which is added to shared images (optional)
+//   - watermark_image: id of a PNG file, which is used as a watermark instead of text (optional)
+//   - watermark_position: top-left, top-right, bottom-left, bottom-right (default) or center
+//   - watermark_opacity: opacity of a watermark in (0, 1] (0.5 by default)
+//   - watermark_scale: width of a watermark relative to the width of an image in (0, 1] (0.25 by default)
+//
+// Response: json object of the share
+//
+func (s Server) addShare(w http.ResponseWriter, r *http.Request) {
+	share := shares.Share{
+		UserID:        s.user(r).ID,
+		Name:          r.FormValue("name"),
+		Expr:          strings.TrimSpace(r.FormValue("expr")),
+		Mode:          shares.Mode(r.FormValue("mode")),
+		StripMetadata: r.FormValue(cleanParam) == "true",
+	}
+	if share.Mode == "" {
+		share.Mode = shares.ModePreview
+	}
+
+	if strIDs := r.FormValue("files"); strIDs != "" {
+		for _, strID := range strings.Split(strIDs, ",") {
+			id, err := strconv.Atoi(strID)
+			if err != nil {
+				s.processError(w, "file id \""+strID+"\" isn't valid", http.StatusBadRequest)
+				return
+			}
+			// Users can share only files they can see
+			if !s.isFileAvailable(r, id) {
+				s.processError(w, "file with id \""+strID+"\" doesn't exist", http.StatusNotFound)
+				return
+			}
+			share.FileIDs = append(share.FileIDs, id)
+		}
+	}
+
+	if share.Expr != "" {
+		_, err := s.fileStorage.Get(s.access(r), share.Expr, filesPck.SortByNameAsc, "", false, 0, 0)
+		if err == aggregation.ErrBadSyntax {
+			s.processError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if v := r.FormValue("max_downloads"); v != "" {
+		var err error
+		share.MaxDownloads, err = strconv.Atoi(v)
+		if err != nil {
+			s.processError(w, "max_downloads must be a number", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if v := r.FormValue("expires"); v != "" {
+		var err error
+		share.Expires, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			s.processError(w, "expires must be in RFC 3339 format", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var err error
+	share.Watermark, err = s.parseWatermark(r)
+	if err != nil {
+		s.processError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	password := r.FormValue("password")
+	if password != "" && !s.isSecure(r) {
+		s.processError(w, errInsecurePassword.Error(), http.StatusForbidden)
+		return
+	}
+
+	share, err = s.shares.Create(share, password)
+	if err != nil {
+		s.processError(w, err.Error(), shareErrorCode(err))
+		return
+	}
+
+	s.logger.Warnf("%s created share %d (%s mode)\n", s.user(r).Login, share.ID, share.Mode)
+	details := "expr: " + share.Expr
+	if share.Expr == "" {
+		details = "files: " + joinInts(share.FileIDs)
+	}
+	s.auditEvent(r, audit.ActionShareAdd, details, share.ID)
+
+	share.PasswordHash = ""
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	enc := json.NewEncoder(w)
+	if s.config.Debug {
+		enc.SetIndent("", "  ")
+	}
+	enc.Encode(share)
+}
+
+// DELETE /api/shares
+//
+// Revokes a share. Admins can revoke shares of all users
+//
+// Params:
+//   - id: id of a share
+//
+// Response: -
+//
+func (s Server) deleteShare(w http.ResponseWriter, r *http.Request) {
+	user := s.user(r)
+
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		s.processError(w, "share id isn't valid", http.StatusBadRequest)
+		return
+	}
+
+	share, err := s.shares.Get(id)
+	if err != nil || (share.UserID != user.ID && user.Role != users.RoleAdmin) {
+		s.processError(w, shares.ErrShareNotExist.Error(), http.StatusNotFound)
+		return
+	}
+
+	err = s.shares.Delete(id)
+	if err != nil {
+		s.processError(w, err.Error(), shareErrorCode(err))
+		return
+	}
+
+	s.watermarks.DeleteShare(share.ID)
+
+	s.logger.Warnf("%s revoked share %d\n", user.Login, share.ID)
+	s.auditEvent(r, audit.ActionShareDelete, "", share.ID)
+}
+
+// GET /api/share/{slug}
+//
+// Available without auth
+//
+// Params:
+//   - slug: slug of a share
+//
+// Response: json object with mode, expiry time, number of remaining downloads (-1 means there's no limit)
+// and shared files. 401 status code means the share must be unlocked with POST /api/share/{slug}/unlock
+//
+func (s Server) returnShare(w http.ResponseWriter, r *http.Request) {
+	share, ok := s.openShare(w, r)
+	if !ok {
+		return
+	}
+
+	list, err := s.shareFiles(share)
+	if err != nil {
+		s.processError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	s.shares.CountView(share.ID)
+
+	resp := struct {
+		Name          string       `json:"name"`
+		Mode          shares.Mode  `json:"mode"`
+		Expires       time.Time    `json:"expires"`
+		DownloadsLeft int          `json:"downloadsLeft"`
+		Files         []sharedFile `json:"files"`
+	}{
+		Name:          share.Name,
+		Mode:          share.Mode,
+		Expires:       share.Expires,
+		DownloadsLeft: share.DownloadsLeft(),
+		Files:         make([]sharedFile, 0, len(list)),
+	}
+	for _, file := range list {
+		resp.Files = append(resp.Files, newSharedFile(file))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	if s.config.Debug {
+		enc.SetIndent("", "  ")
+	}
+	enc.Encode(resp)
+}
+
+// POST /api/share/{slug}/unlock
+//
+// Available without auth. Failed attempts are throttled
+//
+// Params:
+//   - slug: slug of a share
+//   - password: password of the share
+//
+// Response: -. A cookie, which gives access to the share, is set
+//
+func (s Server) unlockShare(w http.ResponseWriter, r *http.Request) {
+	slug := mux.Vars(r)["slug"]
+
+	share, err := s.shares.GetBySlug(slug)
+	if err == nil && !s.isShareActive(share) {
+		err = shares.ErrShareNotExist
+	}
+	if err != nil {
+		s.processError(w, err.Error(), shareErrorCode(err))
+		return
+	}
+	if !share.HasPassword {
+		return
+	}
+
+	cookie, err := s.unlockShareCookie(w, r, share)
+	if err != nil {
+		if err != errThrottled {
+			s.processError(w, err.Error(), shareErrorCode(err))
+		}
+		return
+	}
+	http.SetCookie(w, cookie)
+}
+
+// unlockShareCookie checks the password of a share and returns a cookie with a grant. It returns
+// errThrottled, if the client has to wait (429 status code is already written)
+func (s Server) unlockShareCookie(w http.ResponseWriter, r *http.Request, share shares.Share) (*http.Cookie, error) {
+	keys := []string{ipKey(r), shareKey(share.ID)}
+	if !s.authAllowed(w, r, keys...) {
+		return nil, errThrottled
+	}
+
+	grant, err := s.shares.Unlock(share.ID, r.FormValue("password"))
+	if err != nil {
+		if err == shares.ErrWrongPassword {
+			s.authLimiter.Fail(keys...)
+			s.logger.Warnf("%s tried to unlock share %d\n", r.RemoteAddr, share.ID)
+		}
+		return nil, err
+	}
+	s.authLimiter.Success(keys...)
+
+	cookie := s.authCookie(r, grant, time.Now().Add(shareGrantLife))
+	cookie.Name = shareCookiePrefix + share.Slug
+	return cookie, nil
+}
+
+// GET /api/share/{slug}/preview/{id}
+//
+// Available without auth
+//
+// Params:
+//   - slug: slug of a share
+//   - id: id of a shared file
+//
+// Response: preview of the file
+//
+func (s Server) returnSharedPreview(w http.ResponseWriter, r *http.Request) {
+	share, ok := s.openShare(w, r)
+	if !ok {
+		return
+	}
+
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	file, ok := s.shareFile(share, id)
+	if !ok || file.Preview == "" {
+		s.processError(w, "file doesn't exist", http.StatusNotFound)
+		return
+	}
+
+	if share.Watermark != nil {
+		s.serveWatermarkedPreview(w, share, file)
+		return
+	}
+
+	// Path is "resized/{id}" like in /data/
+	previewRequest := new(http.Request)
+	*previewRequest = *r
+	previewRequest.URL = new(url.URL)
+	*previewRequest.URL = *r.URL
+	previewRequest.URL.Path = "resized/" + strconv.Itoa(file.ID)
+	previewRequest.URL.RawPath = ""
+
+	w.Header().Set("Cache-Control", "private")
+	s.safeContentMiddleware(s.decryptMiddleware(http.Dir(s.config.DataFolder+"/"))).ServeHTTP(w, previewRequest)
+}
+
+// serveWatermarkedPreview writes the preview of an image with the watermark of a share
+func (s Server) serveWatermarkedPreview(w http.ResponseWriter, share shares.Share, file filesPck.File) {
+	body, err := s.fileStorage.ExportPreview(file, s.shareExportOptions(share, true))
+	if err != nil {
+		s.processError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer body.Close()
+
+	contentType, _ := contentHeaders(file)
+
+	header := w.Header()
+	header.Set("X-Content-Type-Options", "nosniff")
+	header.Set("Content-Security-Policy", contentSecurityPolicy)
+	header.Set("Content-Type", contentType)
+	header.Set("Cache-Control", "private")
+	if _, err := io.Copy(w, body); err != nil {
+		s.logger.Errorf("can't copy preview to response body: %s\n", err)
+	}
+}
+
+// GET /api/share/{slug}/stream/{id}
+//
+// Available without auth, only for shares in download mode. It is used by the gallery to play audio and video.
+// Ranges are supported. The first request counts a download and sets a cookie with a key of the stream,
+// range requests with the cookie aren't counted during an hour
+//
+// Params:
+//   - slug: slug of a share
+//   - id: id of a shared audio or video file
+//
+// Response: the file. 410 status code means the download limit is reached
+//
+func (s Server) streamSharedFile(w http.ResponseWriter, r *http.Request) {
+	share, ok := s.openShare(w, r)
+	if !ok {
+		return
+	}
+	if share.Mode != shares.ModeDownload {
+		s.processError(w, "files of the share can't be downloaded", http.StatusForbidden)
+		return
+	}
+
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	file, ok := s.shareFile(share, id)
+	if !ok {
+		s.processError(w, "file doesn't exist", http.StatusNotFound)
+		return
+	}
+	if kind := mediaKind(file.Type.PreviewType); kind != "audio" && kind != "video" {
+		s.processError(w, "only audio and video can be streamed", http.StatusForbidden)
+		return
+	}
+
+	var key string
+	if c, err := r.Cookie(shareStreamCookie); err == nil {
+		key = c.Value
+	}
+	newStream := !s.shares.CheckStream(share, file.ID, key)
+
+	// Don't open files, if the limit is already reached
+	if newStream && share.DownloadsLeft() == 0 {
+		s.processError(w, shares.ErrNoDownloadsLeft.Error(), http.StatusGone)
+		return
+	}
+
+	content, err := s.fileStorage.OpenContent(file)
+	if err != nil {
+		s.processError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer content.Close()
+
+	// Only opened files are counted
+	if newStream {
+		key, err = s.shares.StartStream(share.ID, file.ID)
+		if err != nil {
+			s.processError(w, err.Error(), shareErrorCode(err))
+			return
+		}
+		http.SetCookie(w, s.streamCookie(r, share, file.ID, key))
+	}
+
+	contentType, _ := contentHeaders(file)
+
+	header := w.Header()
+	header.Set("X-Content-Type-Options", "nosniff")
+	header.Set("Content-Security-Policy", contentSecurityPolicy)
+	header.Set("Content-Type", contentType)
+	header.Set("Content-Disposition", "inline")
+	header.Set("Cache-Control", "private")
+	http.ServeContent(w, r, "", file.AddTime, content)
+}
+
+// streamCookie returns a cookie with a key of a stream. The cookie is sent only with requests of the stream
+func (s Server) streamCookie(r *http.Request, share shares.Share, fileID int, key string) *http.Cookie {
+	cookie := s.authCookie(r, key, time.Now().Add(shareStreamLife))
+	cookie.Name = shareStreamCookie
+	cookie.Path = s.withBasePath("/api/share/" + share.Slug + "/stream/" + strconv.Itoa(fileID))
+	return cookie
+}
+
+// GET /api/share/{slug}/file/{id}
+//
+// Available without auth, only for shares in download mode. Every request is counted as a download
+//
+// Params:
+//   - slug: slug of a share
+//   - id: id of a shared file
+//
+// Response: the file. 410 status code means the download limit is reached
+//
+func (s Server) downloadSharedFile(w http.ResponseWriter, r *http.Request) {
+	share, ok := s.openShare(w, r)
+	if !ok {
+		return
+	}
+	if share.Mode != shares.ModeDownload {
+		s.processError(w, "files of the share can't be downloaded", http.StatusForbidden)
+		return
+	}
+
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	file, ok := s.shareFile(share, id)
+	if !ok {
+		s.processError(w, "file doesn't exist", http.StatusNotFound)
+		return
+	}
+	if !canShareFile(share, file) {
+		s.processError(w, "watermark can't be added to the file", http.StatusForbidden)
+		return
+	}
+
+	// Don't export files, if the limit is already reached
+	if share.DownloadsLeft() == 0 {
+		s.processError(w, shares.ErrNoDownloadsLeft.Error(), http.StatusGone)
+		return
+	}
+
+	opts := s.shareExportOptions(share, false)
+	body, cleaned, err := s.fileStorage.Export(file, opts)
+	if err != nil {
+		s.processError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer body.Close()
+
+	// Only successful exports are counted
+	if err := s.shares.CountDownload(share.ID); err != nil {
+		s.processError(w, err.Error(), shareErrorCode(err))
+		return
+	}
+
+	s.auditUserEvent(r, users.User{}, audit.ActionDownload, "share "+strconv.Itoa(share.ID), file.ID)
+
+	contentType, _ := contentHeaders(file)
+	disposition := mime.FormatMediaType("attachment", map[string]string{"filename": file.Filename})
+	if disposition == "" {
+		disposition = "attachment"
+	}
+
+	header := w.Header()
+	header.Set("X-Content-Type-Options", "nosniff")
+	header.Set("Content-Security-Policy", contentSecurityPolicy)
+	header.Set("Content-Type", contentType)
+	header.Set("Content-Disposition", disposition)
+	header.Set("Cache-Control", "private, no-store")
+	if opts.StripMetadata {
+		if cleaned {
+			setCleanedHeader(w, file.ID)
+		} else {
+			setCleanedHeader(w)
+		}
+	}
+
+	if _, err := io.Copy(w, body); err != nil {
+		s.logger.Errorf("can't copy file to response body: %s\n", err)
+	}
+}
+
+// GET /api/share/{slug}/download
+//
+// Available without auth, only for shares in download mode. An archive is counted as one download
+//
+// Params:
+//   - slug: slug of a share
+//
+// Response: zip archive with all files of the share. 410 status code means the download limit is reached
+//
+func (s Server) downloadShare(w http.ResponseWriter, r *http.Request) {
+	share, ok := s.openShare(w, r)
+	if !ok {
+		return
+	}
+	if share.Mode != shares.ModeDownload {
+		s.processError(w, "files of the share can't be downloaded", http.StatusForbidden)
+		return
+	}
+
+	list, err := s.shareFiles(share)
+	if err != nil {
+		s.processError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(list) == 0 {
+		s.processError(w, "share has no files", http.StatusNotFound)
+		return
+	}
+	ids := make([]int, 0, len(list))
+	for _, file := range list {
+		if canShareFile(share, file) {
+			ids = append(ids, file.ID)
+		}
+	}
+
+	// Don't export files, if the limit is already reached
+	if share.DownloadsLeft() == 0 {
+		s.processError(w, shares.ErrNoDownloadsLeft.Error(), http.StatusGone)
+		return
+	}
+
+	opts := s.shareExportOptions(share, false)
+	body, cleaned, err := s.fileStorage.Archive(s.shareAccess(share), ids, opts)
+	if err != nil {
+		s.processError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Only successful archives are counted
+	if err := s.shares.CountDownload(share.ID); err != nil {
+		s.processError(w, err.Error(), shareErrorCode(err))
+		return
+	}
+
+	s.auditUserEvent(r, users.User{}, audit.ActionArchive, "share "+strconv.Itoa(share.ID), ids...)
+
+	if opts.StripMetadata {
+		setCleanedHeader(w, cleaned...)
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="files.zip"`)
+	w.Header().Set("Cache-Control", "private, no-store")
+	if _, err := io.Copy(w, body); err != nil {
+		s.logger.Errorf("can't copy zip file to response body: %s\n", err)
+	}
+}
@@ -0,0 +1,113 @@
+package web
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	clog "github.com/ShoshinNikita/log/v2"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/tags-drive/core/internal/web/apitokens"
+	"github.com/tags-drive/core/internal/web/auth"
+	"github.com/tags-drive/core/internal/web/drops"
+	"github.com/tags-drive/core/internal/web/limiter"
+	"github.com/tags-drive/core/internal/web/shares"
+	"github.com/tags-drive/core/internal/web/users"
+)
+
+// newTestServer returns a server with sessions, users, API tokens, shares, drop links and the auth limiter.
+// The first admin has id 1
+func newTestServer(t *testing.T) (*Server, func()) {
+	dir, err := ioutil.TempDir("", "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lg := clog.NewProdLogger()
+	s := &Server{logger: lg}
+
+	s.authService, err = auth.NewAuthService(auth.Config{
+		TokensJSONFile: filepath.Join(dir, "tokens.json"),
+		MaxTokenLife:   time.Hour,
+		SaveInterval:   time.Minute,
+	}, lg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.users, err = users.NewUsers(users.Config{
+		UsersJSONFile:   filepath.Join(dir, "users.json"),
+		DefaultLogin:    "admin",
+		DefaultPassword: "password",
+	}, lg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.apiTokens, err = apitokens.NewAPITokens(apitokens.Config{
+		APITokensJSONFile: filepath.Join(dir, "api-tokens.json"),
+		SaveInterval:      time.Minute,
+	}, lg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.shares, err = shares.NewShares(shares.Config{
+		SharesJSONFile: filepath.Join(dir, "shares.json"),
+		SaveInterval:   time.Minute,
+		GrantLife:      time.Hour,
+		StreamLife:     time.Hour,
+	}, lg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.drops, err = drops.NewDrops(drops.Config{
+		DropsJSONFile: filepath.Join(dir, "drops.json"),
+		CheckInterval: time.Hour,
+	}, lg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.authLimiter, err = limiter.NewLimiter(limiter.Config{
+		BaseDelay:       time.Second,
+		MaxDelay:        time.Minute,
+		MaxFailures:     10,
+		BanDuration:     time.Hour,
+		FailuresLife:    time.Hour,
+		CleanupInterval: time.Hour,
+	}, lg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s, func() { os.RemoveAll(dir) }
+}
+
+func TestStreamSharedFilePreviewMode(t *testing.T) {
+	assert := assert.New(t)
+
+	s, clean := newTestServer(t)
+	defer clean()
+
+	share, err := s.shares.Create(shares.Share{UserID: 1, FileIDs: []int{1}, Mode: shares.ModePreview}, "")
+	assert.Nil(err)
+
+	r := httptest.NewRequest("GET", "/api/share/"+share.Slug+"/stream/1", nil)
+	r = mux.SetURLVars(r, map[string]string{"slug": share.Slug, "id": "1"})
+	w := httptest.NewRecorder()
+	s.streamSharedFile(w, r)
+
+	assert.Equal(http.StatusForbidden, w.Code)
+	assert.Empty(w.Header().Get("Set-Cookie"))
+
+	share, _ = s.shares.Get(share.ID)
+	assert.Equal(0, share.Downloads)
+}
@@ -3,18 +3,97 @@ package web
 import (
 	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/gorilla/mux"
+
+	"github.com/tags-drive/core/internal/storage/audit"
+	"github.com/tags-drive/core/internal/storage/tags"
+	"github.com/tags-drive/core/internal/web/users"
 )
 
+// tagAllows returns true, if a user has the required permission for a tag. Admins can use all tags
+func tagAllows(user users.User, tag tags.Tag, required tags.Permission) bool {
+	if tag.ACL == nil || user.Role == users.RoleAdmin {
+		return true
+	}
+
+	hasRole := func(role string) bool {
+		return user.Role.Allows(users.Role(role))
+	}
+	return tag.ACL.Allows(user.ID, hasRole, required)
+}
+
+// restrictedTags returns ids of tags with ACLs mapped to true, if a user can read (read) or write (write) the tag.
+// It returns nil maps for admins
+func (s Server) restrictedTags(user users.User) (read, write map[int]bool) {
+	if user.Role == users.RoleAdmin {
+		return nil, nil
+	}
+
+	read = make(map[int]bool)
+	write = make(map[int]bool)
+	for id, tag := range s.tagStorage.GetAll() {
+		if tag.ACL != nil {
+			read[id] = tagAllows(user, tag, tags.PermissionRead)
+			write[id] = tagAllows(user, tag, tags.PermissionWrite)
+		}
+	}
+	return read, write
+}
+
+// isTagAvailable returns true, if a tag exists and the user of a request has the required permission
+func (s Server) isTagAvailable(r *http.Request, id int, required tags.Permission) bool {
+	tag, ok := s.tagStorage.Get(id)
+	return ok && tagAllows(s.user(r), tag, required)
+}
+
+// openTag returns a tag from the path of a request. It writes an error, if the tag doesn't exist
+// or the user of the request doesn't have the required permission
+func (s Server) openTag(w http.ResponseWriter, r *http.Request, required tags.Permission) (tags.Tag, bool) {
+	tagID := mux.Vars(r)["id"]
+	id, err := strconv.Atoi(tagID)
+	if err != nil {
+		s.processError(w, "tag id isn't valid", http.StatusBadRequest)
+		return tags.Tag{}, false
+	}
+
+	user := s.user(r)
+	tag, ok := s.tagStorage.Get(id)
+	if !ok || !tagAllows(user, tag, tags.PermissionRead) {
+		s.processError(w, "tag with id "+tagID+" doesn't exist", http.StatusNotFound)
+		return tags.Tag{}, false
+	}
+	if !tagAllows(user, tag, required) {
+		s.processError(w, "not enough rights: "+string(required)+" permission is needed", http.StatusForbidden)
+		return tags.Tag{}, false
+	}
+
+	return tag, true
+}
+
+// isTagOwner returns true, if a user can change the ACL of a tag and delete it
+func isTagOwner(user users.User, tag tags.Tag) bool {
+	return tag.ACL == nil || tag.ACL.Owner == user.ID || user.Role == users.RoleAdmin
+}
+
 // GET /api/tags
 //
+// Tags, which the user can't read, are skipped
+//
 // Params: -
 //
 // Response: json map
 //
 func (s Server) returnTags(w http.ResponseWriter, r *http.Request) {
+	user := s.user(r)
+
 	allTags := s.tagStorage.GetAll()
+	for id, tag := range allTags {
+		if !tagAllows(user, tag, tags.PermissionRead) {
+			delete(allTags, id)
+		}
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	enc := json.NewEncoder(w)
@@ -45,11 +124,14 @@ func (s Server) addTag(w http.ResponseWriter, r *http.Request) {
 	}
 
 	s.tagStorage.Add(tagName, tagColor)
+	s.auditEvent(r, audit.ActionTagAdd, tagName)
 	w.WriteHeader(http.StatusCreated)
 }
 
 // PUT /api/tag/{id}
 //
+// Restricted tags can be changed only by users with write permission
+//
 // Params:
 //   - id: id of a tag
 //   - name: new name of a tag (can be empty)
@@ -59,32 +141,154 @@ func (s Server) addTag(w http.ResponseWriter, r *http.Request) {
 //
 func (s Server) changeTag(w http.ResponseWriter, r *http.Request) {
 	var (
-		tagID    = mux.Vars(r)["id"]
 		newName  = r.FormValue("name")
 		newColor = r.FormValue("color")
 	)
 
-	var (
-		id  int
-		err error
-	)
-	if id, err = strconv.Atoi(tagID); err != nil {
-		s.processError(w, "tag id isn't valid", http.StatusBadRequest)
+	tag, ok := s.openTag(w, r, tags.PermissionWrite)
+	if !ok {
 		return
 	}
 
-	// Check id
-	if !s.tagStorage.Check(id) {
-		s.processError(w, "tag with id "+tagID+" doesn't exist", http.StatusBadRequest)
+	updatedTag, err := s.tagStorage.Change(tag.ID, newName, newColor)
+	if err != nil {
+		s.processError(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	s.auditEvent(r, audit.ActionTagChange, updatedTag.Name, tag.ID)
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	if s.config.Debug {
+		enc.SetIndent("", "  ")
+	}
+	enc.Encode(updatedTag)
+}
+
+// PUT /api/tag/{id}/acl
+//
+// Sets an ACL of a tag. Any editor can restrict a tag and becomes its owner. The ACL of a restricted tag
+// can be changed only by its owner or an admin
+//
+// Params:
+//   - id: id of a tag
+//   - owner: id of a new owner (optional, the current owner by default)
+//   - users: permissions of users separated by comma (`users=2:read,3:write`)
+//   - roles: permissions of roles separated by comma (`roles=viewer:read,editor:write`)
+//
+// Response: updated tag
+//
+func (s Server) changeTagACL(w http.ResponseWriter, r *http.Request) {
+	user := s.user(r)
 
-	updatedTag, err := s.tagStorage.Change(id, newName, newColor)
+	tag, ok := s.openTag(w, r, tags.PermissionRead)
+	if !ok {
+		return
+	}
+	if !isTagOwner(user, tag) {
+		s.processError(w, "not enough rights: only the owner of a tag can change its ACL", http.StatusForbidden)
+		return
+	}
+
+	acl := &tags.ACL{Owner: user.ID, Users: []tags.UserPermission{}, Roles: []tags.RolePermission{}}
+	if tag.ACL != nil {
+		acl.Owner = tag.ACL.Owner
+	}
+	if v := r.FormValue("owner"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			s.processError(w, "owner must be a user id", http.StatusBadRequest)
+			return
+		}
+		if _, err := s.users.Get(id); err != nil {
+			s.processError(w, "user with id \""+v+"\" doesn't exist", http.StatusNotFound)
+			return
+		}
+		acl.Owner = id
+	}
+
+	for _, entry := range splitACLEntries(r.FormValue("users")) {
+		id, err := strconv.Atoi(entry[0])
+		if err != nil {
+			s.processError(w, "user id \""+entry[0]+"\" isn't valid", http.StatusBadRequest)
+			return
+		}
+		if _, err := s.users.Get(id); err != nil {
+			s.processError(w, "user with id \""+entry[0]+"\" doesn't exist", http.StatusNotFound)
+			return
+		}
+		acl.Users = append(acl.Users, tags.UserPermission{UserID: id, Permission: tags.Permission(entry[1])})
+	}
+
+	for _, entry := range splitACLEntries(r.FormValue("roles")) {
+		if !users.Role(entry[0]).IsValid() {
+			s.processError(w, "role \""+entry[0]+"\" isn't valid", http.StatusBadRequest)
+			return
+		}
+		acl.Roles = append(acl.Roles, tags.RolePermission{Role: entry[0], Permission: tags.Permission(entry[1])})
+	}
+
+	for _, p := range acl.Users {
+		if !p.Permission.IsValid() {
+			s.processError(w, "permission must be read or write", http.StatusBadRequest)
+			return
+		}
+	}
+	for _, p := range acl.Roles {
+		if !p.Permission.IsValid() {
+			s.processError(w, "permission must be read or write", http.StatusBadRequest)
+			return
+		}
+	}
+
+	updatedTag, err := s.tagStorage.ChangeACL(tag.ID, acl)
+	if err != nil {
+		s.processError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	s.logger.Warnf("%s changed ACL of tag %d\n", user.Login, tag.ID)
+	s.auditEvent(r, audit.ActionTagACL, "owner: "+strconv.Itoa(acl.Owner)+", users: "+r.FormValue("users")+
+		", roles: "+r.FormValue("roles"), tag.ID)
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	if s.config.Debug {
+		enc.SetIndent("", "  ")
+	}
+	enc.Encode(updatedTag)
+}
+
+// DELETE /api/tag/{id}/acl
+//
+// Removes all restrictions of a tag. Only the owner of the tag or an admin can do it
+//
+// Params:
+//   - id: id of a tag
+//
+// Response: updated tag
+//
+func (s Server) deleteTagACL(w http.ResponseWriter, r *http.Request) {
+	user := s.user(r)
+
+	tag, ok := s.openTag(w, r, tags.PermissionRead)
+	if !ok {
+		return
+	}
+	if !isTagOwner(user, tag) {
+		s.processError(w, "not enough rights: only the owner of a tag can change its ACL", http.StatusForbidden)
+		return
+	}
+
+	updatedTag, err := s.tagStorage.ChangeACL(tag.ID, nil)
 	if err != nil {
 		s.processError(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	s.logger.Warnf("%s removed ACL of tag %d\n", user.Login, tag.ID)
+	s.auditEvent(r, audit.ActionTagACL, "removed", tag.ID)
+
 	w.Header().Set("Content-Type", "application/json")
 	enc := json.NewEncoder(w)
 	if s.config.Debug {
@@ -93,8 +297,28 @@ func (s Server) changeTag(w http.ResponseWriter, r *http.Request) {
 	enc.Encode(updatedTag)
 }
 
+// splitACLEntries splits a list like "2:read,3:write" into pairs. A pair without permission gets "read"
+func splitACLEntries(list string) [][2]string {
+	var res [][2]string
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		pair := [2]string{entry, string(tags.PermissionRead)}
+		if i := strings.LastIndex(entry, ":"); i != -1 {
+			pair = [2]string{entry[:i], entry[i+1:]}
+		}
+		res = append(res, pair)
+	}
+	return res
+}
+
 // DELETE /api/tags
 //
+// Restricted tags can be deleted only by their owners or admins
+//
 // Params:
 //   - id: id of a tag (one tag at a time)
 //
@@ -110,7 +334,24 @@ func (s Server) deleteTag(w http.ResponseWriter, r *http.Request) {
 		s.processError(w, "tag id isn't valid", http.StatusBadRequest)
 		return
 	}
+	if id == s.config.VaultTag && !s.access(r).VaultUnlocked {
+		s.processError(w, "vault must be unlocked to delete the vault tag", http.StatusForbidden)
+		return
+	}
+	if tag, ok := s.tagStorage.Get(id); ok {
+		user := s.user(r)
+		if !tagAllows(user, tag, tags.PermissionRead) {
+			s.processError(w, "tag with id "+tagID+" doesn't exist", http.StatusNotFound)
+			return
+		}
+		if !isTagOwner(user, tag) {
+			s.processError(w, "not enough rights: only the owner of a tag can delete it", http.StatusForbidden)
+			return
+		}
+	}
 	s.tagStorage.Delete(id)
 	// Delete refs to tag
 	s.fileStorage.DeleteTagFromFiles(id)
+	s.drops.DeleteTag(id)
+	s.auditEvent(r, audit.ActionTagDelete, "", id)
 }
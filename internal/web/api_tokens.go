@@ -0,0 +1,158 @@
+package web
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/tags-drive/core/internal/storage/audit"
+	"github.com/tags-drive/core/internal/web/apitokens"
+	"github.com/tags-drive/core/internal/web/users"
+)
+
+// scopeRoles contains minimal roles of users, who can create tokens with scopes
+var scopeRoles = map[apitokens.Scope]users.Role{
+	apitokens.ScopeRead:   users.RoleViewer,
+	apitokens.ScopeUpload: users.RoleEditor,
+	apitokens.ScopeTag:    users.RoleEditor,
+	apitokens.ScopeDelete: users.RoleEditor,
+	apitokens.ScopeAdmin:  users.RoleAdmin,
+}
+
+// apiTokenErrorCode returns a status code of an error returned by apitokens.APITokensInterface
+func apiTokenErrorCode(err error) int {
+	switch err {
+	case apitokens.ErrTokenNotExist:
+		return http.StatusNotFound
+	case apitokens.ErrEmptyName, apitokens.ErrNoScopes, apitokens.ErrInvalidScope, apitokens.ErrExpired:
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// GET /api/tokens
+//
+// Params:
+//   - all: return tokens of all users (only for admins)
+//
+// Response: json array of tokens
+//
+func (s Server) returnAPITokens(w http.ResponseWriter, r *http.Request) {
+	user := s.user(r)
+
+	userID := user.ID
+	if r.FormValue("all") == "true" {
+		if user.Role != users.RoleAdmin {
+			s.processError(w, "not enough rights: admin role is needed", http.StatusForbidden)
+			return
+		}
+		userID = 0
+	}
+
+	tokens := s.apiTokens.GetAll(userID)
+	for i := range tokens {
+		tokens[i].Hash = ""
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	if s.config.Debug {
+		enc.SetIndent("", "  ")
+	}
+	enc.Encode(tokens)
+}
+
+// POST /api/tokens
+//
+// Params:
+//   - name: name of a token
+//   - scopes: list of scopes, separated by comma (read, upload, tag, delete, admin)
+//   - expires: expiry time in RFC 3339 format (token doesn't expire, if it's empty)
+//
+// Response: json object of the token with the "secret" field. The secret isn't shown again
+//
+func (s Server) addAPIToken(w http.ResponseWriter, r *http.Request) {
+	user := s.user(r)
+
+	scopes, err := apitokens.ParseScopes(r.FormValue("scopes"))
+	if err != nil {
+		s.processError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, scope := range scopes {
+		if !user.Role.Allows(scopeRoles[scope]) {
+			s.processError(w, "not enough rights: "+string(scopeRoles[scope])+" role is needed for "+string(scope)+" scope", http.StatusForbidden)
+			return
+		}
+	}
+
+	var expires time.Time
+	if v := r.FormValue("expires"); v != "" {
+		expires, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			s.processError(w, "expires must be in RFC 3339 format", http.StatusBadRequest)
+			return
+		}
+	}
+
+	token, secret, err := s.apiTokens.Create(user.ID, r.FormValue("name"), scopes, expires)
+	if err != nil {
+		s.processError(w, err.Error(), apiTokenErrorCode(err))
+		return
+	}
+
+	s.logger.Warnf("%s created API token %d (%s) with scopes %v\n", user.Login, token.ID, token.Name, token.Scopes)
+	s.auditEvent(r, audit.ActionTokenAdd, token.Name, token.ID)
+
+	token.Hash = ""
+	resp := struct {
+		apitokens.Token
+		Secret string `json:"secret"`
+	}{
+		Token:  token,
+		Secret: secret,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	enc := json.NewEncoder(w)
+	if s.config.Debug {
+		enc.SetIndent("", "  ")
+	}
+	enc.Encode(resp)
+}
+
+// DELETE /api/tokens
+//
+// Revokes a token. Admins can revoke tokens of all users
+//
+// Params:
+//   - id: id of a token
+//
+// Response: -
+//
+func (s Server) deleteAPIToken(w http.ResponseWriter, r *http.Request) {
+	user := s.user(r)
+
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		s.processError(w, "token id isn't valid", http.StatusBadRequest)
+		return
+	}
+
+	token, err := s.apiTokens.Get(id)
+	if err != nil || (token.UserID != user.ID && user.Role != users.RoleAdmin) {
+		s.processError(w, apitokens.ErrTokenNotExist.Error(), http.StatusNotFound)
+		return
+	}
+
+	err = s.apiTokens.Delete(id)
+	if err != nil {
+		s.processError(w, err.Error(), apiTokenErrorCode(err))
+		return
+	}
+
+	s.logger.Warnf("%s revoked API token %d (%s)\n", user.Login, token.ID, token.Name)
+	s.auditEvent(r, audit.ActionTokenDelete, token.Name, token.ID)
+}
@@ -0,0 +1,204 @@
+package web
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+
+	"github.com/tags-drive/core/internal/storage/audit"
+	"github.com/tags-drive/core/internal/web/twofactor"
+	"github.com/tags-drive/core/internal/web/users"
+)
+
+// twoFactorErrorCode returns a status code of an error returned by twofactor.TwoFactorInterface
+func twoFactorErrorCode(err error) int {
+	switch err {
+	case twofactor.ErrWrongCode, twofactor.ErrInvalidChallenge:
+		return http.StatusUnauthorized
+	case twofactor.ErrNotEnabled, twofactor.ErrAlreadyEnabled, twofactor.ErrNotEnrolled:
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// writeTwoFactor writes a json response
+func (s Server) writeTwoFactor(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	if s.config.Debug {
+		enc.SetIndent("", "  ")
+	}
+	enc.Encode(v)
+}
+
+// GET /api/account/2fa
+//
+// Params: -
+//
+// Response: json object with "enabled" and "recoveryCodes" (number of unused recovery codes) fields
+//
+func (s Server) twoFactorStatus(w http.ResponseWriter, r *http.Request) {
+	s.writeTwoFactor(w, s.twoFactor.Status(s.user(r).ID))
+}
+
+// POST /api/account/2fa
+//
+// Starts enrollment of two-factor authentication. It isn't enabled until POST /api/account/2fa/confirm.
+// TLS is required, except Debug mode
+//
+// Params:
+//   - password: password of the current user
+//
+// Response: json object with "secret" (base32) and "uri" (otpauth URI for authenticator apps) fields
+//
+func (s Server) enrollTwoFactor(w http.ResponseWriter, r *http.Request) {
+	if !s.isSecure(r) {
+		s.processError(w, errInsecurePassword.Error(), http.StatusForbidden)
+		return
+	}
+
+	user := s.user(r)
+	keys := []string{ipKey(r), accountKey(user.Login)}
+	if !s.authAllowed(w, r, keys...) {
+		return
+	}
+
+	if _, err := s.users.Get(user.ID); err != nil {
+		// For example, SkipLogin is true
+		s.processError(w, "current user can't enable two-factor authentication", http.StatusBadRequest)
+		return
+	}
+
+	_, err := s.users.Authenticate(user.Login, r.FormValue("password"))
+	if err != nil {
+		if err == users.ErrWrongPassword {
+			s.authLimiter.Fail(keys...)
+			s.processError(w, "invalid password", http.StatusBadRequest)
+			return
+		}
+		s.processError(w, err.Error(), userErrorCode(err))
+		return
+	}
+
+	secret, uri, err := s.twoFactor.Enroll(user.ID, user.Login)
+	if err != nil {
+		s.processError(w, err.Error(), twoFactorErrorCode(err))
+		return
+	}
+
+	s.writeTwoFactor(w, struct {
+		Secret string `json:"secret"`
+		URI    string `json:"uri"`
+	}{
+		Secret: secret,
+		URI:    uri,
+	})
+}
+
+// POST /api/account/2fa/confirm
+//
+// Enables two-factor authentication. Failed attempts are throttled
+//
+// Params:
+//   - code: TOTP code from an authenticator app
+//
+// Response: json object with "recoveryCodes" field. Every recovery code can be used once instead of TOTP code.
+// Recovery codes aren't shown again
+//
+func (s Server) confirmTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user := s.user(r)
+	keys := []string{ipKey(r), accountKey(user.Login)}
+	if !s.authAllowed(w, r, keys...) {
+		return
+	}
+
+	codes, err := s.twoFactor.Confirm(user.ID, r.FormValue("code"))
+	if err != nil {
+		if err == twofactor.ErrWrongCode {
+			s.authLimiter.Fail(keys...)
+		}
+		s.processError(w, err.Error(), twoFactorErrorCode(err))
+		return
+	}
+
+	s.logger.Warnf("%s enabled two-factor authentication of \"%s\"\n", r.RemoteAddr, user.Login)
+	s.auditEvent(r, audit.ActionTwoFactor, "enabled", user.ID)
+
+	s.writeTwoFactor(w, struct {
+		RecoveryCodes []string `json:"recoveryCodes"`
+	}{
+		RecoveryCodes: codes,
+	})
+}
+
+// DELETE /api/account/2fa
+//
+// Disables two-factor authentication of the current user. Failed attempts are throttled
+//
+// Params:
+//   - code: TOTP code or recovery code
+//
+// Response: -
+//
+func (s Server) disableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user := s.user(r)
+	keys := []string{ipKey(r), accountKey(user.Login)}
+	if !s.authAllowed(w, r, keys...) {
+		return
+	}
+
+	// Pending enrollment can be canceled without a code
+	if s.twoFactor.IsEnabled(user.ID) {
+		err := s.twoFactor.Verify(user.ID, r.FormValue("code"))
+		if err != nil {
+			if err == twofactor.ErrWrongCode {
+				s.authLimiter.Fail(keys...)
+			}
+			s.logger.Warnf("%s tried to disable two-factor authentication of \"%s\": %s\n", r.RemoteAddr, user.Login, err)
+			s.processError(w, err.Error(), twoFactorErrorCode(err))
+			return
+		}
+	}
+
+	err := s.twoFactor.Disable(user.ID)
+	if err != nil {
+		s.processError(w, err.Error(), twoFactorErrorCode(err))
+		return
+	}
+
+	s.logger.Warnf("%s disabled two-factor authentication of \"%s\"\n", r.RemoteAddr, user.Login)
+	s.auditEvent(r, audit.ActionTwoFactor, "disabled", user.ID)
+}
+
+// DELETE /api/user/{id}/2fa
+//
+// Resets two-factor authentication of a user, who lost a device and recovery codes
+//
+// Params:
+//   - id: id of a user
+//
+// Response: -
+//
+func (s Server) resetUserTwoFactor(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		s.processError(w, "user id isn't valid", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := s.users.Get(id); err != nil {
+		s.processError(w, err.Error(), userErrorCode(err))
+		return
+	}
+
+	err = s.twoFactor.Disable(id)
+	if err != nil {
+		s.processError(w, err.Error(), twoFactorErrorCode(err))
+		return
+	}
+
+	s.logger.Warnf("%s reset two-factor authentication of user %d\n", s.user(r).Login, id)
+	s.auditEvent(r, audit.ActionTwoFactor, "reset", id)
+}
@@ -0,0 +1,255 @@
+package web
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+
+	"github.com/tags-drive/core/internal/storage/audit"
+	"github.com/tags-drive/core/internal/web/users"
+)
+
+type contextKey int
+
+const (
+	userContextKey contextKey = iota
+	proxyContextKey
+)
+
+// skipLoginUser is used for all requests, if SkipLogin is true
+var skipLoginUser = users.User{Login: "debug", Role: users.RoleAdmin}
+
+// withUser returns a request with a user in its context
+func withUser(r *http.Request, user users.User) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), userContextKey, user))
+}
+
+// user returns a user of a request. It returns an empty user, if the route doesn't need auth
+func (s Server) user(r *http.Request) users.User {
+	user, _ := r.Context().Value(userContextKey).(users.User)
+	return user
+}
+
+// userErrorCode returns a status code of an error returned by users.UsersInterface
+func userErrorCode(err error) int {
+	switch err {
+	case users.ErrUserNotExist:
+		return http.StatusNotFound
+	case errInsecurePassword:
+		return http.StatusForbidden
+	case users.ErrUserExists, users.ErrEmptyLogin, users.ErrShortPassword, users.ErrInvalidRole, users.ErrLastAdmin:
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// writeUsers writes users without password hashes
+func (s Server) writeUsers(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	if s.config.Debug {
+		enc.SetIndent("", "  ")
+	}
+	enc.Encode(v)
+}
+
+// GET /api/user
+//
+// Params: -
+//
+// Response: json object of the current user
+//
+func (s Server) returnCurrentUser(w http.ResponseWriter, r *http.Request) {
+	user := s.user(r)
+	user.Password = ""
+
+	s.writeUsers(w, user)
+}
+
+// GET /api/users
+//
+// Params: -
+//
+// Response: json array of users
+//
+func (s Server) returnUsers(w http.ResponseWriter, r *http.Request) {
+	allUsers := s.users.GetAll()
+	for i := range allUsers {
+		allUsers[i].Password = ""
+	}
+
+	s.writeUsers(w, allUsers)
+}
+
+// POST /api/users
+//
+// Params:
+//   - login: login of a new user
+//   - password: password of a new user (TLS is required, except Debug mode)
+//   - role: admin, editor or viewer
+//
+// Response: json object of the new user
+//
+func (s Server) addUser(w http.ResponseWriter, r *http.Request) {
+	if !s.isSecure(r) {
+		s.processError(w, errInsecurePassword.Error(), http.StatusForbidden)
+		return
+	}
+
+	var (
+		login    = r.FormValue("login")
+		password = r.FormValue("password")
+		role     = users.Role(r.FormValue("role"))
+	)
+
+	user, err := s.users.Add(login, password, role)
+	if err != nil {
+		s.processError(w, err.Error(), userErrorCode(err))
+		return
+	}
+
+	s.logger.Warnf("%s added user \"%s\" (%s)\n", s.user(r).Login, user.Login, user.Role)
+	s.auditEvent(r, audit.ActionUserAdd, user.Login+" ("+string(user.Role)+")", user.ID)
+
+	user.Password = ""
+	w.WriteHeader(http.StatusCreated)
+	s.writeUsers(w, user)
+}
+
+// PUT /api/account/password
+//
+// Changes the password of the current user. Other sessions and all API tokens of the user are revoked,
+// so a leaked password or token can't be used anymore. TLS is required, except Debug mode
+//
+// Params:
+//   - old_password: current password
+//   - new_password: new password
+//
+// Response: -
+//
+func (s Server) changePassword(w http.ResponseWriter, r *http.Request) {
+	if !s.isSecure(r) {
+		s.processError(w, errInsecurePassword.Error(), http.StatusForbidden)
+		return
+	}
+
+	user := s.user(r)
+	keys := []string{ipKey(r), accountKey(user.Login)}
+	if !s.authAllowed(w, r, keys...) {
+		return
+	}
+
+	if _, err := s.users.Get(user.ID); err != nil {
+		// For example, SkipLogin is true
+		s.processError(w, "current user can't change password", http.StatusBadRequest)
+		return
+	}
+
+	_, err := s.users.Authenticate(user.Login, r.FormValue("old_password"))
+	if err != nil {
+		if err == users.ErrWrongPassword {
+			s.authLimiter.Fail(keys...)
+			s.logger.Warnf("%s tried to change password of \"%s\" with wrong old password\n", r.RemoteAddr, user.Login)
+			s.processError(w, "invalid old password", http.StatusBadRequest)
+			return
+		}
+
+		s.processError(w, err.Error(), userErrorCode(err))
+		return
+	}
+	s.authLimiter.Success(keys...)
+
+	err = s.users.SetPassword(user.ID, r.FormValue("new_password"))
+	if err != nil {
+		s.processError(w, err.Error(), userErrorCode(err))
+		return
+	}
+
+	s.authService.DeleteUserTokens(user.ID, s.session(r))
+	s.apiTokens.DeleteUserTokens(user.ID)
+
+	s.logger.Warnf("%s changed password of \"%s\"\n", r.RemoteAddr, user.Login)
+	s.auditEvent(r, audit.ActionPasswordChange, "", user.ID)
+}
+
+// PUT /api/user/{id}/disabled
+//
+// Disabled users can't log in. Their tokens are deleted
+//
+// Params:
+//   - id: id of a user
+//   - disabled: true or false
+//
+// Response: -
+//
+func (s Server) changeUserDisabled(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		s.processError(w, "user id isn't valid", http.StatusBadRequest)
+		return
+	}
+
+	disabled, err := strconv.ParseBool(r.FormValue("disabled"))
+	if err != nil {
+		s.processError(w, "disabled must be true or false", http.StatusBadRequest)
+		return
+	}
+
+	if disabled && id == s.user(r).ID {
+		s.processError(w, "can't disable yourself", http.StatusBadRequest)
+		return
+	}
+
+	err = s.users.SetDisabled(id, disabled)
+	if err != nil {
+		s.processError(w, err.Error(), userErrorCode(err))
+		return
+	}
+
+	if disabled {
+		s.authService.DeleteUserTokens(id, "")
+	}
+
+	s.logger.Warnf("%s changed user %d: disabled = %t\n", s.user(r).Login, id, disabled)
+	s.auditEvent(r, audit.ActionUserChange, "disabled = "+strconv.FormatBool(disabled), id)
+}
+
+// DELETE /api/users
+//
+// Files uploaded by a user aren't deleted. API tokens, shares, drop links and two-factor authentication of the user are removed
+//
+// Params:
+//   - id: id of a user
+//
+// Response: -
+//
+func (s Server) deleteUser(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		s.processError(w, "user id isn't valid", http.StatusBadRequest)
+		return
+	}
+
+	if id == s.user(r).ID {
+		s.processError(w, "can't delete yourself", http.StatusBadRequest)
+		return
+	}
+
+	err = s.users.Delete(id)
+	if err != nil {
+		s.processError(w, err.Error(), userErrorCode(err))
+		return
+	}
+
+	s.authService.DeleteUserTokens(id, "")
+	s.apiTokens.DeleteUserTokens(id)
+	s.shares.DeleteUserShares(id)
+	s.drops.DeleteUserDrops(id)
+	s.twoFactor.Disable(id)
+
+	s.logger.Warnf("%s deleted user %d\n", s.user(r).Login, id)
+	s.auditEvent(r, audit.ActionUserDelete, "", id)
+}
@@ -0,0 +1,50 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/tags-drive/core/internal/web/apitokens"
+)
+
+func TestChangePasswordRevokesTokens(t *testing.T) {
+	assert := assert.New(t)
+
+	s, clean := newTestServer(t)
+	defer clean()
+	s.config.IsTLS = true
+	s.config.AuthCookieName = "auth"
+
+	user, err := s.users.Get(1)
+	assert.Nil(err)
+
+	session, other := "current-session", "other-session"
+	s.authService.AddToken(session, user.ID, "", "")
+	s.authService.AddToken(other, user.ID, "", "")
+	_, secret, err := s.apiTokens.Create(user.ID, "script", []apitokens.Scope{apitokens.ScopeRead}, time.Time{})
+	assert.Nil(err)
+
+	body := url.Values{"old_password": {"password"}, "new_password": {"new-password"}}.Encode()
+	r := httptest.NewRequest("PUT", "/api/account/password", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.AddCookie(&http.Cookie{Name: "auth", Value: session})
+	r = withUser(r, user)
+
+	w := httptest.NewRecorder()
+	s.changePassword(w, r)
+	assert.Equal(http.StatusOK, w.Code)
+
+	_, ok := s.authService.CheckToken(session, "")
+	assert.True(ok)
+	_, ok = s.authService.CheckToken(other, "")
+	assert.False(ok)
+	_, err = s.apiTokens.Check(secret, "")
+	assert.Equal(apitokens.ErrInvalidToken, err)
+	assert.Empty(s.apiTokens.GetAll(user.ID))
+}
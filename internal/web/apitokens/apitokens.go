@@ -0,0 +1,278 @@
+// Package apitokens keeps personal API tokens. Tokens are used by scripts instead of the login
+package apitokens
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	clog "github.com/ShoshinNikita/log/v2"
+	"github.com/pkg/errors"
+
+	"github.com/tags-drive/core/internal/storage/encryption"
+)
+
+// secretPrefix helps to find leaked tokens
+const secretPrefix = "td_"
+
+const secretSize = 32
+
+// Errors
+var (
+	ErrInvalidToken  = errors.New("invalid or expired token")
+	ErrTokenNotExist = errors.New("token doesn't exist")
+	ErrEmptyName     = errors.New("name can't be empty")
+	ErrNoScopes      = errors.New("token must have at least one scope")
+	ErrInvalidScope  = errors.New("invalid scope")
+	ErrExpired       = errors.New("expiry time must be in the future")
+)
+
+type APITokens struct {
+	config Config
+	file   encryption.JSONFile
+
+	tokens map[int]Token
+	// hashes maps hashes of secrets to ids of tokens
+	hashes map[string]int
+	maxID  int
+	// used is true, if last usage of tokens wasn't saved
+	used  bool
+	mutex *sync.RWMutex
+
+	now func() time.Time
+
+	// this channel signals that APITokens.Shutdown() function was called
+	shutdowned chan struct{}
+
+	logger *clog.Logger
+}
+
+// NewAPITokens creates new APITokens and reads tokens from APITokensJSONFile
+func NewAPITokens(cnf Config, lg *clog.Logger) (*APITokens, error) {
+	t := &APITokens{
+		config: cnf,
+		file: encryption.JSONFile{
+			Path:    cnf.APITokensJSONFile,
+			Encrypt: cnf.Encrypt,
+			Key:     cnf.PassPhrase,
+			Indent:  cnf.Debug,
+		},
+		tokens:     make(map[int]Token),
+		hashes:     make(map[string]int),
+		mutex:      new(sync.RWMutex),
+		now:        time.Now,
+		shutdowned: make(chan struct{}),
+		logger:     lg,
+	}
+
+	var list []Token
+	if _, err := t.file.Read(&list); err != nil {
+		return nil, err
+	}
+
+	for _, token := range list {
+		t.tokens[token.ID] = token
+		t.hashes[token.Hash] = token.ID
+		if t.maxID < token.ID {
+			t.maxID = token.ID
+		}
+	}
+
+	return t, nil
+}
+
+func (t *APITokens) StartBackgroundServices() {
+	// Save last usage of tokens
+	go func() {
+		ticker := time.NewTicker(t.config.SaveInterval)
+		for {
+			select {
+			case <-ticker.C:
+				t.mutex.Lock()
+				if t.used {
+					if err := t.write(); err != nil {
+						t.logger.Errorln(err)
+					}
+				}
+				t.mutex.Unlock()
+			case <-t.shutdowned:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+}
+
+// write writes tokens into APITokensJSONFile. It must be called under the lock
+func (t *APITokens) write() error {
+	if err := t.file.Write(t.getAll(0)); err != nil {
+		return err
+	}
+
+	t.used = false
+	return nil
+}
+
+func hashSecret(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(hash[:])
+}
+
+func (t *APITokens) Create(userID int, name string, scopes []Scope, expires time.Time) (Token, string, error) {
+	name = strings.TrimSpace(name)
+	switch {
+	case name == "":
+		return Token{}, "", ErrEmptyName
+	case len(scopes) == 0:
+		return Token{}, "", ErrNoScopes
+	case !expires.IsZero() && !expires.After(t.now()):
+		return Token{}, "", ErrExpired
+	}
+	for _, scope := range scopes {
+		if !scope.IsValid() {
+			return Token{}, "", ErrInvalidScope
+		}
+	}
+
+	raw := make([]byte, secretSize)
+	if _, err := rand.Read(raw); err != nil {
+		return Token{}, "", errors.Wrap(err, "can't generate token")
+	}
+	secret := secretPrefix + base64.RawURLEncoding.EncodeToString(raw)
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.maxID++
+	token := Token{
+		ID:      t.maxID,
+		UserID:  userID,
+		Name:    name,
+		Hash:    hashSecret(secret),
+		Scopes:  scopes,
+		Created: t.now(),
+		Expires: expires,
+	}
+	t.tokens[token.ID] = token
+	t.hashes[token.Hash] = token.ID
+
+	if err := t.write(); err != nil {
+		delete(t.tokens, token.ID)
+		delete(t.hashes, token.Hash)
+		return Token{}, "", err
+	}
+
+	return token, secret, nil
+}
+
+func (t *APITokens) Check(secret, ip string) (Token, error) {
+	if !strings.HasPrefix(secret, secretPrefix) {
+		return Token{}, ErrInvalidToken
+	}
+
+	hash := hashSecret(secret)
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	id, ok := t.hashes[hash]
+	if !ok {
+		return Token{}, ErrInvalidToken
+	}
+
+	now := t.now()
+	token := t.tokens[id]
+	if token.IsExpired(now) {
+		return Token{}, ErrInvalidToken
+	}
+
+	// Usage is saved in background
+	token.LastUsed = now
+	token.LastIP = ip
+	t.tokens[id] = token
+	t.used = true
+
+	return token, nil
+}
+
+func (t *APITokens) Get(id int) (Token, error) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	token, ok := t.tokens[id]
+	if !ok {
+		return Token{}, ErrTokenNotExist
+	}
+	return token, nil
+}
+
+func (t *APITokens) GetAll(userID int) []Token {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	return t.getAll(userID)
+}
+
+func (t *APITokens) getAll(userID int) []Token {
+	res := make([]Token, 0, len(t.tokens))
+	for _, token := range t.tokens {
+		if userID == 0 || token.UserID == userID {
+			res = append(res, token)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+
+	return res
+}
+
+func (t *APITokens) Delete(id int) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	token, ok := t.tokens[id]
+	if !ok {
+		return ErrTokenNotExist
+	}
+
+	delete(t.tokens, id)
+	delete(t.hashes, token.Hash)
+
+	return t.write()
+}
+
+func (t *APITokens) DeleteUserTokens(userID int) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	deleted := false
+	for id, token := range t.tokens {
+		if token.UserID == userID {
+			delete(t.tokens, id)
+			delete(t.hashes, token.Hash)
+			deleted = true
+		}
+	}
+
+	if deleted {
+		if err := t.write(); err != nil {
+			t.logger.Errorln(err)
+		}
+	}
+}
+
+func (t *APITokens) Shutdown() error {
+	close(t.shutdowned)
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.used {
+		return t.write()
+	}
+	return nil
+}
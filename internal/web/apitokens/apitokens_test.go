@@ -0,0 +1,172 @@
+package apitokens
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	clog "github.com/ShoshinNikita/log/v2"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/tags-drive/core/internal/storage/encryption/encryptiontest"
+)
+
+func newTestTokens(t *testing.T, encrypt bool) (*APITokens, func()) {
+	path, clean := encryptiontest.TempFile(t, "api_tokens.json")
+
+	cnf := Config{
+		APITokensJSONFile: path,
+		Encrypt:           encrypt,
+		PassPhrase:        encryptiontest.Key,
+		SaveInterval:      time.Minute,
+	}
+	tokens, err := NewAPITokens(cnf, clog.NewProdLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tokens, clean
+}
+
+func TestParseScopes(t *testing.T) {
+	assert := assert.New(t)
+
+	scopes, err := ParseScopes("read, upload,read,,tag")
+	assert.Nil(err)
+	assert.Equal([]Scope{ScopeRead, ScopeUpload, ScopeTag}, scopes)
+
+	scopes, err = ParseScopes("")
+	assert.Nil(err)
+	assert.Empty(scopes)
+
+	_, err = ParseScopes("read,write")
+	assert.Equal(ErrInvalidScope, err)
+}
+
+func TestCreateAndCheck(t *testing.T) {
+	assert := assert.New(t)
+
+	tokens, clean := newTestTokens(t, false)
+	defer clean()
+
+	now := time.Date(2019, 5, 1, 12, 0, 0, 0, time.UTC)
+	tokens.now = func() time.Time { return now }
+
+	// Errors
+	_, _, err := tokens.Create(1, " ", []Scope{ScopeRead}, time.Time{})
+	assert.Equal(ErrEmptyName, err)
+	_, _, err = tokens.Create(1, "script", nil, time.Time{})
+	assert.Equal(ErrNoScopes, err)
+	_, _, err = tokens.Create(1, "script", []Scope{"write"}, time.Time{})
+	assert.Equal(ErrInvalidScope, err)
+	_, _, err = tokens.Create(1, "script", []Scope{ScopeRead}, now)
+	assert.Equal(ErrExpired, err)
+
+	token, secret, err := tokens.Create(1, "backup", []Scope{ScopeRead}, now.Add(time.Hour))
+	if !assert.Nil(err) {
+		return
+	}
+	assert.True(strings.HasPrefix(secret, secretPrefix))
+	assert.NotContains(token.Hash, secret)
+
+	// Only the hash is saved
+	data, _ := ioutil.ReadFile(tokens.config.APITokensJSONFile)
+	assert.NotContains(string(data), secret)
+	assert.Contains(string(data), token.Hash)
+
+	// Check
+	checked, err := tokens.Check(secret, "10.0.0.1")
+	assert.Nil(err)
+	assert.Equal(token.ID, checked.ID)
+	assert.True(checked.HasScope(ScopeRead))
+	assert.False(checked.HasScope(ScopeUpload))
+	assert.Equal(now, checked.LastUsed)
+	assert.Equal("10.0.0.1", checked.LastIP)
+
+	_, err = tokens.Check(secret+"a", "")
+	assert.Equal(ErrInvalidToken, err)
+	_, err = tokens.Check("", "")
+	assert.Equal(ErrInvalidToken, err)
+
+	// Expiry
+	now = now.Add(time.Hour)
+	_, err = tokens.Check(secret, "")
+	assert.Equal(ErrInvalidToken, err)
+
+	// Token without expiry
+	_, secret, err = tokens.Create(1, "forever", []Scope{ScopeUpload}, time.Time{})
+	assert.Nil(err)
+	now = now.AddDate(10, 0, 0)
+	_, err = tokens.Check(secret, "")
+	assert.Nil(err)
+}
+
+func TestPersistence(t *testing.T) {
+	for _, encrypt := range []bool{false, true} {
+		assert := assert.New(t)
+
+		tokens, clean := newTestTokens(t, encrypt)
+		defer clean()
+
+		_, secret, err := tokens.Create(1, "first", []Scope{ScopeRead}, time.Time{})
+		assert.Nil(err)
+		second, _, err := tokens.Create(2, "second", []Scope{ScopeAdmin}, time.Time{})
+		assert.Nil(err)
+
+		_, err = tokens.Check(secret, "10.0.0.2")
+		assert.Nil(err)
+
+		// Usage is saved on shutdown
+		assert.Nil(tokens.Shutdown())
+
+		data, _ := ioutil.ReadFile(tokens.config.APITokensJSONFile)
+		assert.Equal(!encrypt, strings.Contains(string(data), "second"))
+
+		tokens, err = NewAPITokens(tokens.config, clog.NewProdLogger())
+		if !assert.Nil(err) {
+			continue
+		}
+
+		all := tokens.GetAll(0)
+		if assert.Len(all, 2) {
+			assert.Equal("10.0.0.2", all[0].LastIP)
+		}
+		checked, err := tokens.Check(secret, "")
+		assert.Nil(err)
+		assert.Equal(1, checked.UserID)
+
+		// New ids don't overlap
+		third, _, err := tokens.Create(1, "third", []Scope{ScopeRead}, time.Time{})
+		assert.Nil(err)
+		assert.Equal(second.ID+1, third.ID)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	assert := assert.New(t)
+
+	tokens, clean := newTestTokens(t, false)
+	defer clean()
+
+	first, firstSecret, _ := tokens.Create(1, "first", []Scope{ScopeRead}, time.Time{})
+	_, secondSecret, _ := tokens.Create(1, "second", []Scope{ScopeRead}, time.Time{})
+	_, otherSecret, _ := tokens.Create(2, "other", []Scope{ScopeRead}, time.Time{})
+
+	assert.Len(tokens.GetAll(1), 2)
+	assert.Len(tokens.GetAll(2), 1)
+
+	assert.Nil(tokens.Delete(first.ID))
+	assert.Equal(ErrTokenNotExist, tokens.Delete(first.ID))
+	_, err := tokens.Check(firstSecret, "")
+	assert.Equal(ErrInvalidToken, err)
+	_, err = tokens.Get(first.ID)
+	assert.Equal(ErrTokenNotExist, err)
+
+	tokens.DeleteUserTokens(1)
+	_, err = tokens.Check(secondSecret, "")
+	assert.Equal(ErrInvalidToken, err)
+	_, err = tokens.Check(otherSecret, "")
+	assert.Nil(err)
+	assert.Len(tokens.GetAll(0), 1)
+}
@@ -0,0 +1,129 @@
+package apitokens
+
+import (
+	"strings"
+	"time"
+)
+
+type Config struct {
+	Debug bool
+
+	APITokensJSONFile string
+	Encrypt           bool
+	PassPhrase        [32]byte
+
+	// SaveInterval is an interval of saving last usage of tokens
+	SaveInterval time.Duration
+}
+
+// Scope defines which routes can be used with a token
+type Scope string
+
+// Scopes
+const (
+	// ScopeRead allows to view and download files and tags
+	ScopeRead Scope = "read"
+	// ScopeUpload allows to upload files
+	ScopeUpload Scope = "upload"
+	// ScopeTag allows to change tags and info of files, to create and change tags
+	ScopeTag Scope = "tag"
+	// ScopeDelete allows to delete and recover files, to delete tags
+	ScopeDelete Scope = "delete"
+	// ScopeAdmin allows to manage users and the drive
+	ScopeAdmin Scope = "admin"
+)
+
+// AllScopes contains all valid scopes
+var AllScopes = []Scope{ScopeRead, ScopeUpload, ScopeTag, ScopeDelete, ScopeAdmin}
+
+// IsValid returns true, if s is a known scope
+func (s Scope) IsValid() bool {
+	for _, scope := range AllScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseScopes parses scopes separated by comma. It returns ErrInvalidScope, if there's an unknown scope
+func ParseScopes(s string) ([]Scope, error) {
+	scopes := []Scope{}
+	for _, part := range strings.Split(s, ",") {
+		scope := Scope(strings.TrimSpace(part))
+		if scope == "" {
+			continue
+		}
+		if !scope.IsValid() {
+			return nil, ErrInvalidScope
+		}
+
+		duplicate := false
+		for _, prev := range scopes {
+			duplicate = duplicate || prev == scope
+		}
+		if !duplicate {
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes, nil
+}
+
+type Token struct {
+	ID     int    `json:"id"`
+	UserID int    `json:"userID"`
+	Name   string `json:"name"`
+	// Hash is sha256 checksum of the secret. It is empty in API responses
+	Hash    string    `json:"hash,omitempty"`
+	Scopes  []Scope   `json:"scopes"`
+	Created time.Time `json:"created"`
+	// Expires is zero, if the token doesn't expire
+	Expires time.Time `json:"expires"`
+	//
+	LastUsed time.Time `json:"lastUsed"`
+	LastIP   string    `json:"lastIP"`
+}
+
+// HasScope returns true, if the token has passed scope
+func (t Token) HasScope(scope Scope) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// IsExpired returns true, if the token is expired at passed time
+func (t Token) IsExpired(now time.Time) bool {
+	return !t.Expires.IsZero() && !now.Before(t.Expires)
+}
+
+// APITokensInterface provides methods for managing personal API tokens
+type APITokensInterface interface {
+	// StartBackgroundServices starts all background services
+	StartBackgroundServices()
+
+	// Create creates a new token. It returns the token and its secret. Only the hash of the secret is stored,
+	// so the secret can't be shown again
+	Create(userID int, name string, scopes []Scope, expires time.Time) (token Token, secret string, err error)
+
+	// Check returns a token with passed secret and saves the usage. It returns ErrInvalidToken,
+	// if there's no such token or the token is expired
+	Check(secret, ip string) (Token, error)
+
+	// Get returns a token with passed id
+	Get(id int) (Token, error)
+
+	// GetAll returns tokens sorted by id. userID 0 means tokens of all users
+	GetAll(userID int) []Token
+
+	// Delete deletes a token
+	Delete(id int) error
+
+	// DeleteUserTokens deletes all tokens of a user
+	DeleteUserTokens(userID int)
+
+	// Shutdown saves last usage of tokens
+	Shutdown() error
+}
@@ -12,13 +12,27 @@ import (
 	"github.com/pkg/errors"
 )
 
-const maxTokenSize = 30
+const (
+	// tokenSize is a number of random bytes of a token
+	tokenSize = 32
+	// sessionIDSize is a number of random bytes of a session id
+	sessionIDSize = 9
+	// maxUserAgentSize is a max length of a saved User-Agent
+	maxUserAgentSize = 256
+)
+
+// ErrSessionNotExist is returned, when there's no session with passed id
+var ErrSessionNotExist = errors.New("session doesn't exist")
 
 type Auth struct {
 	config Config
 
 	tokens []tokenStruct // we can use array instead of map because number of tokens is small and O(n) is enough
-	mutex  *sync.RWMutex
+	// used is true, if last usage of sessions wasn't saved
+	used  bool
+	mutex *sync.RWMutex
+
+	now func() time.Time
 
 	// this channel signals that Auth.Shutdown() function was called
 	shutdowned chan struct{}
@@ -27,8 +41,30 @@ type Auth struct {
 }
 
 type tokenStruct struct {
-	Token   string    `json:"token"`
-	Expires time.Time `json:"expire"`
+	// Hash is sha256 checksum of a token
+	Hash string `json:"hash"`
+	// Token is set only in files of old versions. Such tokens are hashed on start
+	Token string `json:"token,omitempty"`
+
+	ID        string    `json:"id"`
+	UserID    int       `json:"user_id"`
+	Created   time.Time `json:"created"`
+	LastSeen  time.Time `json:"last_seen"`
+	Expires   time.Time `json:"expire"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+}
+
+func (t tokenStruct) session() Session {
+	return Session{
+		ID:        t.ID,
+		UserID:    t.UserID,
+		Created:   t.Created,
+		LastSeen:  t.LastSeen,
+		Expires:   t.Expires,
+		IP:        t.IP,
+		UserAgent: t.UserAgent,
+	}
 }
 
 // NewAuthService create new Auth and inits tokens
@@ -36,6 +72,7 @@ func NewAuthService(cnf Config, lg *clog.Logger) (*Auth, error) {
 	service := &Auth{
 		config:     cnf,
 		mutex:      new(sync.RWMutex),
+		now:        time.Now,
 		logger:     lg,
 		shutdowned: make(chan struct{}),
 	}
@@ -70,6 +107,22 @@ func NewAuthService(cnf Config, lg *clog.Logger) (*Auth, error) {
 		}
 
 		f.Close()
+
+		// Tokens of old versions have no owner
+		for i := range service.tokens {
+			if service.tokens[i].UserID == 0 {
+				service.tokens[i].UserID = cnf.LegacyUserID
+			}
+		}
+
+		migrated, err := service.migrate()
+		if err != nil {
+			return nil, err
+		}
+		if migrated {
+			service.write()
+			lg.Infoln("session tokens were hashed")
+		}
 	}
 
 	return service, nil
@@ -94,12 +147,26 @@ func (a *Auth) StartBackgroundServices() {
 			}
 		}
 	}()
+
+	// Save last usage of sessions
+	go func() {
+		ticker := time.NewTicker(a.config.SaveInterval)
+		for {
+			select {
+			case <-ticker.C:
+				a.saveUsage()
+			case <-a.shutdowned:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
 }
 
 func (a Auth) createNewFile() error {
 	a.logger.Debugf("file %s doesn't exist. Need to create a new file\n", a.config.TokensJSONFile)
 
-	f, err := os.OpenFile(a.config.TokensJSONFile, os.O_CREATE|os.O_RDWR, 0666)
+	f, err := os.OpenFile(a.config.TokensJSONFile, os.O_CREATE|os.O_RDWR, 0600)
 	if err != nil {
 		return errors.Wrap(err, "can't create a new file")
 	}
@@ -125,13 +192,13 @@ func (a Auth) createNewFile() error {
 }
 
 // GenerateToken generates a new token
-func (a Auth) GenerateToken() string {
-	return generate(maxTokenSize)
+func (a Auth) GenerateToken() (string, error) {
+	return generate(tokenSize)
 }
 
-// AddToken adds new generated token
-func (a *Auth) AddToken(token string) {
-	a.add(token)
+// AddToken adds new generated token of a user
+func (a *Auth) AddToken(token string, userID int, ip, userAgent string) {
+	a.add(token, userID, ip, userAgent)
 }
 
 // DeleteToken deletes token
@@ -139,13 +206,35 @@ func (a *Auth) DeleteToken(token string) {
 	a.delete(token)
 }
 
-// CheckToken return true, if there's a passed token
-func (a Auth) CheckToken(token string) bool {
-	return a.check(token)
+// DeleteUserTokens deletes all tokens of a user except passed one (it can be empty)
+func (a *Auth) DeleteUserTokens(userID int, except string) {
+	a.deleteUser(userID, except)
+}
+
+// DeleteSession deletes a session of a user by its id
+func (a *Auth) DeleteSession(userID int, id string) error {
+	return a.deleteSession(userID, id)
+}
+
+// CheckToken returns an id of the owner of a token and true, if there's a passed token
+func (a *Auth) CheckToken(token, ip string) (userID int, ok bool) {
+	return a.check(token, ip)
+}
+
+// GetSession returns a session of passed token
+func (a Auth) GetSession(token string) (Session, bool) {
+	return a.getSession(token)
+}
+
+// GetSessions returns active sessions of a user
+func (a Auth) GetSessions(userID int) []Session {
+	return a.getSessions(userID)
 }
 
 func (a *Auth) Shutdown() error {
 	close(a.shutdowned)
 
+	a.saveUsage()
+
 	return nil
 }
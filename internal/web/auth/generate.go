@@ -1,22 +1,27 @@
 package auth
 
 import (
-	"math/rand"
-	"time"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+
+	"github.com/pkg/errors"
 )
 
-const alphabet = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+// generate returns a random string. n is a number of random bytes
+func generate(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrap(err, "can't generate random bytes")
+	}
 
-func init() {
-	rand.Seed(time.Now().UnixNano())
+	return base64.RawURLEncoding.EncodeToString(b), nil
 }
 
-func generate(n int) string {
-	token := make([]byte, n)
-
-	for i := 0; i < n; i++ {
-		token[i] = alphabet[rand.Intn(len(alphabet))]
-	}
-
-	return string(token)
+// hashToken returns sha256 checksum of a token. Only checksums are stored, so tokens can't be
+// stolen from TokensJSONFile
+func hashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
 }
@@ -1,13 +1,26 @@
 package auth
 
 import (
-	"fmt"
 	"testing"
+
+	"github.com/stretchr/testify/assert"
 )
 
+func TestGenerate(t *testing.T) {
+	assert := assert.New(t)
+
+	tokens := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		token, err := generate(tokenSize)
+		assert.Nil(err)
+		assert.Len(token, 43)
+		assert.False(tokens[token], "duplicate token")
+		tokens[token] = true
+	}
+}
+
 func BenchmarkGenerate(b *testing.B) {
-	fmt.Println(b.N)
 	for i := 0; i < b.N; i++ {
-		fmt.Println(generate(maxTokenSize))
+		generate(tokenSize)
 	}
 }
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"os"
+	"sort"
 	"time"
 
 	"github.com/minio/sio"
@@ -50,20 +51,88 @@ func (a Auth) write() {
 	}
 }
 
-func (a *Auth) add(token string) {
+// migrate hashes tokens of old versions. It must be called before the start of background services
+func (a *Auth) migrate() (migrated bool, err error) {
+	now := a.now()
+	for i, tok := range a.tokens {
+		if tok.Token == "" {
+			continue
+		}
+
+		id, err := generate(sessionIDSize)
+		if err != nil {
+			return false, err
+		}
+
+		created := tok.Expires.Add(-a.config.MaxTokenLife)
+		if created.After(now) {
+			created = now
+		}
+
+		a.tokens[i] = tokenStruct{
+			Hash:     hashToken(tok.Token),
+			ID:       id,
+			UserID:   tok.UserID,
+			Created:  created,
+			LastSeen: now,
+			Expires:  a.expiresAt(created, now),
+		}
+		migrated = true
+	}
+
+	return migrated, nil
+}
+
+// expiresAt returns an expiry time of a session. The session expires after IdleTokenLife without requests,
+// but not later than MaxTokenLife after creation
+func (a Auth) expiresAt(created, lastSeen time.Time) time.Time {
+	expires := created.Add(a.config.MaxTokenLife)
+	if a.config.IdleTokenLife > 0 {
+		if idle := lastSeen.Add(a.config.IdleTokenLife); idle.Before(expires) {
+			expires = idle
+		}
+	}
+	return expires
+}
+
+func (a *Auth) add(token string, userID int, ip, userAgent string) {
+	id, err := generate(sessionIDSize)
+	if err != nil {
+		a.logger.Errorf("can't generate session id: %s\n", err)
+		return
+	}
+
+	if len(userAgent) > maxUserAgentSize {
+		userAgent = userAgent[:maxUserAgentSize]
+	}
+
+	now := a.now()
+	tok := tokenStruct{
+		Hash:      hashToken(token),
+		ID:        id,
+		UserID:    userID,
+		Created:   now,
+		LastSeen:  now,
+		Expires:   a.expiresAt(now, now),
+		IP:        ip,
+		UserAgent: userAgent,
+	}
+
 	a.mutex.Lock()
-	a.tokens = append(a.tokens, tokenStruct{Token: token, Expires: time.Now().Add(a.config.MaxTokenLife)})
+	a.tokens = append(a.tokens, tok)
 	a.mutex.Unlock()
 
 	a.write()
 }
 
 func (a *Auth) delete(token string) {
+	hash := hashToken(token)
+
 	a.mutex.Lock()
 
 	tokenIndex := -1
 	for i, tok := range a.tokens {
-		if tok.Token == token {
+		if tok.Hash == hash {
 			tokenIndex = i
 			break
 		}
@@ -80,17 +149,125 @@ func (a *Auth) delete(token string) {
 	a.write()
 }
 
-func (a Auth) check(token string) bool {
+func (a *Auth) deleteSession(userID int, id string) error {
+	a.mutex.Lock()
+
+	tokenIndex := -1
+	for i, tok := range a.tokens {
+		if tok.ID == id && tok.UserID == userID {
+			tokenIndex = i
+			break
+		}
+	}
+	if tokenIndex == -1 {
+		a.mutex.Unlock()
+		return ErrSessionNotExist
+	}
+
+	a.tokens = append(a.tokens[:tokenIndex], a.tokens[tokenIndex+1:]...)
+
+	a.mutex.Unlock()
+
+	a.write()
+	return nil
+}
+
+// deleteUser removes all tokens of a user except passed one
+func (a *Auth) deleteUser(userID int, except string) {
+	exceptHash := ""
+	if except != "" {
+		exceptHash = hashToken(except)
+	}
+
+	a.mutex.Lock()
+
+	var otherTokens []tokenStruct
+	for _, tok := range a.tokens {
+		if tok.UserID != userID || tok.Hash == exceptHash {
+			otherTokens = append(otherTokens, tok)
+		}
+	}
+
+	a.tokens = otherTokens
+
+	a.mutex.Unlock()
+
+	a.write()
+}
+
+// check checks a token and extends its session
+func (a *Auth) check(token, ip string) (userID int, ok bool) {
+	hash := hashToken(token)
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	now := a.now()
+	for i, tok := range a.tokens {
+		if tok.Hash != hash {
+			continue
+		}
+		if !now.Before(tok.Expires) {
+			return 0, false
+		}
+
+		tok.LastSeen = now
+		tok.Expires = a.expiresAt(tok.Created, now)
+		if ip != "" {
+			tok.IP = ip
+		}
+		a.tokens[i] = tok
+		// Usage is saved in background
+		a.used = true
+
+		return tok.UserID, true
+	}
+
+	return 0, false
+}
+
+func (a Auth) getSession(token string) (Session, bool) {
+	hash := hashToken(token)
+
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+
+	for _, tok := range a.tokens {
+		if tok.Hash == hash {
+			return tok.session(), true
+		}
+	}
+
+	return Session{}, false
+}
+
+func (a Auth) getSessions(userID int) []Session {
 	a.mutex.RLock()
 	defer a.mutex.RUnlock()
 
+	now := a.now()
+	sessions := []Session{}
 	for _, tok := range a.tokens {
-		if tok.Token == token {
-			return true
+		if tok.UserID == userID && now.Before(tok.Expires) {
+			sessions = append(sessions, tok.session())
 		}
 	}
 
-	return false
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].LastSeen.After(sessions[j].LastSeen) })
+
+	return sessions
+}
+
+// saveUsage writes tokens, if there were requests after the last saving
+func (a *Auth) saveUsage() {
+	a.mutex.Lock()
+	used := a.used
+	a.used = false
+	a.mutex.Unlock()
+
+	if used {
+		a.write()
+	}
 }
 
 // expire removes expired tokens
@@ -98,12 +275,12 @@ func (a *Auth) expire() {
 	a.mutex.Lock()
 
 	var freshTokens []tokenStruct
-	now := time.Now()
+	now := a.now()
 	for _, tok := range a.tokens {
 		if now.Before(tok.Expires) {
 			freshTokens = append(freshTokens, tok)
 		} else {
-			a.logger.Debugf("token \"%s\" expired\n", tok.Token)
+			a.logger.Debugf("session \"%s\" expired\n", tok.ID)
 		}
 	}
 
@@ -1,6 +1,7 @@
 package auth
 
 import (
+	"io/ioutil"
 	"os"
 	"sort"
 	"sync"
@@ -8,6 +9,7 @@ import (
 	"time"
 
 	clog "github.com/ShoshinNikita/log/v2"
+	"github.com/stretchr/testify/assert"
 )
 
 func isEqual(a, b []string) bool {
@@ -37,7 +39,15 @@ func removeConfigFile(path string) {
 
 func toStringSlice(t []tokenStruct) (s []string) {
 	for _, tt := range t {
-		s = append(s, tt.Token)
+		s = append(s, tt.Hash)
+	}
+	return
+}
+
+// hashes returns checksums of passed tokens
+func hashes(tokens ...string) (s []string) {
+	for _, t := range tokens {
+		s = append(s, hashToken(t))
 	}
 	return
 }
@@ -48,12 +58,14 @@ func newAuth() *Auth {
 		TokensJSONFile: "tokens.json",
 		Encrypt:        false,
 		MaxTokenLife:   time.Hour,
+		SaveInterval:   time.Minute,
 	}
 
 	auth := &Auth{
 		config:     cnf,
 		mutex:      new(sync.RWMutex),
 		tokens:     originalTokens(),
+		now:        time.Now,
 		logger:     clog.NewProdLogger(),
 		shutdowned: make(chan struct{}),
 	}
@@ -65,41 +77,28 @@ func newAuth() *Auth {
 // originalTokens returns []tokenStruct. The function creates new slice every time.
 // It was created to not copy originalTokens every time
 func originalTokens() []tokenStruct {
+	now := time.Now()
+	expires := now.Add(time.Hour)
 	return []tokenStruct{
-		{Token: "123"},
-		{Token: "465"},
-		{Token: "789"},
-		{Token: "101"},
+		{Hash: hashToken("123"), ID: "a", UserID: 1, Created: now, Expires: expires},
+		{Hash: hashToken("465"), ID: "b", UserID: 2, Created: now, Expires: expires},
+		{Hash: hashToken("789"), ID: "c", UserID: 1, Created: now, Expires: expires},
+		{Hash: hashToken("101"), ID: "d", UserID: 2, Created: now, Expires: expires},
 	}
 }
 
 func TestAdd(t *testing.T) {
 	tt := newAuth()
 
-	tt.add("999")
-	answerSlice := []tokenStruct{
-		{Token: "123"},
-		{Token: "465"},
-		{Token: "789"},
-		{Token: "101"},
-		{Token: "999"},
-	}
-	want := toStringSlice(answerSlice)
+	tt.add("999", 1, "", "")
+	want := hashes("123", "465", "789", "101", "999")
 	got := toStringSlice(tt.tokens)
 	if !isEqual(want, got) {
 		t.Errorf("Wrong add result Want: %v Got: %v", want, got)
 	}
 
-	tt.add("15")
-	answerSlice = []tokenStruct{
-		{Token: "123"},
-		{Token: "465"},
-		{Token: "789"},
-		{Token: "101"},
-		{Token: "999"},
-		{Token: "15"},
-	}
-	want = toStringSlice(answerSlice)
+	tt.add("15", 1, "", "")
+	want = hashes("123", "465", "789", "101", "999", "15")
 	got = toStringSlice(tt.tokens)
 	if !isEqual(want, got) {
 		t.Errorf("Wrong add result Want: %v Got: %v", want, got)
@@ -113,49 +112,35 @@ func TestDelete(t *testing.T) {
 	tt := newAuth()
 
 	tt.delete("465")
-	answerSlice := []tokenStruct{
-		{Token: "123"},
-		{Token: "789"},
-		{Token: "101"},
-	}
-	want := toStringSlice(answerSlice)
+	want := hashes("123", "789", "101")
 	got := toStringSlice(tt.tokens)
 	if !isEqual(want, got) {
 		t.Errorf("Wrong delete result Want: %v Got: %v", want, got)
 	}
 
 	tt.delete("123")
-	answerSlice = []tokenStruct{
-		{Token: "789"},
-		{Token: "101"},
-	}
-	want = toStringSlice(answerSlice)
+	want = hashes("789", "101")
 	got = toStringSlice(tt.tokens)
 	if !isEqual(want, got) {
 		t.Errorf("Wrong delete result Want: %v Got: %v", want, got)
 	}
 
 	tt.delete("789")
-	answerSlice = []tokenStruct{
-		{Token: "101"},
-	}
-	want = toStringSlice(answerSlice)
+	want = hashes("101")
 	got = toStringSlice(tt.tokens)
 	if !isEqual(want, got) {
 		t.Errorf("Wrong delete result Want: %v Got: %v", want, got)
 	}
 
 	tt.delete("101")
-	answerSlice = []tokenStruct{}
-	want = toStringSlice(answerSlice)
+	want = hashes()
 	got = toStringSlice(tt.tokens)
 	if !isEqual(want, got) {
 		t.Errorf("Wrong delete result Want: %v Got: %v", want, got)
 	}
 
 	tt.delete("999")
-	answerSlice = []tokenStruct{}
-	want = toStringSlice(answerSlice)
+	want = hashes()
 	got = toStringSlice(tt.tokens)
 	if !isEqual(want, got) {
 		t.Errorf("Wrong delete result Want: %v Got: %v", want, got)
@@ -168,17 +153,41 @@ func TestDelete(t *testing.T) {
 func TestCheck(t *testing.T) {
 	tt := newAuth()
 
-	res := tt.check("15")
+	_, res := tt.check("15", "")
 	answerBool := false
 	if res != answerBool {
 		t.Errorf("Wrong check result Want: %v Got: %v", answerBool, res)
 	}
 
-	res = tt.check("123")
+	userID, res := tt.check("123", "")
 	answerBool = true
 	if res != answerBool {
 		t.Errorf("Wrong check result Want: %v Got: %v", answerBool, res)
 	}
+	if userID != 1 {
+		t.Errorf("Wrong owner of token Want: %v Got: %v", 1, userID)
+	}
+
+	tt.Shutdown()
+	removeConfigFile(tt.config.TokensJSONFile)
+}
+
+func TestDeleteUser(t *testing.T) {
+	tt := newAuth()
+
+	tt.deleteUser(2, "")
+	want := hashes("123", "789")
+	got := toStringSlice(tt.tokens)
+	if !isEqual(want, got) {
+		t.Errorf("Wrong deleteUser result Want: %v Got: %v", want, got)
+	}
+
+	tt.deleteUser(1, "789")
+	want = hashes("789")
+	got = toStringSlice(tt.tokens)
+	if !isEqual(want, got) {
+		t.Errorf("Wrong deleteUser result Want: %v Got: %v", want, got)
+	}
 
 	tt.Shutdown()
 	removeConfigFile(tt.config.TokensJSONFile)
@@ -192,22 +201,22 @@ func TestExpire(t *testing.T) {
 	}{
 		{
 			before: []tokenStruct{
-				{Token: "123", Expires: time.Now().AddDate(0, 0, -1)},
-				{Token: "456", Expires: time.Now().AddDate(0, -2, 0)},
-				{Token: "789", Expires: time.Now().AddDate(0, 0, 1)},
+				{Hash: hashToken("123"), Expires: time.Now().AddDate(0, 0, -1)},
+				{Hash: hashToken("456"), Expires: time.Now().AddDate(0, -2, 0)},
+				{Hash: hashToken("789"), Expires: time.Now().AddDate(0, 0, 1)},
 			},
 			after: []tokenStruct{
-				{Token: "789", Expires: time.Now().AddDate(0, 0, 1)},
+				{Hash: hashToken("789"), Expires: time.Now().AddDate(0, 0, 1)},
 			},
 		},
 		{
 			before: []tokenStruct{
-				{Token: "123", Expires: time.Now().AddDate(1, 2, -1)},
-				{Token: "456", Expires: time.Now().AddDate(0, -2, 0)},
-				{Token: "789", Expires: time.Now().AddDate(-3, 0, 1)},
+				{Hash: hashToken("123"), Expires: time.Now().AddDate(1, 2, -1)},
+				{Hash: hashToken("456"), Expires: time.Now().AddDate(0, -2, 0)},
+				{Hash: hashToken("789"), Expires: time.Now().AddDate(-3, 0, 1)},
 			},
 			after: []tokenStruct{
-				{Token: "123", Expires: time.Now().AddDate(1, 2, -1)},
+				{Hash: hashToken("123"), Expires: time.Now().AddDate(1, 2, -1)},
 			},
 		},
 	}
@@ -228,3 +237,107 @@ func TestExpire(t *testing.T) {
 	testTokens.Shutdown()
 	removeConfigFile(testTokens.config.TokensJSONFile)
 }
+
+func TestSlidingExpiry(t *testing.T) {
+	assert := assert.New(t)
+
+	tt := newAuth()
+	defer removeConfigFile(tt.config.TokensJSONFile)
+	defer tt.Shutdown()
+
+	now := time.Date(2019, 5, 1, 12, 0, 0, 0, time.UTC)
+	tt.now = func() time.Time { return now }
+	tt.config.MaxTokenLife = 10 * time.Hour
+	tt.config.IdleTokenLife = 3 * time.Hour
+
+	tt.add("token", 1, "10.0.0.1", "curl")
+	session, ok := tt.getSession("token")
+	if !assert.True(ok) {
+		return
+	}
+	assert.Equal(now.Add(3*time.Hour), session.Expires)
+	assert.Equal("10.0.0.1", session.IP)
+	assert.Equal("curl", session.UserAgent)
+
+	// Requests extend the session
+	for i := 0; i < 4; i++ {
+		now = now.Add(2 * time.Hour)
+		_, ok = tt.check("token", "10.0.0.2")
+		assert.True(ok)
+	}
+	session, _ = tt.getSession("token")
+	assert.Equal(now, session.LastSeen)
+	assert.Equal("10.0.0.2", session.IP)
+	assert.True(tt.used)
+
+	// MaxTokenLife is an absolute cap
+	assert.Equal(session.Created.Add(10*time.Hour), session.Expires)
+	now = now.Add(2 * time.Hour)
+	_, ok = tt.check("token", "")
+	assert.False(ok)
+
+	// Idle session
+	tt.add("idle", 1, "", "")
+	now = now.Add(3 * time.Hour)
+	_, ok = tt.check("idle", "")
+	assert.False(ok)
+}
+
+func TestSessions(t *testing.T) {
+	assert := assert.New(t)
+
+	tt := newAuth()
+	defer removeConfigFile(tt.config.TokensJSONFile)
+	defer tt.Shutdown()
+
+	sessions := tt.getSessions(1)
+	assert.Len(sessions, 2)
+
+	// Recently used sessions go first
+	_, ok := tt.check("789", "")
+	assert.True(ok)
+	sessions = tt.getSessions(1)
+	if assert.Len(sessions, 2) {
+		assert.Equal("c", sessions[0].ID)
+	}
+
+	// Sessions of other users can't be deleted
+	assert.Equal(ErrSessionNotExist, tt.deleteSession(1, "b"))
+	assert.Nil(tt.deleteSession(1, "c"))
+	_, ok = tt.check("789", "")
+	assert.False(ok)
+	assert.Len(tt.getSessions(1), 1)
+}
+
+func TestMigrate(t *testing.T) {
+	assert := assert.New(t)
+
+	const file = "tokens_old.json"
+	defer removeConfigFile(file)
+
+	expires := time.Now().Add(time.Hour).Round(0)
+	err := ioutil.WriteFile(file, []byte(`[{"token":"old-token","expire":"`+expires.Format(time.RFC3339Nano)+`"}]`), 0600)
+	if !assert.Nil(err) {
+		return
+	}
+
+	cnf := Config{TokensJSONFile: file, MaxTokenLife: 2 * time.Hour, SaveInterval: time.Minute, LegacyUserID: 1}
+	tt, err := NewAuthService(cnf, clog.NewProdLogger())
+	if !assert.Nil(err) {
+		return
+	}
+
+	// Raw tokens aren't stored
+	data, _ := ioutil.ReadFile(file)
+	assert.NotContains(string(data), "old-token")
+
+	userID, ok := tt.check("old-token", "")
+	assert.True(ok)
+	assert.Equal(1, userID)
+
+	session, _ := tt.getSession("old-token")
+	assert.NotEmpty(session.ID)
+	assert.True(session.Created.Equal(expires.Add(-2 * time.Hour)))
+
+	tt.Shutdown()
+}
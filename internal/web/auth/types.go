@@ -9,7 +9,27 @@ type Config struct {
 	Encrypt        bool
 	PassPhrase     [32]byte
 
+	// MaxTokenLife is an absolute lifetime of a session
 	MaxTokenLife time.Duration
+	// IdleTokenLife is a lifetime of a session without requests. Every request extends the session,
+	// but not longer than MaxTokenLife. Zero means sessions expire only after MaxTokenLife
+	IdleTokenLife time.Duration
+	// SaveInterval is an interval of saving last usage of sessions
+	SaveInterval time.Duration
+
+	// LegacyUserID is an owner of tokens, which were created before users were added
+	LegacyUserID int
+}
+
+// Session contains info about an auth token. The token itself isn't stored
+type Session struct {
+	ID        string    `json:"id"`
+	UserID    int       `json:"userID"`
+	Created   time.Time `json:"created"`
+	LastSeen  time.Time `json:"lastSeen"`
+	Expires   time.Time `json:"expires"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"userAgent"`
 }
 
 // AuthServiceInterface provides methods for auth users
@@ -18,17 +38,31 @@ type AuthServiceInterface interface {
 	StartBackgroundServices()
 
 	// GenerateToken generates a new token. GenerateToken doesn't add new token, just return it!
-	GenerateToken() string
+	GenerateToken() (string, error)
+
+	// AddToken adds passed token of a user into storage. ip and userAgent are saved as session info
+	AddToken(token string, userID int, ip, userAgent string)
 
-	// AddToken adds passed token into storage
-	AddToken(token string)
+	// CheckToken returns an id of the owner of a token and true, if token is in storage and isn't expired.
+	// It extends the session
+	CheckToken(token, ip string) (userID int, ok bool)
 
-	// CheckToken returns true if token is in storage
-	CheckToken(token string) bool
+	// GetSession returns a session of passed token
+	GetSession(token string) (Session, bool)
+
+	// GetSessions returns active sessions of a user. Recently used sessions go first
+	GetSessions(userID int) []Session
 
 	// DeleteToken deletes token from a storage
 	DeleteToken(token string)
 
-	// Shutdown gracefully shutdown FileStorage
+	// DeleteSession deletes a session of a user by its id. It returns ErrSessionNotExist,
+	// if the user has no such session
+	DeleteSession(userID int, id string) error
+
+	// DeleteUserTokens deletes all tokens of a user except passed one (it can be empty)
+	DeleteUserTokens(userID int, except string)
+
+	// Shutdown saves last usage of sessions
 	Shutdown() error
 }
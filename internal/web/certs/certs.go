@@ -0,0 +1,199 @@
+// Package certs loads TLS certificates and reloads them without a restart
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	clog "github.com/ShoshinNikita/log/v2"
+	"github.com/pkg/errors"
+)
+
+type Certs struct {
+	config Config
+
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool // nil, if client certificates aren't requested
+	// modTimes contains modification times of files on the last reload
+	modTimes map[string]time.Time
+	mutex    *sync.RWMutex
+
+	// this channel signals that Certs.Shutdown() function was called
+	shutdowned chan struct{}
+
+	logger *clog.Logger
+}
+
+// NewCerts creates new Certs and loads certificates
+func NewCerts(cnf Config, lg *clog.Logger) (*Certs, error) {
+	c := &Certs{
+		config:     cnf,
+		modTimes:   make(map[string]time.Time),
+		mutex:      new(sync.RWMutex),
+		shutdowned: make(chan struct{}),
+		logger:     lg,
+	}
+
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *Certs) StartBackgroundServices() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	go func() {
+		var check <-chan time.Time
+		if c.config.CheckInterval > 0 {
+			ticker := time.NewTicker(c.config.CheckInterval)
+			defer ticker.Stop()
+			check = ticker.C
+		}
+
+		for {
+			select {
+			case <-hup:
+				c.logger.Infoln("SIGHUP: reload TLS certificates")
+				c.reloadLogged()
+			case <-check:
+				if c.changed() {
+					c.logger.Infoln("TLS certificates were changed, reload them")
+					c.reloadLogged()
+				}
+			case <-c.shutdowned:
+				signal.Stop(hup)
+				return
+			}
+		}
+	}()
+}
+
+func (c *Certs) TLSConfig() *tls.Config {
+	cnf := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: c.getCertificate,
+	}
+
+	if c.config.ClientCAFile != "" {
+		// CAs can be reloaded, so the config is created for every connection
+		cnf.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			c.mutex.RLock()
+			defer c.mutex.RUnlock()
+
+			clientAuth := tls.VerifyClientCertIfGiven
+			if c.config.ClientCertRequired {
+				clientAuth = tls.RequireAndVerifyClientCert
+			}
+
+			return &tls.Config{
+				MinVersion:     tls.VersionTLS12,
+				GetCertificate: c.getCertificate,
+				ClientAuth:     clientAuth,
+				ClientCAs:      c.clientCAs,
+			}, nil
+		}
+	}
+
+	return cnf
+}
+
+func (c *Certs) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return c.cert, nil
+}
+
+func (c *Certs) Reload() error {
+	// Remember modification times before reading, so changes during the reload aren't missed
+	modTimes := c.readModTimes()
+
+	c.mutex.Lock()
+	c.modTimes = modTimes
+	c.mutex.Unlock()
+
+	cert, err := tls.LoadX509KeyPair(c.config.CertFile, c.config.KeyFile)
+	if err != nil {
+		return errors.Wrap(err, "can't load TLS certificate")
+	}
+
+	var clientCAs *x509.CertPool
+	if c.config.ClientCAFile != "" {
+		data, err := ioutil.ReadFile(c.config.ClientCAFile)
+		if err != nil {
+			return errors.Wrapf(err, "can't read file %s", c.config.ClientCAFile)
+		}
+
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(data) {
+			return errors.Errorf("file %s doesn't contain PEM certificates", c.config.ClientCAFile)
+		}
+	}
+
+	c.mutex.Lock()
+	c.cert = &cert
+	c.clientCAs = clientCAs
+	c.mutex.Unlock()
+
+	c.logger.Debugln("TLS certificates were loaded")
+
+	return nil
+}
+
+// reloadLogged calls Reload and logs an error. The old certificates are used, if the new ones are invalid
+func (c *Certs) reloadLogged() {
+	if err := c.Reload(); err != nil {
+		c.logger.Errorf("can't reload TLS certificates, the old ones are used: %s\n", err)
+		return
+	}
+	c.logger.Infoln("TLS certificates were reloaded")
+}
+
+func (c *Certs) files() []string {
+	files := []string{c.config.CertFile, c.config.KeyFile}
+	if c.config.ClientCAFile != "" {
+		files = append(files, c.config.ClientCAFile)
+	}
+	return files
+}
+
+// readModTimes returns modification times of files. Missing files have zero time
+func (c *Certs) readModTimes() map[string]time.Time {
+	modTimes := make(map[string]time.Time)
+	for _, file := range c.files() {
+		if info, err := os.Stat(file); err == nil {
+			modTimes[file] = info.ModTime()
+		}
+	}
+	return modTimes
+}
+
+// changed returns true, if any file was changed after the last reload. A certificate and a key
+// can be replaced one by one, so a failed reload is retried after the next change
+func (c *Certs) changed() bool {
+	modTimes := c.readModTimes()
+
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	for _, file := range c.files() {
+		if !modTimes[file].Equal(c.modTimes[file]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Certs) Shutdown() error {
+	close(c.shutdowned)
+	return nil
+}
@@ -0,0 +1,163 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	clog "github.com/ShoshinNikita/log/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+// writeCert generates a self-signed certificate and writes it with its key into files
+func writeCert(t *testing.T, certFile, keyFile, name string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keyFile == "" {
+		return
+	}
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newTestConfig(t *testing.T) (cnf Config, clean func()) {
+	dir, err := ioutil.TempDir("", "certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cnf = Config{
+		CertFile: filepath.Join(dir, "cert.cert"),
+		KeyFile:  filepath.Join(dir, "key.key"),
+	}
+	writeCert(t, cnf.CertFile, cnf.KeyFile, "first")
+
+	return cnf, func() { os.RemoveAll(dir) }
+}
+
+// commonName returns CN of the current certificate
+func commonName(t *testing.T, c *Certs) string {
+	cert, err := c.TLSConfig().GetCertificate(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.Subject.CommonName
+}
+
+func TestReload(t *testing.T) {
+	assert := assert.New(t)
+
+	cnf, clean := newTestConfig(t)
+	defer clean()
+
+	c, err := NewCerts(cnf, clog.NewProdLogger())
+	if !assert.Nil(err) {
+		return
+	}
+	assert.Equal("first", commonName(t, c))
+	assert.False(c.changed())
+	assert.Nil(c.TLSConfig().GetConfigForClient)
+
+	// New certificate
+	writeCert(t, cnf.CertFile, cnf.KeyFile, "second")
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(cnf.CertFile, future, future)
+
+	assert.True(c.changed())
+	assert.Nil(c.Reload())
+	assert.False(c.changed())
+	assert.Equal("second", commonName(t, c))
+
+	// The old certificate is kept, if the new one is invalid
+	ioutil.WriteFile(cnf.KeyFile, []byte("invalid key"), 0600)
+	assert.NotNil(c.Reload())
+	assert.Equal("second", commonName(t, c))
+	// The failed reload isn't retried until the next change
+	assert.False(c.changed())
+
+	// Invalid certificates can't be loaded on start
+	_, err = NewCerts(cnf, clog.NewProdLogger())
+	assert.NotNil(err)
+}
+
+func TestClientCA(t *testing.T) {
+	assert := assert.New(t)
+
+	cnf, clean := newTestConfig(t)
+	defer clean()
+
+	cnf.ClientCAFile = filepath.Join(filepath.Dir(cnf.CertFile), "ca.cert")
+
+	// There's no file
+	_, err := NewCerts(cnf, clog.NewProdLogger())
+	assert.NotNil(err)
+
+	ioutil.WriteFile(cnf.ClientCAFile, []byte("not a certificate"), 0600)
+	_, err = NewCerts(cnf, clog.NewProdLogger())
+	assert.NotNil(err)
+
+	writeCert(t, cnf.ClientCAFile, "", "ca")
+
+	for _, required := range []bool{false, true} {
+		cnf.ClientCertRequired = required
+
+		c, err := NewCerts(cnf, clog.NewProdLogger())
+		if !assert.Nil(err) {
+			return
+		}
+
+		getConfig := c.TLSConfig().GetConfigForClient
+		if !assert.NotNil(getConfig) {
+			return
+		}
+		tlsConfig, err := getConfig(&tls.ClientHelloInfo{})
+		assert.Nil(err)
+		assert.NotNil(tlsConfig.ClientCAs)
+		if required {
+			assert.Equal(tls.RequireAndVerifyClientCert, tlsConfig.ClientAuth)
+		} else {
+			assert.Equal(tls.VerifyClientCertIfGiven, tlsConfig.ClientAuth)
+		}
+	}
+}
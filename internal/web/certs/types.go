@@ -0,0 +1,38 @@
+package certs
+
+import (
+	"crypto/tls"
+	"time"
+)
+
+type Config struct {
+	Debug bool
+
+	CertFile string
+	KeyFile  string
+
+	// ClientCAFile contains PEM certificates of CAs, which sign client certificates.
+	// Empty means client certificates aren't requested
+	ClientCAFile string
+	// ClientCertRequired means connections without a valid client certificate are rejected.
+	// Otherwise a client certificate is optional
+	ClientCertRequired bool
+
+	// CheckInterval is an interval of checking files for changes. 0 means files are reloaded only on SIGHUP
+	CheckInterval time.Duration
+}
+
+// CertsInterface provides TLS certificates, which can be changed without a restart
+type CertsInterface interface {
+	// StartBackgroundServices starts reloading of certificates on SIGHUP and on changes of files
+	StartBackgroundServices()
+
+	// TLSConfig returns a config for a TLS listener. It always uses the last loaded certificates
+	TLSConfig() *tls.Config
+
+	// Reload reads certificates again. The old certificates are kept, if new ones are invalid
+	Reload() error
+
+	// Shutdown stops background services
+	Shutdown() error
+}
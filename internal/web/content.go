@@ -0,0 +1,251 @@
+package web
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	filesPck "github.com/tags-drive/core/internal/storage/files"
+	"github.com/tags-drive/core/internal/storage/files/extensions"
+)
+
+// contentSecurityPolicy is set for all uploaded files. Even if a browser renders a file as a document,
+// scripts can't be run and the document gets a unique origin without access to cookies
+const contentSecurityPolicy = "sandbox; default-src 'none'; img-src 'self' data:; media-src 'self'; style-src 'unsafe-inline'"
+
+const textContentType = "text/plain; charset=utf-8"
+
+// inlineTypes are content types of files, which can be shown by a browser safely
+var inlineTypes = map[string]string{
+	".bmp":  "image/bmp",
+	".gif":  "image/gif",
+	".ico":  "image/x-icon",
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".png":  "image/png",
+	".webp": "image/webp",
+	//
+	".mp3": "audio/mpeg",
+	".ogg": "audio/ogg",
+	".wav": "audio/wav",
+	//
+	".mp4":  "video/mp4",
+	".webm": "video/webm",
+}
+
+// activeTypes are content types of files, which can run scripts. They are always downloaded.
+// Documents are served as plain text, so the text preview still works
+var activeTypes = map[string]string{
+	".svg":   "image/svg+xml", // <img> ignores Content-Disposition, so images are still shown
+	".html":  textContentType,
+	".htm":   textContentType,
+	".xhtml": textContentType,
+	".xml":   textContentType,
+	".xsl":   textContentType,
+	".js":    textContentType,
+	".mjs":   textContentType,
+}
+
+// contentHeaders returns Content-Type of a file and whether it must be downloaded
+func contentHeaders(file filesPck.File) (contentType string, attachment bool) {
+	if file.ClientEncrypted {
+		return "application/octet-stream", true
+	}
+
+	ext := strings.ToLower(filepath.Ext(file.Filename))
+
+	if contentType, ok := activeTypes[ext]; ok {
+		return contentType, true
+	}
+	if contentType, ok := inlineTypes[ext]; ok {
+		return contentType, false
+	}
+
+	switch file.Type.FileType {
+	case extensions.FileTypeText, extensions.FileTypeLanguage:
+		return textContentType, false
+	default:
+		return "application/octet-stream", true
+	}
+}
+
+// safeContentMiddleware sets headers, which don't allow uploaded files to run scripts on the drive origin:
+// Content-Type isn't sniffed, active content is sandboxed and downloaded. Path is "{id}" or "resized/{id}"
+func (s Server) safeContentMiddleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(path.Base(r.URL.Path))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		file, err := s.fileStorage.GetFile(id)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		contentType, attachment := contentHeaders(file)
+
+		header := w.Header()
+		header.Set("X-Content-Type-Options", "nosniff")
+		header.Set("Content-Security-Policy", contentSecurityPolicy)
+		// http.FileServer doesn't sniff content, if Content-Type is set
+		header.Set("Content-Type", contentType)
+
+		if attachment {
+			filename := file.Filename
+			if file.ClientEncrypted {
+				filename = fmt.Sprintf("%d.encrypted", file.ID)
+			}
+
+			disposition := mime.FormatMediaType("attachment", map[string]string{"filename": filename})
+			if disposition == "" {
+				disposition = "attachment"
+			}
+			header.Set("Content-Disposition", disposition)
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// cleanParam is a query param, which enables removing of metadata
+const cleanParam = "clean"
+
+// setCleanedHeader sets ids of files, which metadata was removed. Header is set even if
+// there are no cleaned files
+func setCleanedHeader(w http.ResponseWriter, ids ...int) {
+	w.Header().Set("X-Cleaned-Files", joinInts(ids))
+}
+
+// joinInts returns ids separated by comma
+func joinInts(ids []int) string {
+	strIDs := make([]string, 0, len(ids))
+	for _, id := range ids {
+		strIDs = append(strIDs, strconv.Itoa(id))
+	}
+	return strings.Join(strIDs, ",")
+}
+
+// cleanMiddleware removes metadata from an original file, if "clean=true". Previews don't contain metadata.
+// Path is "{id}" or "resized/{id}"
+func (s Server) cleanMiddleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue(cleanParam) != "true" || strings.Contains(r.URL.Path, "/") {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		id, err := strconv.Atoi(r.URL.Path)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		file, err := s.fileStorage.GetFile(id)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		body, cleaned, err := s.fileStorage.Export(file, filesPck.ExportOptions{StripMetadata: true})
+		if err != nil {
+			s.processError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer body.Close()
+
+		if cleaned {
+			setCleanedHeader(w, file.ID)
+		} else {
+			setCleanedHeader(w)
+		}
+
+		if _, err := io.Copy(w, body); err != nil {
+			s.logger.Errorf("can't copy file to response body: %s\n", err)
+		}
+	})
+}
+
+// signedPath returns a path of an uploaded file with options, which are signed for the content origin
+func signedPath(r *http.Request) string {
+	if r.FormValue(cleanParam) == "true" {
+		return r.URL.Path + "?" + cleanParam + "=true"
+	}
+	return r.URL.Path
+}
+
+// contentRedirectHandler redirects requests of uploaded files to the content origin with signed links.
+// It is used instead of the file server, if the content origin is set. Path is "{id}" or "resized/{id}"
+func (s Server) contentRedirectHandler() http.Handler {
+	maxAge := fmt.Sprintf("private, max-age=%d", int64(s.config.ContentTokenLife/time.Second))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(path.Base(r.URL.Path))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		if _, err := s.fileStorage.GetFile(id); err != nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		query := s.signer.Sign(signedPath(r))
+		if r.FormValue(cleanParam) == "true" {
+			query.Set(cleanParam, "true")
+		}
+		link := s.config.ContentOrigin + "/data/" + r.URL.Path + "?" + query.Encode()
+
+		// Links are valid at least ContentTokenLife
+		w.Header().Set("Cache-Control", maxAge)
+		http.Redirect(w, r, link, http.StatusFound)
+	})
+}
+
+// contentHandler returns a handler of the content origin. It serves only uploaded files with valid signed links
+func (s *Server) contentHandler() http.Handler {
+	filesHandler := s.safeContentMiddleware(s.cleanMiddleware(s.decryptMiddleware(http.Dir(s.config.DataFolder + "/"))))
+
+	checkLink := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.signer.Check(signedPath(r), r.URL.Query()) {
+			s.processError(w, "invalid or expired link", http.StatusForbidden)
+			return
+		}
+
+		// Text previews are loaded with fetch() after the redirect from the drive origin
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Expose-Headers", "X-Cleaned-Files")
+
+		filesHandler.ServeHTTP(w, r)
+	})
+
+	maxAge := int64(2 * s.config.ContentTokenLife / time.Second)
+
+	mux := http.NewServeMux()
+	mux.Handle("/data/", cacheMiddleware(http.StripPrefix("/data/", hideDotFilesMiddleware(checkLink)), maxAge))
+
+	return mux
+}
+
+// startContentServer starts the server of the content origin
+func (s *Server) startContentServer() {
+	s.contentServer = &http.Server{Addr: s.config.ContentPort, Handler: s.contentHandler()}
+
+	go func() {
+		s.logger.Debugln("start content server")
+
+		// http.ErrServerClosed is a valid error
+		if err := listenAndServe(s.contentServer, s.certs); err != nil && err != http.ErrServerClosed {
+			s.logger.Errorf("content server error: %s\n", err)
+		}
+	}()
+}
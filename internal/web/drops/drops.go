@@ -0,0 +1,356 @@
+// Package drops keeps drop links. Drop links allow anonymous users to upload files, which are reviewed later
+package drops
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	clog "github.com/ShoshinNikita/log/v2"
+	"github.com/pkg/errors"
+
+	"github.com/tags-drive/core/internal/storage/encryption"
+)
+
+const slugSize = 16
+
+// Upper limits of drop links. The upload size of a link (MaxFileSize * MaxFiles) must fit into int64
+const (
+	MaxFileSizeLimit int64 = 10 << 30 // 10GB
+	MaxFilesLimit          = 1000
+)
+
+// Errors
+var (
+	ErrDropNotExist   = errors.New("drop link doesn't exist")
+	ErrInvalidLimit   = errors.New("max file size must be in (0, 10GB], max number of files must be in (0, 1000]")
+	ErrExpired        = errors.New("expiry time must be in the future")
+	ErrInvalidType    = errors.New("allowed types must be extensions, for example \".pdf\"")
+	ErrNoUploadsLeft  = errors.New("upload limit is reached")
+	ErrTypeNotAllowed = errors.New("file type isn't allowed")
+	ErrFileTooLarge   = errors.New("file is too large")
+)
+
+type Drops struct {
+	config Config
+	file   encryption.JSONFile
+
+	drops map[int]Drop
+	// slugs maps slugs to ids of drop links
+	slugs map[string]int
+	maxID int
+	mutex *sync.RWMutex
+
+	now func() time.Time
+
+	// this channel signals that Drops.Shutdown() function was called
+	shutdowned chan struct{}
+
+	logger *clog.Logger
+}
+
+// NewDrops creates new Drops and reads drop links from DropsJSONFile
+func NewDrops(cnf Config, lg *clog.Logger) (*Drops, error) {
+	d := &Drops{
+		config: cnf,
+		file: encryption.JSONFile{
+			Path:    cnf.DropsJSONFile,
+			Encrypt: cnf.Encrypt,
+			Key:     cnf.PassPhrase,
+			Indent:  cnf.Debug,
+		},
+		drops:      make(map[int]Drop),
+		slugs:      make(map[string]int),
+		mutex:      new(sync.RWMutex),
+		now:        time.Now,
+		shutdowned: make(chan struct{}),
+		logger:     lg,
+	}
+
+	var list []Drop
+	if _, err := d.file.Read(&list); err != nil {
+		return nil, err
+	}
+
+	for _, drop := range list {
+		d.drops[drop.ID] = drop
+		d.slugs[drop.Slug] = drop.ID
+		if d.maxID < drop.ID {
+			d.maxID = drop.ID
+		}
+	}
+
+	return d, nil
+}
+
+func (d *Drops) StartBackgroundServices() {
+	// Remove expired drop links
+	go func() {
+		ticker := time.NewTicker(d.config.CheckInterval)
+		for {
+			select {
+			case <-ticker.C:
+				d.mutex.Lock()
+				if d.expire() {
+					if err := d.write(); err != nil {
+						d.logger.Errorln(err)
+					}
+				}
+				d.mutex.Unlock()
+			case <-d.shutdowned:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+}
+
+// expire removes expired drop links and returns true, if any link was removed. It must be called under the lock
+func (d *Drops) expire() (removed bool) {
+	now := d.now()
+
+	for id, drop := range d.drops {
+		if drop.IsExpired(now) {
+			d.delete(drop)
+			removed = true
+			d.logger.Debugf("drop link %d is expired\n", id)
+		}
+	}
+	return removed
+}
+
+// write writes drop links into DropsJSONFile. It must be called under the lock
+func (d *Drops) write() error {
+	if err := d.file.Write(d.getAll(0)); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// normalizeTypes returns lowercase extensions with leading dot without duplicates
+func normalizeTypes(types []string) ([]string, error) {
+	res := make([]string, 0, len(types))
+	seen := make(map[string]struct{}, len(types))
+	for _, t := range types {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t == "" {
+			continue
+		}
+		if t[0] != '.' {
+			t = "." + t
+		}
+		if len(t) == 1 || strings.ContainsAny(t[1:], "./\\ ") {
+			return nil, ErrInvalidType
+		}
+
+		if _, ok := seen[t]; !ok {
+			seen[t] = struct{}{}
+			res = append(res, t)
+		}
+	}
+	return res, nil
+}
+
+func (d *Drops) Create(drop Drop) (Drop, error) {
+	switch {
+	case drop.MaxFileSize <= 0 || drop.MaxFileSize > MaxFileSizeLimit,
+		drop.MaxFiles <= 0 || drop.MaxFiles > MaxFilesLimit:
+		return Drop{}, ErrInvalidLimit
+	case !drop.Expires.After(d.now()):
+		return Drop{}, ErrExpired
+	}
+
+	types, err := normalizeTypes(drop.AllowedTypes)
+	if err != nil {
+		return Drop{}, err
+	}
+
+	raw := make([]byte, slugSize)
+	if _, err := rand.Read(raw); err != nil {
+		return Drop{}, errors.Wrap(err, "can't generate slug")
+	}
+
+	drop.Name = strings.TrimSpace(drop.Name)
+	drop.Slug = base64.RawURLEncoding.EncodeToString(raw)
+	drop.AllowedTypes = types
+	if drop.Tags == nil {
+		drop.Tags = []int{}
+	}
+	drop.Uploads = 0
+	drop.LastUpload = time.Time{}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.maxID++
+	drop.ID = d.maxID
+	drop.Created = d.now()
+
+	d.drops[drop.ID] = drop
+	d.slugs[drop.Slug] = drop.ID
+
+	if err := d.write(); err != nil {
+		delete(d.drops, drop.ID)
+		delete(d.slugs, drop.Slug)
+		return Drop{}, err
+	}
+
+	return drop, nil
+}
+
+func (d *Drops) Get(id int) (Drop, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	drop, ok := d.drops[id]
+	if !ok {
+		return Drop{}, ErrDropNotExist
+	}
+	return drop, nil
+}
+
+func (d *Drops) GetBySlug(slug string) (Drop, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	id, ok := d.slugs[slug]
+	if !ok {
+		return Drop{}, ErrDropNotExist
+	}
+
+	drop := d.drops[id]
+	if drop.IsExpired(d.now()) {
+		return Drop{}, ErrDropNotExist
+	}
+	return drop, nil
+}
+
+func (d *Drops) GetAll(userID int) []Drop {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	return d.getAll(userID)
+}
+
+func (d *Drops) getAll(userID int) []Drop {
+	res := make([]Drop, 0, len(d.drops))
+	for _, drop := range d.drops {
+		if userID == 0 || drop.UserID == userID {
+			res = append(res, drop)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+
+	return res
+}
+
+func (d *Drops) CountUpload(id int) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	drop, ok := d.drops[id]
+	if !ok || drop.IsExpired(d.now()) {
+		return ErrDropNotExist
+	}
+	if drop.FilesLeft() == 0 {
+		return ErrNoUploadsLeft
+	}
+
+	drop.Uploads++
+	drop.LastUpload = d.now()
+	d.drops[id] = drop
+
+	// Save right away, so the limit can't be bypassed with a restart
+	return d.write()
+}
+
+func (d *Drops) UncountUpload(id int) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	drop, ok := d.drops[id]
+	if !ok {
+		return ErrDropNotExist
+	}
+	if drop.Uploads == 0 {
+		return nil
+	}
+
+	drop.Uploads--
+	d.drops[id] = drop
+
+	return d.write()
+}
+
+func (d *Drops) Delete(id int) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	drop, ok := d.drops[id]
+	if !ok {
+		return ErrDropNotExist
+	}
+	d.delete(drop)
+
+	return d.write()
+}
+
+// delete deletes a drop link. It must be called under the lock
+func (d *Drops) delete(drop Drop) {
+	delete(d.drops, drop.ID)
+	delete(d.slugs, drop.Slug)
+}
+
+func (d *Drops) DeleteUserDrops(userID int) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	deleted := false
+	for _, drop := range d.drops {
+		if drop.UserID == userID {
+			d.delete(drop)
+			deleted = true
+		}
+	}
+
+	if deleted {
+		if err := d.write(); err != nil {
+			d.logger.Errorln(err)
+		}
+	}
+}
+
+func (d *Drops) DeleteTag(tagID int) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	changed := false
+	for id, drop := range d.drops {
+		tags := make([]int, 0, len(drop.Tags))
+		for _, t := range drop.Tags {
+			if t != tagID {
+				tags = append(tags, t)
+			}
+		}
+		if len(tags) != len(drop.Tags) {
+			drop.Tags = tags
+			d.drops[id] = drop
+			changed = true
+		}
+	}
+
+	if changed {
+		if err := d.write(); err != nil {
+			d.logger.Errorln(err)
+		}
+	}
+}
+
+func (d *Drops) Shutdown() error {
+	close(d.shutdowned)
+	return nil
+}
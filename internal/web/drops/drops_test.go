@@ -0,0 +1,203 @@
+package drops
+
+import (
+	"testing"
+	"time"
+
+	clog "github.com/ShoshinNikita/log/v2"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/tags-drive/core/internal/storage/encryption/encryptiontest"
+)
+
+func newTestDrops(t *testing.T, encrypt bool) (*Drops, func()) {
+	path, clean := encryptiontest.TempFile(t, "drops.json")
+
+	cnf := Config{
+		DropsJSONFile: path,
+		Encrypt:       encrypt,
+		PassPhrase:    encryptiontest.Key,
+		CheckInterval: time.Minute,
+	}
+	drops, err := NewDrops(cnf, clog.NewProdLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return drops, clean
+}
+
+func TestCreate(t *testing.T) {
+	assert := assert.New(t)
+
+	drops, clean := newTestDrops(t, true)
+	defer clean()
+
+	now := time.Date(2019, 5, 1, 12, 0, 0, 0, time.UTC)
+	drops.now = func() time.Time { return now }
+
+	valid := Drop{MaxFileSize: 1 << 20, MaxFiles: 5, Expires: now.Add(time.Hour)}
+
+	// Errors
+	drop := valid
+	drop.MaxFileSize = 0
+	_, err := drops.Create(drop)
+	assert.Equal(ErrInvalidLimit, err)
+
+	drop = valid
+	drop.MaxFiles = -1
+	_, err = drops.Create(drop)
+	assert.Equal(ErrInvalidLimit, err)
+
+	// Limits are bounded, so the upload size of a link can't overflow
+	drop = valid
+	drop.MaxFileSize = MaxFileSizeLimit + 1
+	_, err = drops.Create(drop)
+	assert.Equal(ErrInvalidLimit, err)
+
+	drop = valid
+	drop.MaxFiles = MaxFilesLimit + 1
+	_, err = drops.Create(drop)
+	assert.Equal(ErrInvalidLimit, err)
+
+	drop = valid
+	drop.MaxFileSize = 1 << 62
+	drop.MaxFiles = 4
+	_, err = drops.Create(drop)
+	assert.Equal(ErrInvalidLimit, err)
+
+	drop = valid
+	drop.Expires = time.Time{}
+	_, err = drops.Create(drop)
+	assert.Equal(ErrExpired, err)
+
+	drop = valid
+	drop.AllowedTypes = []string{"tar.gz"}
+	_, err = drops.Create(drop)
+	assert.Equal(ErrInvalidType, err)
+
+	// Valid links
+	drop = valid
+	drop.UserID = 1
+	drop.Name = " Invoices "
+	drop.Tags = []int{1, 2}
+	drop.AllowedTypes = []string{"PDF", ".jpg", " ", ".pdf"}
+	drop.Uploads = 10
+	first, err := drops.Create(drop)
+	if !assert.Nil(err) {
+		return
+	}
+	second, err := drops.Create(Drop{UserID: 2, MaxFileSize: 1, MaxFiles: 1, Expires: now.Add(time.Minute)})
+	if !assert.Nil(err) {
+		return
+	}
+
+	assert.Equal(1, first.ID)
+	assert.Equal("Invoices", first.Name)
+	assert.Equal([]string{".pdf", ".jpg"}, first.AllowedTypes)
+	assert.Equal(0, first.Uploads)
+	assert.Equal(5, first.FilesLeft())
+	assert.Equal(now, first.Created)
+	assert.Equal([]int{}, second.Tags)
+	assert.NotEqual(first.Slug, second.Slug)
+
+	got, err := drops.GetBySlug(first.Slug)
+	assert.Nil(err)
+	assert.Equal(first, got)
+
+	assert.Len(drops.GetAll(0), 2)
+	assert.Equal([]Drop{second}, drops.GetAll(2))
+
+	// Expired link
+	now = now.Add(time.Minute)
+	_, err = drops.GetBySlug(second.Slug)
+	assert.Equal(ErrDropNotExist, err)
+	assert.Equal(ErrDropNotExist, drops.CountUpload(second.ID))
+
+	assert.True(drops.expire())
+	assert.False(drops.expire())
+	_, err = drops.Get(second.ID)
+	assert.Equal(ErrDropNotExist, err)
+
+	// Persistence
+	assert.Nil(drops.write())
+	drops, err = NewDrops(drops.config, clog.NewProdLogger())
+	if !assert.Nil(err) {
+		return
+	}
+	assert.Equal([]Drop{first}, drops.GetAll(0))
+
+	// Max limits
+	drop = valid
+	drop.MaxFileSize = MaxFileSizeLimit
+	drop.MaxFiles = MaxFilesLimit
+	drop.Expires = time.Now().Add(time.Hour)
+	maxDrop, err := drops.Create(drop)
+	if assert.Nil(err) {
+		assert.True(maxDrop.MaxFileSize*int64(maxDrop.FilesLeft()) > 0)
+	}
+}
+
+func TestIsAllowed(t *testing.T) {
+	assert := assert.New(t)
+
+	drop := Drop{AllowedTypes: []string{".pdf", ".jpg"}}
+	assert.True(drop.IsAllowed("invoice.pdf"))
+	assert.True(drop.IsAllowed("photo.JPG"))
+	assert.False(drop.IsAllowed("photo.jpeg"))
+	assert.False(drop.IsAllowed("pdf"))
+	assert.False(drop.IsAllowed("script.pdf.exe"))
+
+	drop = Drop{}
+	assert.True(drop.IsAllowed("script.exe"))
+	assert.True(drop.IsAllowed("README"))
+}
+
+func TestCountUpload(t *testing.T) {
+	assert := assert.New(t)
+
+	drops, clean := newTestDrops(t, false)
+	defer clean()
+
+	expires := time.Now().Add(time.Hour)
+	drop, err := drops.Create(Drop{UserID: 1, Tags: []int{1, 2}, MaxFileSize: 100, MaxFiles: 2, Expires: expires})
+	assert.Nil(err)
+	other, err := drops.Create(Drop{UserID: 2, Tags: []int{2}, MaxFileSize: 100, MaxFiles: 2, Expires: expires})
+	assert.Nil(err)
+
+	assert.Nil(drops.CountUpload(drop.ID))
+	assert.Nil(drops.CountUpload(drop.ID))
+	assert.Equal(ErrNoUploadsLeft, drops.CountUpload(drop.ID))
+
+	// A failed upload returns its place
+	assert.Nil(drops.UncountUpload(drop.ID))
+	got, _ := drops.Get(drop.ID)
+	assert.Equal(1, got.FilesLeft())
+	assert.Nil(drops.CountUpload(drop.ID))
+	assert.Nil(drops.UncountUpload(other.ID))
+	got, _ = drops.Get(other.ID)
+	assert.Equal(0, got.Uploads)
+
+	// Uploads are saved right away
+	reopened, err := NewDrops(drops.config, clog.NewProdLogger())
+	if assert.Nil(err) {
+		got, _ := reopened.Get(drop.ID)
+		assert.Equal(2, got.Uploads)
+		assert.Equal(0, got.FilesLeft())
+	}
+
+	drops.DeleteTag(2)
+	drop, _ = drops.Get(drop.ID)
+	assert.Equal([]int{1}, drop.Tags)
+	other, _ = drops.Get(other.ID)
+	assert.Equal([]int{}, other.Tags)
+
+	drops.DeleteUserDrops(1)
+	_, err = drops.Get(drop.ID)
+	assert.Equal(ErrDropNotExist, err)
+	assert.Len(drops.GetAll(0), 1)
+
+	assert.Equal(ErrDropNotExist, drops.Delete(drop.ID))
+	assert.Nil(drops.Delete(other.ID))
+	assert.Empty(drops.GetAll(0))
+}
@@ -0,0 +1,110 @@
+package drops
+
+import (
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type Config struct {
+	Debug bool
+
+	DropsJSONFile string
+	Encrypt       bool
+	PassPhrase    [32]byte
+
+	// CheckInterval is an interval of removing expired drop links
+	CheckInterval time.Duration
+}
+
+// Drop is a link, which allows anonymous users to upload files. Uploaded files are pending
+// until a user accepts them
+type Drop struct {
+	ID int `json:"id"`
+	// Slug is a random part of the link
+	Slug   string `json:"slug"`
+	UserID int    `json:"userID"`
+	Name   string `json:"name"`
+
+	// Tags are added to all uploaded files
+	Tags []int `json:"tags"`
+	// MaxFileSize is a max size of an uploaded file in bytes
+	MaxFileSize int64 `json:"maxFileSize"`
+	// MaxFiles is a max number of files, which can be uploaded via the link
+	MaxFiles int `json:"maxFiles"`
+	// AllowedTypes are lowercase extensions with leading dot. Empty list means all types are allowed
+	AllowedTypes []string `json:"allowedTypes"`
+
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+	//
+	Uploads    int       `json:"uploads"`
+	LastUpload time.Time `json:"lastUpload"`
+}
+
+// IsExpired returns true, if the drop link is expired at passed time
+func (d Drop) IsExpired(now time.Time) bool {
+	return !now.Before(d.Expires)
+}
+
+// FilesLeft returns a number of files, which can be uploaded
+func (d Drop) FilesLeft() int {
+	if d.Uploads >= d.MaxFiles {
+		return 0
+	}
+	return d.MaxFiles - d.Uploads
+}
+
+// IsAllowed returns true, if a file with passed name can be uploaded
+func (d Drop) IsAllowed(filename string) bool {
+	if len(d.AllowedTypes) == 0 {
+		return true
+	}
+
+	ext := strings.ToLower(filepath.Ext(filename))
+	for _, t := range d.AllowedTypes {
+		if t == ext {
+			return true
+		}
+	}
+	return false
+}
+
+// DropsInterface provides methods for managing drop links
+type DropsInterface interface {
+	// StartBackgroundServices starts all background services
+	StartBackgroundServices()
+
+	// Create creates a new drop link with a random slug. ID, Slug, Created and counters of passed
+	// drop are ignored. Allowed types are normalized
+	Create(drop Drop) (Drop, error)
+
+	// Get returns a drop link with passed id
+	Get(id int) (Drop, error)
+
+	// GetBySlug returns a drop link with passed slug. It returns ErrDropNotExist, if the link is expired
+	GetBySlug(slug string) (Drop, error)
+
+	// GetAll returns drop links sorted by id. userID 0 means links of all users
+	GetAll(userID int) []Drop
+
+	// CountUpload increments the number of uploaded files. It must be called before a file is saved.
+	// It returns ErrNoUploadsLeft, if the limit is reached
+	CountUpload(id int) error
+
+	// UncountUpload decrements the number of uploaded files. It must be called, if a counted file
+	// wasn't saved
+	UncountUpload(id int) error
+
+	// Delete deletes a drop link
+	Delete(id int) error
+
+	// DeleteUserDrops deletes all drop links of a user
+	DeleteUserDrops(userID int)
+
+	// DeleteTag removes a tag from all drop links
+	DeleteTag(tagID int)
+
+	// Shutdown stops background services
+	Shutdown() error
+}
@@ -0,0 +1,287 @@
+package web
+
+import (
+	"bytes"
+	"html/template"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/tags-drive/core/internal/storage/files/extensions"
+	"github.com/tags-drive/core/internal/web/shares"
+)
+
+// galleryPageSize is a number of files on a page of the gallery
+const galleryPageSize = 24
+
+// galleryContentSecurityPolicy allows only inline styles, images and media of the drive. Pages of the gallery
+// don't use scripts
+const galleryContentSecurityPolicy = "default-src 'none'; img-src 'self'; media-src 'self'; style-src 'unsafe-inline'; " +
+	"form-action 'self'; frame-ancestors 'none'; base-uri 'none'"
+
+// galleryData is passed to templates of the gallery
+type galleryData struct {
+	// Base is a path of the gallery of the share, API is a path of the share API
+	Base string
+	API  string
+
+	Name          string
+	Download      bool
+	DownloadsLeft int
+	Expires       time.Time
+
+	// Grid page
+	Files    []sharedFile
+	Page     int
+	Pages    int
+	PrevPage int // 0, if there's no previous page
+	NextPage int // 0, if there's no next page
+
+	// File page
+	File sharedFile
+	Prev int // id of the previous file (0, if there's no one)
+	Next int // id of the next file (0, if there's no one)
+
+	// Password page
+	Error string
+}
+
+// setGalleryHeaders sets headers, which don't allow to leak links of shares and to index or embed the gallery
+func setGalleryHeaders(w http.ResponseWriter) {
+	header := w.Header()
+	header.Set("Content-Type", "text/html; charset=utf-8")
+	header.Set("Content-Security-Policy", galleryContentSecurityPolicy)
+	header.Set("Referrer-Policy", "same-origin")
+	header.Set("X-Robots-Tag", "noindex, nofollow")
+	header.Set("X-Frame-Options", "DENY")
+	header.Set("X-Content-Type-Options", "nosniff")
+	header.Set("Cache-Control", "private, no-store")
+}
+
+// renderGallery executes a template of the gallery. The page is rendered into a buffer,
+// so a template error doesn't produce a broken page
+func (s Server) renderGallery(w http.ResponseWriter, name string, data galleryData, code int) {
+	buff := new(bytes.Buffer)
+	if err := galleryTemplates.ExecuteTemplate(buff, name, data); err != nil {
+		s.processError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	setGalleryHeaders(w)
+	w.WriteHeader(code)
+	w.Write(buff.Bytes())
+}
+
+// openGallery returns a share and data for templates. It renders the password form, if the share
+// has a password, which wasn't entered
+func (s Server) openGallery(w http.ResponseWriter, r *http.Request) (shares.Share, galleryData, bool) {
+	slug := mux.Vars(r)["slug"]
+
+	share, err := s.shares.GetBySlug(slug)
+	if err == nil && !s.isShareActive(share) {
+		err = shares.ErrShareNotExist
+	}
+	if err != nil {
+		s.processError(w, err.Error(), shareErrorCode(err))
+		return shares.Share{}, galleryData{}, false
+	}
+
+	data := galleryData{
+		Base:          s.withBasePath("/share/" + slug),
+		API:           s.withBasePath("/api/share/" + slug),
+		Name:          share.Name,
+		Download:      share.Mode == shares.ModeDownload,
+		DownloadsLeft: share.DownloadsLeft(),
+		Expires:       share.Expires,
+	}
+
+	var grant string
+	if c, err := r.Cookie(shareCookiePrefix + slug); err == nil {
+		grant = c.Value
+	}
+	if !s.shares.CheckGrant(share, grant) {
+		s.renderGallery(w, "password", data, http.StatusUnauthorized)
+		return shares.Share{}, galleryData{}, false
+	}
+
+	return share, data, true
+}
+
+// GET /share/{slug}
+//
+// Available without auth. Gallery of a share, which works without the web app
+//
+// Params:
+//   - slug: slug of a share
+//   - page: number of a page (starts from 1)
+//
+// Response: html page with a grid of files or a password form
+//
+func (s Server) gallery(w http.ResponseWriter, r *http.Request) {
+	share, data, ok := s.openGallery(w, r)
+	if !ok {
+		return
+	}
+
+	list, err := s.shareFiles(share)
+	if err != nil {
+		s.processError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	data.Pages = (len(list) + galleryPageSize - 1) / galleryPageSize
+	if data.Pages == 0 {
+		data.Pages = 1
+	}
+	data.Page = 1
+	if page, err := strconv.Atoi(r.FormValue("page")); err == nil {
+		data.Page = page
+	}
+	if data.Page < 1 || data.Page > data.Pages {
+		s.processError(w, "page doesn't exist", http.StatusNotFound)
+		return
+	}
+	if data.Page > 1 {
+		data.PrevPage = data.Page - 1
+	}
+	if data.Page < data.Pages {
+		data.NextPage = data.Page + 1
+	}
+
+	start := (data.Page - 1) * galleryPageSize
+	end := start + galleryPageSize
+	if end > len(list) {
+		end = len(list)
+	}
+	for _, file := range list[start:end] {
+		data.Files = append(data.Files, newSharedFile(file))
+	}
+
+	s.shares.CountView(share.ID)
+
+	s.renderGallery(w, "grid", data, http.StatusOK)
+}
+
+// GET /share/{slug}/{id}
+//
+// Available without auth. Page of a single file of a share
+//
+// Params:
+//   - slug: slug of a share
+//   - id: id of a shared file
+//
+// Response: html page with a preview of the file and links to the neighbouring files
+//
+func (s Server) galleryFile(w http.ResponseWriter, r *http.Request) {
+	share, data, ok := s.openGallery(w, r)
+	if !ok {
+		return
+	}
+
+	list, err := s.shareFiles(share)
+	if err != nil {
+		s.processError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	index := -1
+	for i := range list {
+		if list[i].ID == id {
+			index = i
+			break
+		}
+	}
+	if index == -1 {
+		s.processError(w, "file doesn't exist", http.StatusNotFound)
+		return
+	}
+
+	data.File = newSharedFile(list[index])
+	if index > 0 {
+		data.Prev = list[index-1].ID
+	}
+	if index < len(list)-1 {
+		data.Next = list[index+1].ID
+	}
+	data.Page = index/galleryPageSize + 1
+
+	s.renderGallery(w, "file", data, http.StatusOK)
+}
+
+// POST /share/{slug}
+//
+// Available without auth. Checks the password of a share and redirects to the gallery
+//
+// Params:
+//   - slug: slug of a share
+//   - password: password of the share
+//
+// Response: redirect to the gallery or the password form with an error
+//
+func (s Server) unlockGallery(w http.ResponseWriter, r *http.Request) {
+	slug := mux.Vars(r)["slug"]
+
+	share, err := s.shares.GetBySlug(slug)
+	if err == nil && !s.isShareActive(share) {
+		err = shares.ErrShareNotExist
+	}
+	if err != nil {
+		s.processError(w, err.Error(), shareErrorCode(err))
+		return
+	}
+
+	base := s.withBasePath("/share/" + slug)
+	if share.HasPassword {
+		cookie, err := s.unlockShareCookie(w, r, share)
+		if err == errThrottled {
+			return
+		}
+		if err != nil {
+			data := galleryData{Base: base, Name: share.Name, Error: err.Error()}
+			s.renderGallery(w, "password", data, shareErrorCode(err))
+			return
+		}
+		http.SetCookie(w, cookie)
+	}
+
+	http.Redirect(w, r, base, http.StatusSeeOther)
+}
+
+// mediaKind returns "image", "audio" or "video" according to a preview type. Other files are shown as icons
+func mediaKind(t extensions.PreviewType) string {
+	switch t {
+	case extensions.PreviewTypeImage:
+		return "image"
+	case extensions.PreviewTypeAudioMP3, extensions.PreviewTypeAudioOGG, extensions.PreviewTypeAudioWAV:
+		return "audio"
+	case extensions.PreviewTypeVideoMP4, extensions.PreviewTypeVideoWebM:
+		return "video"
+	default:
+		return ""
+	}
+}
+
+// formatSize returns a size in human-readable format
+func formatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return strconv.FormatInt(size, 10) + " B"
+	}
+
+	value := float64(size)
+	for _, suffix := range []string{"KB", "MB", "GB"} {
+		value /= unit
+		if value < unit {
+			return strconv.FormatFloat(value, 'f', 1, 64) + " " + suffix
+		}
+	}
+	return strconv.FormatFloat(value/unit, 'f', 1, 64) + " TB"
+}
+
+var galleryTemplates = template.Must(template.New("gallery").Funcs(template.FuncMap{
+	"mediaKind":  mediaKind,
+	"formatSize": formatSize,
+}).Parse(galleryTemplatesText))
@@ -0,0 +1,110 @@
+package web
+
+// galleryTemplatesText contains templates of the gallery. Pages don't need static files of the web app
+const galleryTemplatesText = `
+{{define "head"}}<!DOCTYPE html>
+<html lang="en">
+<head>
+	<meta charset="utf-8">
+	<meta name="viewport" content="width=device-width, initial-scale=1">
+	<meta name="robots" content="noindex, nofollow">
+	<meta name="referrer" content="same-origin">
+	<title>{{if .Name}}{{.Name}}{{else}}Shared files{{end}}</title>
+	<style>
+		body { margin: 0; padding: 16px; font-family: sans-serif; background: #fafafa; color: #222; }
+		a { color: #1565c0; text-decoration: none; }
+		h1 { margin: 0 0 8px; font-size: 22px; word-break: break-all; }
+		.info { margin-bottom: 16px; color: #666; font-size: 14px; }
+		.button { display: inline-block; padding: 6px 14px; border: 1px solid #1565c0; border-radius: 4px; }
+		.grid { display: grid; grid-template-columns: repeat(auto-fill, minmax(160px, 1fr)); gap: 12px; padding: 0; list-style: none; }
+		.grid a { display: block; background: #fff; border: 1px solid #ddd; border-radius: 4px; overflow: hidden; color: #222; }
+		.thumb { display: flex; align-items: center; justify-content: center; height: 140px; background: #eee; }
+		.thumb img { max-width: 100%; max-height: 140px; }
+		.ext { font-size: 20px; color: #888; text-transform: uppercase; }
+		.name { padding: 6px 8px; font-size: 13px; white-space: nowrap; overflow: hidden; text-overflow: ellipsis; }
+		.pages, .nav { display: flex; justify-content: space-between; align-items: center; margin: 16px 0; }
+		.view { text-align: center; }
+		.view img, .view video { max-width: 100%; max-height: 75vh; }
+		.view audio { width: 100%; max-width: 600px; }
+		.description { white-space: pre-wrap; }
+	</style>
+</head>
+<body>
+{{end}}
+
+{{define "foot"}}
+</body>
+</html>
+{{end}}
+
+{{define "grid"}}{{template "head" .}}
+	<h1>{{if .Name}}{{.Name}}{{else}}Shared files{{end}}</h1>
+	<div class="info">
+		{{if not .Expires.IsZero}}Available until {{.Expires.UTC.Format "2006-01-02 15:04"}} UTC.{{end}}
+		{{if .Download}}{{if ge .DownloadsLeft 0}}Downloads left: {{.DownloadsLeft}}.{{end}}{{end}}
+	</div>
+	{{if .Download}}{{if .Files}}<a class="button" href="{{.API}}/download">Download all</a>{{end}}{{end}}
+
+	{{if .Files}}
+	<ul class="grid">
+		{{range .Files}}
+		<li>
+			<a href="{{$.Base}}/{{.ID}}" title="{{.Filename}}">
+				<div class="thumb">
+					{{if .Preview}}<img src="{{$.API}}/preview/{{.ID}}" alt="{{.Filename}}" loading="lazy">
+					{{else}}<span class="ext">{{if .Type.Ext}}{{.Type.Ext}}{{else}}file{{end}}</span>{{end}}
+				</div>
+				<div class="name">{{.Filename}}</div>
+			</a>
+		</li>
+		{{end}}
+	</ul>
+	{{else}}
+	<p>There are no files.</p>
+	{{end}}
+
+	{{if gt .Pages 1}}
+	<div class="pages">
+		<span>{{if .PrevPage}}<a href="{{.Base}}?page={{.PrevPage}}">&larr; Previous</a>{{end}}</span>
+		<span>Page {{.Page}} of {{.Pages}}</span>
+		<span>{{if .NextPage}}<a href="{{.Base}}?page={{.NextPage}}">Next &rarr;</a>{{end}}</span>
+	</div>
+	{{end}}
+{{template "foot" .}}{{end}}
+
+{{define "file"}}{{template "head" .}}
+	<div class="nav">
+		<span>{{if .Prev}}<a href="{{.Base}}/{{.Prev}}">&larr; Previous</a>{{end}}</span>
+		<a href="{{.Base}}?page={{.Page}}">All files</a>
+		<span>{{if .Next}}<a href="{{.Base}}/{{.Next}}">Next &rarr;</a>{{end}}</span>
+	</div>
+
+	<div class="view">
+		{{$kind := mediaKind .File.Type.PreviewType}}
+		{{if and (eq $kind "image") .File.Preview}}
+		<img src="{{.API}}/preview/{{.File.ID}}" alt="{{.File.Filename}}">
+		{{else if and (eq $kind "audio") .Download}}
+		<audio controls preload="none"><source src="{{.API}}/stream/{{.File.ID}}" type="{{.File.Type.PreviewType}}"></audio>
+		{{else if and (eq $kind "video") .Download}}
+		<video controls preload="none"><source src="{{.API}}/stream/{{.File.ID}}" type="{{.File.Type.PreviewType}}"></video>
+		{{else}}
+		<p class="ext">{{if .File.Type.Ext}}{{.File.Type.Ext}}{{else}}file{{end}}</p>
+		{{end}}
+	</div>
+
+	<h1>{{.File.Filename}}</h1>
+	<div class="info">{{formatSize .File.Size}}, {{.File.AddTime.UTC.Format "2006-01-02"}}</div>
+	{{if .File.Description}}<p class="description">{{.File.Description}}</p>{{end}}
+	{{if .Download}}<a class="button" href="{{.API}}/file/{{.File.ID}}">Download</a>{{end}}
+{{template "foot" .}}{{end}}
+
+{{define "password"}}{{template "head" .}}
+	<h1>{{if .Name}}{{.Name}}{{else}}Shared files{{end}}</h1>
+	<form method="post" action="{{.Base}}">
+		<p>The share is protected with a password</p>
+		{{if .Error}}<p style="color: #c62828">{{.Error}}</p>{{end}}
+		<input type="password" name="password" autocomplete="current-password" autofocus required>
+		<button type="submit">Open</button>
+	</form>
+{{template "foot" .}}{{end}}
+`
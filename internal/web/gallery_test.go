@@ -0,0 +1,50 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/tags-drive/core/internal/web/shares"
+)
+
+func TestUnlockGalleryWithOrigin(t *testing.T) {
+	assert := assert.New(t)
+
+	s, clean := newTestServer(t)
+	defer clean()
+
+	share, err := s.shares.Create(shares.Share{UserID: 1, FileIDs: []int{1}, Mode: shares.ModePreview}, "secret")
+	assert.Nil(err)
+
+	// Pages of the gallery must keep Origin of the password form
+	w := httptest.NewRecorder()
+	setGalleryHeaders(w)
+	assert.Equal("same-origin", w.Header().Get("Referrer-Policy"))
+
+	h := s.csrfMiddleware(http.HandlerFunc(s.unlockGallery))
+	unlock := func(origin string) *httptest.ResponseRecorder {
+		body := url.Values{"password": {"secret"}}.Encode()
+		r := httptest.NewRequest("POST", "http://drive.example/share/"+share.Slug, strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("Origin", origin)
+		r = mux.SetURLVars(r, map[string]string{"slug": share.Slug})
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	// Browsers without Sec-Fetch-Site send only Origin
+	w = unlock("http://drive.example")
+	assert.Equal(http.StatusSeeOther, w.Code)
+	assert.Contains(w.Header().Get("Set-Cookie"), shareCookiePrefix+share.Slug)
+
+	w = unlock("null")
+	assert.Equal(http.StatusForbidden, w.Code)
+}
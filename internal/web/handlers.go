@@ -4,6 +4,8 @@ import (
 	"io"
 	"net/http"
 	"os"
+
+	"github.com/tags-drive/core/internal/storage/audit"
 )
 
 const (
@@ -48,9 +50,8 @@ func (s Server) mobile(w http.ResponseWriter, r *http.Request) {
 //
 func (s Server) login(w http.ResponseWriter, r *http.Request) {
 	// Redirect to / if user is authorized
-	c, err := r.Cookie(s.config.AuthCookieName)
-	if err == nil && s.authService.CheckToken(c.Value) {
-		http.Redirect(w, r, "/", http.StatusSeeOther)
+	if _, ok := s.tokenUser(r); ok {
+		http.Redirect(w, r, s.withBasePath("/"), http.StatusSeeOther)
 		return
 	}
 
@@ -75,6 +76,24 @@ func (s Server) backendVersion(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(s.config.Version))
 }
 
+// POST /api/seal
+//
+// Seals the drive: storages are shut down and the key is wiped from memory.
+// Only GET /health and POST /api/unseal are available after sealing
+//
+// Response: -
+//
+func (s Server) sealDrive(w http.ResponseWriter, r *http.Request) {
+	s.logger.Warnf("%s sealed the drive\n", r.RemoteAddr)
+	// The audit log is closed during sealing
+	s.auditEvent(r, audit.ActionSeal, "")
+
+	err := s.seal()
+	if err != nil {
+		s.processError(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
 // extensionHandler servers extensions
 func (s Server) extensionHandler(dir http.Dir) http.Handler {
 	const blankFilename = "_blank.png"
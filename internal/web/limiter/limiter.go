@@ -0,0 +1,275 @@
+// Package limiter protects auth endpoints against brute-force attacks
+package limiter
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	clog "github.com/ShoshinNikita/log/v2"
+	"github.com/pkg/errors"
+
+	"github.com/tags-drive/core/internal/storage/encryption"
+)
+
+// Errors
+var (
+	ErrBanNotExist = errors.New("ban doesn't exist")
+)
+
+// failures of a key
+type failures struct {
+	count int
+	last  time.Time
+}
+
+type Limiter struct {
+	config Config
+	file   encryption.JSONFile
+
+	failures map[string]failures
+	bans     map[string]Ban
+	mutex    *sync.Mutex
+
+	now func() time.Time
+
+	// this channel signals that Limiter.Shutdown() function was called
+	shutdowned chan struct{}
+
+	logger *clog.Logger
+}
+
+// NewLimiter creates new Limiter and reads bans from BansJSONFile
+func NewLimiter(cnf Config, lg *clog.Logger) (*Limiter, error) {
+	switch {
+	case cnf.BaseDelay <= 0 || cnf.MaxDelay < cnf.BaseDelay:
+		return nil, errors.New("invalid delays")
+	case cnf.MaxFailures <= 0:
+		return nil, errors.New("max failures must be positive")
+	}
+
+	l := &Limiter{
+		config: cnf,
+		file: encryption.JSONFile{
+			Path:    cnf.BansJSONFile,
+			Encrypt: cnf.Encrypt,
+			Key:     cnf.PassPhrase,
+			Indent:  cnf.Debug,
+		},
+		failures:   make(map[string]failures),
+		bans:       make(map[string]Ban),
+		mutex:      new(sync.Mutex),
+		now:        time.Now,
+		shutdowned: make(chan struct{}),
+		logger:     lg,
+	}
+
+	if cnf.BansJSONFile == "" {
+		return l, nil
+	}
+
+	var list []Ban
+	if _, err := l.file.Read(&list); err != nil {
+		return nil, err
+	}
+
+	now := l.now()
+	for _, ban := range list {
+		if now.Before(ban.Expires) {
+			l.bans[ban.Key] = ban
+		}
+	}
+
+	return l, nil
+}
+
+func (l *Limiter) StartBackgroundServices() {
+	if l.config.CleanupInterval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(l.config.CleanupInterval)
+		for {
+			select {
+			case <-ticker.C:
+				l.cleanup()
+			case <-l.shutdowned:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+}
+
+// cleanup removes forgotten failures and expired bans
+func (l *Limiter) cleanup() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := l.now()
+	for key, f := range l.failures {
+		if !now.Before(f.last.Add(l.config.FailuresLife)) {
+			delete(l.failures, key)
+		}
+	}
+
+	expired := false
+	for key, ban := range l.bans {
+		if !now.Before(ban.Expires) {
+			delete(l.bans, key)
+			expired = true
+		}
+	}
+	if expired {
+		l.writeLogged()
+	}
+}
+
+// write writes bans into BansJSONFile. It must be called under the lock
+func (l *Limiter) write() error {
+	if l.config.BansJSONFile == "" {
+		return nil
+	}
+
+	return l.file.Write(l.getBans())
+}
+
+// writeLogged calls write and logs an error. Bans are kept in memory, if they can't be saved
+func (l *Limiter) writeLogged() {
+	if err := l.write(); err != nil {
+		l.logger.Errorf("can't save bans: %s\n", err)
+	}
+}
+
+// delay returns a delay after n failures in a row
+func (l *Limiter) delay(n int) time.Duration {
+	delay := l.config.BaseDelay
+	for i := 1; i < n && delay < l.config.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > l.config.MaxDelay {
+		delay = l.config.MaxDelay
+	}
+	return delay
+}
+
+func (l *Limiter) Check(keys ...string) time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := l.now()
+
+	var wait time.Duration
+	for _, key := range keys {
+		var until time.Time
+		if ban, ok := l.bans[key]; ok {
+			until = ban.Expires
+		} else if f, ok := l.failures[key]; ok {
+			until = f.last.Add(l.delay(f.count))
+		}
+
+		if d := until.Sub(now); d > wait {
+			wait = d
+		}
+	}
+	return wait
+}
+
+func (l *Limiter) Fail(keys ...string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := l.now()
+
+	banned := false
+	for _, key := range keys {
+		f := l.failures[key]
+		if !now.Before(f.last.Add(l.config.FailuresLife)) {
+			// Old failures are forgotten
+			f.count = 0
+		}
+		f.count++
+		f.last = now
+
+		if f.count < l.config.MaxFailures {
+			l.failures[key] = f
+			continue
+		}
+
+		delete(l.failures, key)
+		l.bans[key] = Ban{
+			Key:      key,
+			Failures: f.count,
+			Created:  now,
+			Expires:  now.Add(l.config.BanDuration),
+		}
+		banned = true
+
+		l.logger.Warnf("%s was banned for %s after %d failures\n", key, l.config.BanDuration, f.count)
+	}
+
+	if banned {
+		l.writeLogged()
+	}
+}
+
+func (l *Limiter) Success(keys ...string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for _, key := range keys {
+		delete(l.failures, key)
+	}
+}
+
+func (l *Limiter) GetBans() []Ban {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.getBans()
+}
+
+// getBans returns active bans. It must be called under the lock
+func (l *Limiter) getBans() []Ban {
+	now := l.now()
+
+	bans := []Ban{}
+	for _, ban := range l.bans {
+		if now.Before(ban.Expires) {
+			bans = append(bans, ban)
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool {
+		if bans[i].Created.Equal(bans[j].Created) {
+			return bans[i].Key < bans[j].Key
+		}
+		return bans[i].Created.Before(bans[j].Created)
+	})
+
+	return bans
+}
+
+func (l *Limiter) Unban(key string) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	ban, ok := l.bans[key]
+	if !ok || !l.now().Before(ban.Expires) {
+		return ErrBanNotExist
+	}
+
+	delete(l.bans, key)
+	delete(l.failures, key)
+
+	return l.write()
+}
+
+func (l *Limiter) Shutdown() error {
+	close(l.shutdowned)
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.write()
+}
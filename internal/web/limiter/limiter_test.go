@@ -4,108 +4,193 @@ import (
 	"testing"
 	"time"
 
+	clog "github.com/ShoshinNikita/log/v2"
 	"github.com/stretchr/testify/assert"
+
+	"github.com/tags-drive/core/internal/storage/encryption/encryptiontest"
 )
 
-func TestLimit(t *testing.T) {
-	const (
-		rate    = 5
-		timeout = time.Millisecond * 200
-	)
+func newTestConfig(t *testing.T, encrypt bool) (cnf Config, clean func()) {
+	path, clean := encryptiontest.TempFile(t, "bans.json")
+
+	cnf = Config{
+		BansJSONFile:    path,
+		Encrypt:         encrypt,
+		PassPhrase:      encryptiontest.Key,
+		BaseDelay:       time.Second,
+		MaxDelay:        10 * time.Second,
+		MaxFailures:     6,
+		BanDuration:     time.Hour,
+		FailuresLife:    time.Hour,
+		CleanupInterval: time.Minute,
+	}
+	return cnf, clean
+}
+
+// clock is a fake time
+type clock struct {
+	t time.Time
+}
+
+func (c *clock) now() time.Time          { return c.t }
+func (c *clock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func newTestLimiter(t *testing.T, cnf Config, c *clock) *Limiter {
+	l, err := NewLimiter(cnf, clog.NewProdLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.now = c.now
+	return l
+}
 
+func TestDelay(t *testing.T) {
 	assert := assert.New(t)
-	l := newLimit(rate, timeout)
-
-	// -1
-	assert.Equal(true, l.take())
-	assert.Equal(uint32(rate-1), l.limit)
-	time.Sleep(timeout)
-	// limit wasn't updated
-	assert.Equal(uint32(rate-1), l.limit)
-	// limit was updated
-	l.update()
-	assert.Equal(uint32(rate), l.limit)
-
-	// -4
-	assert.Equal(true, l.take())
-	assert.Equal(true, l.take())
-	assert.Equal(true, l.take())
-	assert.Equal(true, l.take())
-	assert.Equal(uint32(rate-4), l.limit)
-	//
-	time.Sleep(timeout)
-	l.update()
-	// recover 1 pts
-	assert.Equal(uint32(rate-3), l.limit)
-	//
-	// reset limit.lastTime
-	l.lastTime = time.Now()
-	time.Sleep(2 * timeout)
-	l.update()
-	// recover 2 pts
-	assert.Equal(uint32(rate-1), l.limit)
-
-	// reset limiter to not wait timeout * 5
-	l = newLimit(rate, timeout)
-	for i := 0; i < rate; i++ {
-		assert.Equal(true, l.take())
+
+	cnf, clean := newTestConfig(t, false)
+	defer clean()
+
+	l := newTestLimiter(t, cnf, &clock{t: time.Now()})
+
+	delays := []time.Duration{1, 2, 4, 8, 10, 10}
+	for i, d := range delays {
+		assert.Equal(d*time.Second, l.delay(i+1), "failures: %d", i+1)
 	}
-	assert.Equal(false, l.take())
-	assert.Equal(false, l.take())
-	assert.Equal(false, l.take())
-	time.Sleep(timeout)
-	assert.Equal(true, l.take())
+	assert.Equal(cnf.MaxDelay, l.delay(1000))
 }
 
-func TestRateLimiterWithRateFive(t *testing.T) {
-	const (
-		rate    = 5
-		timeout = time.Second / rate
-	)
+func TestBackoff(t *testing.T) {
+	assert := assert.New(t)
+
+	cnf, clean := newTestConfig(t, false)
+	defer clean()
+
+	c := &clock{t: time.Now()}
+	l := newTestLimiter(t, cnf, c)
+
+	assert.Zero(l.Check("ip:1", "account:a"))
+
+	l.Fail("ip:1", "account:a")
+	assert.Equal(time.Second, l.Check("ip:1"))
+	assert.Equal(time.Second, l.Check("ip:2", "account:a"))
+	assert.Zero(l.Check("ip:2", "account:b"))
+
+	c.advance(time.Second)
+	assert.Zero(l.Check("ip:1", "account:a"))
 
+	// The delay is doubled
+	l.Fail("ip:1", "account:a")
+	assert.Equal(2*time.Second, l.Check("ip:1"))
+	c.advance(500 * time.Millisecond)
+	assert.Equal(1500*time.Millisecond, l.Check("ip:1"))
+
+	// The longest delay is returned
+	l.Fail("ip:2")
+	assert.Equal(1500*time.Millisecond, l.Check("ip:1", "ip:2"))
+
+	// Success resets failures
+	l.Success("ip:1", "account:a")
+	assert.Zero(l.Check("ip:1", "account:a"))
+
+	// Old failures are forgotten
+	l.Fail("ip:3")
+	l.Fail("ip:3")
+	c.advance(cnf.FailuresLife)
+	l.Fail("ip:3")
+	assert.Equal(time.Second, l.Check("ip:3"))
+}
+
+func TestBans(t *testing.T) {
 	assert := assert.New(t)
-	l := NewRateLimiter(rate, timeout)
 
-	b := l.Take("500")
-	assert.Equal(b, true)
-	b = l.Take("400")
-	assert.Equal(b, true)
-	assert.Equal(l.limits["500"].limit, uint32(rate-1))
-	assert.Equal(l.limits["400"].limit, uint32(rate-1))
+	cnf, clean := newTestConfig(t, true)
+	defer clean()
 
-	time.Sleep(timeout)
+	c := &clock{t: time.Now().Truncate(time.Second)}
+	l := newTestLimiter(t, cnf, c)
 
-	// weren't updated
-	assert.Equal(l.limits["500"].limit, uint32(rate-1))
-	assert.Equal(l.limits["400"].limit, uint32(rate-1))
+	for i := 0; i < cnf.MaxFailures-1; i++ {
+		l.Fail("ip:1")
+	}
+	assert.Empty(l.GetBans())
+
+	l.Fail("ip:1", "account:a")
+	bans := l.GetBans()
+	if assert.Len(bans, 1) {
+		assert.Equal(Ban{Key: "ip:1", Failures: cnf.MaxFailures, Created: c.now(), Expires: c.now().Add(cnf.BanDuration)}, bans[0])
+	}
+	assert.Equal(cnf.BanDuration, l.Check("ip:1"))
+
+	// Bans survive restarts
+	l.Shutdown()
+	l = newTestLimiter(t, cnf, c)
+	if bans := l.GetBans(); assert.Len(bans, 1) {
+		assert.Equal("ip:1", bans[0].Key)
+		assert.True(bans[0].Expires.Equal(c.now().Add(cnf.BanDuration)))
+	}
+	// Failures aren't saved
+	assert.Zero(l.Check("account:a"))
 
-	// limits must not change after Take() (+1 after update and -1 after return)
-	assert.Equal(l.Take("500"), true)
-	assert.Equal(l.Take("400"), true)
-	assert.Equal(l.limits["500"].limit, uint32(rate-1))
-	assert.Equal(l.limits["400"].limit, uint32(rate-1))
+	// Unban
+	assert.Equal(ErrBanNotExist, l.Unban("ip:2"))
+	assert.Nil(l.Unban("ip:1"))
+	assert.Zero(l.Check("ip:1"))
+	assert.Empty(l.GetBans())
 
-	for i := 0; i < rate; i++ {
-		assert.Equal(true, l.Take("300"))
+	l = newTestLimiter(t, cnf, c)
+	assert.Empty(l.GetBans())
+
+	// Bans expire
+	for i := 0; i < cnf.MaxFailures; i++ {
+		l.Fail("ip:1")
 	}
-	assert.Equal(false, l.Take("300"))
+	c.advance(cnf.BanDuration)
+	assert.Zero(l.Check("ip:1"))
+	assert.Empty(l.GetBans())
 }
 
-func TestRateLimiterWithRateOne(t *testing.T) {
-	const (
-		rate    = 1
-		timeout = time.Millisecond * 10
-		id      = "500"
-	)
-
+func TestCleanup(t *testing.T) {
 	assert := assert.New(t)
-	l := NewRateLimiter(rate, timeout)
 
-	assert.Equal(true, l.Take(id))
-	assert.Equal(false, l.Take(id))
+	cnf, clean := newTestConfig(t, false)
+	defer clean()
+	cnf.BanDuration = 2 * cnf.FailuresLife
+
+	c := &clock{t: time.Now()}
+	l := newTestLimiter(t, cnf, c)
+
+	for i := 0; i < cnf.MaxFailures; i++ {
+		l.Fail("ip:1")
+	}
+	l.Fail("ip:2")
+	c.advance(cnf.FailuresLife / 2)
+	l.Fail("ip:3")
+
+	c.advance(cnf.FailuresLife / 2)
+	l.cleanup()
+	assert.Len(l.failures, 1)
+	assert.Contains(l.failures, "ip:3")
+	assert.Len(l.bans, 1)
+
+	c.advance(cnf.BanDuration)
+	l.cleanup()
+	assert.Empty(l.failures)
+	assert.Empty(l.bans)
+
+	// Expired bans are removed from the file
+	l = newTestLimiter(t, cnf, c)
+	assert.Empty(l.bans)
+}
 
-	time.Sleep(timeout)
-	assert.Equal(true, l.Take(id))
-	assert.Equal(false, l.Take(id))
-	assert.Equal(false, l.Take(id))
+func TestMemoryOnly(t *testing.T) {
+	cnf, clean := newTestConfig(t, false)
+	defer clean()
+	cnf.BansJSONFile = ""
+
+	l := newTestLimiter(t, cnf, &clock{t: time.Now()})
+	for i := 0; i < cnf.MaxFailures; i++ {
+		l.Fail("ip:1")
+	}
+	assert.Len(t, l.GetBans(), 1)
+	assert.Nil(t, l.Shutdown())
 }
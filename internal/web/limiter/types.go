@@ -1,5 +1,56 @@
 package limiter
 
-type RateLimiterInterface interface {
-	Take(remoteAddr string) bool
+import "time"
+
+type Config struct {
+	Debug bool
+
+	// BansJSONFile contains active bans. Empty BansJSONFile means bans are stored only in memory
+	BansJSONFile string
+	Encrypt      bool
+	PassPhrase   [32]byte
+
+	// BaseDelay is a delay after the first failure. Every next failure doubles the delay up to MaxDelay
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// MaxFailures is a number of failures in a row, after which a key is banned for BanDuration
+	MaxFailures int
+	BanDuration time.Duration
+	// FailuresLife is a time, after which failures of a key are forgotten, if there are no new ones
+	FailuresLife time.Duration
+	// CleanupInterval is an interval of removing forgotten failures and expired bans
+	CleanupInterval time.Duration
+}
+
+// Ban is a temporary ban of a key (for example, an IP address or an account)
+type Ban struct {
+	Key      string    `json:"key"`
+	Failures int       `json:"failures"`
+	Created  time.Time `json:"created"`
+	Expires  time.Time `json:"expires"`
+}
+
+// LimiterInterface protects against brute-force attacks. Every key (an IP address, an account and so on)
+// has to wait after a failure. The delay grows exponentially, a key is banned after too many failures
+type LimiterInterface interface {
+	// StartBackgroundServices starts all background services
+	StartBackgroundServices()
+
+	// Check returns time to wait before the next attempt with passed keys. Zero means the attempt is allowed
+	Check(keys ...string) time.Duration
+
+	// Fail registers a failed attempt of every key
+	Fail(keys ...string)
+
+	// Success resets failures of keys
+	Success(keys ...string)
+
+	// GetBans returns active bans sorted by creation time
+	GetBans() []Ban
+
+	// Unban removes a ban and failures of a key. It returns ErrBanNotExist, if there's no such ban
+	Unban(key string) error
+
+	// Shutdown gracefully shutdowns the limiter
+	Shutdown() error
 }
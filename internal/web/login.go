@@ -1,58 +1,204 @@
 package web
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
 	"net/http"
 	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/tags-drive/core/internal/storage/audit"
+	"github.com/tags-drive/core/internal/web/twofactor"
+	"github.com/tags-drive/core/internal/web/users"
 )
 
+// errInsecurePassword is returned, if a password is sent without TLS
+var errInsecurePassword = errors.New("password can be sent only over TLS")
+
+// isSecure returns true, if passwords can be sent to the server. Requests are secure, if TLS is enabled
+// or a trusted proxy received them over https
+func (s Server) isSecure(r *http.Request) bool {
+	return s.config.IsTLS || isHTTPS(r) || s.config.Debug
+}
+
+// checkCredentials returns a user with passed login and password. Old clients send a client hash
+// of a password (see users.ClientHash), it is accepted if LegacyLogin is true. Both are accepted only over TLS:
+// a captured client hash can be replayed as well as a password
+func (s Server) checkCredentials(r *http.Request, login, password string) (users.User, error) {
+	if !s.isSecure(r) {
+		return users.User{}, errInsecurePassword
+	}
+
+	if s.config.LegacyLogin && users.IsClientHash(password) {
+		user, err := s.users.AuthenticateClientHash(login, password)
+		if err == nil {
+			s.logger.Warnf("%s logged in as \"%s\" with a client hash of the password: LEGACY_LOGIN is deprecated\n",
+				r.RemoteAddr, user.Login)
+		}
+		if err != users.ErrWrongPassword {
+			return user, err
+		}
+		// A password can look like a client hash. So, check it as a password
+	}
+
+	return s.users.Authenticate(login, password)
+}
+
 // POST /api/login
 //
 // Params:
 //   - login: user's login
-//   - password: password (sha256 checksum repeated 11 times)
+//   - password: password (TLS is required, except Debug mode). Old clients can send sha256 checksum
+//     repeated 11 times, if LEGACY_LOGIN is true (TLS is required too)
+//   - code (optional): TOTP code or recovery code, if the user has enabled two-factor authentication
 //
-// Response: cookie with auth token
+// Response: cookie with auth token. If two-factor authentication is enabled and there's no code,
+// the cookie isn't set and the response is json object with a challenge for POST /api/login/2fa
 //
 func (s Server) authentication(w http.ResponseWriter, r *http.Request) {
-	if !s.authRateLimiter.Take(r.RemoteAddr) {
-		s.processError(w, "too many auth requests", http.StatusTooManyRequests)
+	var (
+		login    = r.FormValue("login")
+		password = r.FormValue("password")
+		keys     = []string{ipKey(r), accountKey(login)}
+	)
+
+	if !s.authAllowed(w, r, keys...) {
 		return
 	}
 
-	encrypt := func(s string) string {
-		const repeats = 11
-
-		hash := sha256.Sum256([]byte(s))
-		for i := 0; i < repeats-1; i++ {
-			hash = sha256.Sum256([]byte(hex.EncodeToString(hash[:])))
+	user, err := s.checkCredentials(r, login, password)
+	if err != nil {
+		switch err {
+		case users.ErrUserNotExist:
+			s.authLimiter.Fail(keys...)
+			s.processError(w, "invalid login", http.StatusBadRequest)
+		case users.ErrWrongPassword:
+			s.authLimiter.Fail(keys...)
+			s.processError(w, "invalid password", http.StatusBadRequest)
+		case users.ErrUserDisabled, errInsecurePassword:
+			s.processError(w, err.Error(), http.StatusForbidden)
+		default:
+			s.processError(w, err.Error(), http.StatusInternalServerError)
 		}
-		return hex.EncodeToString(hash[:])
+
+		s.logger.Warnf("%s tried to login with \"%s\": %s\n", r.RemoteAddr, login, err)
+		s.auditUserEvent(r, users.User{Login: login}, audit.ActionLoginFailed, err.Error())
+		return
 	}
 
-	var (
-		login = r.FormValue("login")
-		// password is already encrypted
-		password = r.FormValue("password")
-	)
+	if s.twoFactor.IsEnabled(user.ID) {
+		code := r.FormValue("code")
+		if code == "" {
+			challenge, err := s.twoFactor.NewChallenge(user.ID)
+			if err != nil {
+				s.processError(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
 
-	if password != encrypt(s.config.Password) || login != s.config.Login {
-		if login != s.config.Login {
-			s.processError(w, "invalid login", http.StatusBadRequest)
-		} else {
-			s.processError(w, "invalid password", http.StatusBadRequest)
+			s.logger.Infof("%s entered valid password of \"%s\", two-factor code is needed\n", r.RemoteAddr, user.Login)
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(twoFactorChallenge{TwoFactor: true, Challenge: challenge})
+			return
+		}
+
+		if err := s.twoFactor.Verify(user.ID, code); err != nil {
+			if err == twofactor.ErrWrongCode {
+				s.authLimiter.Fail(keys...)
+			}
+			s.logger.Warnf("%s tried to login as \"%s\": %s\n", r.RemoteAddr, user.Login, err)
+			s.auditUserEvent(r, user, audit.ActionLoginFailed, err.Error())
+			s.processError(w, err.Error(), twoFactorErrorCode(err))
+			return
 		}
+	}
+
+	if s.startSession(w, r, user, "password") {
+		s.authLimiter.Success(keys...)
+	}
+}
+
+// twoFactorChallenge is returned by POST /api/login, if a two-factor code is needed
+type twoFactorChallenge struct {
+	TwoFactor bool   `json:"twoFactor"`
+	Challenge string `json:"challenge"`
+}
+
+// POST /api/login/2fa
+//
+// The second step of login for users with two-factor authentication. Failed attempts are throttled
+//
+// Params:
+//   - challenge: challenge returned by POST /api/login
+//   - code: TOTP code or recovery code
+//
+// Response: cookie with auth token
+//
+func (s Server) authenticationSecondFactor(w http.ResponseWriter, r *http.Request) {
+	if !s.authAllowed(w, r, ipKey(r)) {
+		return
+	}
+
+	userID, err := s.twoFactor.CheckChallenge(r.FormValue("challenge"), r.FormValue("code"))
+	if err != nil {
+		// A challenge allows only a few attempts, so only the address is throttled
+		s.authLimiter.Fail(ipKey(r))
+		s.logger.Warnf("%s failed the second step of login: %s\n", r.RemoteAddr, err)
+		s.auditUserEvent(r, users.User{}, audit.ActionLoginFailed, "two-factor: "+err.Error())
+		s.processError(w, err.Error(), twoFactorErrorCode(err))
+		return
+	}
 
-		s.logger.Warnf("%s tried to login with \"%s\" and \"%s\"\n", r.RemoteAddr, login, password)
+	user, err := s.users.Get(userID)
+	if err != nil || user.Disabled {
+		s.processError(w, users.ErrUserDisabled.Error(), http.StatusForbidden)
 		return
 	}
 
-	s.logger.Warnf("%s successfully logged in\n", r.RemoteAddr)
+	if s.startSession(w, r, user, "two-factor") {
+		s.authLimiter.Success(ipKey(r), accountKey(user.Login))
+	}
+}
+
+// startSession sets cookie with a new auth token of a user. It returns false, if an error was written.
+// method is saved in the audit log
+func (s Server) startSession(w http.ResponseWriter, r *http.Request, user users.User, method string) bool {
+	s.logger.Warnf("%s successfully logged in as \"%s\"\n", r.RemoteAddr, user.Login)
+	s.auditUserEvent(r, user, audit.ActionLogin, method)
+
+	token, err := s.authService.GenerateToken()
+	if err != nil {
+		s.processError(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	s.authService.AddToken(token, user.ID, remoteIP(r), r.UserAgent())
+	http.SetCookie(w, s.authCookie(r, token, time.Now().Add(s.config.MaxTokenLife)))
+	return true
+}
+
+// authCookie returns a cookie with an auth token. The cookie is deleted, if the token is empty
+func (s Server) authCookie(r *http.Request, token string, expires time.Time) *http.Cookie {
+	if token == "" {
+		expires = time.Unix(0, 0)
+	}
+
+	sameSite := http.SameSiteLaxMode
+	switch s.config.CookieSameSite {
+	case "strict":
+		sameSite = http.SameSiteStrictMode
+	case "none":
+		sameSite = http.SameSiteNoneMode
+	}
 
-	token := s.authService.GenerateToken()
-	s.authService.AddToken(token)
-	http.SetCookie(w, &http.Cookie{Name: s.config.AuthCookieName, Value: token, HttpOnly: true, Expires: time.Now().Add(s.config.MaxTokenLife)})
+	return &http.Cookie{
+		Name:     s.config.AuthCookieName,
+		Value:    token,
+		Path:     s.config.CookiePath,
+		Domain:   s.config.CookieDomain,
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   s.config.IsTLS || isHTTPS(r),
+		SameSite: sameSite,
+	}
 }
 
 // POST /api/logout – deletes auth cookie
@@ -68,9 +214,13 @@ func (s Server) logout(w http.ResponseWriter, r *http.Request) {
 	}
 
 	s.logger.Warnf("%s logged out\n", r.RemoteAddr)
+	s.auditEvent(r, audit.ActionLogout, "")
 
 	token := c.Value
 	s.authService.DeleteToken(token)
+	if s.vault != nil {
+		s.vault.Lock(token)
+	}
 	// Delete cookie
-	http.SetCookie(w, &http.Cookie{Name: s.config.AuthCookieName, Expires: time.Unix(0, 0)})
+	http.SetCookie(w, s.authCookie(r, "", time.Time{}))
 }
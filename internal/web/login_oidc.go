@@ -0,0 +1,126 @@
+package web
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"time"
+
+	"github.com/tags-drive/core/internal/storage/audit"
+	"github.com/tags-drive/core/internal/web/oidc"
+	"github.com/tags-drive/core/internal/web/users"
+)
+
+const (
+	// oidcStateCookieName is a name of a cookie with a state of a started OIDC login
+	oidcStateCookieName = "oidc-state"
+	oidcStateCookieLife = 10 * time.Minute
+	oidcCallbackPath    = "/api/login/oidc/callback"
+)
+
+// oidcStateCookie returns a cookie with a state. The cookie is deleted, if the state is empty.
+// SameSite must be Lax: the provider redirects a user to the callback
+func (s Server) oidcStateCookie(r *http.Request, state string) *http.Cookie {
+	maxAge := int(oidcStateCookieLife / time.Second)
+	if state == "" {
+		maxAge = -1
+	}
+
+	return &http.Cookie{
+		Name:     oidcStateCookieName,
+		Value:    state,
+		Path:     s.withBasePath(oidcCallbackPath),
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   s.config.IsTLS || isHTTPS(r),
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// GET /api/login/oidc
+//
+// Starts login via OpenID Connect. Requests from banned addresses are rejected
+//
+// Params: -
+//
+// Response: redirect to the login page of the provider
+//
+func (s Server) loginOIDC(w http.ResponseWriter, r *http.Request) {
+	if !s.authAllowed(w, r, ipKey(r)) {
+		return
+	}
+
+	authURL, state, err := s.oidc.AuthURL(r.Context())
+	if err != nil {
+		s.processError(w, "can't start OIDC login: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	http.SetCookie(w, s.oidcStateCookie(r, state))
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// GET /api/login/oidc/callback
+//
+// The provider redirects a user to the callback after login. A user is created on the first login.
+// The role of a user is updated on every login
+//
+// Params:
+//   - state: state of the login
+//   - code: authorization code
+//
+// Response: cookie with auth token and redirect to the main page
+//
+func (s Server) loginOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	// The state is single use
+	http.SetCookie(w, s.oidcStateCookie(r, ""))
+
+	if e := r.FormValue("error"); e != "" {
+		s.logger.Warnf("%s failed OIDC login: provider returned \"%s\"\n", r.RemoteAddr, e)
+		s.processError(w, "OIDC login failed: "+e+" "+r.FormValue("error_description"), http.StatusUnauthorized)
+		return
+	}
+
+	// The state must be passed by the same browser, which started the login
+	state := r.FormValue("state")
+	c, err := r.Cookie(oidcStateCookieName)
+	if err != nil || state == "" || subtle.ConstantTimeCompare([]byte(c.Value), []byte(state)) != 1 {
+		s.processError(w, oidc.ErrInvalidState.Error(), http.StatusBadRequest)
+		return
+	}
+
+	identity, err := s.oidc.Exchange(r.Context(), state, r.FormValue("code"))
+	if err != nil {
+		s.logger.Warnf("%s failed OIDC login: %s\n", r.RemoteAddr, err)
+		s.auditUserEvent(r, users.User{}, audit.ActionLoginFailed, "oidc: "+err.Error())
+
+		switch err {
+		case oidc.ErrInvalidState:
+			s.processError(w, err.Error(), http.StatusBadRequest)
+		case oidc.ErrNoRole, oidc.ErrNoLogin:
+			s.processError(w, err.Error(), http.StatusForbidden)
+		default:
+			s.processError(w, "OIDC login failed: "+err.Error(), http.StatusUnauthorized)
+		}
+		return
+	}
+
+	user, err := s.users.LoginExternal(identity.Subject, identity.Login, identity.Role)
+	if err != nil {
+		s.logger.Warnf("%s failed OIDC login as \"%s\": %s\n", r.RemoteAddr, identity.Login, err)
+		s.auditUserEvent(r, users.User{Login: identity.Login}, audit.ActionLoginFailed, "oidc: "+err.Error())
+
+		switch err {
+		case users.ErrUserDisabled:
+			s.processError(w, err.Error(), http.StatusForbidden)
+		case users.ErrUserExists:
+			s.processError(w, "local user with the same login already exists", http.StatusConflict)
+		default:
+			s.processError(w, err.Error(), userErrorCode(err))
+		}
+		return
+	}
+
+	if s.startSession(w, r, user, "oidc") {
+		http.Redirect(w, r, s.withBasePath("/"), http.StatusSeeOther)
+	}
+}
@@ -0,0 +1,37 @@
+package web
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/tags-drive/core/internal/web/users"
+)
+
+func TestCheckCredentialsClientHash(t *testing.T) {
+	assert := assert.New(t)
+
+	s, clean := newTestServer(t)
+	defer clean()
+
+	hash := users.ClientHash("password")
+	r := httptest.NewRequest("POST", "/api/login", nil)
+
+	// A client hash is replayable, so it isn't accepted without TLS
+	s.config.LegacyLogin = true
+	_, err := s.checkCredentials(r, "admin", hash)
+	assert.Equal(errInsecurePassword, err)
+
+	s.config.IsTLS = true
+	user, err := s.checkCredentials(r, "admin", hash)
+	assert.Nil(err)
+	assert.Equal("admin", user.Login)
+
+	s.config.LegacyLogin = false
+	_, err = s.checkCredentials(r, "admin", hash)
+	assert.Equal(users.ErrWrongPassword, err)
+
+	_, err = s.checkCredentials(r, "admin", "password")
+	assert.Nil(err)
+}
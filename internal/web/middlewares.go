@@ -3,28 +3,127 @@ package web
 import (
 	"fmt"
 	"net/http"
+	"net/url"
+	"path"
+	"strconv"
 	"strings"
 
 	clog "github.com/ShoshinNikita/log/v2"
 	"github.com/minio/sio"
+
+	"github.com/tags-drive/core/internal/web/apitokens"
+	"github.com/tags-drive/core/internal/web/users"
 )
 
-func (s Server) authMiddleware(h http.Handler) http.Handler {
+// tokenUser returns the owner of the auth token of a request. It returns false, if the token is invalid
+// or the user is disabled
+func (s Server) tokenUser(r *http.Request) (users.User, bool) {
+	c, err := r.Cookie(s.config.AuthCookieName)
+	if err != nil {
+		return users.User{}, false
+	}
+
+	userID, ok := s.authService.CheckToken(c.Value, remoteIP(r))
+	if !ok {
+		return users.User{}, false
+	}
+
+	user, err := s.users.Get(userID)
+	if err != nil || user.Disabled {
+		return users.User{}, false
+	}
+	return user, true
+}
+
+// apiTokenCredentials returns a secret of an API token from the Authorization header. Bearer and Basic
+// schemes are supported. login is set only for Basic scheme. ok is false, if there's no header
+func apiTokenCredentials(r *http.Request) (login, secret string, ok bool) {
+	if login, password, ok := r.BasicAuth(); ok {
+		return login, password, true
+	}
+
+	const bearerPrefix = "Bearer "
+
+	header := r.Header.Get("Authorization")
+	if len(header) > len(bearerPrefix) && strings.EqualFold(header[:len(bearerPrefix)], bearerPrefix) {
+		return "", strings.TrimSpace(header[len(bearerPrefix):]), true
+	}
+
+	return "", "", false
+}
+
+// apiTokenUser returns an API token and its owner. login is checked, if it isn't empty
+func (s Server) apiTokenUser(r *http.Request, login, secret string) (users.User, apitokens.Token, bool) {
+	token, err := s.apiTokens.Check(secret, remoteIP(r))
+	if err != nil {
+		return users.User{}, apitokens.Token{}, false
+	}
+
+	user, err := s.users.Get(token.UserID)
+	if err != nil || user.Disabled || (login != "" && login != user.Login) {
+		return users.User{}, apitokens.Token{}, false
+	}
+	return user, token, true
+}
+
+// authMiddleware checks the auth token (or the API token) and the role of its owner. API tokens must have
+// passed scope. The user is saved in the request context (see Server.user)
+func (s Server) authMiddleware(h http.Handler, role users.Role, scope apitokens.Scope) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if s.config.SkipLogin {
-			h.ServeHTTP(w, r)
+			h.ServeHTTP(w, withUser(r, skipLoginUser))
 			return
 		}
 
-		validToken := func() bool {
-			c, err := r.Cookie(s.config.AuthCookieName)
-			if err != nil {
-				return false
+		if login, secret, ok := apiTokenCredentials(r); ok {
+			if scope == sessionOnly {
+				s.processError(w, "API tokens can't be used for this request", http.StatusForbidden)
+				return
 			}
 
-			token := c.Value
-			return s.authService.CheckToken(token)
-		}()
+			user, token, ok := s.apiTokenUser(r, login, secret)
+			if !ok {
+				w.Header().Set("WWW-Authenticate", `Basic realm="Tags Drive", charset="UTF-8"`)
+				s.processError(w, apitokens.ErrInvalidToken.Error(), http.StatusUnauthorized)
+				return
+			}
+
+			if !token.HasScope(scope) {
+				s.processError(w, "not enough rights: token must have "+string(scope)+" scope", http.StatusForbidden)
+				return
+			}
+			if !user.Role.Allows(role) {
+				s.processError(w, "not enough rights: "+string(role)+" role is needed", http.StatusForbidden)
+				return
+			}
+
+			h.ServeHTTP(w, withUser(r, user))
+			return
+		}
+
+		var (
+			user       users.User
+			validToken bool
+		)
+		if login, ok := s.forwardedLogin(r); ok {
+			authorized, externalUser, err := s.externalAuth(w, r, login, "forward auth")
+			if err != nil {
+				s.logger.Warnf("%s failed forward auth as \"%s\": %s\n", r.RemoteAddr, login, err)
+				s.processError(w, "forward auth failed: "+err.Error(), http.StatusForbidden)
+				return
+			}
+			r, user, validToken = authorized, externalUser, true
+		} else if login, ok := s.clientCertLogin(r); ok {
+			authorized, externalUser, err := s.externalAuth(w, r, login, "client certificate")
+			if err != nil {
+				s.logger.Warnf("%s failed client certificate auth as \"%s\": %s\n", r.RemoteAddr, login, err)
+				s.processError(w, "client certificate auth failed: "+err.Error(), http.StatusForbidden)
+				return
+			}
+			r, user, validToken = authorized, externalUser, true
+		} else {
+			user, validToken = s.tokenUser(r)
+		}
 
 		if !validToken {
 			// Redirect won't help
@@ -33,7 +132,34 @@ func (s Server) authMiddleware(h http.Handler) http.Handler {
 				return
 			}
 
-			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			http.Redirect(w, r, s.withBasePath("/login"), http.StatusSeeOther)
+			return
+		}
+
+		if !user.Role.Allows(role) {
+			s.processError(w, "not enough rights: "+string(role)+" role is needed", http.StatusForbidden)
+			return
+		}
+
+		h.ServeHTTP(w, withUser(r, user))
+	})
+}
+
+// csrfMiddleware rejects cross-origin requests, which can change something. Browsers send Sec-Fetch-Site
+// or Origin headers with such requests, so a malicious page can't use the auth cookie. Requests without
+// both headers are sent by other clients (scripts, old browsers send Origin with cross-origin requests)
+func (s Server) csrfMiddleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET", "HEAD", "OPTIONS":
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		if !s.isSameOrigin(r) {
+			s.logger.Warnf("%s cross-origin request %s %s was rejected (Origin: \"%s\", Sec-Fetch-Site: \"%s\")\n",
+				r.RemoteAddr, r.Method, r.URL.Path, r.Header.Get("Origin"), r.Header.Get("Sec-Fetch-Site"))
+			s.processError(w, "cross-origin request is forbidden", http.StatusForbidden)
 			return
 		}
 
@@ -41,6 +167,39 @@ func (s Server) authMiddleware(h http.Handler) http.Handler {
 	})
 }
 
+// isSameOrigin returns true, if a request was sent from the drive or from a trusted origin
+func (s Server) isSameOrigin(r *http.Request) bool {
+	fetchSite := r.Header.Get("Sec-Fetch-Site")
+	switch fetchSite {
+	case "same-origin", "none":
+		// "none" means the request was initiated by the user
+		return true
+	}
+
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		// Browsers, which send Sec-Fetch-Site, always send Origin with cross-origin requests
+		return fetchSite == ""
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		// For example, "null"
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+
+	origin = strings.ToLower(u.Scheme + "://" + u.Host)
+	for _, trusted := range s.config.TrustedOrigins {
+		if origin == trusted {
+			return true
+		}
+	}
+	return false
+}
+
 func (s Server) decryptMiddleware(dir http.Dir) http.Handler {
 	if !s.config.Encrypt {
 		return http.FileServer(dir)
@@ -48,6 +207,26 @@ func (s Server) decryptMiddleware(dir http.Dir) http.Handler {
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		fileName := r.URL.Path
+
+		// Path is "{id}" or "resized/{id}"
+		id, err := strconv.Atoi(path.Base(fileName))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		file, err := s.fileStorage.GetFile(id)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		key, err := s.fileStorage.DataKey(file)
+		if err != nil {
+			s.processError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
 		f, err := dir.Open(fileName)
 		if err != nil {
 			s.processError(w, err.Error(), http.StatusBadRequest)
@@ -55,7 +234,7 @@ func (s Server) decryptMiddleware(dir http.Dir) http.Handler {
 		}
 		defer f.Close()
 
-		_, err = sio.Decrypt(w, f, sio.Config{Key: s.config.PassPhrase[:]})
+		_, err = sio.Decrypt(w, f, sio.Config{Key: key[:]})
 		if err != nil {
 			s.processError(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -63,6 +242,31 @@ func (s Server) decryptMiddleware(dir http.Dir) http.Handler {
 	})
 }
 
+// hideDotFilesMiddleware returns 404 for service files, like encryption marker
+func hideDotFilesMiddleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, part := range strings.Split(r.URL.Path, "/") {
+			if strings.HasPrefix(part, ".") {
+				http.NotFound(w, r)
+				return
+			}
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// isSecretParam reports whether a value of a form param mustn't be logged
+func isSecretParam(key string) bool {
+	key = strings.ToLower(key)
+	for _, secret := range []string{"password", "passphrase", "code", "challenge", "token", "state"} {
+		if strings.Contains(key, secret) {
+			return true
+		}
+	}
+	return false
+}
+
 // debugMiddleware logs requests and sets debug headers
 func (s Server) debugMiddleware(h http.Handler) http.Handler {
 	const (
@@ -123,6 +327,11 @@ func (s Server) debugMiddleware(h http.Handler) http.Handler {
 			space++
 
 			for k, v := range r.Form {
+				// Don't log passwords, one-time codes and tokens
+				if isSecretParam(k) {
+					v = []string{"***"}
+				}
+
 				p := strings.Repeat(" ", space-len(k))
 				builder.WriteString(prefix)
 				builder.WriteString(k)
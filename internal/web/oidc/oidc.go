@@ -0,0 +1,375 @@
+// Package oidc provides login via OpenID Connect (authorization code flow with PKCE)
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	clog "github.com/ShoshinNikita/log/v2"
+	"github.com/pkg/errors"
+
+	"github.com/tags-drive/core/internal/web/users"
+)
+
+const (
+	requestTimeout = 10 * time.Second
+	// maxResponseSize is a max size of responses of the provider
+	maxResponseSize = 1 << 20
+
+	randomSize  = 32
+	pendingLife = 10 * time.Minute
+)
+
+// Errors
+var (
+	ErrInvalidState = errors.New("invalid or expired state")
+	ErrNoRole       = errors.New("user has no role on the drive")
+	ErrNoLogin      = errors.New("ID token has no login claim")
+)
+
+// discovery is a part of the provider metadata
+type discovery struct {
+	Issuer                string   `json:"issuer"`
+	AuthorizationEndpoint string   `json:"authorization_endpoint"`
+	TokenEndpoint         string   `json:"token_endpoint"`
+	JWKSURI               string   `json:"jwks_uri"`
+	TokenAuthMethods      []string `json:"token_endpoint_auth_methods_supported"`
+}
+
+// pendingAuth is a started login
+type pendingAuth struct {
+	nonce    string
+	verifier string
+	expires  time.Time
+}
+
+type Provider struct {
+	config Config
+	client *http.Client
+
+	mutex     *sync.Mutex
+	discovery *discovery // nil, until the metadata is fetched
+	keys      map[string]*rsa.PublicKey
+	keysTime  time.Time // time of the last JWKS fetching
+	pending   map[string]pendingAuth
+
+	now func() time.Time
+
+	logger *clog.Logger
+}
+
+// NewProvider creates new Provider. The metadata of the provider is fetched on the first login,
+// so the drive can start, when the provider is unavailable
+func NewProvider(cnf Config, lg *clog.Logger) (*Provider, error) {
+	switch {
+	case cnf.Issuer == "":
+		return nil, errors.New("issuer can't be empty")
+	case cnf.ClientID == "":
+		return nil, errors.New("client id can't be empty")
+	case cnf.RedirectURL == "":
+		return nil, errors.New("redirect url can't be empty")
+	case cnf.DefaultRole != "" && !cnf.DefaultRole.IsValid():
+		return nil, errors.Errorf("invalid default role \"%s\"", cnf.DefaultRole)
+	}
+	for value, role := range cnf.RoleMapping {
+		if !role.IsValid() {
+			return nil, errors.Errorf("invalid role \"%s\" for \"%s\"", role, value)
+		}
+	}
+
+	hasOpenID := false
+	for _, scope := range cnf.Scopes {
+		hasOpenID = hasOpenID || scope == "openid"
+	}
+	if !hasOpenID {
+		cnf.Scopes = append([]string{"openid"}, cnf.Scopes...)
+	}
+
+	return &Provider{
+		config:  cnf,
+		client:  &http.Client{Timeout: requestTimeout},
+		mutex:   new(sync.Mutex),
+		keys:    make(map[string]*rsa.PublicKey),
+		pending: make(map[string]pendingAuth),
+		now:     time.Now,
+		logger:  lg,
+	}, nil
+}
+
+// ParseRoleMapping parses pairs "value=role" separated by comma
+func ParseRoleMapping(s string) (map[string]users.Role, error) {
+	mapping := make(map[string]users.Role)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		i := strings.LastIndex(pair, "=")
+		if i <= 0 {
+			return nil, errors.Errorf("invalid role mapping \"%s\": format is value=role", pair)
+		}
+
+		value, role := strings.TrimSpace(pair[:i]), users.Role(strings.TrimSpace(pair[i+1:]))
+		if !role.IsValid() {
+			return nil, errors.Errorf("invalid role \"%s\" in role mapping", role)
+		}
+		mapping[value] = role
+	}
+	return mapping, nil
+}
+
+func randomString() (string, error) {
+	b := make([]byte, randomSize)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrap(err, "can't generate random bytes")
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// getJSON decodes a response of a GET request
+func (p *Provider) getJSON(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return errors.Wrap(err, "can't create request")
+	}
+
+	resp, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return errors.Wrapf(err, "can't get %s", url)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("can't get %s: status code %d", url, resp.StatusCode)
+	}
+
+	err = json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(v)
+	return errors.Wrapf(err, "can't decode %s", url)
+}
+
+// discover returns the metadata of the provider
+func (p *Provider) discover(ctx context.Context) (*discovery, error) {
+	p.mutex.Lock()
+	d := p.discovery
+	p.mutex.Unlock()
+	if d != nil {
+		return d, nil
+	}
+
+	d = new(discovery)
+	err := p.getJSON(ctx, strings.TrimSuffix(p.config.Issuer, "/")+"/.well-known/openid-configuration", d)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case d.Issuer != p.config.Issuer:
+		return nil, errors.Errorf("issuer of the provider \"%s\" doesn't match the configured one", d.Issuer)
+	case d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "":
+		return nil, errors.New("provider metadata doesn't contain required endpoints")
+	}
+
+	p.mutex.Lock()
+	p.discovery = d
+	p.mutex.Unlock()
+
+	p.logger.Infof("OIDC provider %s was discovered\n", d.Issuer)
+
+	return d, nil
+}
+
+func (p *Provider) AuthURL(ctx context.Context) (authURL, state string, err error) {
+	d, err := p.discover(ctx)
+	if err != nil {
+		return "", "", err
+	}
+
+	var auth pendingAuth
+	for _, s := range []*string{&state, &auth.nonce, &auth.verifier} {
+		*s, err = randomString()
+		if err != nil {
+			return "", "", err
+		}
+	}
+
+	challenge := sha256.Sum256([]byte(auth.verifier))
+
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", p.config.ClientID)
+	params.Set("redirect_uri", p.config.RedirectURL)
+	params.Set("scope", strings.Join(p.config.Scopes, " "))
+	params.Set("state", state)
+	params.Set("nonce", auth.nonce)
+	params.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	params.Set("code_challenge_method", "S256")
+
+	p.mutex.Lock()
+	now := p.now()
+	for s, a := range p.pending {
+		if !now.Before(a.expires) {
+			delete(p.pending, s)
+		}
+	}
+	auth.expires = now.Add(pendingLife)
+	p.pending[state] = auth
+	p.mutex.Unlock()
+
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return d.AuthorizationEndpoint + sep + params.Encode(), state, nil
+}
+
+func (p *Provider) Exchange(ctx context.Context, state, code string) (Identity, error) {
+	p.mutex.Lock()
+	auth, ok := p.pending[state]
+	// A state can be used only once
+	delete(p.pending, state)
+	p.mutex.Unlock()
+
+	if !ok || !p.now().Before(auth.expires) {
+		return Identity{}, ErrInvalidState
+	}
+
+	d, err := p.discover(ctx)
+	if err != nil {
+		return Identity{}, err
+	}
+
+	idToken, err := p.requestToken(ctx, d, code, auth.verifier)
+	if err != nil {
+		return Identity{}, err
+	}
+
+	claims, err := p.verifyIDToken(ctx, d, idToken, auth.nonce)
+	if err != nil {
+		return Identity{}, err
+	}
+
+	return p.identity(claims)
+}
+
+// requestToken exchanges a code for an ID token
+func (p *Provider) requestToken(ctx context.Context, d *discovery, code, verifier string) (idToken string, err error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.config.RedirectURL)
+	form.Set("code_verifier", verifier)
+	form.Set("client_id", p.config.ClientID)
+
+	// client_secret_basic is the default method
+	useBasic := len(d.TokenAuthMethods) == 0
+	for _, m := range d.TokenAuthMethods {
+		useBasic = useBasic || m == "client_secret_basic"
+	}
+	if p.config.ClientSecret != "" && !useBasic {
+		form.Set("client_secret", p.config.ClientSecret)
+	}
+
+	req, err := http.NewRequest("POST", d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", errors.Wrap(err, "can't create request")
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.config.ClientSecret != "" && useBasic {
+		req.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(p.config.ClientSecret))
+	}
+
+	resp, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", errors.Wrap(err, "can't request token")
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return "", errors.Wrap(err, "can't read token response")
+	}
+
+	var tokenResp struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.Unmarshal(body, &tokenResp); err != nil {
+		return "", errors.Errorf("can't decode token response (status code %d)", resp.StatusCode)
+	}
+
+	if resp.StatusCode != http.StatusOK || tokenResp.Error != "" {
+		return "", errors.Errorf("token request failed: %s %s", tokenResp.Error, tokenResp.ErrorDescription)
+	}
+	if tokenResp.IDToken == "" {
+		return "", errors.New("token response has no ID token")
+	}
+
+	return tokenResp.IDToken, nil
+}
+
+// identity returns an identity from verified claims
+func (p *Provider) identity(claims map[string]interface{}) (Identity, error) {
+	sub, _ := claims["sub"].(string)
+
+	var login string
+	for _, claim := range []string{p.config.LoginClaim, "email", "sub"} {
+		if v, ok := claims[claim].(string); ok && claim != "" && strings.TrimSpace(v) != "" {
+			login = strings.TrimSpace(v)
+			break
+		}
+	}
+	if login == "" {
+		return Identity{}, ErrNoLogin
+	}
+
+	role, err := p.role(claims)
+	if err != nil {
+		return Identity{}, err
+	}
+
+	return Identity{Subject: sub, Login: login, Role: role}, nil
+}
+
+// role returns the highest role of mapped values of RoleClaim or DefaultRole
+func (p *Provider) role(claims map[string]interface{}) (users.Role, error) {
+	var values []string
+	switch v := claims[p.config.RoleClaim].(type) {
+	case string:
+		values = append(values, v)
+	case []interface{}:
+		for _, value := range v {
+			if s, ok := value.(string); ok {
+				values = append(values, s)
+			}
+		}
+	}
+
+	var role users.Role
+	for _, value := range values {
+		if mapped, ok := p.config.RoleMapping[value]; ok && !role.Allows(mapped) {
+			role = mapped
+		}
+	}
+
+	if role == "" {
+		role = p.config.DefaultRole
+	}
+	if role == "" {
+		return "", ErrNoRole
+	}
+	return role, nil
+}
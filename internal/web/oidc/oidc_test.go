@@ -0,0 +1,386 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	clog "github.com/ShoshinNikita/log/v2"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/tags-drive/core/internal/web/users"
+)
+
+const (
+	testClientID     = "drive"
+	testClientSecret = "secret"
+	testRedirectURL  = "https://drive.example.com/api/login/oidc/callback"
+)
+
+// mockProvider is a minimal OpenID Connect provider
+type mockProvider struct {
+	server *httptest.Server
+
+	mutex *sync.Mutex
+	key   *rsa.PrivateKey
+	kid   string
+	// codes contains issued authorization codes
+	codes map[string]mockCode
+	// tokenHook can change claims and the header of an ID token
+	tokenHook func(header, claims map[string]interface{})
+	// signKey is used instead of key to sign ID tokens, if it isn't nil
+	signKey *rsa.PrivateKey
+	// jwksRequests is a number of JWKS requests
+	jwksRequests int
+}
+
+type mockCode struct {
+	challenge string
+	nonce     string
+	claims    map[string]interface{}
+}
+
+func newMockProvider(t *testing.T) *mockProvider {
+	m := &mockProvider{
+		mutex: new(sync.Mutex),
+		codes: make(map[string]mockCode),
+	}
+	m.rotateKey(t)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                                m.server.URL,
+			"authorization_endpoint":                m.server.URL + "/authorize",
+			"token_endpoint":                        m.server.URL + "/token",
+			"jwks_uri":                              m.server.URL + "/jwks",
+			"token_endpoint_auth_methods_supported": []string{"client_secret_basic"},
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		m.mutex.Lock()
+		defer m.mutex.Unlock()
+
+		m.jwksRequests++
+		e := big.NewInt(int64(m.key.E)).Bytes()
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{
+				{"kty": "EC", "kid": "ec-key", "crv": "P-256"},
+				{
+					"kty": "RSA", "kid": m.kid, "use": "sig", "alg": "RS256",
+					"n": base64.RawURLEncoding.EncodeToString(m.key.N.Bytes()),
+					"e": base64.RawURLEncoding.EncodeToString(e),
+				},
+			},
+		})
+	})
+	mux.HandleFunc("/token", m.token)
+
+	m.server = httptest.NewServer(mux)
+	return m
+}
+
+func (m *mockProvider) rotateKey(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.mutex.Lock()
+	m.key = key
+	m.kid = "key-" + time.Now().Format("150405.000000000")
+	m.mutex.Unlock()
+}
+
+// authorize imitates the login page of the provider: it checks params and returns a code
+func (m *mockProvider) authorize(t *testing.T, authURL string, claims map[string]interface{}) (code, state string) {
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+
+	assert.Equal(t, m.server.URL+"/authorize", u.Scheme+"://"+u.Host+u.Path)
+	assert.Equal(t, "code", q.Get("response_type"))
+	assert.Equal(t, testClientID, q.Get("client_id"))
+	assert.Equal(t, testRedirectURL, q.Get("redirect_uri"))
+	assert.Equal(t, "S256", q.Get("code_challenge_method"))
+	assert.Contains(t, strings.Split(q.Get("scope"), " "), "openid")
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	code = "code-" + q.Get("state")
+	m.codes[code] = mockCode{challenge: q.Get("code_challenge"), nonce: q.Get("nonce"), claims: claims}
+	return code, q.Get("state")
+}
+
+func (m *mockProvider) token(w http.ResponseWriter, r *http.Request) {
+	tokenError := func(e string) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": e})
+	}
+
+	id, secret, ok := r.BasicAuth()
+	if !ok || id != testClientID || secret != testClientSecret {
+		tokenError("invalid_client")
+		return
+	}
+	if r.FormValue("grant_type") != "authorization_code" || r.FormValue("redirect_uri") != testRedirectURL {
+		tokenError("invalid_request")
+		return
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	code, ok := m.codes[r.FormValue("code")]
+	delete(m.codes, r.FormValue("code"))
+	if !ok {
+		tokenError("invalid_grant")
+		return
+	}
+
+	// PKCE
+	hash := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+	if base64.RawURLEncoding.EncodeToString(hash[:]) != code.challenge {
+		tokenError("invalid_grant")
+		return
+	}
+
+	header := map[string]interface{}{"alg": "RS256", "typ": "JWT", "kid": m.kid}
+	claims := map[string]interface{}{
+		"iss":   m.server.URL,
+		"aud":   testClientID,
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"iat":   time.Now().Unix(),
+		"nonce": code.nonce,
+	}
+	for k, v := range code.claims {
+		claims[k] = v
+	}
+	if m.tokenHook != nil {
+		m.tokenHook(header, claims)
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{
+		"access_token": "access",
+		"token_type":   "Bearer",
+		"id_token":     m.sign(header, claims),
+	})
+}
+
+func (m *mockProvider) sign(header, claims map[string]interface{}) string {
+	h, _ := json.Marshal(header)
+	c, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+
+	key := m.key
+	if m.signKey != nil {
+		key = m.signKey
+	}
+
+	hash := sha256.Sum256([]byte(signed))
+	sig, _ := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func newTestProvider(t *testing.T, m *mockProvider) *Provider {
+	cnf := Config{
+		Issuer:       m.server.URL,
+		ClientID:     testClientID,
+		ClientSecret: testClientSecret,
+		RedirectURL:  testRedirectURL,
+		Scopes:       []string{"profile", "email"},
+		LoginClaim:   "preferred_username",
+		RoleClaim:    "groups",
+		RoleMapping: map[string]users.Role{
+			"drive-admins":  users.RoleAdmin,
+			"drive-editors": users.RoleEditor,
+		},
+	}
+	p, err := NewProvider(cnf, clog.NewProdLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// login runs the whole flow
+func login(t *testing.T, m *mockProvider, p *Provider, claims map[string]interface{}) (Identity, error) {
+	authURL, state, err := p.AuthURL(context.Background())
+	if err != nil {
+		return Identity{}, err
+	}
+
+	code, returnedState := m.authorize(t, authURL, claims)
+	assert.Equal(t, state, returnedState)
+
+	return p.Exchange(context.Background(), returnedState, code)
+}
+
+func TestParseRoleMapping(t *testing.T) {
+	assert := assert.New(t)
+
+	mapping, err := ParseRoleMapping("drive-admins=admin, team=staff=viewer,,")
+	assert.Nil(err)
+	assert.Equal(map[string]users.Role{"drive-admins": users.RoleAdmin, "team=staff": users.RoleViewer}, mapping)
+
+	_, err = ParseRoleMapping("drive-admins=root")
+	assert.NotNil(err)
+	_, err = ParseRoleMapping("admin")
+	assert.NotNil(err)
+}
+
+func TestLogin(t *testing.T) {
+	assert := assert.New(t)
+
+	m := newMockProvider(t)
+	defer m.server.Close()
+	p := newTestProvider(t, m)
+
+	identity, err := login(t, m, p, map[string]interface{}{
+		"sub":                "user-1",
+		"preferred_username": "alice",
+		"groups":             []string{"staff", "drive-editors", "drive-admins"},
+	})
+	if assert.Nil(err) {
+		assert.Equal(Identity{Subject: "user-1", Login: "alice", Role: users.RoleAdmin}, identity)
+	}
+
+	// Login claim fallback
+	identity, err = login(t, m, p, map[string]interface{}{
+		"sub":    "user-2",
+		"email":  "bob@example.com",
+		"groups": "drive-editors",
+	})
+	if assert.Nil(err) {
+		assert.Equal(Identity{Subject: "user-2", Login: "bob@example.com", Role: users.RoleEditor}, identity)
+	}
+
+	// No role
+	_, err = login(t, m, p, map[string]interface{}{"sub": "user-3", "groups": []string{"staff"}})
+	assert.Equal(ErrNoRole, err)
+
+	p.config.DefaultRole = users.RoleViewer
+	identity, err = login(t, m, p, map[string]interface{}{"sub": "user-3"})
+	if assert.Nil(err) {
+		assert.Equal(users.RoleViewer, identity.Role)
+		assert.Equal("user-3", identity.Login)
+	}
+}
+
+func TestState(t *testing.T) {
+	assert := assert.New(t)
+
+	m := newMockProvider(t)
+	defer m.server.Close()
+	p := newTestProvider(t, m)
+
+	claims := map[string]interface{}{"sub": "user-1", "groups": "drive-admins"}
+
+	// Unknown state
+	authURL, _, err := p.AuthURL(context.Background())
+	assert.Nil(err)
+	code, _ := m.authorize(t, authURL, claims)
+	_, err = p.Exchange(context.Background(), "other", code)
+	assert.Equal(ErrInvalidState, err)
+
+	// A state can be used only once
+	authURL, state, _ := p.AuthURL(context.Background())
+	code, _ = m.authorize(t, authURL, claims)
+	_, err = p.Exchange(context.Background(), state, code)
+	assert.Nil(err)
+	_, err = p.Exchange(context.Background(), state, code)
+	assert.Equal(ErrInvalidState, err)
+
+	// Expired state
+	authURL, state, _ = p.AuthURL(context.Background())
+	code, _ = m.authorize(t, authURL, claims)
+	p.now = func() time.Time { return time.Now().Add(pendingLife) }
+	_, err = p.Exchange(context.Background(), state, code)
+	assert.Equal(ErrInvalidState, err)
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	m := newMockProvider(t)
+	defer m.server.Close()
+	p := newTestProvider(t, m)
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		hook func(header, claims map[string]interface{})
+		err  string
+	}{
+		{"alg none", func(h, c map[string]interface{}) { h["alg"] = "none" }, "unsupported algorithm"},
+		{"alg HS256", func(h, c map[string]interface{}) { h["alg"] = "HS256" }, "unsupported algorithm"},
+		{"wrong issuer", func(h, c map[string]interface{}) { c["iss"] = "https://evil.com" }, "wrong issuer"},
+		{"wrong audience", func(h, c map[string]interface{}) { c["aud"] = []string{"other"} }, "isn't issued for the drive"},
+		{"wrong azp", func(h, c map[string]interface{}) { c["aud"] = []string{testClientID, "other"}; c["azp"] = "other" }, "authorized party"},
+		{"expired", func(h, c map[string]interface{}) { c["exp"] = time.Now().Add(-2 * time.Minute).Unix() }, "expired"},
+		{"future", func(h, c map[string]interface{}) { c["iat"] = time.Now().Add(time.Hour).Unix() }, "future"},
+		{"wrong nonce", func(h, c map[string]interface{}) { c["nonce"] = "other" }, "wrong nonce"},
+		{"no subject", func(h, c map[string]interface{}) { delete(c, "sub") }, "no subject"},
+		{"unknown key", func(h, c map[string]interface{}) { h["kid"] = "other" }, "unknown signing key"},
+	}
+
+	for _, tt := range tests {
+		m.tokenHook = tt.hook
+		_, err := login(t, m, p, map[string]interface{}{"sub": "user-1", "groups": "drive-admins"})
+		if assert.NotNil(t, err, tt.name) {
+			assert.Contains(t, err.Error(), tt.err, tt.name)
+		}
+	}
+
+	// Wrong signature: the token is signed with a key, which isn't published
+	m.tokenHook = nil
+	m.signKey = otherKey
+	_, err = login(t, m, p, map[string]interface{}{"sub": "user-1", "groups": "drive-admins"})
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "wrong signature")
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	assert := assert.New(t)
+
+	m := newMockProvider(t)
+	defer m.server.Close()
+	p := newTestProvider(t, m)
+
+	claims := map[string]interface{}{"sub": "user-1", "groups": "drive-admins"}
+
+	_, err := login(t, m, p, claims)
+	assert.Nil(err)
+	_, err = login(t, m, p, claims)
+	assert.Nil(err)
+	assert.Equal(1, m.jwksRequests)
+
+	// New keys are fetched, but not too often
+	m.rotateKey(t)
+	_, err = login(t, m, p, claims)
+	assert.NotNil(err)
+
+	p.now = func() time.Time { return time.Now().Add(minKeysRefreshInterval) }
+	_, err = login(t, m, p, claims)
+	assert.Nil(err)
+	assert.Equal(2, m.jwksRequests)
+}
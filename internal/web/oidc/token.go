@@ -0,0 +1,217 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// clockSkew is an allowed difference between clocks of the drive and the provider
+	clockSkew = time.Minute
+	// minKeysRefreshInterval limits fetching of JWKS, when a token is signed with an unknown key
+	minKeysRefreshInterval = time.Minute
+)
+
+// jwk is a JSON Web Key (RFC 7517). Only RSA keys are supported
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+func (k jwk) publicKey() (*rsa.PublicKey, error) {
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid modulus")
+	}
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil || len(e) == 0 || len(e) > 4 {
+		return nil, errors.New("invalid exponent")
+	}
+
+	var exp int
+	for _, b := range e {
+		exp = exp<<8 | int(b)
+	}
+
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: exp}, nil
+}
+
+// fetchKeys fetches signing keys of the provider
+func (p *Provider) fetchKeys(ctx context.Context, d *discovery) (map[string]*rsa.PublicKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := p.getJSON(ctx, d.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+
+		key, err := k.publicKey()
+		if err != nil {
+			p.logger.Warnf("skip OIDC key \"%s\": %s\n", k.Kid, err)
+			continue
+		}
+		keys[k.Kid] = key
+	}
+
+	return keys, nil
+}
+
+// key returns a signing key with passed id. Keys are refetched, if there's no such key (keys can be rotated)
+func (p *Provider) key(ctx context.Context, d *discovery, kid string) (*rsa.PublicKey, error) {
+	find := func() *rsa.PublicKey {
+		if key, ok := p.keys[kid]; ok {
+			return key
+		}
+		if kid == "" && len(p.keys) == 1 {
+			for _, key := range p.keys {
+				return key
+			}
+		}
+		return nil
+	}
+
+	p.mutex.Lock()
+	key := find()
+	canRefresh := p.now().Sub(p.keysTime) >= minKeysRefreshInterval
+	p.mutex.Unlock()
+
+	if key != nil {
+		return key, nil
+	}
+	if !canRefresh {
+		return nil, errors.Errorf("unknown signing key \"%s\"", kid)
+	}
+
+	keys, err := p.fetchKeys(ctx, d)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.keys = keys
+	p.keysTime = p.now()
+
+	if key = find(); key == nil {
+		return nil, errors.Errorf("unknown signing key \"%s\"", kid)
+	}
+	return key, nil
+}
+
+// verifyIDToken checks the signature (only RS256 is supported) and claims of an ID token. It returns the claims
+func (p *Provider) verifyIDToken(ctx context.Context, d *discovery, token, nonce string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("invalid ID token: malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, errors.Wrap(err, "invalid ID token: can't decode header")
+	}
+	if header.Alg != "RS256" {
+		return nil, errors.Errorf("invalid ID token: unsupported algorithm \"%s\"", header.Alg)
+	}
+
+	key, err := p.key(ctx, d, header.Kid)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid ID token")
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("invalid ID token: can't decode signature")
+	}
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], signature); err != nil {
+		return nil, errors.New("invalid ID token: wrong signature")
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, errors.Wrap(err, "invalid ID token: can't decode claims")
+	}
+
+	if err := p.checkClaims(d, claims, nonce); err != nil {
+		return nil, errors.Wrap(err, "invalid ID token")
+	}
+	return claims, nil
+}
+
+func decodeSegment(s string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// checkClaims checks claims of an ID token (OpenID Connect Core 1.0, 3.1.3.7)
+func (p *Provider) checkClaims(d *discovery, claims map[string]interface{}, nonce string) error {
+	if iss, _ := claims["iss"].(string); iss != d.Issuer {
+		return errors.Errorf("wrong issuer \"%s\"", iss)
+	}
+
+	if sub, _ := claims["sub"].(string); sub == "" {
+		return errors.New("no subject")
+	}
+
+	var audience []string
+	switch aud := claims["aud"].(type) {
+	case string:
+		audience = append(audience, aud)
+	case []interface{}:
+		for _, a := range aud {
+			if s, ok := a.(string); ok {
+				audience = append(audience, s)
+			}
+		}
+	}
+	validAudience := false
+	for _, a := range audience {
+		validAudience = validAudience || a == p.config.ClientID
+	}
+	if !validAudience {
+		return errors.New("token isn't issued for the drive")
+	}
+	if azp, ok := claims["azp"].(string); ok && azp != p.config.ClientID {
+		return errors.Errorf("wrong authorized party \"%s\"", azp)
+	}
+
+	now := p.now()
+	exp, ok := claims["exp"].(float64)
+	if !ok || !now.Before(time.Unix(int64(exp), 0).Add(clockSkew)) {
+		return errors.New("token is expired")
+	}
+	if iat, ok := claims["iat"].(float64); ok && time.Unix(int64(iat), 0).After(now.Add(clockSkew)) {
+		return errors.New("token is issued in the future")
+	}
+
+	if n, _ := claims["nonce"].(string); n != nonce {
+		return errors.New("wrong nonce")
+	}
+
+	return nil
+}
@@ -0,0 +1,44 @@
+package oidc
+
+import (
+	"context"
+
+	"github.com/tags-drive/core/internal/web/users"
+)
+
+type Config struct {
+	// Issuer is an URL of the provider. Endpoints are discovered via "{Issuer}/.well-known/openid-configuration"
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is an URL of the callback (for example, https://drive.example.com/api/login/oidc/callback)
+	RedirectURL string
+	Scopes      []string
+
+	// LoginClaim is a claim with a login of a user. "email" and "sub" claims are used, if it is empty
+	LoginClaim string
+	// RoleClaim is a claim with groups or roles of a user. It can be a string or an array of strings
+	RoleClaim string
+	// RoleMapping maps values of RoleClaim to roles. The highest role is chosen
+	RoleMapping map[string]users.Role
+	// DefaultRole is a role of users without mapped values. Users can't log in, if it is empty
+	DefaultRole users.Role
+}
+
+// Identity is a verified user of the provider
+type Identity struct {
+	Subject string
+	Login   string
+	Role    users.Role
+}
+
+// ProviderInterface provides methods for OpenID Connect authorization code flow with PKCE
+type ProviderInterface interface {
+	// AuthURL returns an URL of the login page of the provider. The state must be saved
+	// (for example, in a cookie) and passed to Exchange
+	AuthURL(ctx context.Context) (authURL, state string, err error)
+
+	// Exchange exchanges an authorization code for an ID token, verifies the token and returns
+	// the identity of the user
+	Exchange(ctx context.Context, state, code string) (Identity, error)
+}
@@ -0,0 +1,80 @@
+// Package passwords hashes passwords of users and shares with scrypt
+package passwords
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/scrypt"
+)
+
+// scrypt params. They are saved with every hash, so they can be changed later
+const (
+	scryptN      = 1 << 15
+	scryptR      = 8
+	scryptP      = 1
+	scryptKeyLen = 32
+	saltSize     = 16
+
+	scryptPrefix = "scrypt$"
+)
+
+// Hash returns a salted scrypt hash of a password in format "scrypt$N$r$p$salt$hash"
+func Hash(password string) (string, error) {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return "", errors.Wrap(err, "can't generate salt")
+	}
+
+	key, err := scrypt.Key([]byte(password), salt, scryptN, scryptR, scryptP, scryptKeyLen)
+	if err != nil {
+		return "", errors.Wrap(err, "can't hash password")
+	}
+
+	enc := base64.RawStdEncoding
+	return fmt.Sprintf("%s%d$%d$%d$%s$%s", scryptPrefix, scryptN, scryptR, scryptP, enc.EncodeToString(salt), enc.EncodeToString(key)), nil
+}
+
+// IsHash returns true, if s looks like a result of Hash
+func IsHash(s string) bool {
+	return strings.HasPrefix(s, scryptPrefix)
+}
+
+// Check returns true, if hash is a hash of password
+func Check(hash, password string) bool {
+	parts := strings.Split(strings.TrimPrefix(hash, scryptPrefix), "$")
+	if !strings.HasPrefix(hash, scryptPrefix) || len(parts) != 5 {
+		return false
+	}
+
+	var params [3]int
+	for i := range params {
+		v, err := strconv.Atoi(parts[i])
+		if err != nil {
+			return false
+		}
+		params[i] = v
+	}
+
+	enc := base64.RawStdEncoding
+	salt, err := enc.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+	expected, err := enc.DecodeString(parts[4])
+	if err != nil {
+		return false
+	}
+
+	key, err := scrypt.Key([]byte(password), salt, params[0], params[1], params[2], len(expected))
+	if err != nil {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare(key, expected) == 1
+}
@@ -0,0 +1,32 @@
+package passwords
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPasswords(t *testing.T) {
+	assert := assert.New(t)
+
+	hash, err := Hash("password")
+	if !assert.Nil(err) {
+		return
+	}
+	assert.True(strings.HasPrefix(hash, "scrypt$32768$8$1$"))
+	assert.NotContains(hash, "password")
+
+	assert.True(Check(hash, "password"))
+	assert.False(Check(hash, "Password"))
+	assert.False(Check("password", "password"))
+	assert.False(Check("scrypt$1$2$3", "password"))
+	assert.False(Check("scrypt$1$2$3$4$5", "password"))
+
+	assert.True(IsHash(hash))
+	assert.False(IsHash("password"))
+
+	// Salt is random
+	other, _ := Hash("password")
+	assert.NotEqual(hash, other)
+}
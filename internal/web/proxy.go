@@ -0,0 +1,201 @@
+package web
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/tags-drive/core/internal/storage/audit"
+	"github.com/tags-drive/core/internal/web/users"
+)
+
+// proxyInfo is saved in the request context by proxyMiddleware
+type proxyInfo struct {
+	// trusted is true, if the request was sent by a trusted proxy
+	trusted bool
+	// proto is a scheme of the original request (X-Forwarded-Proto)
+	proto string
+}
+
+// isTrustedProxy returns true, if ip belongs to one of trusted networks
+func isTrustedProxy(ip net.IP, trusted []*net.IPNet) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedClient returns an IP address of a client from X-Forwarded-For. Every proxy appends an address
+// of its client, so the header is read from the right and the first untrusted address is the client.
+// Addresses on the left can be forged by the client. It returns an empty string, if the header is invalid
+func forwardedClient(r *http.Request, trusted []*net.IPNet) string {
+	var hops []string
+	for _, header := range r.Header["X-Forwarded-For"] {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+
+	client := ""
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			break
+		}
+
+		client = ip.String()
+		if !isTrustedProxy(ip, trusted) {
+			break
+		}
+	}
+	return client
+}
+
+// proxyMiddleware handles requests from trusted proxies: RemoteAddr is replaced with an address of
+// the client from X-Forwarded-For and X-Forwarded-Proto is saved (see isHTTPS). Headers of other
+// requests are ignored
+func proxyMiddleware(h http.Handler, trusted []*net.IPNet) http.Handler {
+	if len(trusted) == 0 {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var info proxyInfo
+		client := ""
+		if isTrustedProxy(net.ParseIP(remoteIP(r)), trusted) {
+			info.trusted = true
+			client = forwardedClient(r, trusted)
+			// The first value is set by the first proxy
+			proto := strings.Split(r.Header.Get("X-Forwarded-Proto"), ",")[0]
+			info.proto = strings.ToLower(strings.TrimSpace(proto))
+		}
+
+		r = r.WithContext(context.WithValue(r.Context(), proxyContextKey, info))
+		if client != "" {
+			r.RemoteAddr = client
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// fromTrustedProxy returns true, if a request was sent by a trusted proxy
+func fromTrustedProxy(r *http.Request) bool {
+	info, _ := r.Context().Value(proxyContextKey).(proxyInfo)
+	return info.trusted
+}
+
+// isHTTPS returns true, if a request was sent over TLS directly or to a trusted proxy
+func isHTTPS(r *http.Request) bool {
+	info, _ := r.Context().Value(proxyContextKey).(proxyInfo)
+	return r.TLS != nil || info.proto == "https"
+}
+
+// basePathMiddleware serves requests under basePath and strips it, so routes don't depend on it.
+// Other requests get 404
+func basePathMiddleware(h http.Handler, basePath string) http.Handler {
+	if basePath == "" {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == basePath {
+			http.Redirect(w, r, basePath+"/", http.StatusMovedPermanently)
+			return
+		}
+		if !strings.HasPrefix(r.URL.Path, basePath+"/") {
+			http.NotFound(w, r)
+			return
+		}
+
+		r2 := new(http.Request)
+		*r2 = *r
+		r2.URL = new(url.URL)
+		*r2.URL = *r.URL
+		r2.URL.Path = strings.TrimPrefix(r.URL.Path, basePath)
+		r2.URL.RawPath = strings.TrimPrefix(r.URL.RawPath, basePath)
+
+		h.ServeHTTP(w, r2)
+	})
+}
+
+// withBasePath returns an absolute path of a route of the drive
+func (s Server) withBasePath(path string) string {
+	return s.config.BasePath + path
+}
+
+// forwardedLogin returns a login from ForwardAuthHeader. The header is used only, if it is set
+// by a trusted proxy
+func (s Server) forwardedLogin(r *http.Request) (string, bool) {
+	if s.config.ForwardAuthHeader == "" || !fromTrustedProxy(r) {
+		return "", false
+	}
+
+	login := strings.TrimSpace(r.Header.Get(s.config.ForwardAuthHeader))
+	return login, login != ""
+}
+
+// externalAuth authenticates a user by the proxy or by a client certificate. A new session is started only
+// for navigation requests of browsers without a session of this user, so sessions and the vault work as usual.
+// Other requests (scripts, clients without cookies) are authenticated statelessly: they have no session.
+// The returned request contains the auth cookie of the session, if there's one
+func (s Server) externalAuth(w http.ResponseWriter, r *http.Request, login, method string) (*http.Request, users.User, error) {
+	if user, ok := s.tokenUser(r); ok && user.Login == login {
+		return r, user, nil
+	}
+
+	user, err := s.users.GetByLogin(login)
+	if err != nil {
+		return nil, users.User{}, err
+	}
+	if user.Disabled {
+		return nil, users.User{}, users.ErrUserDisabled
+	}
+
+	if r.Header.Get("Sec-Fetch-Mode") != "navigate" {
+		// The session of another user mustn't be used
+		return s.withAuthCookie(r, ""), user, nil
+	}
+
+	token, err := s.authService.GenerateToken()
+	if err != nil {
+		return nil, users.User{}, errors.Wrap(err, "can't start session")
+	}
+	s.authService.AddToken(token, user.ID, remoteIP(r), r.UserAgent())
+	http.SetCookie(w, s.authCookie(r, token, time.Now().Add(s.config.MaxTokenLife)))
+
+	s.logger.Warnf("%s logged in as \"%s\" via %s\n", r.RemoteAddr, user.Login, method)
+	s.auditUserEvent(r, user, audit.ActionLogin, method)
+
+	return s.withAuthCookie(r, token), user, nil
+}
+
+// withAuthCookie returns a copy of a request with passed auth token. The old auth cookie is removed.
+// Empty token means the request has no auth cookie
+func (s Server) withAuthCookie(r *http.Request, token string) *http.Request {
+	cookies := r.Cookies()
+	r = r.WithContext(r.Context())
+	header := make(http.Header, len(r.Header))
+	for k, v := range r.Header {
+		header[k] = v
+	}
+	header.Del("Cookie")
+	r.Header = header
+	for _, c := range cookies {
+		if c.Name != s.config.AuthCookieName {
+			r.AddCookie(c)
+		}
+	}
+	if token != "" {
+		r.AddCookie(&http.Cookie{Name: s.config.AuthCookieName, Value: token})
+	}
+
+	return r
+}
@@ -5,58 +5,171 @@ import (
 	"net/http/pprof"
 
 	"github.com/gorilla/mux"
+
+	"github.com/tags-drive/core/internal/web/apitokens"
+	"github.com/tags-drive/core/internal/web/users"
+)
+
+// Roles of routes. Routes with empty role don't need auth
+const (
+	public = users.Role("")
+	viewer = users.RoleViewer
+	editor = users.RoleEditor
+	admin  = users.RoleAdmin
+)
+
+// Scopes of API tokens. Routes with sessionOnly scope can't be used with API tokens
+const (
+	sessionOnly = apitokens.Scope("")
+	scopeRead   = apitokens.ScopeRead
+	scopeUpload = apitokens.ScopeUpload
+	scopeTag    = apitokens.ScopeTag
+	scopeDelete = apitokens.ScopeDelete
+	scopeAdmin  = apitokens.ScopeAdmin
 )
 
 type route struct {
-	path     string
-	methods  string
-	handler  http.HandlerFunc
-	needAuth bool
+	path    string
+	methods string
+	handler http.HandlerFunc
+	// role is a minimal role of a user, who can use the route
+	role users.Role
+	// scope is a scope of API tokens, which can be used for the route
+	scope apitokens.Scope
 }
 
 func (s *Server) addDefaultRoutes(router *mux.Router) {
 	routes := []route{
 		// Pages
-		{"/", "GET", s.index, true},
-		{"/mobile", "GET", s.mobile, true},
-		{"/login", "GET", s.login, false},
-		{"/version", "GET", s.backendVersion, false},
+		{"/", "GET", s.index, viewer, sessionOnly},
+		{"/mobile", "GET", s.mobile, viewer, sessionOnly},
+		{"/login", "GET", s.login, public, sessionOnly},
+		{"/version", "GET", s.backendVersion, public, sessionOnly},
 
 		// Auth
-		{"/api/login", "POST", s.authentication, false},
-		{"/api/logout", "POST", s.logout, true},
+		{"/api/login", "POST", s.authentication, public, sessionOnly},
+		{"/api/login/2fa", "POST", s.authenticationSecondFactor, public, sessionOnly},
+		{"/api/logout", "POST", s.logout, viewer, sessionOnly},
 		// deprecated
-		{"/login", "POST", s.authentication, false},
-		{"/logout", "POST", s.logout, true},
+		{"/login", "POST", s.authentication, public, sessionOnly},
+		{"/logout", "POST", s.logout, viewer, sessionOnly},
 
 		// Files
-		{"/api/file/{id:\\d+}", "GET", s.returnSingleFile, false},
-		{"/api/files", "GET", s.returnFiles, true},
-		{"/api/files/recent", "GET", s.returnRecentFiles, true},
-		{"/api/files/download", "GET", s.downloadFiles, true},
-		{"/api/files", "POST", s.upload, true},
+		{"/api/file/{id:\\d+}", "GET", s.returnSingleFile, viewer, scopeRead},
+		{"/api/files", "GET", s.returnFiles, viewer, scopeRead},
+		{"/api/files/recent", "GET", s.returnRecentFiles, viewer, scopeRead},
+		{"/api/files/download", "GET", s.downloadFiles, viewer, scopeRead},
+		{"/api/files", "POST", s.upload, editor, scopeUpload},
+		{"/api/files/encrypted", "POST", s.uploadEncrypted, editor, scopeUpload},
 		// change file info
-		{"/api/file/{id:\\d+}/name", "PUT", s.changeFilename, true},
-		{"/api/file/{id:\\d+}/tags", "PUT", s.changeFileTags, true},
-		{"/api/file/{id:\\d+}/description", "PUT", s.changeFileDescription, true},
+		{"/api/file/{id:\\d+}/name", "PUT", s.changeFilename, editor, scopeTag},
+		{"/api/file/{id:\\d+}/tags", "PUT", s.changeFileTags, editor, scopeTag},
+		{"/api/file/{id:\\d+}/description", "PUT", s.changeFileDescription, editor, scopeTag},
 		// bulk tags changing
-		{"/api/files/tags", "POST", s.addTagsToFiles, true},
-		{"/api/files/tags", "DELETE", s.removeTagsFromFiles, true},
+		{"/api/files/tags", "POST", s.addTagsToFiles, editor, scopeTag},
+		{"/api/files/tags", "DELETE", s.removeTagsFromFiles, editor, scopeTag},
 		// remove or recover files
-		{"/api/files", "DELETE", s.deleteFile, true},
-		{"/api/files/recover", "POST", s.recoverFile, true},
+		{"/api/files", "DELETE", s.deleteFile, editor, scopeDelete},
+		{"/api/files/recover", "POST", s.recoverFile, editor, scopeDelete},
+		// review of files uploaded via drop links
+		{"/api/files/pending", "GET", s.returnPendingFiles, editor, sessionOnly},
+		{"/api/files/accept", "POST", s.acceptFiles, editor, sessionOnly},
 
 		// Tags
-		{"/api/tags", "GET", s.returnTags, true},
-		{"/api/tags", "POST", s.addTag, true},
-		{"/api/tag/{id:\\d+}", "PUT", s.changeTag, true},
-		{"/api/tags", "DELETE", s.deleteTag, true},
+		{"/api/tags", "GET", s.returnTags, viewer, scopeRead},
+		{"/api/tags", "POST", s.addTag, editor, scopeTag},
+		{"/api/tag/{id:\\d+}", "PUT", s.changeTag, editor, scopeTag},
+		{"/api/tag/{id:\\d+}/acl", "PUT", s.changeTagACL, editor, scopeTag},
+		{"/api/tag/{id:\\d+}/acl", "DELETE", s.deleteTagACL, editor, scopeTag},
+		{"/api/tags", "DELETE", s.deleteTag, editor, scopeDelete},
+
+		// Client-side encryption
+		{"/api/client-encryption", "GET", s.returnClientParams, viewer, scopeRead},
+		{"/api/client-encryption", "POST", s.setClientParams, admin, scopeAdmin},
+
+		// Users
+		{"/api/user", "GET", s.returnCurrentUser, viewer, scopeRead},
+		{"/api/account/password", "PUT", s.changePassword, viewer, sessionOnly},
+		{"/api/users", "GET", s.returnUsers, admin, scopeAdmin},
+		{"/api/users", "POST", s.addUser, admin, scopeAdmin},
+		{"/api/user/{id:\\d+}/disabled", "PUT", s.changeUserDisabled, admin, scopeAdmin},
+		{"/api/users", "DELETE", s.deleteUser, admin, scopeAdmin},
+		{"/api/user/{id:\\d+}/2fa", "DELETE", s.resetUserTwoFactor, admin, scopeAdmin},
+
+		// Two-factor authentication
+		{"/api/account/2fa", "GET", s.twoFactorStatus, viewer, sessionOnly},
+		{"/api/account/2fa", "POST", s.enrollTwoFactor, viewer, sessionOnly},
+		{"/api/account/2fa/confirm", "POST", s.confirmTwoFactor, viewer, sessionOnly},
+		{"/api/account/2fa", "DELETE", s.disableTwoFactor, viewer, sessionOnly},
+
+		// Sessions
+		{"/api/sessions", "GET", s.returnSessions, viewer, sessionOnly},
+		{"/api/sessions", "DELETE", s.deleteSessions, viewer, sessionOnly},
+
+		// API tokens
+		{"/api/tokens", "GET", s.returnAPITokens, viewer, sessionOnly},
+		{"/api/tokens", "POST", s.addAPIToken, viewer, sessionOnly},
+		{"/api/tokens", "DELETE", s.deleteAPIToken, viewer, sessionOnly},
+
+		// Shares
+		{"/api/shares", "GET", s.returnShares, editor, sessionOnly},
+		{"/api/shares", "POST", s.addShare, editor, sessionOnly},
+		{"/api/shares", "DELETE", s.deleteShare, editor, sessionOnly},
+		// available without auth
+		{"/api/share/{slug}", "GET", s.returnShare, public, sessionOnly},
+		{"/api/share/{slug}/unlock", "POST", s.unlockShare, public, sessionOnly},
+		{"/api/share/{slug}/preview/{id:\\d+}", "GET", s.returnSharedPreview, public, sessionOnly},
+		{"/api/share/{slug}/stream/{id:\\d+}", "GET", s.streamSharedFile, public, sessionOnly},
+		{"/api/share/{slug}/file/{id:\\d+}", "GET", s.downloadSharedFile, public, sessionOnly},
+		{"/api/share/{slug}/download", "GET", s.downloadShare, public, sessionOnly},
+		// gallery, which works without the web app
+		{"/share/{slug}", "GET", s.gallery, public, sessionOnly},
+		{"/share/{slug}", "POST", s.unlockGallery, public, sessionOnly},
+		{"/share/{slug}/{id:\\d+}", "GET", s.galleryFile, public, sessionOnly},
+
+		// Drop links
+		{"/api/drops", "GET", s.returnDrops, editor, sessionOnly},
+		{"/api/drops", "POST", s.addDrop, editor, sessionOnly},
+		{"/api/drops", "DELETE", s.deleteDrop, editor, sessionOnly},
+		// available without auth
+		{"/api/drop/{slug}", "GET", s.returnDrop, public, sessionOnly},
+		{"/api/drop/{slug}", "POST", s.uploadToDrop, public, sessionOnly},
+
+		// Brute-force protection
+		{"/api/bans", "GET", s.returnBans, admin, scopeAdmin},
+		{"/api/bans", "DELETE", s.deleteBan, admin, scopeAdmin},
+	}
+
+	if s.vault != nil {
+		routes = append(routes,
+			route{"/api/vault", "GET", s.vaultStatus, viewer, sessionOnly},
+			route{"/api/vault/unlock", "POST", s.unlockVault, viewer, sessionOnly},
+			route{"/api/vault/lock", "POST", s.lockVault, viewer, sessionOnly},
+		)
+	}
+
+	if s.seal != nil {
+		routes = append(routes, route{"/api/seal", "POST", s.sealDrive, admin, scopeAdmin})
+	}
+
+	if s.audit != nil {
+		routes = append(routes,
+			route{"/api/audit", "GET", s.returnAuditEvents, admin, scopeAdmin},
+			route{"/api/audit/export", "GET", s.exportAuditEvents, admin, scopeAdmin},
+		)
+	}
+
+	if s.oidc != nil {
+		routes = append(routes,
+			route{"/api/login/oidc", "GET", s.loginOIDC, public, sessionOnly},
+			route{oidcCallbackPath, "GET", s.loginOIDCCallback, public, sessionOnly},
+		)
 	}
 
 	for _, r := range routes {
 		var handler http.Handler = r.handler
-		if r.needAuth {
-			handler = s.authMiddleware(r.handler)
+		if r.role != public {
+			handler = s.authMiddleware(r.handler, r.role, r.scope)
 		}
 		router.Path(r.path).Methods(r.methods).Handler(handler)
 	}
@@ -64,23 +177,38 @@ func (s *Server) addDefaultRoutes(router *mux.Router) {
 
 func (s *Server) addDebugRoutes(router *mux.Router) {
 	routes := []route{
-		{"/login", "OPTIONS", setDebugHeaders, false},
-		{"/logout", "OPTIONS", setDebugHeaders, false},
-		{"/api/file/{id:\\d+}", "OPTIONS", setDebugHeaders, false},
-		{"/api/files", "OPTIONS", setDebugHeaders, false},
-		{"/api/files/tags", "OPTIONS", setDebugHeaders, false},
-		{"/api/files/recover", "OPTIONS", setDebugHeaders, false},
-		{"/api/file/{id:\\d+}/tags", "OPTIONS", setDebugHeaders, false},
-		{"/api/file/{id:\\d+}/name", "OPTIONS", setDebugHeaders, false},
-		{"/api/file/{id:\\d+}/description", "OPTIONS", setDebugHeaders, false},
-		{"/api/tags", "OPTIONS", setDebugHeaders, false},
-		{"/api/tag/{id:\\d+}", "OPTIONS", setDebugHeaders, false},
+		{"/login", "OPTIONS", setDebugHeaders, public, sessionOnly},
+		{"/logout", "OPTIONS", setDebugHeaders, public, sessionOnly},
+		{"/api/file/{id:\\d+}", "OPTIONS", setDebugHeaders, public, sessionOnly},
+		{"/api/files", "OPTIONS", setDebugHeaders, public, sessionOnly},
+		{"/api/files/encrypted", "OPTIONS", setDebugHeaders, public, sessionOnly},
+		{"/api/client-encryption", "OPTIONS", setDebugHeaders, public, sessionOnly},
+		{"/api/files/tags", "OPTIONS", setDebugHeaders, public, sessionOnly},
+		{"/api/files/recover", "OPTIONS", setDebugHeaders, public, sessionOnly},
+		{"/api/files/accept", "OPTIONS", setDebugHeaders, public, sessionOnly},
+		{"/api/file/{id:\\d+}/tags", "OPTIONS", setDebugHeaders, public, sessionOnly},
+		{"/api/file/{id:\\d+}/name", "OPTIONS", setDebugHeaders, public, sessionOnly},
+		{"/api/file/{id:\\d+}/description", "OPTIONS", setDebugHeaders, public, sessionOnly},
+		{"/api/tags", "OPTIONS", setDebugHeaders, public, sessionOnly},
+		{"/api/tag/{id:\\d+}", "OPTIONS", setDebugHeaders, public, sessionOnly},
+		{"/api/tag/{id:\\d+}/acl", "OPTIONS", setDebugHeaders, public, sessionOnly},
+		{"/api/users", "OPTIONS", setDebugHeaders, public, sessionOnly},
+		{"/api/account/password", "OPTIONS", setDebugHeaders, public, sessionOnly},
+		{"/api/login/2fa", "OPTIONS", setDebugHeaders, public, sessionOnly},
+		{"/api/account/2fa", "OPTIONS", setDebugHeaders, public, sessionOnly},
+		{"/api/account/2fa/confirm", "OPTIONS", setDebugHeaders, public, sessionOnly},
+		{"/api/sessions", "OPTIONS", setDebugHeaders, public, sessionOnly},
+		{"/api/tokens", "OPTIONS", setDebugHeaders, public, sessionOnly},
+		{"/api/bans", "OPTIONS", setDebugHeaders, public, sessionOnly},
+		{"/api/shares", "OPTIONS", setDebugHeaders, public, sessionOnly},
+		{"/api/drops", "OPTIONS", setDebugHeaders, public, sessionOnly},
+		{"/api/user/{id:\\d+}/disabled", "OPTIONS", setDebugHeaders, public, sessionOnly},
 	}
 
 	for _, r := range routes {
 		var handler http.Handler = r.handler
-		if r.needAuth {
-			handler = s.authMiddleware(r.handler)
+		if r.role != public {
+			handler = s.authMiddleware(r.handler, r.role, r.scope)
 		}
 		router.Path(r.path).Methods(r.methods).Handler(handler)
 	}
@@ -0,0 +1,287 @@
+package web
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	clog "github.com/ShoshinNikita/log/v2"
+	"github.com/pkg/errors"
+
+	"github.com/tags-drive/core/internal/web/certs"
+	"github.com/tags-drive/core/internal/web/limiter"
+)
+
+// Errors
+var (
+	ErrAlreadyUnsealed = errors.New("drive is already unsealed")
+	ErrAlreadySealed   = errors.New("drive is already sealed")
+)
+
+// Unsealer opens and closes storages of the drive
+type Unsealer interface {
+	// Unseal inits storages with passed passphrase and returns a server of the drive
+	Unseal(passPhrase []byte) (*Server, error)
+	// Seal shutdowns storages and wipes the key
+	Seal() error
+}
+
+// SealedServer starts with locked storages. It serves only GET /health and POST /api/unseal
+// until the drive is unsealed. After that all requests are passed to the handler of the drive
+type SealedServer struct {
+	config   Config
+	unsealer Unsealer
+
+	// handler is nil, when the drive is sealed
+	handler http.Handler
+	server  *Server
+	mutex   *sync.RWMutex
+
+	unsealLimiter limiter.LimiterInterface
+	certs         certs.CertsInterface // nil, if TLS is off
+
+	httpServer     *http.Server
+	redirectServer *http.Server // server, which redirects HTTP to HTTPS
+
+	logger *clog.Logger
+}
+
+// NewSealedServer creates new SealedServer. The drive is sealed
+func NewSealedServer(cnf Config, u Unsealer, lg *clog.Logger) (*SealedServer, error) {
+	// Bans of the unseal limiter are kept only in memory: bans.json can't be decrypted without the key
+	limiterConfig := limiter.Config{
+		Debug:           cnf.Debug,
+		BaseDelay:       authBaseDelay,
+		MaxDelay:        authMaxDelay,
+		MaxFailures:     cnf.MaxLoginFailures,
+		BanDuration:     cnf.LoginBanDuration,
+		FailuresLife:    authFailuresLife,
+		CleanupInterval: authCleanupInterval,
+	}
+	unsealLimiter, err := limiter.NewLimiter(limiterConfig, lg)
+	if err != nil {
+		return nil, err
+	}
+
+	// Certificates of the listener. The server of the drive loads own ones for the content origin
+	c, err := newCerts(cnf, lg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SealedServer{
+		config:        cnf,
+		unsealer:      u,
+		mutex:         new(sync.RWMutex),
+		unsealLimiter: unsealLimiter,
+		certs:         c,
+		logger:        lg,
+	}, nil
+}
+
+// Start starts the server. It has to be ran in goroutine
+func (s *SealedServer) Start() error {
+	s.httpServer = &http.Server{Addr: s.config.Port, Handler: frontMiddlewares(s, s.config)}
+
+	s.unsealLimiter.StartBackgroundServices()
+	if s.certs != nil {
+		s.certs.StartBackgroundServices()
+	}
+
+	if s.config.HTTPRedirectPort != "" {
+		s.redirectServer = startRedirectServer(s.config.HTTPRedirectPort, s.config.Port, s.logger)
+	}
+
+	s.logger.Debugln("start sealed web server")
+
+	// http.ErrServerClosed is a valid error
+	if err := listenAndServe(s.httpServer, s.certs); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+
+	return nil
+}
+
+func (s *SealedServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/health" && r.Method == "GET":
+		s.health(w, r)
+		return
+	case r.URL.Path == "/api/unseal" && r.Method == "POST":
+		s.unseal(w, r)
+		return
+	}
+
+	s.mutex.RLock()
+	handler := s.handler
+	s.mutex.RUnlock()
+
+	if handler == nil {
+		s.processError(w, "drive is sealed", http.StatusServiceUnavailable)
+		return
+	}
+
+	handler.ServeHTTP(w, r)
+}
+
+// IsSealed returns true if the drive is sealed
+func (s *SealedServer) IsSealed() bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.handler == nil
+}
+
+// Unseal unseals the drive with passed passphrase
+func (s *SealedServer) Unseal(passPhrase []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.handler != nil {
+		return ErrAlreadyUnsealed
+	}
+
+	server, err := s.unsealer.Unseal(passPhrase)
+	if err != nil {
+		return err
+	}
+
+	server.OnSeal(s.Seal)
+	s.handler = server.handler()
+	s.server = server
+	server.StartBackgroundServices()
+
+	s.logger.Infoln("drive was unsealed")
+
+	return nil
+}
+
+// Seal seals the drive: storages are shut down and the key is wiped
+func (s *SealedServer) Seal() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.handler == nil {
+		return ErrAlreadySealed
+	}
+
+	// New requests will get 503
+	s.handler = nil
+
+	if err := s.server.Shutdown(); err != nil {
+		s.logger.Warnf("can't shutdown server of the drive gracefully: %s\n", err)
+	}
+	s.server = nil
+
+	err := s.unsealer.Seal()
+	if err != nil {
+		return err
+	}
+
+	s.logger.Infoln("drive was sealed")
+
+	return nil
+}
+
+// Shutdown gracefully shutdowns the server and seals the drive
+func (s *SealedServer) Shutdown() error {
+	shutdown, release := context.WithTimeout(context.Background(), time.Second*10)
+	defer release()
+
+	var serverErr error
+	if s.httpServer != nil {
+		s.httpServer.SetKeepAlivesEnabled(false)
+		serverErr = s.httpServer.Shutdown(shutdown)
+	}
+
+	if s.redirectServer != nil {
+		s.redirectServer.SetKeepAlivesEnabled(false)
+		if err := s.redirectServer.Shutdown(shutdown); err != nil {
+			s.logger.Warnf("can't shutdown HTTP redirect server gracefully: %s\n", err)
+		}
+	}
+
+	if err := s.Seal(); err != nil && err != ErrAlreadySealed {
+		s.logger.Warnf("can't seal the drive: %s\n", err)
+	}
+
+	if err := s.unsealLimiter.Shutdown(); err != nil {
+		s.logger.Warnf("can't shutdown unsealLimiter gracefully: %s\n", err)
+	}
+
+	if s.certs != nil {
+		s.certs.Shutdown()
+	}
+
+	return serverErr
+}
+
+// GET /health
+//
+// Response: json object ({"sealed": bool, "version": string})
+//
+func (s *SealedServer) health(w http.ResponseWriter, r *http.Request) {
+	resp := struct {
+		Sealed  bool   `json:"sealed"`
+		Version string `json:"version"`
+	}{
+		Sealed:  s.IsSealed(),
+		Version: s.config.Version,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// POST /api/unseal
+//
+// Params:
+//   - passphrase: passphrase of the drive
+//
+// Response: -
+//
+func (s *SealedServer) unseal(w http.ResponseWriter, r *http.Request) {
+	if !s.config.IsTLS && !isHTTPS(r) && !s.config.Debug {
+		s.processError(w, "drive can be unsealed only over TLS", http.StatusForbidden)
+		return
+	}
+
+	key := ipKey(r)
+	if wait := s.unsealLimiter.Check(key); wait > 0 {
+		s.logger.Infof("%s was throttled for %s\n", r.RemoteAddr, wait)
+		tooManyRequests(w, wait)
+		return
+	}
+
+	passPhrase := r.FormValue("passphrase")
+	if passPhrase == "" {
+		s.processError(w, "passphrase can't be empty", http.StatusBadRequest)
+		return
+	}
+
+	err := s.Unseal([]byte(passPhrase))
+	if err != nil {
+		if err == ErrAlreadyUnsealed {
+			s.processError(w, err.Error(), http.StatusConflict)
+			return
+		}
+
+		s.unsealLimiter.Fail(key)
+		s.logger.Warnf("%s tried to unseal the drive: %s\n", r.RemoteAddr, err)
+		s.processError(w, "invalid passphrase", http.StatusBadRequest)
+		return
+	}
+
+	s.unsealLimiter.Success(key)
+	s.logger.Warnf("%s unsealed the drive\n", r.RemoteAddr)
+}
+
+// processError is a wrapper over http.Error
+func (s *SealedServer) processError(w http.ResponseWriter, err string, code int) {
+	if s.config.Debug || (500 <= code && code < 600) {
+		s.logger.Errorf("request error: %s (code: %d)\n", err, code)
+	}
+
+	http.Error(w, err, code)
+}
@@ -0,0 +1,440 @@
+// Package shares keeps share links. Share links give anonymous users access to files or to tag queries
+package shares
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	clog "github.com/ShoshinNikita/log/v2"
+	"github.com/pkg/errors"
+
+	"github.com/tags-drive/core/internal/storage/encryption"
+	"github.com/tags-drive/core/internal/web/passwords"
+)
+
+const (
+	slugSize  = 16
+	grantSize = 32
+)
+
+// Errors
+var (
+	ErrShareNotExist   = errors.New("share doesn't exist")
+	ErrNoTarget        = errors.New("share must contain either files or a tag expression")
+	ErrInvalidMode     = errors.New("invalid mode")
+	ErrExpired         = errors.New("expiry time must be in the future")
+	ErrInvalidLimit    = errors.New("download limit can't be negative")
+	ErrWrongPassword   = errors.New("wrong password")
+	ErrNoDownloadsLeft = errors.New("download limit is reached")
+)
+
+type grant struct {
+	shareID int
+	expires time.Time
+}
+
+type stream struct {
+	shareID int
+	fileID  int
+	expires time.Time
+}
+
+type Shares struct {
+	config Config
+	file   encryption.JSONFile
+
+	shares map[int]Share
+	// slugs maps slugs to ids of shares
+	slugs map[string]int
+	maxID int
+	// grants are kept in memory, so passwords have to be entered again after restart
+	grants map[string]grant
+	// streams are keys of started streams of files. A stream is counted as one download
+	streams map[string]stream
+	// used is true, if access counters weren't saved
+	used  bool
+	mutex *sync.RWMutex
+
+	now func() time.Time
+
+	// this channel signals that Shares.Shutdown() function was called
+	shutdowned chan struct{}
+
+	logger *clog.Logger
+}
+
+// NewShares creates new Shares and reads shares from SharesJSONFile
+func NewShares(cnf Config, lg *clog.Logger) (*Shares, error) {
+	s := &Shares{
+		config: cnf,
+		file: encryption.JSONFile{
+			Path:    cnf.SharesJSONFile,
+			Encrypt: cnf.Encrypt,
+			Key:     cnf.PassPhrase,
+			Indent:  cnf.Debug,
+		},
+		shares:     make(map[int]Share),
+		slugs:      make(map[string]int),
+		grants:     make(map[string]grant),
+		streams:    make(map[string]stream),
+		mutex:      new(sync.RWMutex),
+		now:        time.Now,
+		shutdowned: make(chan struct{}),
+		logger:     lg,
+	}
+
+	var list []Share
+	if _, err := s.file.Read(&list); err != nil {
+		return nil, err
+	}
+
+	for _, share := range list {
+		s.shares[share.ID] = share
+		s.slugs[share.Slug] = share.ID
+		if s.maxID < share.ID {
+			s.maxID = share.ID
+		}
+	}
+
+	return s, nil
+}
+
+func (s *Shares) StartBackgroundServices() {
+	// Save access counters, remove expired shares and grants
+	go func() {
+		ticker := time.NewTicker(s.config.SaveInterval)
+		for {
+			select {
+			case <-ticker.C:
+				s.mutex.Lock()
+				s.expire()
+				if s.used {
+					if err := s.write(); err != nil {
+						s.logger.Errorln(err)
+					}
+				}
+				s.mutex.Unlock()
+			case <-s.shutdowned:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+}
+
+// expire removes expired shares and grants. It must be called under the lock
+func (s *Shares) expire() {
+	now := s.now()
+
+	for id, share := range s.shares {
+		if share.IsExpired(now) {
+			s.delete(share)
+			s.used = true
+			s.logger.Debugf("share %d is expired\n", id)
+		}
+	}
+	for key, g := range s.grants {
+		if !now.Before(g.expires) {
+			delete(s.grants, key)
+		}
+	}
+	for key, st := range s.streams {
+		if !now.Before(st.expires) {
+			delete(s.streams, key)
+		}
+	}
+}
+
+// write writes shares into SharesJSONFile. It must be called under the lock
+func (s *Shares) write() error {
+	if err := s.file.Write(s.getAll(0)); err != nil {
+		return err
+	}
+
+	s.used = false
+	return nil
+}
+
+// randomString returns a random url-safe string
+func randomString(size int) (string, error) {
+	raw := make([]byte, size)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+func (s *Shares) Create(share Share, password string) (Share, error) {
+	switch {
+	case (len(share.FileIDs) == 0) == (share.Expr == ""):
+		return Share{}, ErrNoTarget
+	case !share.Mode.IsValid():
+		return Share{}, ErrInvalidMode
+	case !share.Expires.IsZero() && !share.Expires.After(s.now()):
+		return Share{}, ErrExpired
+	case share.MaxDownloads < 0:
+		return Share{}, ErrInvalidLimit
+	}
+	if share.Watermark != nil {
+		if err := share.Watermark.Validate(); err != nil {
+			return Share{}, err
+		}
+	}
+
+	slug, err := randomString(slugSize)
+	if err != nil {
+		return Share{}, errors.Wrap(err, "can't generate slug")
+	}
+
+	share.Name = strings.TrimSpace(share.Name)
+	share.Slug = slug
+	share.PasswordHash = ""
+	share.HasPassword = password != ""
+	if share.HasPassword {
+		share.PasswordHash, err = passwords.Hash(password)
+		if err != nil {
+			return Share{}, err
+		}
+	}
+	share.Views = 0
+	share.Downloads = 0
+	share.LastAccess = time.Time{}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.maxID++
+	share.ID = s.maxID
+	share.Created = s.now()
+
+	s.shares[share.ID] = share
+	s.slugs[share.Slug] = share.ID
+
+	if err := s.write(); err != nil {
+		delete(s.shares, share.ID)
+		delete(s.slugs, share.Slug)
+		return Share{}, err
+	}
+
+	return share, nil
+}
+
+func (s *Shares) Get(id int) (Share, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	share, ok := s.shares[id]
+	if !ok {
+		return Share{}, ErrShareNotExist
+	}
+	return share, nil
+}
+
+func (s *Shares) GetBySlug(slug string) (Share, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	id, ok := s.slugs[slug]
+	if !ok {
+		return Share{}, ErrShareNotExist
+	}
+
+	share := s.shares[id]
+	if share.IsExpired(s.now()) {
+		return Share{}, ErrShareNotExist
+	}
+	return share, nil
+}
+
+func (s *Shares) GetAll(userID int) []Share {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.getAll(userID)
+}
+
+func (s *Shares) getAll(userID int) []Share {
+	res := make([]Share, 0, len(s.shares))
+	for _, share := range s.shares {
+		if userID == 0 || share.UserID == userID {
+			res = append(res, share)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+
+	return res
+}
+
+func (s *Shares) Unlock(id int, password string) (string, error) {
+	share, err := s.Get(id)
+	if err != nil {
+		return "", err
+	}
+
+	// Passwords are checked without the lock: scrypt is slow
+	if !passwords.Check(share.PasswordHash, password) {
+		return "", ErrWrongPassword
+	}
+
+	key, err := randomString(grantSize)
+	if err != nil {
+		return "", errors.Wrap(err, "can't generate grant")
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.shares[id]; !ok {
+		// The share was deleted
+		return "", ErrShareNotExist
+	}
+	s.grants[key] = grant{shareID: id, expires: s.now().Add(s.config.GrantLife)}
+
+	return key, nil
+}
+
+func (s *Shares) CheckGrant(share Share, key string) bool {
+	if !share.HasPassword {
+		return true
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	g, ok := s.grants[key]
+	return ok && g.shareID == share.ID && s.now().Before(g.expires)
+}
+
+func (s *Shares) CountView(id int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	share, ok := s.shares[id]
+	if !ok {
+		return
+	}
+
+	// Counters are saved in background
+	share.Views++
+	share.LastAccess = s.now()
+	s.shares[id] = share
+	s.used = true
+}
+
+func (s *Shares) CountDownload(id int) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.countDownload(id)
+}
+
+// countDownload increments the number of downloads. It must be called under the lock
+func (s *Shares) countDownload(id int) error {
+	share, ok := s.shares[id]
+	if !ok {
+		return ErrShareNotExist
+	}
+	if share.DownloadsLeft() == 0 {
+		return ErrNoDownloadsLeft
+	}
+
+	share.Downloads++
+	share.LastAccess = s.now()
+	s.shares[id] = share
+
+	if share.MaxDownloads > 0 {
+		// Save right away, so the limit can't be bypassed with a restart
+		return s.write()
+	}
+	s.used = true
+	return nil
+}
+
+func (s *Shares) StartStream(id, fileID int) (string, error) {
+	key, err := randomString(grantSize)
+	if err != nil {
+		return "", errors.Wrap(err, "can't generate stream key")
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.countDownload(id); err != nil {
+		return "", err
+	}
+	s.streams[key] = stream{shareID: id, fileID: fileID, expires: s.now().Add(s.config.StreamLife)}
+
+	return key, nil
+}
+
+func (s *Shares) CheckStream(share Share, fileID int, key string) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	st, ok := s.streams[key]
+	return ok && st.shareID == share.ID && st.fileID == fileID && s.now().Before(st.expires)
+}
+
+func (s *Shares) Delete(id int) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	share, ok := s.shares[id]
+	if !ok {
+		return ErrShareNotExist
+	}
+	s.delete(share)
+
+	return s.write()
+}
+
+// delete deletes a share and its grants. It must be called under the lock
+func (s *Shares) delete(share Share) {
+	delete(s.shares, share.ID)
+	delete(s.slugs, share.Slug)
+	for key, g := range s.grants {
+		if g.shareID == share.ID {
+			delete(s.grants, key)
+		}
+	}
+	for key, st := range s.streams {
+		if st.shareID == share.ID {
+			delete(s.streams, key)
+		}
+	}
+}
+
+func (s *Shares) DeleteUserShares(userID int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	deleted := false
+	for _, share := range s.shares {
+		if share.UserID == userID {
+			s.delete(share)
+			deleted = true
+		}
+	}
+
+	if deleted {
+		if err := s.write(); err != nil {
+			s.logger.Errorln(err)
+		}
+	}
+}
+
+func (s *Shares) Shutdown() error {
+	close(s.shutdowned)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.used {
+		return s.write()
+	}
+	return nil
+}
@@ -0,0 +1,224 @@
+package shares
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+
+	clog "github.com/ShoshinNikita/log/v2"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/tags-drive/core/internal/storage/encryption/encryptiontest"
+	"github.com/tags-drive/core/internal/web/watermark"
+)
+
+func newTestShares(t *testing.T, encrypt bool) (*Shares, func()) {
+	path, clean := encryptiontest.TempFile(t, "shares.json")
+
+	cnf := Config{
+		SharesJSONFile: path,
+		Encrypt:        encrypt,
+		PassPhrase:     encryptiontest.Key,
+		SaveInterval:   time.Minute,
+		GrantLife:      time.Hour,
+		StreamLife:     time.Hour,
+	}
+	shares, err := NewShares(cnf, clog.NewProdLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return shares, clean
+}
+
+func TestCreate(t *testing.T) {
+	assert := assert.New(t)
+
+	shares, clean := newTestShares(t, false)
+	defer clean()
+
+	now := time.Date(2019, 5, 1, 12, 0, 0, 0, time.UTC)
+	shares.now = func() time.Time { return now }
+
+	// Errors
+	_, err := shares.Create(Share{Mode: ModePreview}, "")
+	assert.Equal(ErrNoTarget, err)
+	_, err = shares.Create(Share{FileIDs: []int{1}, Expr: "2", Mode: ModePreview}, "")
+	assert.Equal(ErrNoTarget, err)
+	_, err = shares.Create(Share{FileIDs: []int{1}, Mode: "edit"}, "")
+	assert.Equal(ErrInvalidMode, err)
+	_, err = shares.Create(Share{FileIDs: []int{1}, Mode: ModePreview, Expires: now}, "")
+	assert.Equal(ErrExpired, err)
+	_, err = shares.Create(Share{FileIDs: []int{1}, Mode: ModePreview, MaxDownloads: -1}, "")
+	assert.Equal(ErrInvalidLimit, err)
+	_, err = shares.Create(Share{FileIDs: []int{1}, Mode: ModePreview, Watermark: &watermark.Options{Text: "test"}}, "")
+	assert.Equal(watermark.ErrInvalidPosition, err)
+
+	first, err := shares.Create(Share{UserID: 1, FileIDs: []int{1, 2}, Mode: ModeDownload, Downloads: 10}, "")
+	if !assert.Nil(err) {
+		return
+	}
+	second, err := shares.Create(Share{
+		UserID:    2,
+		Expr:      "1",
+		Mode:      ModePreview,
+		Expires:   now.Add(time.Hour),
+		Watermark: &watermark.Options{Text: "test", Position: watermark.PositionCenter, Opacity: 0.5, Scale: 0.5},
+	}, "secret")
+	if !assert.Nil(err) {
+		return
+	}
+
+	assert.Equal(1, first.ID)
+	assert.Equal(0, first.Downloads)
+	assert.False(first.HasPassword)
+	assert.Equal(2, second.ID)
+	assert.True(second.HasPassword)
+	assert.NotEqual(first.Slug, second.Slug)
+	assert.True(len(first.Slug) >= 20)
+
+	// Only the hash is saved
+	data, _ := ioutil.ReadFile(shares.config.SharesJSONFile)
+	assert.NotContains(string(data), "secret")
+	assert.Contains(string(data), second.PasswordHash)
+
+	share, err := shares.GetBySlug(second.Slug)
+	assert.Nil(err)
+	assert.Equal(second, share)
+
+	assert.Len(shares.GetAll(0), 2)
+	assert.Equal([]Share{first}, shares.GetAll(1))
+
+	// Expired share
+	now = now.Add(time.Hour)
+	_, err = shares.GetBySlug(second.Slug)
+	assert.Equal(ErrShareNotExist, err)
+
+	shares.expire()
+	_, err = shares.Get(second.ID)
+	assert.Equal(ErrShareNotExist, err)
+
+	// Persistence
+	assert.Nil(shares.Shutdown())
+	shares, err = NewShares(shares.config, clog.NewProdLogger())
+	if !assert.Nil(err) {
+		return
+	}
+	assert.Equal([]Share{first}, shares.GetAll(0))
+}
+
+func TestUnlock(t *testing.T) {
+	assert := assert.New(t)
+
+	shares, clean := newTestShares(t, true)
+	defer clean()
+
+	now := time.Date(2019, 5, 1, 12, 0, 0, 0, time.UTC)
+	shares.now = func() time.Time { return now }
+
+	open, err := shares.Create(Share{FileIDs: []int{1}, Mode: ModePreview}, "")
+	assert.Nil(err)
+	locked, err := shares.Create(Share{FileIDs: []int{1}, Mode: ModePreview}, "secret")
+	assert.Nil(err)
+
+	assert.True(shares.CheckGrant(open, ""))
+	assert.False(shares.CheckGrant(locked, ""))
+
+	_, err = shares.Unlock(locked.ID, "wrong")
+	assert.Equal(ErrWrongPassword, err)
+
+	grant, err := shares.Unlock(locked.ID, "secret")
+	if !assert.Nil(err) {
+		return
+	}
+	assert.True(shares.CheckGrant(locked, grant))
+
+	// The grant is valid only for its share
+	other, err := shares.Create(Share{FileIDs: []int{2}, Mode: ModePreview}, "secret")
+	assert.Nil(err)
+	assert.False(shares.CheckGrant(other, grant))
+
+	now = now.Add(time.Hour)
+	assert.False(shares.CheckGrant(locked, grant))
+
+	// Grants are deleted with the share
+	grant, err = shares.Unlock(locked.ID, "secret")
+	assert.Nil(err)
+	assert.Nil(shares.Delete(locked.ID))
+	assert.False(shares.CheckGrant(locked, grant))
+	assert.Empty(shares.grants)
+}
+
+func TestCountDownload(t *testing.T) {
+	assert := assert.New(t)
+
+	shares, clean := newTestShares(t, false)
+	defer clean()
+
+	limited, err := shares.Create(Share{UserID: 1, FileIDs: []int{1}, Mode: ModeDownload, MaxDownloads: 2}, "")
+	assert.Nil(err)
+	unlimited, err := shares.Create(Share{UserID: 2, Expr: "1", Mode: ModeDownload}, "")
+	assert.Nil(err)
+
+	assert.Nil(shares.CountDownload(limited.ID))
+	assert.Nil(shares.CountDownload(limited.ID))
+	assert.Equal(ErrNoDownloadsLeft, shares.CountDownload(limited.ID))
+
+	for i := 0; i < 5; i++ {
+		assert.Nil(shares.CountDownload(unlimited.ID))
+	}
+	shares.CountView(unlimited.ID)
+
+	limited, _ = shares.Get(limited.ID)
+	assert.Equal(2, limited.Downloads)
+	assert.Equal(0, limited.DownloadsLeft())
+	unlimited, _ = shares.Get(unlimited.ID)
+	assert.Equal(5, unlimited.Downloads)
+	assert.Equal(1, unlimited.Views)
+	assert.Equal(-1, unlimited.DownloadsLeft())
+
+	// Downloads of limited shares are saved right away
+	reopened, err := NewShares(shares.config, clog.NewProdLogger())
+	if assert.Nil(err) {
+		share, _ := reopened.Get(limited.ID)
+		assert.Equal(2, share.Downloads)
+	}
+
+	shares.DeleteUserShares(1)
+	_, err = shares.Get(limited.ID)
+	assert.Equal(ErrShareNotExist, err)
+	assert.Len(shares.GetAll(0), 1)
+
+	assert.Equal(ErrShareNotExist, shares.Delete(limited.ID))
+}
+
+func TestStream(t *testing.T) {
+	assert := assert.New(t)
+
+	shares, clean := newTestShares(t, false)
+	defer clean()
+
+	share, err := shares.Create(Share{UserID: 1, FileIDs: []int{1, 2}, Mode: ModeDownload, MaxDownloads: 2}, "")
+	assert.Nil(err)
+
+	key, err := shares.StartStream(share.ID, 1)
+	assert.Nil(err)
+	assert.True(shares.CheckStream(share, 1, key))
+	assert.False(shares.CheckStream(share, 2, key))
+	assert.False(shares.CheckStream(share, 1, "wrong key"))
+
+	// A stream is counted once
+	share, _ = shares.Get(share.ID)
+	assert.Equal(1, share.Downloads)
+
+	_, err = shares.StartStream(share.ID, 2)
+	assert.Nil(err)
+	_, err = shares.StartStream(share.ID, 1)
+	assert.Equal(ErrNoDownloadsLeft, err)
+
+	// Keys of streams expire
+	shares.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	assert.False(shares.CheckStream(share, 1, key))
+	shares.expire()
+	assert.Empty(shares.streams)
+}
@@ -0,0 +1,137 @@
+package shares
+
+import (
+	"time"
+
+	"github.com/tags-drive/core/internal/web/watermark"
+)
+
+type Config struct {
+	Debug bool
+
+	SharesJSONFile string
+	Encrypt        bool
+	PassPhrase     [32]byte
+
+	// SaveInterval is an interval of saving access counters and removing expired shares
+	SaveInterval time.Duration
+	// GrantLife is a time, during which a share with a password is available after unlocking
+	GrantLife time.Duration
+	// StreamLife is a time, during which a started stream of a file can be continued without
+	// counting a new download
+	StreamLife time.Duration
+}
+
+// Mode defines what anonymous users can do with shared files
+type Mode string
+
+// Modes
+const (
+	// ModePreview allows to view the list of files and previews of images
+	ModePreview Mode = "preview"
+	// ModeDownload also allows to download original files and archives
+	ModeDownload Mode = "download"
+)
+
+// IsValid returns true, if m is a known mode
+func (m Mode) IsValid() bool {
+	return m == ModePreview || m == ModeDownload
+}
+
+type Share struct {
+	ID int `json:"id"`
+	// Slug is a random part of the link
+	Slug   string `json:"slug"`
+	UserID int    `json:"userID"`
+	Name   string `json:"name"`
+
+	// Exactly one of FileIDs and Expr is set. Files matching Expr are found on every request,
+	// so new files with the tags are shared too
+	FileIDs []int  `json:"fileIDs,omitempty"`
+	Expr    string `json:"expr,omitempty"`
+
+	Mode Mode `json:"mode"`
+	// StripMetadata means metadata is removed from all downloaded images
+	StripMetadata bool `json:"stripMetadata"`
+	// Watermark is added to images, if it isn't nil. Stored files aren't changed
+	Watermark *watermark.Options `json:"watermark,omitempty"`
+	// PasswordHash is empty, if the share has no password. It is empty in API responses
+	PasswordHash string `json:"passwordHash,omitempty"`
+	HasPassword  bool   `json:"hasPassword"`
+	// MaxDownloads is 0, if downloads aren't limited. An archive is counted as one download
+	MaxDownloads int `json:"maxDownloads"`
+
+	Created time.Time `json:"created"`
+	// Expires is zero, if the share doesn't expire
+	Expires time.Time `json:"expires"`
+	//
+	Views      int       `json:"views"`
+	Downloads  int       `json:"downloads"`
+	LastAccess time.Time `json:"lastAccess"`
+}
+
+// IsExpired returns true, if the share is expired at passed time
+func (s Share) IsExpired(now time.Time) bool {
+	return !s.Expires.IsZero() && !now.Before(s.Expires)
+}
+
+// DownloadsLeft returns a number of remaining downloads or -1, if downloads aren't limited
+func (s Share) DownloadsLeft() int {
+	if s.MaxDownloads == 0 {
+		return -1
+	}
+	if s.Downloads >= s.MaxDownloads {
+		return 0
+	}
+	return s.MaxDownloads - s.Downloads
+}
+
+// SharesInterface provides methods for managing share links
+type SharesInterface interface {
+	// StartBackgroundServices starts all background services
+	StartBackgroundServices()
+
+	// Create creates a new share with a random slug. ID, Slug, Created and counters of passed share
+	// are ignored. Empty password means the share has no password. Options of a watermark are validated
+	Create(share Share, password string) (Share, error)
+
+	// Get returns a share with passed id
+	Get(id int) (Share, error)
+
+	// GetBySlug returns a share with passed slug. It returns ErrShareNotExist, if the share is expired
+	GetBySlug(slug string) (Share, error)
+
+	// GetAll returns shares sorted by id. userID 0 means shares of all users
+	GetAll(userID int) []Share
+
+	// Unlock checks the password of a share and returns a grant, which gives access to the share
+	// during GrantLife. It returns ErrWrongPassword, if the password is wrong
+	Unlock(id int, password string) (grant string, err error)
+
+	// CheckGrant returns true, if the grant gives access to the share. Shares without a password
+	// don't need grants
+	CheckGrant(share Share, grant string) bool
+
+	// CountView increments the number of views of a share
+	CountView(id int)
+
+	// CountDownload increments the number of downloads of a share. It returns ErrNoDownloadsLeft,
+	// if the limit is reached
+	CountDownload(id int) error
+
+	// StartStream counts a download of a file and returns a key of the stream. Range requests
+	// with the key aren't counted during StreamLife. It returns ErrNoDownloadsLeft, if the limit is reached
+	StartStream(id, fileID int) (key string, err error)
+
+	// CheckStream returns true, if the key belongs to a stream of the file of the share
+	CheckStream(share Share, fileID int, key string) bool
+
+	// Delete deletes a share, its grants and streams
+	Delete(id int) error
+
+	// DeleteUserShares deletes all shares of a user
+	DeleteUserShares(userID int)
+
+	// Shutdown saves access counters
+	Shutdown() error
+}
@@ -0,0 +1,88 @@
+// Package signer signs short-lived links to files. Keys are generated on start, so all links
+// become invalid after restart
+package signer
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/url"
+	"strconv"
+	"time"
+
+	clog "github.com/ShoshinNikita/log/v2"
+	"github.com/pkg/errors"
+)
+
+const (
+	expiresParam   = "expires"
+	signatureParam = "signature"
+)
+
+type Signer struct {
+	config Config
+
+	key []byte
+
+	now func() time.Time
+
+	logger *clog.Logger
+}
+
+// NewSigner creates new Signer with a random key
+func NewSigner(cnf Config, lg *clog.Logger) (*Signer, error) {
+	if cnf.TokenLife < time.Second {
+		return nil, errors.New("token life must be at least 1 second")
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, errors.Wrap(err, "can't generate a key")
+	}
+
+	return &Signer{
+		config: cnf,
+		key:    key,
+		now:    time.Now,
+		logger: lg,
+	}, nil
+}
+
+func (s Signer) Sign(path string) url.Values {
+	life := int64(s.config.TokenLife / time.Second)
+
+	// Round the expiration time up, so the signature doesn't change within TokenLife
+	expires := (s.now().Unix()/life + 2) * life
+	strExpires := strconv.FormatInt(expires, 10)
+
+	return url.Values{
+		expiresParam:   []string{strExpires},
+		signatureParam: []string{s.sign(path, strExpires)},
+	}
+}
+
+func (s Signer) Check(path string, query url.Values) bool {
+	strExpires := query.Get(expiresParam)
+	expires, err := strconv.ParseInt(strExpires, 10, 64)
+	if err != nil || s.now().Unix() >= expires {
+		return false
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(query.Get(signatureParam))
+	if err != nil {
+		return false
+	}
+	expected, _ := base64.RawURLEncoding.DecodeString(s.sign(path, strExpires))
+
+	return hmac.Equal(signature, expected)
+}
+
+func (s Signer) sign(path, expires string) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(path))
+	mac.Write([]byte{'\n'})
+	mac.Write([]byte(expires))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
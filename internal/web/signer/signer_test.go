@@ -0,0 +1,52 @@
+package signer
+
+import (
+	"testing"
+	"time"
+
+	clog "github.com/ShoshinNikita/log/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSigner(t *testing.T) {
+	assert := assert.New(t)
+
+	s, err := NewSigner(Config{TokenLife: time.Minute}, clog.NewProdLogger())
+	if !assert.Nil(err) {
+		return
+	}
+
+	now := time.Unix(960000, 0) // start of a minute
+	s.now = func() time.Time { return now }
+
+	query := s.Sign("1")
+	assert.True(s.Check("1", query))
+
+	// Another path
+	assert.False(s.Check("2", query))
+	assert.False(s.Check("resized/1", query))
+
+	// Signatures are stable within TokenLife
+	now = now.Add(30 * time.Second)
+	assert.Equal(query, s.Sign("1"))
+
+	// Expiration time can't be changed
+	changed := s.Sign("1")
+	changed.Set(expiresParam, "9999999999")
+	assert.False(s.Check("1", changed))
+
+	// Signature is valid at least TokenLife
+	now = now.Add(time.Minute)
+	assert.True(s.Check("1", query))
+
+	now = now.Add(2 * time.Minute)
+	assert.False(s.Check("1", query))
+
+	// Another signer
+	another, _ := NewSigner(Config{TokenLife: time.Minute}, clog.NewProdLogger())
+	another.now = s.now
+	assert.False(s.Check("1", another.Sign("1")))
+
+	_, err = NewSigner(Config{}, clog.NewProdLogger())
+	assert.NotNil(err)
+}
@@ -0,0 +1,23 @@
+package signer
+
+import (
+	"net/url"
+	"time"
+)
+
+type Config struct {
+	Debug bool
+
+	// TokenLife is a minimal lifetime of a signature. Signatures are valid for [TokenLife, 2*TokenLife)
+	TokenLife time.Duration
+}
+
+// SignerInterface provides methods for signing of short-lived links
+type SignerInterface interface {
+	// Sign returns query params with a signature of a path. Signatures of the same path are equal
+	// within TokenLife, so links can be cached by browsers
+	Sign(path string) url.Values
+
+	// Check returns true, if the signature of a path is valid and isn't expired
+	Check(path string, query url.Values) bool
+}
@@ -0,0 +1,103 @@
+package web
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	clog "github.com/ShoshinNikita/log/v2"
+
+	"github.com/tags-drive/core/internal/web/certs"
+)
+
+// certsCheckInterval is an interval of checking TLS certificates for changes
+const certsCheckInterval = 30 * time.Second
+
+// newCerts loads TLS certificates. It returns nil, if TLS is off
+func newCerts(cnf Config, lg *clog.Logger) (certs.CertsInterface, error) {
+	if !cnf.IsTLS {
+		return nil, nil
+	}
+
+	certsConfig := certs.Config{
+		Debug:              cnf.Debug,
+		CertFile:           cnf.CertFile,
+		KeyFile:            cnf.KeyFile,
+		ClientCAFile:       cnf.ClientCAFile,
+		ClientCertRequired: cnf.ClientCertRequired,
+		CheckInterval:      certsCheckInterval,
+	}
+	return certs.NewCerts(certsConfig, lg)
+}
+
+// listenAndServe starts a server. It uses TLS, if c isn't nil
+func listenAndServe(server *http.Server, c certs.CertsInterface) error {
+	if c == nil {
+		return server.ListenAndServe()
+	}
+
+	server.TLSConfig = c.TLSConfig()
+	// Certificates are returned by TLSConfig
+	return server.ListenAndServeTLS("", "")
+}
+
+// startRedirectServer starts a plain HTTP server, which redirects all requests to HTTPS on tlsPort
+func startRedirectServer(port, tlsPort string, lg *clog.Logger) *http.Server {
+	server := &http.Server{Addr: port, Handler: httpsRedirectHandler(tlsPort)}
+
+	go func() {
+		lg.Debugln("start HTTP redirect server")
+
+		// http.ErrServerClosed is a valid error
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			lg.Errorf("HTTP redirect server error: %s\n", err)
+		}
+	}()
+
+	return server
+}
+
+// httpsRedirectHandler redirects requests to the same host and path over HTTPS
+func httpsRedirectHandler(tlsPort string) http.Handler {
+	if _, port, err := net.SplitHostPort(tlsPort); err == nil {
+		tlsPort = port
+	}
+	tlsPort = strings.TrimPrefix(tlsPort, ":")
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if host == "" {
+			http.Error(w, "Host header is required", http.StatusBadRequest)
+			return
+		}
+		if strings.Contains(host, ":") {
+			// IPv6 address
+			host = "[" + host + "]"
+		}
+		if tlsPort != "443" {
+			host += ":" + tlsPort
+		}
+
+		// Browsers repeat the method and the body only after 307 and 308
+		code := http.StatusMovedPermanently
+		if r.Method != "GET" && r.Method != "HEAD" {
+			code = http.StatusPermanentRedirect
+		}
+
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), code)
+	})
+}
+
+// clientCertLogin returns a login from the Common Name of a verified client certificate
+func (s Server) clientCertLogin(r *http.Request) (string, bool) {
+	if s.config.ClientCAFile == "" || r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return "", false
+	}
+
+	login := strings.TrimSpace(r.TLS.VerifiedChains[0][0].Subject.CommonName)
+	return login, login != ""
+}
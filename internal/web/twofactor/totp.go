@@ -0,0 +1,78 @@
+package twofactor
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// TOTP params. Default values are used, because some authenticator apps ignore other ones
+const (
+	period = 30
+	digits = 6
+	// skew is a number of allowed periods before and after the current one
+	skew = 1
+)
+
+var b32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// hotp returns a code of a counter (RFC 4226)
+func hotp(secret []byte, counter int64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(counter))
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", digits, value%1000000)
+}
+
+// step returns a TOTP time step of unix time
+func step(unix int64) int64 {
+	return unix / period
+}
+
+// validateCode returns a step of a valid code. lastStep is a step of the last used code: old codes
+// can't be used again. ok is false, if the code is invalid
+func validateCode(secret []byte, code string, unix, lastStep int64) (codeStep int64, ok bool) {
+	code = strings.TrimSpace(code)
+	if len(code) != digits {
+		return 0, false
+	}
+
+	current := step(unix)
+	for s := current - skew; s <= current+skew; s++ {
+		if s <= lastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(hotp(secret, s)), []byte(code)) == 1 {
+			return s, true
+		}
+	}
+
+	return 0, false
+}
+
+// otpauthURI returns an URI for authenticator apps
+// (https://github.com/google/google-authenticator/wiki/Key-Uri-Format)
+func otpauthURI(issuer, account, secret string) string {
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", issuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(digits))
+	params.Set("period", fmt.Sprint(period))
+
+	label := url.PathEscape(issuer) + ":" + url.PathEscape(account)
+
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
@@ -0,0 +1,346 @@
+// Package twofactor provides TOTP two-factor authentication and recovery codes
+package twofactor
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	clog "github.com/ShoshinNikita/log/v2"
+	"github.com/pkg/errors"
+
+	"github.com/tags-drive/core/internal/storage/encryption"
+)
+
+const (
+	secretSize = 20
+
+	recoveryCodesNumber = 10
+	// recoveryCodeSize is a number of characters of a recovery code (without a separator)
+	recoveryCodeSize = 10
+
+	challengeSize        = 32
+	challengeLife        = 5 * time.Minute
+	maxChallengeAttempts = 5
+)
+
+// Errors
+var (
+	ErrNotEnabled       = errors.New("two-factor authentication isn't enabled")
+	ErrAlreadyEnabled   = errors.New("two-factor authentication is already enabled")
+	ErrNotEnrolled      = errors.New("two-factor authentication enrollment wasn't started")
+	ErrWrongCode        = errors.New("wrong two-factor code")
+	ErrInvalidChallenge = errors.New("invalid or expired challenge")
+)
+
+type entry struct {
+	UserID int `json:"userID"`
+	// Secret is a TOTP secret in base32
+	Secret string `json:"secret"`
+	// Enabled is false, until the enrollment is confirmed
+	Enabled bool `json:"enabled"`
+	// LastStep is a time step of the last used code
+	LastStep int64 `json:"lastStep"`
+	// RecoveryCodes contains sha256 checksums of unused recovery codes
+	RecoveryCodes []string  `json:"recoveryCodes"`
+	Created       time.Time `json:"created"`
+}
+
+type challenge struct {
+	userID   int
+	expires  time.Time
+	attempts int
+}
+
+type TwoFactor struct {
+	config Config
+	file   encryption.JSONFile
+
+	entries    map[int]entry
+	challenges map[string]challenge
+	mutex      *sync.Mutex
+
+	now func() time.Time
+
+	logger *clog.Logger
+}
+
+// NewTwoFactor creates new TwoFactor and reads secrets from TwoFactorJSONFile
+func NewTwoFactor(cnf Config, lg *clog.Logger) (*TwoFactor, error) {
+	t := &TwoFactor{
+		config: cnf,
+		file: encryption.JSONFile{
+			Path:    cnf.TwoFactorJSONFile,
+			Encrypt: cnf.Encrypt,
+			Key:     cnf.PassPhrase,
+			Indent:  cnf.Debug,
+		},
+		entries:    make(map[int]entry),
+		challenges: make(map[string]challenge),
+		mutex:      new(sync.Mutex),
+		now:        time.Now,
+		logger:     lg,
+	}
+
+	var list []entry
+	if _, err := t.file.Read(&list); err != nil {
+		return nil, err
+	}
+	for _, e := range list {
+		t.entries[e.UserID] = e
+	}
+
+	return t, nil
+}
+
+// write writes entries into TwoFactorJSONFile. It must be called under the lock
+func (t *TwoFactor) write() error {
+	list := make([]entry, 0, len(t.entries))
+	for _, e := range t.entries {
+		list = append(list, e)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].UserID < list[j].UserID })
+
+	return t.file.Write(list)
+}
+
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return nil, errors.Wrap(err, "can't generate random bytes")
+	}
+	return b, nil
+}
+
+// normalizeRecoveryCode removes separators and spaces from a recovery code
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.Replace(code, "-", "", -1)
+	code = strings.Replace(code, " ", "", -1)
+	return code
+}
+
+func hashRecoveryCode(code string) string {
+	hash := sha256.Sum256([]byte(normalizeRecoveryCode(code)))
+	return hex.EncodeToString(hash[:])
+}
+
+// generateRecoveryCodes returns recovery codes and their hashes
+func generateRecoveryCodes() (codes, hashes []string, err error) {
+	for i := 0; i < recoveryCodesNumber; i++ {
+		raw, err := randomBytes(recoveryCodeSize)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		code := strings.ToLower(b32.EncodeToString(raw))[:recoveryCodeSize]
+		code = code[:recoveryCodeSize/2] + "-" + code[recoveryCodeSize/2:]
+
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+
+	return codes, hashes, nil
+}
+
+func (t *TwoFactor) Status(userID int) Status {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	e, ok := t.entries[userID]
+	if !ok || !e.Enabled {
+		return Status{}
+	}
+	return Status{Enabled: true, RecoveryCodes: len(e.RecoveryCodes)}
+}
+
+func (t *TwoFactor) IsEnabled(userID int) bool {
+	return t.Status(userID).Enabled
+}
+
+func (t *TwoFactor) Enroll(userID int, account string) (secret, uri string, err error) {
+	raw, err := randomBytes(secretSize)
+	if err != nil {
+		return "", "", err
+	}
+	secret = b32.EncodeToString(raw)
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	old, ok := t.entries[userID]
+	if ok && old.Enabled {
+		return "", "", ErrAlreadyEnabled
+	}
+
+	t.entries[userID] = entry{UserID: userID, Secret: secret, Created: t.now()}
+	if err := t.write(); err != nil {
+		if ok {
+			t.entries[userID] = old
+		} else {
+			delete(t.entries, userID)
+		}
+		return "", "", err
+	}
+
+	return secret, otpauthURI(t.config.Issuer, account, secret), nil
+}
+
+func (t *TwoFactor) Confirm(userID int, code string) ([]string, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	e, ok := t.entries[userID]
+	switch {
+	case !ok:
+		return nil, ErrNotEnrolled
+	case e.Enabled:
+		return nil, ErrAlreadyEnabled
+	}
+
+	secret, err := b32.DecodeString(e.Secret)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't decode secret")
+	}
+
+	codeStep, ok := validateCode(secret, code, t.now().Unix(), e.LastStep)
+	if !ok {
+		return nil, ErrWrongCode
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	e.Enabled = true
+	e.LastStep = codeStep
+	e.RecoveryCodes = hashes
+	t.entries[userID] = e
+
+	if err := t.write(); err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+func (t *TwoFactor) Verify(userID int, code string) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return t.verify(userID, code)
+}
+
+// verify checks a code. It must be called under the lock
+func (t *TwoFactor) verify(userID int, code string) error {
+	e, ok := t.entries[userID]
+	if !ok || !e.Enabled {
+		return ErrNotEnabled
+	}
+
+	secret, err := b32.DecodeString(e.Secret)
+	if err != nil {
+		return errors.Wrap(err, "can't decode secret")
+	}
+
+	if codeStep, ok := validateCode(secret, code, t.now().Unix(), e.LastStep); ok {
+		e.LastStep = codeStep
+		t.entries[userID] = e
+		return t.write()
+	}
+
+	// Check recovery codes
+	hash := hashRecoveryCode(code)
+	for i, h := range e.RecoveryCodes {
+		if h != hash {
+			continue
+		}
+
+		e.RecoveryCodes = append(e.RecoveryCodes[:i:i], e.RecoveryCodes[i+1:]...)
+		t.entries[userID] = e
+
+		t.logger.Warnf("recovery code of user %d was used, %d codes left\n", userID, len(e.RecoveryCodes))
+
+		return t.write()
+	}
+
+	return ErrWrongCode
+}
+
+func (t *TwoFactor) Disable(userID int) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if _, ok := t.entries[userID]; !ok {
+		return ErrNotEnabled
+	}
+
+	delete(t.entries, userID)
+	for id, c := range t.challenges {
+		if c.userID == userID {
+			delete(t.challenges, id)
+		}
+	}
+
+	return t.write()
+}
+
+func (t *TwoFactor) NewChallenge(userID int) (string, error) {
+	raw, err := randomBytes(challengeSize)
+	if err != nil {
+		return "", err
+	}
+	id := base64.RawURLEncoding.EncodeToString(raw)
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	// Remove expired challenges
+	now := t.now()
+	for id, c := range t.challenges {
+		if !now.Before(c.expires) {
+			delete(t.challenges, id)
+		}
+	}
+
+	t.challenges[id] = challenge{userID: userID, expires: now.Add(challengeLife)}
+
+	return id, nil
+}
+
+func (t *TwoFactor) CheckChallenge(id, code string) (userID int, err error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	c, ok := t.challenges[id]
+	if !ok {
+		return 0, ErrInvalidChallenge
+	}
+	if !t.now().Before(c.expires) {
+		delete(t.challenges, id)
+		return 0, ErrInvalidChallenge
+	}
+
+	err = t.verify(c.userID, code)
+	if err != nil {
+		if err == ErrWrongCode {
+			c.attempts++
+			if c.attempts >= maxChallengeAttempts {
+				delete(t.challenges, id)
+			} else {
+				t.challenges[id] = c
+			}
+		}
+		return 0, err
+	}
+
+	delete(t.challenges, id)
+
+	return c.userID, nil
+}
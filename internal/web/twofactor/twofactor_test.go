@@ -0,0 +1,225 @@
+package twofactor
+
+import (
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	clog "github.com/ShoshinNikita/log/v2"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/tags-drive/core/internal/storage/encryption/encryptiontest"
+)
+
+func newTestTwoFactor(t *testing.T, encrypt bool) (*TwoFactor, func()) {
+	path, clean := encryptiontest.TempFile(t, "2fa.json")
+
+	cnf := Config{
+		TwoFactorJSONFile: path,
+		Encrypt:           encrypt,
+		PassPhrase:        encryptiontest.Key,
+		Issuer:            "Tags Drive",
+	}
+	tf, err := NewTwoFactor(cnf, clog.NewProdLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tf, clean
+}
+
+// codeAt returns a valid code of a secret
+func codeAt(t *testing.T, secret string, now time.Time) string {
+	raw, err := b32.DecodeString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hotp(raw, step(now.Unix()))
+}
+
+func TestHOTP(t *testing.T) {
+	// Test vectors from RFC 6238 (the last 6 digits)
+	secret := []byte("12345678901234567890")
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.code, hotp(secret, step(tt.unix)), "unix %d", tt.unix)
+	}
+}
+
+func TestValidateCode(t *testing.T) {
+	assert := assert.New(t)
+
+	secret := []byte("12345678901234567890")
+	const unix = 1111111111
+
+	s, ok := validateCode(secret, "050471", unix, 0)
+	assert.True(ok)
+	assert.Equal(step(unix), s)
+
+	// The previous and the next periods are allowed
+	_, ok = validateCode(secret, hotp(secret, step(unix)-1), unix, 0)
+	assert.True(ok)
+	_, ok = validateCode(secret, hotp(secret, step(unix)+1), unix, 0)
+	assert.True(ok)
+	_, ok = validateCode(secret, hotp(secret, step(unix)+2), unix, 0)
+	assert.False(ok)
+
+	// Replay
+	_, ok = validateCode(secret, "050471", unix, step(unix))
+	assert.False(ok)
+
+	_, ok = validateCode(secret, "", unix, 0)
+	assert.False(ok)
+}
+
+func TestOtpauthURI(t *testing.T) {
+	assert := assert.New(t)
+
+	u, err := url.Parse(otpauthURI("Tags Drive", "user@home", "ABCDEF"))
+	if !assert.Nil(err) {
+		return
+	}
+	assert.Equal("otpauth", u.Scheme)
+	assert.Equal("totp", u.Host)
+	assert.Equal("/Tags Drive:user@home", u.Path)
+	assert.Equal("ABCDEF", u.Query().Get("secret"))
+	assert.Equal("Tags Drive", u.Query().Get("issuer"))
+}
+
+func TestEnrollment(t *testing.T) {
+	assert := assert.New(t)
+
+	tf, clean := newTestTwoFactor(t, false)
+	defer clean()
+
+	now := time.Date(2019, 5, 1, 12, 0, 0, 0, time.UTC)
+	tf.now = func() time.Time { return now }
+
+	_, err := tf.Confirm(1, "123456")
+	assert.Equal(ErrNotEnrolled, err)
+
+	secret, uri, err := tf.Enroll(1, "user")
+	if !assert.Nil(err) {
+		return
+	}
+	assert.Contains(uri, "secret="+secret)
+	// Not enabled until confirmation
+	assert.False(tf.IsEnabled(1))
+	assert.Equal(ErrNotEnabled, tf.Verify(1, codeAt(t, secret, now)))
+
+	_, err = tf.Confirm(1, "000000")
+	assert.Equal(ErrWrongCode, err)
+
+	codes, err := tf.Confirm(1, codeAt(t, secret, now))
+	if !assert.Nil(err) {
+		return
+	}
+	assert.Len(codes, recoveryCodesNumber)
+	assert.Equal(Status{Enabled: true, RecoveryCodes: recoveryCodesNumber}, tf.Status(1))
+
+	_, _, err = tf.Enroll(1, "user")
+	assert.Equal(ErrAlreadyEnabled, err)
+
+	// The code used for confirmation can't be used again
+	assert.Equal(ErrWrongCode, tf.Verify(1, codeAt(t, secret, now)))
+
+	now = now.Add(time.Minute)
+	assert.Nil(tf.Verify(1, codeAt(t, secret, now)))
+	assert.Equal(ErrWrongCode, tf.Verify(1, codeAt(t, secret, now)))
+
+	// Recovery codes can be used once
+	assert.Nil(tf.Verify(1, strings.ToUpper(codes[0])))
+	assert.Equal(ErrWrongCode, tf.Verify(1, codes[0]))
+	assert.Equal(recoveryCodesNumber-1, tf.Status(1).RecoveryCodes)
+
+	// Only hashes are stored
+	data, _ := ioutil.ReadFile(tf.config.TwoFactorJSONFile)
+	assert.NotContains(string(data), codes[1])
+
+	assert.Nil(tf.Disable(1))
+	assert.Equal(ErrNotEnabled, tf.Disable(1))
+	assert.False(tf.IsEnabled(1))
+}
+
+func TestPersistence(t *testing.T) {
+	for _, encrypt := range []bool{false, true} {
+		assert := assert.New(t)
+
+		tf, clean := newTestTwoFactor(t, encrypt)
+		defer clean()
+
+		secret, _, err := tf.Enroll(1, "user")
+		assert.Nil(err)
+		_, err = tf.Confirm(1, codeAt(t, secret, time.Now()))
+		assert.Nil(err)
+
+		data, _ := ioutil.ReadFile(tf.config.TwoFactorJSONFile)
+		assert.Equal(!encrypt, strings.Contains(string(data), secret))
+
+		tf, err = NewTwoFactor(tf.config, clog.NewProdLogger())
+		if !assert.Nil(err) {
+			continue
+		}
+		assert.True(tf.IsEnabled(1))
+		assert.Equal(secret, tf.entries[1].Secret)
+	}
+}
+
+func TestChallenges(t *testing.T) {
+	assert := assert.New(t)
+
+	tf, clean := newTestTwoFactor(t, false)
+	defer clean()
+
+	now := time.Date(2019, 5, 1, 12, 0, 0, 0, time.UTC)
+	tf.now = func() time.Time { return now }
+
+	secret, _, _ := tf.Enroll(1, "user")
+	codes, err := tf.Confirm(1, codeAt(t, secret, now))
+	if !assert.Nil(err) {
+		return
+	}
+	now = now.Add(time.Minute)
+
+	// Success
+	challenge, err := tf.NewChallenge(1)
+	assert.Nil(err)
+	userID, err := tf.CheckChallenge(challenge, codeAt(t, secret, now))
+	assert.Nil(err)
+	assert.Equal(1, userID)
+	_, err = tf.CheckChallenge(challenge, codes[0])
+	assert.Equal(ErrInvalidChallenge, err)
+
+	// Too many attempts
+	challenge, _ = tf.NewChallenge(1)
+	for i := 0; i < maxChallengeAttempts; i++ {
+		_, err = tf.CheckChallenge(challenge, "000000")
+		assert.Equal(ErrWrongCode, err)
+	}
+	_, err = tf.CheckChallenge(challenge, codes[0])
+	assert.Equal(ErrInvalidChallenge, err)
+
+	// Expiry
+	challenge, _ = tf.NewChallenge(1)
+	now = now.Add(challengeLife)
+	_, err = tf.CheckChallenge(challenge, codes[0])
+	assert.Equal(ErrInvalidChallenge, err)
+
+	// Disabling removes challenges
+	challenge, _ = tf.NewChallenge(1)
+	assert.Nil(tf.Disable(1))
+	_, err = tf.CheckChallenge(challenge, codes[0])
+	assert.Equal(ErrInvalidChallenge, err)
+}
@@ -0,0 +1,49 @@
+package twofactor
+
+type Config struct {
+	Debug bool
+
+	TwoFactorJSONFile string
+	Encrypt           bool
+	PassPhrase        [32]byte
+
+	// Issuer is shown in authenticator apps
+	Issuer string
+}
+
+// Status is a state of two-factor authentication of a user
+type Status struct {
+	Enabled bool `json:"enabled"`
+	// RecoveryCodes is a number of unused recovery codes
+	RecoveryCodes int `json:"recoveryCodes"`
+}
+
+// TwoFactorInterface provides methods for TOTP two-factor authentication (RFC 6238)
+type TwoFactorInterface interface {
+	// Status returns a state of two-factor authentication of a user
+	Status(userID int) Status
+
+	// IsEnabled returns true, if a user has enabled two-factor authentication
+	IsEnabled(userID int) bool
+
+	// Enroll generates a new secret for a user. The secret isn't used until it is confirmed.
+	// It returns the secret in base32 and an otpauth URI for authenticator apps
+	Enroll(userID int, account string) (secret, uri string, err error)
+
+	// Confirm enables two-factor authentication, if the code is valid. It returns recovery codes.
+	// Only hashes of recovery codes are stored, so they can't be shown again
+	Confirm(userID int, code string) (recoveryCodes []string, err error)
+
+	// Verify checks a TOTP code or a recovery code. Every code can be used only once
+	Verify(userID int, code string) error
+
+	// Disable disables two-factor authentication of a user
+	Disable(userID int) error
+
+	// NewChallenge returns a challenge for the second step of login. It expires after a few minutes
+	NewChallenge(userID int) (string, error)
+
+	// CheckChallenge verifies a code of a challenge and returns an id of the user.
+	// A challenge can be used only once and is deleted after several wrong codes
+	CheckChallenge(challenge, code string) (userID int, err error)
+}
@@ -1,6 +1,9 @@
 package web
 
-import "time"
+import (
+	"net"
+	"time"
+)
 
 type Config struct {
 	Debug bool
@@ -9,17 +12,94 @@ type Config struct {
 
 	Port  string
 	IsTLS bool
+	// CertFile and KeyFile are reloaded on SIGHUP and on changes
+	CertFile string
+	KeyFile  string
+	// ClientCAFile contains CAs of client certificates. A client certificate signed by them authenticates
+	// a user with the login from the Common Name. Empty means client certificates aren't used
+	ClientCAFile string
+	// ClientCertRequired means connections without a valid client certificate are rejected
+	ClientCertRequired bool
+	// HTTPRedirectPort is a port of a plain HTTP server, which redirects to HTTPS. Empty means there's no such server
+	HTTPRedirectPort string
 
+	// Login and Password are used to create the first admin, if there's no UsersJSONFile
 	Login          string
 	Password       string
 	SkipLogin      bool
+	LegacyLogin    bool // allows old clients to send sha256 checksum of a password repeated 11 times
 	AuthCookieName string
+	CookieSameSite string // strict, lax or none
+	CookiePath     string
+	CookieDomain   string
+	// TrustedOrigins are origins (scheme://host[:port]), which can send requests with the auth cookie
+	// in addition to the origin of the drive
+	TrustedOrigins []string
+	// TrustedProxies are networks of reverse proxies. X-Forwarded-For, X-Forwarded-Proto and ForwardAuthHeader
+	// are used only in requests from them
+	TrustedProxies []*net.IPNet
+	// BasePath is a path prefix of all routes (for example, "/drive"). Empty means "/"
+	BasePath string
+	// ForwardAuthHeader is a header with a login of a user authenticated by a trusted proxy.
+	// Empty means forward auth is disabled
+	ForwardAuthHeader string
+
 	MaxTokenLife   time.Duration
+	IdleTokenLife  time.Duration
 	TokensJSONFile string
+	UsersJSONFile  string
+	// APITokensJSONFile contains personal API tokens
+	APITokensJSONFile string
+	// TwoFactorJSONFile contains TOTP secrets
+	TwoFactorJSONFile string
+	// SharesJSONFile contains share links
+	SharesJSONFile string
+	// DropsJSONFile contains drop links
+	DropsJSONFile string
+	// BansJSONFile contains bans of the auth limiter
+	BansJSONFile string
+	// MaxLoginFailures is a number of failed auth attempts in a row, after which an address or an account
+	// is banned for LoginBanDuration
+	MaxLoginFailures int
+	LoginBanDuration time.Duration
+
+	// AuditFolder contains the audit log. Empty means the audit log is disabled
+	AuditFolder string
+	// AuditMaxFileSize is a size of the audit log, after which it is rotated
+	AuditMaxFileSize int64
+	// AuditMaxFiles is a number of rotated audit logs, which are kept. 0 means all logs are kept
+	AuditMaxFiles int
+
+	// OIDCIssuer is an issuer of an OpenID Connect provider. Empty OIDCIssuer means login via OIDC is disabled
+	OIDCIssuer       string
+	OIDCClientID     string
+	OIDCClientSecret string
+	OIDCRedirectURL  string
+	OIDCScopes       []string
+	OIDCLoginClaim   string
+	OIDCRoleClaim    string
+	// OIDCRoleMapping is a list of pairs "value=role" separated by comma. Values are taken from OIDCRoleClaim
+	OIDCRoleMapping string
+	// OIDCDefaultRole is a role of users without mapped values. Empty OIDCDefaultRole means such users can't log in
+	OIDCDefaultRole string
 
 	Encrypt    bool
 	PassPhrase [32]byte
 
+	ClientEncryption bool
+	ClientParamsFile string
+
+	VaultTag         int // 0 means there's no vault
+	VaultPassword    string
+	VaultIdleTimeout time.Duration
+
+	// ContentOrigin is a public origin of uploaded files (for example, "https://files.example.com").
+	// Files are served on it by a separate server on ContentPort. Empty ContentPort means files
+	// are served on the drive origin
+	ContentOrigin    string
+	ContentPort      string
+	ContentTokenLife time.Duration
+
 	Version string
 }
 
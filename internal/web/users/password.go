@@ -0,0 +1,31 @@
+package users
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+// MinPasswordLength is a minimal length of passwords set via API
+const MinPasswordLength = 8
+
+// ClientHash returns a hash of a password, which is sent by old clients (sha256 checksum repeated 11 times).
+// Passwords are hashed with scrypt after ClientHash, so both the password and the client hash can be checked
+func ClientHash(password string) string {
+	const repeats = 11
+
+	hash := sha256.Sum256([]byte(password))
+	for i := 0; i < repeats-1; i++ {
+		hash = sha256.Sum256([]byte(hex.EncodeToString(hash[:])))
+	}
+	return hex.EncodeToString(hash[:])
+}
+
+// IsClientHash returns true, if s looks like a result of ClientHash
+func IsClientHash(s string) bool {
+	if len(s) != sha256.Size*2 || strings.ToLower(s) != s {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
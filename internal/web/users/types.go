@@ -0,0 +1,106 @@
+package users
+
+import "time"
+
+type Config struct {
+	Debug bool
+
+	UsersJSONFile string
+	Encrypt       bool
+	PassPhrase    [32]byte
+
+	// DefaultLogin and DefaultPassword are used to create the first admin, if UsersJSONFile doesn't exist.
+	// So single-user setups (LOGIN and PSWRD) are migrated automatically
+	DefaultLogin    string
+	DefaultPassword string
+}
+
+// Role defines what a user can do
+type Role string
+
+// Roles. Every role can do everything the previous one can
+const (
+	// RoleViewer can only view and download files
+	RoleViewer Role = "viewer"
+	// RoleEditor can upload, change and delete files and tags
+	RoleEditor Role = "editor"
+	// RoleAdmin can manage users
+	RoleAdmin Role = "admin"
+)
+
+func (r Role) level() int {
+	switch r {
+	case RoleViewer:
+		return 1
+	case RoleEditor:
+		return 2
+	case RoleAdmin:
+		return 3
+	default:
+		return 0
+	}
+}
+
+// IsValid returns true, if r is a known role
+func (r Role) IsValid() bool {
+	return r.level() != 0
+}
+
+// Allows returns true, if a user with role r can do actions, which need the required role
+func (r Role) Allows(required Role) bool {
+	return r.IsValid() && r.level() >= required.level()
+}
+
+type User struct {
+	ID    int    `json:"id"`
+	Login string `json:"login"`
+	// Password is a salted hash of a password. It is empty in API responses
+	Password string    `json:"password,omitempty"`
+	Role     Role      `json:"role"`
+	Disabled bool      `json:"disabled"`
+	Created  time.Time `json:"created"`
+	// OIDCSubject is set for users, who log in via OpenID Connect. Such users have no password
+	OIDCSubject string `json:"oidcSubject,omitempty"`
+}
+
+// IsExternal returns true, if the user logs in via OpenID Connect
+func (u User) IsExternal() bool {
+	return u.OIDCSubject != ""
+}
+
+// UsersInterface provides methods for managing users
+type UsersInterface interface {
+	// Authenticate returns a user with passed login and password.
+	// It returns ErrUserDisabled, if the user is disabled
+	Authenticate(login, password string) (User, error)
+
+	// AuthenticateClientHash is like Authenticate, but it accepts a client hash of a password (see ClientHash).
+	// It is used by old clients
+	AuthenticateClientHash(login, clientHash string) (User, error)
+
+	// Get returns a user with passed id
+	Get(id int) (User, error)
+
+	// GetByLogin returns a user with passed login
+	GetByLogin(login string) (User, error)
+
+	// GetAll returns all users sorted by id
+	GetAll() []User
+
+	// Add adds a new user. It returns ErrShortPassword, if the password is shorter than MinPasswordLength
+	Add(login, password string, role Role) (User, error)
+
+	// LoginExternal returns a user with passed OIDC subject and updates its role. A new user is created,
+	// if there's no such user. It returns ErrUserExists, if a local user has the same login, and ErrUserDisabled,
+	// if the user is disabled
+	LoginExternal(subject, login string, role Role) (User, error)
+
+	// SetPassword changes a password of a user
+	SetPassword(id int, password string) error
+
+	// SetDisabled disables or enables a user. The last admin can't be disabled
+	SetDisabled(id int, disabled bool) error
+
+	// Delete deletes a user. The last admin can't be deleted
+	Delete(id int) error
+}
@@ -0,0 +1,378 @@
+// Package users keeps accounts of the drive and their roles
+package users
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	clog "github.com/ShoshinNikita/log/v2"
+	"github.com/pkg/errors"
+
+	"github.com/tags-drive/core/internal/storage/encryption"
+	"github.com/tags-drive/core/internal/web/passwords"
+)
+
+// Errors
+var (
+	ErrUserNotExist  = errors.New("user doesn't exist")
+	ErrWrongPassword = errors.New("wrong password")
+	ErrUserDisabled  = errors.New("user is disabled")
+	ErrUserExists    = errors.New("user with this login already exists")
+	ErrEmptyLogin    = errors.New("login can't be empty")
+	ErrShortPassword = errors.Errorf("password must contain at least %d characters", MinPasswordLength)
+	ErrInvalidRole   = errors.New("invalid role")
+	ErrLastAdmin     = errors.New("the last admin can't be disabled or deleted")
+)
+
+type Users struct {
+	config Config
+	file   encryption.JSONFile
+
+	users map[int]User
+	maxID int
+	mutex *sync.RWMutex
+
+	logger *clog.Logger
+}
+
+// NewUsers creates new Users and reads users from UsersJSONFile. If the file doesn't exist,
+// the admin with DefaultLogin and DefaultPassword is created
+func NewUsers(cnf Config, lg *clog.Logger) (*Users, error) {
+	u := &Users{
+		config: cnf,
+		file: encryption.JSONFile{
+			Path:    cnf.UsersJSONFile,
+			Encrypt: cnf.Encrypt,
+			Key:     cnf.PassPhrase,
+			Indent:  cnf.Debug,
+		},
+		users:  make(map[int]User),
+		mutex:  new(sync.RWMutex),
+		logger: lg,
+	}
+
+	var list []User
+	exists, err := u.file.Read(&list)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		lg.Infof("file %s doesn't exist. Create admin \"%s\"\n", cnf.UsersJSONFile, cnf.DefaultLogin)
+
+		// The length of the default password isn't checked: old setups could use short passwords
+		_, err := u.add(cnf.DefaultLogin, cnf.DefaultPassword, RoleAdmin)
+		if err != nil {
+			return nil, errors.Wrap(err, "can't create admin")
+		}
+		return u, nil
+	}
+
+	migrated := false
+	for _, user := range list {
+		// Old versions stored client hashes of passwords
+		if !user.IsExternal() && !passwords.IsHash(user.Password) {
+			user.Password, err = passwords.Hash(user.Password)
+			if err != nil {
+				return nil, err
+			}
+			migrated = true
+		}
+
+		u.users[user.ID] = user
+		if u.maxID < user.ID {
+			u.maxID = user.ID
+		}
+	}
+
+	if migrated {
+		lg.Infoln("passwords of users were rehashed")
+		if err := u.write(); err != nil {
+			return nil, err
+		}
+	}
+
+	return u, nil
+}
+
+// write writes users into UsersJSONFile. It must be called under the lock
+func (u *Users) write() error {
+	return u.file.Write(u.getAll())
+}
+
+func (u *Users) Authenticate(login, password string) (User, error) {
+	return u.authenticate(login, ClientHash(password))
+}
+
+func (u *Users) AuthenticateClientHash(login, clientHash string) (User, error) {
+	return u.authenticate(login, clientHash)
+}
+
+func (u *Users) authenticate(login, clientHash string) (User, error) {
+	u.mutex.RLock()
+	defer u.mutex.RUnlock()
+
+	for _, user := range u.users {
+		if user.Login != login {
+			continue
+		}
+
+		if user.IsExternal() || !passwords.Check(user.Password, clientHash) {
+			return User{}, ErrWrongPassword
+		}
+		if user.Disabled {
+			return User{}, ErrUserDisabled
+		}
+		return user, nil
+	}
+
+	return User{}, ErrUserNotExist
+}
+
+func (u *Users) Get(id int) (User, error) {
+	u.mutex.RLock()
+	defer u.mutex.RUnlock()
+
+	user, ok := u.users[id]
+	if !ok {
+		return User{}, ErrUserNotExist
+	}
+	return user, nil
+}
+
+func (u *Users) GetByLogin(login string) (User, error) {
+	u.mutex.RLock()
+	defer u.mutex.RUnlock()
+
+	for _, user := range u.users {
+		if user.Login == login {
+			return user, nil
+		}
+	}
+	return User{}, ErrUserNotExist
+}
+
+func (u *Users) GetAll() []User {
+	u.mutex.RLock()
+	defer u.mutex.RUnlock()
+
+	return u.getAll()
+}
+
+func (u *Users) getAll() []User {
+	res := make([]User, 0, len(u.users))
+	for _, user := range u.users {
+		res = append(res, user)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+
+	return res
+}
+
+func (u *Users) Add(login, password string, role Role) (User, error) {
+	if len(password) < MinPasswordLength {
+		return User{}, ErrShortPassword
+	}
+	return u.add(login, password, role)
+}
+
+func (u *Users) add(login, password string, role Role) (User, error) {
+	login = strings.TrimSpace(login)
+	switch {
+	case login == "":
+		return User{}, ErrEmptyLogin
+	case !role.IsValid():
+		return User{}, ErrInvalidRole
+	}
+
+	hash, err := passwords.Hash(ClientHash(password))
+	if err != nil {
+		return User{}, err
+	}
+
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	for _, user := range u.users {
+		if user.Login == login {
+			return User{}, ErrUserExists
+		}
+	}
+
+	u.maxID++
+	user := User{
+		ID:       u.maxID,
+		Login:    login,
+		Password: hash,
+		Role:     role,
+		Created:  time.Now(),
+	}
+	u.users[user.ID] = user
+
+	if err := u.write(); err != nil {
+		delete(u.users, user.ID)
+		return User{}, err
+	}
+
+	return user, nil
+}
+
+func (u *Users) LoginExternal(subject, login string, role Role) (User, error) {
+	login = strings.TrimSpace(login)
+	switch {
+	case subject == "":
+		return User{}, errors.New("subject can't be empty")
+	case login == "":
+		return User{}, ErrEmptyLogin
+	case !role.IsValid():
+		return User{}, ErrInvalidRole
+	}
+
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	for _, user := range u.users {
+		if user.OIDCSubject != subject {
+			continue
+		}
+
+		if user.Disabled {
+			return User{}, ErrUserDisabled
+		}
+		if user.Role == role {
+			return user, nil
+		}
+		if role != RoleAdmin && u.isLastAdmin(user) {
+			u.logger.Warnf("role of \"%s\" wasn't changed to %s: the last admin can't be demoted\n", user.Login, role)
+			return user, nil
+		}
+
+		oldRole := user.Role
+		user.Role = role
+		u.users[user.ID] = user
+		if err := u.write(); err != nil {
+			user.Role = oldRole
+			u.users[user.ID] = user
+			return User{}, err
+		}
+		return user, nil
+	}
+
+	for _, user := range u.users {
+		if user.Login == login {
+			return User{}, ErrUserExists
+		}
+	}
+
+	u.maxID++
+	user := User{
+		ID:          u.maxID,
+		Login:       login,
+		Role:        role,
+		Created:     time.Now(),
+		OIDCSubject: subject,
+	}
+	u.users[user.ID] = user
+
+	if err := u.write(); err != nil {
+		delete(u.users, user.ID)
+		return User{}, err
+	}
+
+	return user, nil
+}
+
+func (u *Users) SetPassword(id int, password string) error {
+	if len(password) < MinPasswordLength {
+		return ErrShortPassword
+	}
+
+	hash, err := passwords.Hash(ClientHash(password))
+	if err != nil {
+		return err
+	}
+
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	user, ok := u.users[id]
+	if !ok {
+		return ErrUserNotExist
+	}
+
+	oldHash := user.Password
+	user.Password = hash
+	u.users[id] = user
+
+	if err := u.write(); err != nil {
+		user.Password = oldHash
+		u.users[id] = user
+		return err
+	}
+
+	return nil
+}
+
+func (u *Users) SetDisabled(id int, disabled bool) error {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	user, ok := u.users[id]
+	if !ok {
+		return ErrUserNotExist
+	}
+	if user.Disabled == disabled {
+		return nil
+	}
+	if disabled && u.isLastAdmin(user) {
+		return ErrLastAdmin
+	}
+
+	user.Disabled = disabled
+	u.users[id] = user
+
+	if err := u.write(); err != nil {
+		user.Disabled = !disabled
+		u.users[id] = user
+		return err
+	}
+
+	return nil
+}
+
+func (u *Users) Delete(id int) error {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	user, ok := u.users[id]
+	if !ok {
+		return ErrUserNotExist
+	}
+	if u.isLastAdmin(user) {
+		return ErrLastAdmin
+	}
+
+	delete(u.users, id)
+
+	if err := u.write(); err != nil {
+		u.users[id] = user
+		return err
+	}
+
+	return nil
+}
+
+// isLastAdmin returns true, if user is the only enabled admin. It must be called under the lock
+func (u *Users) isLastAdmin(user User) bool {
+	if user.Role != RoleAdmin || user.Disabled {
+		return false
+	}
+
+	for _, other := range u.users {
+		if other.ID != user.ID && other.Role == RoleAdmin && !other.Disabled {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,271 @@
+package users
+
+import (
+	"crypto/sha256"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	clog "github.com/ShoshinNikita/log/v2"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/tags-drive/core/internal/storage/encryption/encryptiontest"
+	"github.com/tags-drive/core/internal/web/passwords"
+)
+
+func newTestConfig(t *testing.T, encrypt bool) (Config, func()) {
+	path, clean := encryptiontest.TempFile(t, "users.json")
+
+	cnf := Config{
+		UsersJSONFile:   path,
+		Encrypt:         encrypt,
+		PassPhrase:      encryptiontest.Key,
+		DefaultLogin:    "user",
+		DefaultPassword: "qwerty",
+	}
+	return cnf, clean
+}
+
+func TestRoles(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.True(RoleAdmin.Allows(RoleEditor))
+	assert.True(RoleEditor.Allows(RoleEditor))
+	assert.True(RoleViewer.Allows(RoleViewer))
+	assert.False(RoleViewer.Allows(RoleEditor))
+	assert.False(RoleEditor.Allows(RoleAdmin))
+	assert.False(Role("root").Allows(RoleViewer))
+	assert.False(Role("").IsValid())
+}
+
+func TestMigration(t *testing.T) {
+	for _, encrypt := range []bool{false, true} {
+		assert := assert.New(t)
+
+		cnf, clean := newTestConfig(t, encrypt)
+		defer clean()
+
+		u, err := NewUsers(cnf, clog.NewProdLogger())
+		if !assert.Nil(err) {
+			continue
+		}
+
+		// The admin is created from the default login and password
+		user, err := u.Authenticate("user", "qwerty")
+		if assert.Nil(err) {
+			assert.Equal(1, user.ID)
+			assert.Equal(RoleAdmin, user.Role)
+		}
+
+		_, err = u.Add("viewer", "viewer-password", RoleViewer)
+		assert.Nil(err)
+
+		// Logins are hidden, if the file is encrypted
+		data, _ := ioutil.ReadFile(cnf.UsersJSONFile)
+		assert.Equal(!encrypt, strings.Contains(string(data), "\"viewer\""))
+
+		// Users are read from the file. The default login isn't used anymore
+		cnf.DefaultLogin = "other"
+		u, err = NewUsers(cnf, clog.NewProdLogger())
+		if !assert.Nil(err) {
+			continue
+		}
+		assert.Len(u.GetAll(), 2)
+		_, err = u.Authenticate("other", "qwerty")
+		assert.Equal(ErrUserNotExist, err)
+
+		// Wrong key
+		cnf.PassPhrase = sha256.Sum256([]byte("wrong"))
+		_, err = NewUsers(cnf, clog.NewProdLogger())
+		assert.Equal(encrypt, err != nil)
+	}
+}
+
+func TestPasswords(t *testing.T) {
+	assert := assert.New(t)
+
+	// Client hashes are hashed with scrypt
+	hash, err := passwords.Hash(ClientHash("password"))
+	if !assert.Nil(err) {
+		return
+	}
+	assert.NotContains(hash, ClientHash("password"))
+	assert.True(passwords.Check(hash, ClientHash("password")))
+	assert.False(passwords.Check(hash, ClientHash("Password")))
+
+	assert.True(IsClientHash(ClientHash("password")))
+	assert.False(IsClientHash("password"))
+	assert.False(IsClientHash(strings.ToUpper(ClientHash("password"))))
+}
+
+func TestRehash(t *testing.T) {
+	assert := assert.New(t)
+
+	cnf, clean := newTestConfig(t, false)
+	defer clean()
+
+	// Users file of the previous version contains client hashes
+	data := `[{"id": 1, "login": "user", "password": "` + ClientHash("qwerty") + `", "role": "admin"}]`
+	ioutil.WriteFile(cnf.UsersJSONFile, []byte(data), 0600)
+
+	u, err := NewUsers(cnf, clog.NewProdLogger())
+	if !assert.Nil(err) {
+		return
+	}
+	_, err = u.Authenticate("user", "qwerty")
+	assert.Nil(err)
+
+	newData, _ := ioutil.ReadFile(cnf.UsersJSONFile)
+	assert.NotContains(string(newData), ClientHash("qwerty"))
+	assert.Contains(string(newData), "scrypt$")
+}
+
+func TestUsers(t *testing.T) {
+	assert := assert.New(t)
+
+	cnf, clean := newTestConfig(t, false)
+	defer clean()
+
+	u, err := NewUsers(cnf, clog.NewProdLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Add
+	editor, err := u.Add(" editor ", "password", RoleEditor)
+	assert.Nil(err)
+	assert.Equal("editor", editor.Login)
+	assert.Equal(2, editor.ID)
+
+	_, err = u.Add("editor", "password", RoleViewer)
+	assert.Equal(ErrUserExists, err)
+	_, err = u.Add("", "password", RoleViewer)
+	assert.Equal(ErrEmptyLogin, err)
+	_, err = u.Add("viewer", "short", RoleViewer)
+	assert.Equal(ErrShortPassword, err)
+	_, err = u.Add("viewer", "password", Role("root"))
+	assert.Equal(ErrInvalidRole, err)
+
+	// GetByLogin
+	byLogin, err := u.GetByLogin("editor")
+	assert.Nil(err)
+	assert.Equal(editor.ID, byLogin.ID)
+	_, err = u.GetByLogin("unknown")
+	assert.Equal(ErrUserNotExist, err)
+
+	// Authenticate
+	_, err = u.Authenticate("editor", "wrong-password")
+	assert.Equal(ErrWrongPassword, err)
+	_, err = u.Authenticate("unknown", "password")
+	assert.Equal(ErrUserNotExist, err)
+
+	// Old clients send a client hash
+	_, err = u.AuthenticateClientHash("editor", ClientHash("password"))
+	assert.Nil(err)
+	_, err = u.AuthenticateClientHash("editor", ClientHash("wrong-password"))
+	assert.Equal(ErrWrongPassword, err)
+
+	// Change password
+	assert.Nil(u.SetPassword(editor.ID, "new-password"))
+	assert.Equal(ErrShortPassword, u.SetPassword(editor.ID, "short"))
+	assert.Equal(ErrUserNotExist, u.SetPassword(10, "new-password"))
+	_, err = u.Authenticate("editor", "password")
+	assert.Equal(ErrWrongPassword, err)
+	_, err = u.Authenticate("editor", "new-password")
+	assert.Nil(err)
+	assert.Nil(u.SetPassword(editor.ID, "password"))
+
+	// Disable
+	assert.Nil(u.SetDisabled(editor.ID, true))
+	_, err = u.Authenticate("editor", "password")
+	assert.Equal(ErrUserDisabled, err)
+	assert.Nil(u.SetDisabled(editor.ID, false))
+	_, err = u.Authenticate("editor", "password")
+	assert.Nil(err)
+	assert.Equal(ErrUserNotExist, u.SetDisabled(10, true))
+
+	// The last admin
+	assert.Equal(ErrLastAdmin, u.SetDisabled(1, true))
+	assert.Equal(ErrLastAdmin, u.Delete(1))
+
+	admin, err := u.Add("admin", "password", RoleAdmin)
+	assert.Nil(err)
+	assert.Nil(u.SetDisabled(1, true))
+	assert.Equal(ErrLastAdmin, u.Delete(admin.ID))
+	assert.Nil(u.Delete(1))
+
+	// Delete
+	assert.Nil(u.Delete(editor.ID))
+	assert.Equal(ErrUserNotExist, u.Delete(editor.ID))
+	_, err = u.Get(editor.ID)
+	assert.Equal(ErrUserNotExist, err)
+
+	// Ids aren't reused
+	viewer, err := u.Add("viewer", "password", RoleViewer)
+	assert.Nil(err)
+	assert.Equal(4, viewer.ID)
+
+	users := u.GetAll()
+	if assert.Len(users, 2) {
+		assert.Equal(admin.ID, users[0].ID)
+		assert.Equal(viewer.ID, users[1].ID)
+	}
+}
+
+func TestLoginExternal(t *testing.T) {
+	assert := assert.New(t)
+
+	cnf, clean := newTestConfig(t, false)
+	defer clean()
+
+	u, err := NewUsers(cnf, clog.NewProdLogger())
+	if !assert.Nil(err) {
+		return
+	}
+
+	// A new user is created
+	user, err := u.LoginExternal("sub-1", "alice", RoleEditor)
+	if !assert.Nil(err) {
+		return
+	}
+	assert.True(user.IsExternal())
+	assert.Empty(user.Password)
+
+	// The role is updated, the login isn't changed
+	same, err := u.LoginExternal("sub-1", "alice-new", RoleViewer)
+	assert.Nil(err)
+	assert.Equal(user.ID, same.ID)
+	assert.Equal("alice", same.Login)
+	assert.Equal(RoleViewer, same.Role)
+
+	// External users can't log in with a password
+	_, err = u.Authenticate("alice", "")
+	assert.Equal(ErrWrongPassword, err)
+
+	// Local users aren't linked
+	_, err = u.LoginExternal("sub-2", "user", RoleAdmin)
+	assert.Equal(ErrUserExists, err)
+
+	_, err = u.LoginExternal("sub-1", "alice", Role("root"))
+	assert.Equal(ErrInvalidRole, err)
+
+	assert.Nil(u.SetDisabled(user.ID, true))
+	_, err = u.LoginExternal("sub-1", "alice", RoleViewer)
+	assert.Equal(ErrUserDisabled, err)
+
+	// The last admin isn't demoted
+	assert.Nil(u.SetDisabled(user.ID, false))
+	admin, err := u.LoginExternal("sub-3", "bob", RoleAdmin)
+	assert.Nil(err)
+	assert.Nil(u.SetDisabled(1, true))
+	admin, err = u.LoginExternal("sub-3", "bob", RoleViewer)
+	assert.Nil(err)
+	assert.Equal(RoleAdmin, admin.Role)
+
+	// External users aren't rehashed on start
+	u, err = NewUsers(cnf, clog.NewProdLogger())
+	if assert.Nil(err) {
+		user, _ = u.Get(user.ID)
+		assert.Empty(user.Password)
+	}
+}
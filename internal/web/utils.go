@@ -1,6 +1,7 @@
 package web
 
 import (
+	"net"
 	"net/http"
 	"sync"
 )
@@ -19,6 +20,15 @@ func (s Server) processError(w http.ResponseWriter, err string, code int) {
 	http.Error(w, err, code)
 }
 
+// remoteIP returns an IP address of a client
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
 func runPool(n int, data <-chan interface{}, worker func(data <-chan interface{})) {
 	wg := sync.WaitGroup{}
 
@@ -0,0 +1,158 @@
+package web
+
+import (
+	"net/http"
+	"path"
+	"strconv"
+
+	"github.com/tags-drive/core/internal/storage/audit"
+	filesPck "github.com/tags-drive/core/internal/storage/files"
+	"github.com/tags-drive/core/internal/web/users"
+	"github.com/tags-drive/core/internal/web/vault"
+)
+
+// session returns an id of the session of a request (an auth token)
+func (s Server) session(r *http.Request) string {
+	c, err := r.Cookie(s.config.AuthCookieName)
+	if err != nil {
+		return ""
+	}
+	return c.Value
+}
+
+// access returns files.Access of a request
+func (s Server) access(r *http.Request) filesPck.Access {
+	user := s.user(r)
+	read, write := s.restrictedTags(user)
+	return filesPck.Access{
+		VaultUnlocked: s.vault == nil || s.vault.IsUnlocked(s.session(r)),
+		// Users, who can accept files, can see them before
+		Review:         user.Role.Allows(users.RoleEditor),
+		RestrictedTags: read,
+		WritableTags:   write,
+	}
+}
+
+// isFileAvailable returns false, if a file doesn't exist or is hidden from a request
+func (s Server) isFileAvailable(r *http.Request, id int) bool {
+	file, err := s.fileStorage.GetFile(id)
+	if err != nil {
+		return false
+	}
+
+	return s.fileStorage.CanAccess(file, s.access(r))
+}
+
+// availableFiles removes ids of hidden files
+func (s Server) availableFiles(r *http.Request, ids []int) []int {
+	access := s.access(r)
+
+	res := make([]int, 0, len(ids))
+	for _, id := range ids {
+		file, err := s.fileStorage.GetFile(id)
+		if err == nil && s.fileStorage.CanAccess(file, access) {
+			res = append(res, id)
+		}
+	}
+	return res
+}
+
+// isFileWritable returns false, if a file doesn't exist, is hidden from a request or has restricted tags,
+// which the user can't write
+func (s Server) isFileWritable(r *http.Request, id int) bool {
+	file, err := s.fileStorage.GetFile(id)
+	if err != nil {
+		return false
+	}
+
+	return s.fileStorage.CanChange(file, s.access(r))
+}
+
+// writableFiles removes ids of files, which can't be changed
+func (s Server) writableFiles(r *http.Request, ids []int) []int {
+	access := s.access(r)
+
+	res := make([]int, 0, len(ids))
+	for _, id := range ids {
+		file, err := s.fileStorage.GetFile(id)
+		if err == nil && s.fileStorage.CanChange(file, access) {
+			res = append(res, id)
+		}
+	}
+	return res
+}
+
+// accessMiddleware returns 404 for files in the locked vault, pending files and files hidden by ACLs of tags.
+// Path is "{id}" or "resized/{id}"
+func (s Server) accessMiddleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(path.Base(r.URL.Path))
+		if err == nil && !s.isFileAvailable(r, id) {
+			http.NotFound(w, r)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// GET /api/vault
+//
+// Response: json object ({"unlocked": bool})
+//
+func (s Server) vaultStatus(w http.ResponseWriter, r *http.Request) {
+	resp := struct {
+		Unlocked bool `json:"unlocked"`
+	}{
+		Unlocked: s.vault.IsUnlocked(s.session(r)),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// POST /api/vault/unlock
+//
+// Unlocks the vault for the current session. The vault is locked automatically after the idle timeout
+//
+// Params:
+//   - password: password of the vault
+//
+// Response: -
+//
+func (s Server) unlockVault(w http.ResponseWriter, r *http.Request) {
+	keys := []string{ipKey(r), accountKey(s.user(r).Login)}
+	if !s.authAllowed(w, r, keys...) {
+		return
+	}
+
+	// Requests authenticated by a proxy or a client certificate can have no session
+	if s.session(r) == "" {
+		s.processError(w, "vault can be unlocked only in a session", http.StatusForbidden)
+		return
+	}
+
+	err := s.vault.Unlock(s.session(r), r.FormValue("password"))
+	if err != nil {
+		if err == vault.ErrWrongPassword {
+			s.authLimiter.Fail(keys...)
+			s.logger.Warnf("%s tried to unlock the vault\n", r.RemoteAddr)
+			s.processError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		s.processError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	s.logger.Warnf("%s unlocked the vault\n", r.RemoteAddr)
+	s.auditEvent(r, audit.ActionVaultUnlock, "")
+}
+
+// POST /api/vault/lock
+//
+// Response: -
+//
+func (s Server) lockVault(w http.ResponseWriter, r *http.Request) {
+	s.vault.Lock(s.session(r))
+}
@@ -0,0 +1,30 @@
+package vault
+
+import "time"
+
+type Config struct {
+	Debug bool
+
+	// Password unlocks the vault
+	Password string
+	// IdleTimeout is a time after the last request, when the vault is locked automatically
+	IdleTimeout time.Duration
+}
+
+// VaultInterface provides methods for locking and unlocking the vault for sessions
+type VaultInterface interface {
+	// Start starts all background services
+	StartBackgroundServices()
+
+	// Unlock unlocks the vault for a session. It returns ErrWrongPassword, if the password is wrong
+	Unlock(session, password string) error
+
+	// Lock locks the vault for a session
+	Lock(session string)
+
+	// IsUnlocked returns true, if the vault is unlocked for a session. It prolongs the unlock
+	IsUnlocked(session string) bool
+
+	// Shutdown gracefully shutdown Vault
+	Shutdown() error
+}
@@ -0,0 +1,122 @@
+// Package vault keeps sessions, which unlocked the vault
+package vault
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"sync"
+	"time"
+
+	clog "github.com/ShoshinNikita/log/v2"
+	"github.com/pkg/errors"
+)
+
+// Errors
+var (
+	ErrWrongPassword = errors.New("wrong vault password")
+)
+
+type Vault struct {
+	config Config
+
+	// sessions contains time of the last request of unlocked sessions
+	sessions map[string]time.Time
+	mutex    *sync.Mutex
+
+	now func() time.Time
+
+	// this channel signals that Vault.Shutdown() function was called
+	shutdowned chan struct{}
+
+	logger *clog.Logger
+}
+
+// NewVault creates new Vault. The vault is locked for all sessions
+func NewVault(cnf Config, lg *clog.Logger) *Vault {
+	return &Vault{
+		config:     cnf,
+		sessions:   make(map[string]time.Time),
+		mutex:      new(sync.Mutex),
+		now:        time.Now,
+		shutdowned: make(chan struct{}),
+		logger:     lg,
+	}
+}
+
+func (v *Vault) StartBackgroundServices() {
+	// Remove expired sessions
+	go func() {
+		ticker := time.NewTicker(v.config.IdleTimeout)
+		for {
+			select {
+			case <-ticker.C:
+				v.expire()
+			case <-v.shutdowned:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+}
+
+// Unlock unlocks the vault for a session
+func (v *Vault) Unlock(session, password string) error {
+	// Compare hashes to not leak the length of the password
+	passed := sha256.Sum256([]byte(password))
+	expected := sha256.Sum256([]byte(v.config.Password))
+	if subtle.ConstantTimeCompare(passed[:], expected[:]) != 1 {
+		return ErrWrongPassword
+	}
+
+	v.mutex.Lock()
+	v.sessions[session] = v.now()
+	v.mutex.Unlock()
+
+	return nil
+}
+
+// Lock locks the vault for a session
+func (v *Vault) Lock(session string) {
+	v.mutex.Lock()
+	delete(v.sessions, session)
+	v.mutex.Unlock()
+}
+
+// IsUnlocked returns true, if the vault is unlocked for a session and the idle timeout isn't over
+func (v *Vault) IsUnlocked(session string) bool {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	lastRequest, ok := v.sessions[session]
+	if !ok {
+		return false
+	}
+
+	now := v.now()
+	if now.Sub(lastRequest) > v.config.IdleTimeout {
+		delete(v.sessions, session)
+		return false
+	}
+
+	v.sessions[session] = now
+	return true
+}
+
+// expire removes sessions with expired idle timeout
+func (v *Vault) expire() {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	now := v.now()
+	for session, lastRequest := range v.sessions {
+		if now.Sub(lastRequest) > v.config.IdleTimeout {
+			delete(v.sessions, session)
+		}
+	}
+}
+
+func (v *Vault) Shutdown() error {
+	close(v.shutdowned)
+
+	return nil
+}
@@ -0,0 +1,62 @@
+package vault
+
+import (
+	"testing"
+	"time"
+
+	clog "github.com/ShoshinNikita/log/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVault(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now()
+
+	v := NewVault(Config{Password: "secret", IdleTimeout: time.Minute}, clog.NewProdLogger())
+	v.now = func() time.Time { return now }
+
+	assert.False(v.IsUnlocked("first"))
+
+	assert.Equal(ErrWrongPassword, v.Unlock("first", "wrong"))
+	assert.False(v.IsUnlocked("first"))
+
+	assert.Nil(v.Unlock("first", "secret"))
+	assert.True(v.IsUnlocked("first"))
+	// Other sessions are still locked
+	assert.False(v.IsUnlocked("second"))
+
+	// Requests prolong the unlock
+	now = now.Add(50 * time.Second)
+	assert.True(v.IsUnlocked("first"))
+	now = now.Add(50 * time.Second)
+	assert.True(v.IsUnlocked("first"))
+
+	// Idle timeout
+	now = now.Add(61 * time.Second)
+	assert.False(v.IsUnlocked("first"))
+
+	// Lock
+	assert.Nil(v.Unlock("first", "secret"))
+	v.Lock("first")
+	assert.False(v.IsUnlocked("first"))
+}
+
+func TestVaultExpire(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now()
+
+	v := NewVault(Config{Password: "secret", IdleTimeout: time.Minute}, clog.NewProdLogger())
+	v.now = func() time.Time { return now }
+
+	v.Unlock("first", "secret")
+	now = now.Add(30 * time.Second)
+	v.Unlock("second", "secret")
+
+	now = now.Add(40 * time.Second)
+	v.expire()
+
+	assert.Len(v.sessions, 1)
+	assert.Contains(v.sessions, "second")
+}
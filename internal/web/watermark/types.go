@@ -0,0 +1,60 @@
+package watermark
+
+type Config struct {
+	// MaxCacheSize is a max total size of cached images in bytes
+	MaxCacheSize int64
+}
+
+// Position is a position of a watermark on an image
+type Position string
+
+// Positions
+const (
+	PositionTopLeft     Position = "top-left"
+	PositionTopRight    Position = "top-right"
+	PositionBottomLeft  Position = "bottom-left"
+	PositionBottomRight Position = "bottom-right"
+	PositionCenter      Position = "center"
+)
+
+// IsValid returns true, if p is a known position
+func (p Position) IsValid() bool {
+	switch p {
+	case PositionTopLeft, PositionTopRight, PositionBottomLeft, PositionBottomRight, PositionCenter:
+		return true
+	default:
+		return false
+	}
+}
+
+// Options describe a watermark. Exactly one of Text and ImageID is set
+type Options struct {
+	Text string `json:"text,omitempty"`
+	// ImageID is an id of a PNG file, which is used as a watermark
+	ImageID int `json:"imageID,omitempty"`
+
+	Position Position `json:"position"`
+	// Opacity is in (0, 1]
+	Opacity float64 `json:"opacity"`
+	// Scale is a width of a watermark relative to the width of an image. It is in (0, 1]
+	Scale float64 `json:"scale"`
+}
+
+// Key identifies a watermarked image in the cache
+type Key struct {
+	ShareID int
+	FileID  int
+	Preview bool
+}
+
+// WatermarksInterface caches watermarked images. Images are removed in LRU order, when the cache is full
+type WatermarksInterface interface {
+	// Get returns a cached image
+	Get(key Key) (data []byte, ok bool)
+
+	// Add adds an image to the cache. Images larger than MaxCacheSize aren't cached
+	Add(key Key, data []byte)
+
+	// DeleteShare removes all cached images of a share
+	DeleteShare(shareID int)
+}
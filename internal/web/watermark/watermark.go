@@ -0,0 +1,229 @@
+// Package watermark adds watermarks to images, which leave the drive via share links, and caches the results
+package watermark
+
+import (
+	"bytes"
+	"container/list"
+	"image"
+	"image/color"
+	"sync"
+	"unicode/utf8"
+
+	clog "github.com/ShoshinNikita/log/v2"
+	"github.com/disintegration/imaging"
+	"github.com/pkg/errors"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+const maxTextLength = 100
+
+// Errors
+var (
+	ErrNoMark            = errors.New("either text or image of a watermark must be set")
+	ErrTextTooLong       = errors.New("text of a watermark is too long")
+	ErrInvalidPosition   = errors.New("position must be top-left, top-right, bottom-left, bottom-right or center")
+	ErrInvalidOpacity    = errors.New("opacity must be in (0, 1]")
+	ErrInvalidScale      = errors.New("scale must be in (0, 1]")
+	ErrUnsupportedFormat = errors.New("image format doesn't support watermarks")
+)
+
+// Validate checks options of a watermark
+func (o Options) Validate() error {
+	switch {
+	case (o.Text == "") == (o.ImageID == 0):
+		return ErrNoMark
+	case utf8.RuneCountInString(o.Text) > maxTextLength:
+		return ErrTextTooLong
+	case !o.Position.IsValid():
+		return ErrInvalidPosition
+	case !(o.Opacity > 0 && o.Opacity <= 1):
+		return ErrInvalidOpacity
+	case !(o.Scale > 0 && o.Scale <= 1):
+		return ErrInvalidScale
+	}
+	return nil
+}
+
+// Text returns an image with white text and dark outline, so the text is visible on any background
+func Text(text string) image.Image {
+	face := basicfont.Face7x13
+	width := font.MeasureString(face, text).Ceil()
+
+	img := image.NewNRGBA(image.Rect(0, 0, width+2, face.Height+2))
+	drawer := font.Drawer{Dst: img, Face: face}
+
+	// Outline
+	drawer.Src = image.NewUniform(color.NRGBA{0, 0, 0, 160})
+	for _, d := range []image.Point{{0, 1}, {1, 0}, {2, 1}, {1, 2}} {
+		drawer.Dot = fixed.P(d.X, d.Y+face.Ascent)
+		drawer.DrawString(text)
+	}
+
+	drawer.Src = image.White
+	drawer.Dot = fixed.P(1, 1+face.Ascent)
+	drawer.DrawString(text)
+
+	return img
+}
+
+// Apply returns an image with a watermark. The watermark is resized according to Scale, but it is never
+// higher than the image
+func Apply(img, mark image.Image, opts Options) image.Image {
+	bounds := img.Bounds()
+	markBounds := mark.Bounds()
+	if bounds.Empty() || markBounds.Empty() {
+		return img
+	}
+
+	width := int(float64(bounds.Dx())*opts.Scale + 0.5)
+	if width < 1 {
+		width = 1
+	}
+	height := width * markBounds.Dy() / markBounds.Dx()
+	if height > bounds.Dy() {
+		height = bounds.Dy()
+		width = height * markBounds.Dx() / markBounds.Dy()
+	}
+	if width < 1 || height < 1 {
+		return img
+	}
+	mark = imaging.Resize(mark, width, height, imaging.Linear)
+
+	margin := bounds.Dx()
+	if bounds.Dy() < margin {
+		margin = bounds.Dy()
+	}
+	margin /= 50
+
+	left, top := bounds.Min.X+margin, bounds.Min.Y+margin
+	right, bottom := bounds.Max.X-margin-width, bounds.Max.Y-margin-height
+	if right < left {
+		left, right = bounds.Min.X, bounds.Max.X-width
+	}
+	if bottom < top {
+		top, bottom = bounds.Min.Y, bounds.Max.Y-height
+	}
+
+	var pos image.Point
+	switch opts.Position {
+	case PositionTopLeft:
+		pos = image.Pt(left, top)
+	case PositionTopRight:
+		pos = image.Pt(right, top)
+	case PositionBottomLeft:
+		pos = image.Pt(left, bottom)
+	case PositionBottomRight:
+		pos = image.Pt(right, bottom)
+	default:
+		pos = image.Pt(bounds.Min.X+(bounds.Dx()-width)/2, bounds.Min.Y+(bounds.Dy()-height)/2)
+	}
+
+	return imaging.Overlay(img, mark, pos, opts.Opacity)
+}
+
+// IsSupported returns true, if a watermark can be added to images with passed extension
+func IsSupported(ext string) bool {
+	_, err := imaging.FormatFromExtension(ext)
+	return err == nil
+}
+
+// Process decodes an image, adds a watermark and encodes the result in the same format. Orientation is applied,
+// metadata is removed. It returns ErrUnsupportedFormat, if the image can't be encoded
+func Process(data []byte, ext string, mark image.Image, opts Options) ([]byte, error) {
+	format, err := imaging.FormatFromExtension(ext)
+	if err != nil {
+		return nil, ErrUnsupportedFormat
+	}
+
+	img, err := imaging.Decode(bytes.NewReader(data), imaging.AutoOrientation(true))
+	if err != nil {
+		return nil, errors.Wrap(err, "can't decode image")
+	}
+
+	buff := bytes.NewBuffer([]byte{})
+	err = imaging.Encode(buff, Apply(img, mark, opts), format)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't encode image")
+	}
+	return buff.Bytes(), nil
+}
+
+type entry struct {
+	key  Key
+	data []byte
+}
+
+type Watermarks struct {
+	config Config
+
+	// entries contains elements of order
+	entries map[Key]*list.Element
+	// order contains entries. The front element is the most recently used one
+	order *list.List
+	size  int64
+	mutex *sync.Mutex
+
+	logger *clog.Logger
+}
+
+// NewWatermarks creates an empty cache of watermarked images
+func NewWatermarks(cnf Config, lg *clog.Logger) *Watermarks {
+	return &Watermarks{
+		config:  cnf,
+		entries: make(map[Key]*list.Element),
+		order:   list.New(),
+		mutex:   new(sync.Mutex),
+		logger:  lg,
+	}
+}
+
+func (w *Watermarks) Get(key Key) ([]byte, bool) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	elem, ok := w.entries[key]
+	if !ok {
+		return nil, false
+	}
+	w.order.MoveToFront(elem)
+	return elem.Value.(*entry).data, true
+}
+
+func (w *Watermarks) Add(key Key, data []byte) {
+	if int64(len(data)) > w.config.MaxCacheSize {
+		return
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if elem, ok := w.entries[key]; ok {
+		w.remove(elem)
+	}
+	w.entries[key] = w.order.PushFront(&entry{key: key, data: data})
+	w.size += int64(len(data))
+
+	for w.size > w.config.MaxCacheSize {
+		w.remove(w.order.Back())
+	}
+}
+
+func (w *Watermarks) DeleteShare(shareID int) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	for key, elem := range w.entries {
+		if key.ShareID == shareID {
+			w.remove(elem)
+		}
+	}
+}
+
+// remove removes an element from the cache. It must be called under the lock
+func (w *Watermarks) remove(elem *list.Element) {
+	e := w.order.Remove(elem).(*entry)
+	delete(w.entries, e.key)
+	w.size -= int64(len(e.data))
+}
@@ -0,0 +1,162 @@
+package watermark
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+
+	clog "github.com/ShoshinNikita/log/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func newImage(width, height int, c color.Color) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for x := 0; x < width; x++ {
+		for y := 0; y < height; y++ {
+			img.Set(x, y, c)
+		}
+	}
+	return img
+}
+
+// isMarked returns true, if a pixel isn't black
+func isMarked(img image.Image, x, y int) bool {
+	r, g, b, _ := img.At(x, y).RGBA()
+	return r+g+b > 0
+}
+
+func TestValidate(t *testing.T) {
+	valid := Options{Text: "tags-drive", Position: PositionBottomRight, Opacity: 0.5, Scale: 0.3}
+
+	tests := []struct {
+		change func(o *Options)
+		err    error
+	}{
+		{change: func(o *Options) {}},
+		{change: func(o *Options) { o.Text = ""; o.ImageID = 5 }},
+		{change: func(o *Options) { o.Opacity = 1; o.Scale = 1 }},
+		{change: func(o *Options) { o.Text = "" }, err: ErrNoMark},
+		{change: func(o *Options) { o.ImageID = 5 }, err: ErrNoMark},
+		{change: func(o *Options) { o.Text = string(make([]byte, maxTextLength+1)) }, err: ErrTextTooLong},
+		{change: func(o *Options) { o.Position = "left" }, err: ErrInvalidPosition},
+		{change: func(o *Options) { o.Opacity = 0 }, err: ErrInvalidOpacity},
+		{change: func(o *Options) { o.Opacity = 1.5 }, err: ErrInvalidOpacity},
+		{change: func(o *Options) { o.Scale = -0.1 }, err: ErrInvalidScale},
+	}
+
+	for i, tt := range tests {
+		opts := valid
+		tt.change(&opts)
+		assert.Equal(t, tt.err, opts.Validate(), "test #%d", i)
+	}
+}
+
+func TestApply(t *testing.T) {
+	assert := assert.New(t)
+
+	img := newImage(400, 200, color.Black)
+	mark := newImage(10, 5, color.White)
+
+	tests := []struct {
+		position Position
+		marked   image.Point
+		clean    image.Point
+	}{
+		{position: PositionTopLeft, marked: image.Pt(10, 10), clean: image.Pt(390, 190)},
+		{position: PositionTopRight, marked: image.Pt(390, 10), clean: image.Pt(10, 190)},
+		{position: PositionBottomLeft, marked: image.Pt(10, 190), clean: image.Pt(390, 10)},
+		{position: PositionBottomRight, marked: image.Pt(390, 190), clean: image.Pt(10, 10)},
+		{position: PositionCenter, marked: image.Pt(200, 100), clean: image.Pt(10, 10)},
+	}
+
+	for _, tt := range tests {
+		res := Apply(img, mark, Options{Position: tt.position, Opacity: 1, Scale: 0.25})
+		assert.Equal(img.Bounds(), res.Bounds(), tt.position)
+		assert.True(isMarked(res, tt.marked.X, tt.marked.Y), tt.position)
+		assert.False(isMarked(res, tt.clean.X, tt.clean.Y), tt.position)
+	}
+
+	// Watermark isn't higher than the image
+	tall := newImage(5, 50, color.White)
+	res := Apply(img, tall, Options{Position: PositionTopLeft, Opacity: 1, Scale: 1})
+	assert.Equal(img.Bounds(), res.Bounds())
+	assert.True(isMarked(res, 10, 199))
+	assert.False(isMarked(res, 399, 0))
+
+	// Original image isn't changed
+	assert.False(isMarked(img, 10, 10))
+}
+
+func TestProcess(t *testing.T) {
+	assert := assert.New(t)
+
+	buff := bytes.NewBuffer([]byte{})
+	err := png.Encode(buff, newImage(120, 80, color.Black))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := Options{Text: "test", Position: PositionCenter, Opacity: 1, Scale: 0.5}
+	data, err := Process(buff.Bytes(), ".png", Text(opts.Text), opts)
+	if !assert.Nil(err) {
+		return
+	}
+
+	img, err := png.Decode(bytes.NewReader(data))
+	if !assert.Nil(err) {
+		return
+	}
+	assert.Equal(image.Rect(0, 0, 120, 80), img.Bounds())
+	assert.False(isMarked(img, 0, 0))
+
+	marked := false
+	for x := 30; x < 90 && !marked; x++ {
+		marked = isMarked(img, x, 40)
+	}
+	assert.True(marked)
+
+	_, err = Process(buff.Bytes(), ".svg", Text(opts.Text), opts)
+	assert.Equal(ErrUnsupportedFormat, err)
+
+	_, err = Process([]byte("not an image"), ".png", Text(opts.Text), opts)
+	assert.NotNil(err)
+}
+
+func TestCache(t *testing.T) {
+	assert := assert.New(t)
+
+	w := NewWatermarks(Config{MaxCacheSize: 10}, clog.NewProdLogger())
+
+	w.Add(Key{ShareID: 1, FileID: 1}, []byte("1234"))
+	w.Add(Key{ShareID: 1, FileID: 1, Preview: true}, []byte("12"))
+	w.Add(Key{ShareID: 2, FileID: 1}, []byte("1234"))
+
+	data, ok := w.Get(Key{ShareID: 1, FileID: 1})
+	assert.True(ok)
+	assert.Equal([]byte("1234"), data)
+
+	// The least recently used image is removed
+	w.Add(Key{ShareID: 2, FileID: 2}, []byte("123"))
+	_, ok = w.Get(Key{ShareID: 1, FileID: 1, Preview: true})
+	assert.False(ok)
+	_, ok = w.Get(Key{ShareID: 1, FileID: 1})
+	assert.True(ok)
+
+	// Too large images aren't cached
+	w.Add(Key{ShareID: 3, FileID: 1}, make([]byte, 11))
+	_, ok = w.Get(Key{ShareID: 3, FileID: 1})
+	assert.False(ok)
+	_, ok = w.Get(Key{ShareID: 2, FileID: 2})
+	assert.True(ok)
+
+	w.DeleteShare(2)
+	_, ok = w.Get(Key{ShareID: 2, FileID: 1})
+	assert.False(ok)
+	_, ok = w.Get(Key{ShareID: 2, FileID: 2})
+	assert.False(ok)
+	_, ok = w.Get(Key{ShareID: 1, FileID: 1})
+	assert.True(ok)
+	assert.Equal(int64(4), w.size)
+}
@@ -4,33 +4,92 @@ package web
 import (
 	"context"
 	"net/http"
+	"sync"
 	"time"
 
 	clog "github.com/ShoshinNikita/log/v2"
 	"github.com/gorilla/mux"
 	jsoniter "github.com/json-iterator/go"
+	"github.com/pkg/errors"
 
+	"github.com/tags-drive/core/internal/storage/audit"
 	"github.com/tags-drive/core/internal/storage/files"
 	"github.com/tags-drive/core/internal/storage/tags"
+	"github.com/tags-drive/core/internal/web/apitokens"
 	"github.com/tags-drive/core/internal/web/auth"
+	"github.com/tags-drive/core/internal/web/certs"
+	"github.com/tags-drive/core/internal/web/drops"
 	"github.com/tags-drive/core/internal/web/limiter"
+	"github.com/tags-drive/core/internal/web/oidc"
+	"github.com/tags-drive/core/internal/web/shares"
+	"github.com/tags-drive/core/internal/web/signer"
+	"github.com/tags-drive/core/internal/web/twofactor"
+	"github.com/tags-drive/core/internal/web/users"
+	"github.com/tags-drive/core/internal/web/vault"
+	"github.com/tags-drive/core/internal/web/watermark"
 )
 
+// Params of the auth limiter. Every failed attempt doubles a delay before the next one
 const (
-	authMaxRequests    = 1 // per second
-	authLimiterTimeout = time.Second
+	authBaseDelay = time.Second
+	authMaxDelay  = 5 * time.Minute
+	// authFailuresLife is a time, after which failures are forgotten
+	authFailuresLife    = time.Hour
+	authCleanupInterval = 10 * time.Minute
 )
 
+// apiTokensSaveInterval is an interval of saving last usage of API tokens
+const apiTokensSaveInterval = time.Minute
+
+// sessionsSaveInterval is an interval of saving last usage of sessions
+const sessionsSaveInterval = time.Minute
+
+// sharesSaveInterval is an interval of saving access counters of shares
+const sharesSaveInterval = time.Minute
+
+// shareGrantLife is a time, during which a share is available after entering its password
+const shareGrantLife = 12 * time.Hour
+
+// shareStreamLife is a time, during which a stream of a shared file is counted as one download
+const shareStreamLife = time.Hour
+
+// watermarkCacheSize is a max total size of cached watermarked images
+const watermarkCacheSize = 64 << 20 // 64MB
+
+// dropsCheckInterval is an interval of removing expired drop links
+const dropsCheckInterval = time.Hour
+
+// twoFactorIssuer is shown in authenticator apps
+const twoFactorIssuer = "Tags Drive"
+
 var json = jsoniter.ConfigCompatibleWithStandardLibrary
 
 type Server struct {
-	config          Config
-	fileStorage     files.FileStorageInterface
-	tagStorage      tags.TagStorageInterface
-	authService     auth.AuthServiceInterface
-	authRateLimiter limiter.RateLimiterInterface
+	config      Config
+	fileStorage files.FileStorageInterface
+	tagStorage  tags.TagStorageInterface
+	authService auth.AuthServiceInterface
+	users       users.UsersInterface
+	apiTokens   apitokens.APITokensInterface
+	twoFactor   twofactor.TwoFactorInterface
+	shares      shares.SharesInterface
+	drops       drops.DropsInterface
+	watermarks  watermark.WatermarksInterface
+	oidc        oidc.ProviderInterface // nil, if login via OIDC is disabled
+	authLimiter limiter.LimiterInterface
+	vault       vault.VaultInterface   // nil, if there's no vault
+	signer      signer.SignerInterface // nil, if there's no content origin
+	certs       certs.CertsInterface   // nil, if TLS is off
+	audit       audit.AuditInterface   // nil, if the audit log is disabled
 
-	httpServer *http.Server
+	httpServer     *http.Server
+	contentServer  *http.Server // server of the content origin
+	redirectServer *http.Server // server, which redirects HTTP to HTTPS
+
+	clientParamsMutex *sync.Mutex
+
+	// seal is called by POST /api/seal. It is nil, if the server isn't run in the sealed mode
+	seal func() error
 
 	logger *clog.Logger
 }
@@ -42,6 +101,12 @@ func NewWebServer(cnf Config, fs files.FileStorageInterface, ts tags.TagStorageI
 		fileStorage: fs,
 		tagStorage:  ts,
 		logger:      lg,
+
+		clientParamsMutex: new(sync.Mutex),
+	}
+
+	if cnf.LegacyLogin {
+		lg.Warnln("LEGACY_LOGIN is deprecated and will be removed: update clients, so they send passwords")
 	}
 
 	var err error
@@ -52,13 +117,164 @@ func NewWebServer(cnf Config, fs files.FileStorageInterface, ts tags.TagStorageI
 		Encrypt:        cnf.Encrypt,
 		PassPhrase:     cnf.PassPhrase,
 		MaxTokenLife:   cnf.MaxTokenLife,
+		IdleTokenLife:  cnf.IdleTokenLife,
+		SaveInterval:   sessionsSaveInterval,
+		// The first admin is created from Login and Password, if there are no users
+		LegacyUserID: 1,
 	}
 	s.authService, err = auth.NewAuthService(authConfig, lg)
 	if err != nil {
 		return nil, err
 	}
 
-	s.authRateLimiter = limiter.NewRateLimiter(authMaxRequests, authLimiterTimeout)
+	usersConfig := users.Config{
+		Debug:           cnf.Debug,
+		UsersJSONFile:   cnf.UsersJSONFile,
+		Encrypt:         cnf.Encrypt,
+		PassPhrase:      cnf.PassPhrase,
+		DefaultLogin:    cnf.Login,
+		DefaultPassword: cnf.Password,
+	}
+	s.users, err = users.NewUsers(usersConfig, lg)
+	if err != nil {
+		return nil, err
+	}
+	// The password isn't needed anymore
+	s.config.Password = ""
+
+	apiTokensConfig := apitokens.Config{
+		Debug:             cnf.Debug,
+		APITokensJSONFile: cnf.APITokensJSONFile,
+		Encrypt:           cnf.Encrypt,
+		PassPhrase:        cnf.PassPhrase,
+		SaveInterval:      apiTokensSaveInterval,
+	}
+	s.apiTokens, err = apitokens.NewAPITokens(apiTokensConfig, lg)
+	if err != nil {
+		return nil, err
+	}
+
+	twoFactorConfig := twofactor.Config{
+		Debug:             cnf.Debug,
+		TwoFactorJSONFile: cnf.TwoFactorJSONFile,
+		Encrypt:           cnf.Encrypt,
+		PassPhrase:        cnf.PassPhrase,
+		Issuer:            twoFactorIssuer,
+	}
+	s.twoFactor, err = twofactor.NewTwoFactor(twoFactorConfig, lg)
+	if err != nil {
+		return nil, err
+	}
+
+	sharesConfig := shares.Config{
+		Debug:          cnf.Debug,
+		SharesJSONFile: cnf.SharesJSONFile,
+		Encrypt:        cnf.Encrypt,
+		PassPhrase:     cnf.PassPhrase,
+		SaveInterval:   sharesSaveInterval,
+		GrantLife:      shareGrantLife,
+		StreamLife:     shareStreamLife,
+	}
+	s.shares, err = shares.NewShares(sharesConfig, lg)
+	if err != nil {
+		return nil, err
+	}
+
+	s.watermarks = watermark.NewWatermarks(watermark.Config{MaxCacheSize: watermarkCacheSize}, lg)
+
+	dropsConfig := drops.Config{
+		Debug:         cnf.Debug,
+		DropsJSONFile: cnf.DropsJSONFile,
+		Encrypt:       cnf.Encrypt,
+		PassPhrase:    cnf.PassPhrase,
+		CheckInterval: dropsCheckInterval,
+	}
+	s.drops, err = drops.NewDrops(dropsConfig, lg)
+	if err != nil {
+		return nil, err
+	}
+
+	if cnf.OIDCIssuer != "" {
+		roleMapping, err := oidc.ParseRoleMapping(cnf.OIDCRoleMapping)
+		if err != nil {
+			return nil, err
+		}
+
+		oidcConfig := oidc.Config{
+			Issuer:       cnf.OIDCIssuer,
+			ClientID:     cnf.OIDCClientID,
+			ClientSecret: cnf.OIDCClientSecret,
+			RedirectURL:  cnf.OIDCRedirectURL,
+			Scopes:       cnf.OIDCScopes,
+			LoginClaim:   cnf.OIDCLoginClaim,
+			RoleClaim:    cnf.OIDCRoleClaim,
+			RoleMapping:  roleMapping,
+			DefaultRole:  users.Role(cnf.OIDCDefaultRole),
+		}
+		s.oidc, err = oidc.NewProvider(oidcConfig, lg)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid OIDC config")
+		}
+	}
+	// The client secret isn't needed anymore
+	s.config.OIDCClientSecret = ""
+
+	limiterConfig := limiter.Config{
+		Debug:           cnf.Debug,
+		BansJSONFile:    cnf.BansJSONFile,
+		Encrypt:         cnf.Encrypt,
+		PassPhrase:      cnf.PassPhrase,
+		BaseDelay:       authBaseDelay,
+		MaxDelay:        authMaxDelay,
+		MaxFailures:     cnf.MaxLoginFailures,
+		BanDuration:     cnf.LoginBanDuration,
+		FailuresLife:    authFailuresLife,
+		CleanupInterval: authCleanupInterval,
+	}
+	s.authLimiter, err = limiter.NewLimiter(limiterConfig, lg)
+	if err != nil {
+		return nil, err
+	}
+
+	if cnf.AuditFolder != "" {
+		auditConfig := audit.Config{
+			Debug:       cnf.Debug,
+			Folder:      cnf.AuditFolder,
+			Encrypt:     cnf.Encrypt,
+			PassPhrase:  cnf.PassPhrase,
+			MaxFileSize: cnf.AuditMaxFileSize,
+			MaxFiles:    cnf.AuditMaxFiles,
+		}
+		s.audit, err = audit.NewAudit(auditConfig, lg)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	s.certs, err = newCerts(cnf, lg)
+	if err != nil {
+		return nil, err
+	}
+
+	if cnf.VaultTag != 0 {
+		vaultConfig := vault.Config{
+			Debug:       cnf.Debug,
+			Password:    cnf.VaultPassword,
+			IdleTimeout: cnf.VaultIdleTimeout,
+		}
+		s.vault = vault.NewVault(vaultConfig, lg)
+	}
+
+	if cnf.ContentPort != "" {
+		signerConfig := signer.Config{
+			Debug:     cnf.Debug,
+			TokenLife: cnf.ContentTokenLife,
+		}
+		s.signer, err = signer.NewSigner(signerConfig, lg)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	return s, nil
 }
@@ -67,14 +283,75 @@ func NewWebServer(cnf Config, fs files.FileStorageInterface, ts tags.TagStorageI
 //
 // Server stops when ctx.Done()
 func (s *Server) Start() error {
+	s.httpServer = &http.Server{Addr: s.config.Port, Handler: s.Handler()}
+
+	s.StartBackgroundServices()
+
+	if s.config.HTTPRedirectPort != "" {
+		s.redirectServer = startRedirectServer(s.config.HTTPRedirectPort, s.config.Port, s.logger)
+	}
+
+	s.logger.Debugln("start web server")
+
+	// http.ErrServerClosed is a valid error
+	if err := listenAndServe(s.httpServer, s.certs); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+
+	return nil
+}
+
+// OnSeal enables POST /api/seal. It must be called before Handler()
+func (s *Server) OnSeal(seal func() error) {
+	s.seal = seal
+}
+
+// StartBackgroundServices starts background services of the server
+func (s *Server) StartBackgroundServices() {
+	s.authService.StartBackgroundServices()
+	s.apiTokens.StartBackgroundServices()
+	s.shares.StartBackgroundServices()
+	s.drops.StartBackgroundServices()
+	s.authLimiter.StartBackgroundServices()
+	if s.certs != nil {
+		s.certs.StartBackgroundServices()
+	}
+	if s.vault != nil {
+		s.vault.StartBackgroundServices()
+	}
+	if s.signer != nil {
+		s.startContentServer()
+	}
+}
+
+// Handler returns a handler with all routes served under BasePath. It is used by Start()
+func (s *Server) Handler() http.Handler {
+	return frontMiddlewares(s.handler(), s.config)
+}
+
+// frontMiddlewares handles requests from trusted proxies and strips the base path
+func frontMiddlewares(h http.Handler, cnf Config) http.Handler {
+	return proxyMiddleware(basePathMiddleware(h, cnf.BasePath), cnf.TrustedProxies)
+}
+
+// handler returns a handler with all routes. It is used by Handler() and by SealedServer
+func (s *Server) handler() http.Handler {
 	router := mux.NewRouter()
 
 	// For static files
 	staticHandler := http.StripPrefix("/static/", http.FileServer(http.Dir("./web/static/")))
 	router.PathPrefix("/static/").Handler(staticHandler)
 
-	// For uploaded files
-	uploadedFilesHandler := http.StripPrefix("/data/", s.decryptMiddleware(http.Dir(s.config.DataFolder+"/")))
+	// For uploaded files. They are redirected to the content origin, if it is set
+	var filesHandler http.Handler
+	if s.signer != nil {
+		filesHandler = s.contentRedirectHandler()
+	} else {
+		filesHandler = s.safeContentMiddleware(s.cleanMiddleware(s.decryptMiddleware(http.Dir(s.config.DataFolder + "/"))))
+	}
+	uploadedFilesHandler := http.StripPrefix("/data/", hideDotFilesMiddleware(s.accessMiddleware(s.auditDataMiddleware(filesHandler))))
+	// Uploaded files are available only for users. Anonymous users can use shares
+	uploadedFilesHandler = s.authMiddleware(uploadedFilesHandler, viewer, scopeRead)
 	router.PathPrefix("/data/").Handler(cacheMiddleware(uploadedFilesHandler, 60*60*24*14)) // cache for 14 days
 
 	// For exitensions
@@ -89,45 +366,77 @@ func (s *Server) Start() error {
 		s.addPprofRoutes(router)
 	}
 
-	var handler http.Handler = router
+	var handler http.Handler = s.csrfMiddleware(router)
 	if s.config.Debug {
-		handler = s.debugMiddleware(router)
+		handler = s.debugMiddleware(handler)
 	}
 
-	s.httpServer = &http.Server{Addr: s.config.Port, Handler: handler}
+	return handler
+}
 
-	listenAndServe := s.httpServer.ListenAndServe
-	if s.config.IsTLS {
-		listenAndServe = func() error {
-			return s.httpServer.ListenAndServeTLS("ssl/cert.cert", "ssl/key.key")
-		}
-	}
+func (s Server) Shutdown() error {
+	shutdown, release := context.WithTimeout(context.Background(), time.Second*10)
+	defer release()
 
-	// Start background services
-	s.authService.StartBackgroundServices()
+	var serverErr error
 
-	s.logger.Debugln("start web server")
+	// httpServer is nil, if the server is run by SealedServer
+	if s.httpServer != nil {
+		s.httpServer.SetKeepAlivesEnabled(false)
 
-	// http.ErrServerClosed is a valid error
-	if err := listenAndServe(); err != nil && err != http.ErrServerClosed {
-		return err
+		serverErr = s.httpServer.Shutdown(shutdown)
 	}
 
-	return nil
-}
+	if s.redirectServer != nil {
+		s.redirectServer.SetKeepAlivesEnabled(false)
 
-func (s Server) Shutdown() error {
-	shutdown, release := context.WithTimeout(context.Background(), time.Second*10)
-	defer release()
+		if err := s.redirectServer.Shutdown(shutdown); err != nil {
+			s.logger.Warnf("can't shutdown HTTP redirect server gracefully: %s\n", err)
+		}
+	}
 
-	s.httpServer.SetKeepAlivesEnabled(false)
+	if s.contentServer != nil {
+		s.contentServer.SetKeepAlivesEnabled(false)
 
-	serverErr := s.httpServer.Shutdown(shutdown)
+		if err := s.contentServer.Shutdown(shutdown); err != nil {
+			s.logger.Warnf("can't shutdown content server gracefully: %s\n", err)
+		}
+	}
 
 	// Shutdown auth service
 	if err := s.authService.Shutdown(); err != nil {
 		s.logger.Warnf("can't shutdown authService gracefully: %s\n", err)
 	}
 
+	if err := s.apiTokens.Shutdown(); err != nil {
+		s.logger.Warnf("can't shutdown apiTokens gracefully: %s\n", err)
+	}
+
+	if err := s.shares.Shutdown(); err != nil {
+		s.logger.Warnf("can't shutdown shares gracefully: %s\n", err)
+	}
+
+	if err := s.drops.Shutdown(); err != nil {
+		s.logger.Warnf("can't shutdown drops gracefully: %s\n", err)
+	}
+
+	if err := s.authLimiter.Shutdown(); err != nil {
+		s.logger.Warnf("can't shutdown authLimiter gracefully: %s\n", err)
+	}
+
+	if s.certs != nil {
+		s.certs.Shutdown()
+	}
+
+	if s.audit != nil {
+		if err := s.audit.Shutdown(); err != nil {
+			s.logger.Warnf("can't shutdown audit log gracefully: %s\n", err)
+		}
+	}
+
+	if s.vault != nil {
+		s.vault.Shutdown()
+	}
+
 	return serverErr
 }
@@ -0,0 +1,246 @@
+// Package clientcrypto implements the format of client-side (zero-knowledge) encryption.
+//
+// Clients encrypt files before uploading, so the server never sees plaintext or keys:
+//
+//   - master key is derived from a client passphrase with scrypt. Parameters of the derivation (salt, cost)
+//     are stored on the server in Params
+//   - every file has its own random data key. Content of the file and its preview are encrypted
+//     with the data key in DARE format (github.com/minio/sio)
+//   - data key is wrapped by the master key (DARE, base64 encoded). The server stores it in File.Key
+//   - filename and description are encrypted with the data key and stored as "enc:v1:" + base64(DARE)
+//
+// Tag ids aren't encrypted, so search by tags works as usual.
+package clientcrypto
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/base64"
+	"io"
+	"strings"
+
+	"github.com/minio/sio"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/scrypt"
+
+	"github.com/tags-drive/core/internal/storage/encryption"
+)
+
+// Version is a version of the format
+const Version = 1
+
+// FieldPrefix is a prefix of encrypted text fields (filename, description)
+const FieldPrefix = "enc:v1:"
+
+// KeySize is a size of master and data keys
+const KeySize = encryption.KeySize
+
+const (
+	saltSize = 16
+
+	// checkText is encrypted with the master key to check a passphrase
+	checkText = "tags-drive client encryption"
+
+	// Default scrypt parameters
+	defaultN = 1 << 15
+	defaultR = 8
+	defaultP = 1
+)
+
+// Errors
+var (
+	ErrWrongPassPhrase = errors.New("wrong passphrase")
+	ErrBadParams       = errors.New("invalid params of client encryption")
+	ErrNotEncrypted    = errors.New("field isn't encrypted")
+	ErrBadField        = errors.New("encrypted field is invalid")
+)
+
+// Params contains public parameters of the master key derivation. They are created by the first client
+// and are stored on the server
+type Params struct {
+	Version int `json:"version"`
+
+	// scrypt parameters
+	Salt string `json:"salt"` // base64 encoded
+	N    int    `json:"n"`
+	R    int    `json:"r"`
+	P    int    `json:"p"`
+
+	// Check is a known text encrypted with the master key. It is used to detect a wrong passphrase
+	Check string `json:"check"`
+}
+
+// NewParams generates new params and returns them with the master key derived from passed passphrase
+func NewParams(passPhrase []byte) (Params, [KeySize]byte, error) {
+	salt, err := encryption.GenerateKey()
+	if err != nil {
+		return Params{}, [KeySize]byte{}, errors.Wrap(err, "can't generate salt")
+	}
+
+	p := Params{
+		Version: Version,
+		Salt:    base64.StdEncoding.EncodeToString(salt[:saltSize]),
+		N:       defaultN,
+		R:       defaultR,
+		P:       defaultP,
+	}
+
+	master, err := p.derive(passPhrase)
+	if err != nil {
+		return Params{}, [KeySize]byte{}, err
+	}
+
+	p.Check, err = encryptText(checkText, master)
+	if err != nil {
+		return Params{}, [KeySize]byte{}, err
+	}
+
+	return p, master, nil
+}
+
+// Validate checks params. It doesn't need a passphrase, so the server can use it
+func (p Params) Validate() error {
+	if p.Version != Version {
+		return errors.Wrapf(ErrBadParams, "unsupported version %d", p.Version)
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(p.Salt)
+	if err != nil || len(salt) < saltSize {
+		return errors.Wrap(ErrBadParams, "invalid salt")
+	}
+
+	// scrypt requires N to be a power of 2
+	if p.N <= 1 || p.N&(p.N-1) != 0 || p.R <= 0 || p.P <= 0 {
+		return errors.Wrap(ErrBadParams, "invalid scrypt parameters")
+	}
+
+	if _, err := base64.StdEncoding.DecodeString(p.Check); err != nil || p.Check == "" {
+		return errors.Wrap(ErrBadParams, "invalid check")
+	}
+
+	return nil
+}
+
+// MasterKey derives the master key from passed passphrase. It returns ErrWrongPassPhrase,
+// if the passphrase doesn't match the params
+func (p Params) MasterKey(passPhrase []byte) ([KeySize]byte, error) {
+	var master [KeySize]byte
+
+	if err := p.Validate(); err != nil {
+		return master, err
+	}
+
+	master, err := p.derive(passPhrase)
+	if err != nil {
+		return master, err
+	}
+
+	text, err := decryptText(p.Check, master)
+	if err != nil || subtle.ConstantTimeCompare([]byte(text), []byte(checkText)) != 1 {
+		return [KeySize]byte{}, ErrWrongPassPhrase
+	}
+
+	return master, nil
+}
+
+func (p Params) derive(passPhrase []byte) ([KeySize]byte, error) {
+	var master [KeySize]byte
+
+	salt, err := base64.StdEncoding.DecodeString(p.Salt)
+	if err != nil {
+		return master, errors.Wrap(ErrBadParams, "invalid salt")
+	}
+
+	key, err := scrypt.Key(passPhrase, salt, p.N, p.R, p.P, KeySize)
+	if err != nil {
+		return master, errors.Wrap(err, "can't derive a key")
+	}
+
+	copy(master[:], key)
+	return master, nil
+}
+
+// NewDataKey generates a data key for a new file. wrapped has to be passed to the server
+func NewDataKey(master [KeySize]byte) (key [KeySize]byte, wrapped string, err error) {
+	return encryption.NewDataKey(master)
+}
+
+// UnwrapKey returns a data key of a file
+func UnwrapKey(wrapped string, master [KeySize]byte) ([KeySize]byte, error) {
+	return encryption.UnwrapKey(wrapped, master)
+}
+
+// EncryptWriter returns io.WriteCloser, which encrypts content of a file or its preview.
+// It must be closed to flush the last package. Closing of the writer closes dst
+func EncryptWriter(dst io.Writer, key [KeySize]byte) (io.WriteCloser, error) {
+	return sio.EncryptWriter(dst, sio.Config{Key: key[:]})
+}
+
+// EncryptReader returns io.Reader with encrypted content of src
+func EncryptReader(src io.Reader, key [KeySize]byte) (io.Reader, error) {
+	return sio.EncryptReader(src, sio.Config{Key: key[:]})
+}
+
+// DecryptReader returns io.Reader with decrypted content of a file or its preview
+func DecryptReader(src io.Reader, key [KeySize]byte) (io.Reader, error) {
+	return sio.DecryptReader(src, sio.Config{Key: key[:]})
+}
+
+// EncryptField encrypts a text field (filename or description) with a data key
+func EncryptField(text string, key [KeySize]byte) (string, error) {
+	enc, err := encryptText(text, key)
+	if err != nil {
+		return "", err
+	}
+
+	return FieldPrefix + enc, nil
+}
+
+// DecryptField decrypts a field encrypted by EncryptField
+func DecryptField(field string, key [KeySize]byte) (string, error) {
+	if !IsEncryptedField(field) {
+		return "", ErrNotEncrypted
+	}
+
+	text, err := decryptText(strings.TrimPrefix(field, FieldPrefix), key)
+	if err != nil {
+		return "", ErrBadField
+	}
+
+	return text, nil
+}
+
+// IsEncryptedField checks the format of a field. It doesn't need a key, so the server can use it
+func IsEncryptedField(field string) bool {
+	if !strings.HasPrefix(field, FieldPrefix) {
+		return false
+	}
+
+	_, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(field, FieldPrefix))
+	return err == nil
+}
+
+func encryptText(text string, key [KeySize]byte) (string, error) {
+	buff := new(bytes.Buffer)
+	_, err := sio.Encrypt(buff, strings.NewReader(text), sio.Config{Key: key[:]})
+	if err != nil {
+		return "", errors.Wrap(err, "can't encrypt text")
+	}
+
+	return base64.StdEncoding.EncodeToString(buff.Bytes()), nil
+}
+
+func decryptText(enc string, key [KeySize]byte) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(enc)
+	if err != nil {
+		return "", err
+	}
+
+	buff := new(bytes.Buffer)
+	_, err = sio.Decrypt(buff, bytes.NewReader(data), sio.Config{Key: key[:]})
+	if err != nil {
+		return "", err
+	}
+
+	return buff.String(), nil
+}
@@ -0,0 +1,120 @@
+package clientcrypto
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParams(t *testing.T) {
+	assert := assert.New(t)
+
+	params, master, err := NewParams([]byte("passphrase"))
+	if !assert.Nil(err) {
+		return
+	}
+	assert.Nil(params.Validate())
+
+	derived, err := params.MasterKey([]byte("passphrase"))
+	assert.Nil(err)
+	assert.Equal(master, derived)
+
+	_, err = params.MasterKey([]byte("wrong"))
+	assert.Equal(ErrWrongPassPhrase, err)
+
+	// Every drive has its own salt
+	another, anotherMaster, _ := NewParams([]byte("passphrase"))
+	assert.NotEqual(params.Salt, another.Salt)
+	assert.NotEqual(master, anotherMaster)
+
+	// Invalid params
+	bad := params
+	bad.N = 1000
+	assert.NotNil(bad.Validate())
+
+	bad = params
+	bad.Version = 2
+	assert.NotNil(bad.Validate())
+
+	bad = params
+	bad.Salt = "!"
+	assert.NotNil(bad.Validate())
+}
+
+func TestFile(t *testing.T) {
+	assert := assert.New(t)
+
+	_, master, err := NewParams([]byte("passphrase"))
+	if !assert.Nil(err) {
+		return
+	}
+
+	key, wrapped, err := NewDataKey(master)
+	if !assert.Nil(err) {
+		return
+	}
+
+	unwrapped, err := UnwrapKey(wrapped, master)
+	assert.Nil(err)
+	assert.Equal(key, unwrapped)
+
+	content := bytes.Repeat([]byte("content of a file "), 10000)
+
+	// Encrypt
+	buff := new(bytes.Buffer)
+	w, err := EncryptWriter(buff, key)
+	if !assert.Nil(err) {
+		return
+	}
+	w.Write(content)
+	assert.Nil(w.Close())
+	assert.NotContains(buff.String(), "content")
+
+	// Decrypt
+	r, err := DecryptReader(bytes.NewReader(buff.Bytes()), key)
+	if !assert.Nil(err) {
+		return
+	}
+	decrypted, err := ioutil.ReadAll(r)
+	assert.Nil(err)
+	assert.Equal(content, decrypted)
+
+	// Wrong key
+	anotherKey, _, _ := NewDataKey(master)
+	r, _ = DecryptReader(bytes.NewReader(buff.Bytes()), anotherKey)
+	_, err = ioutil.ReadAll(r)
+	assert.NotNil(err)
+}
+
+func TestField(t *testing.T) {
+	assert := assert.New(t)
+
+	_, master, _ := NewParams([]byte("passphrase"))
+	key, _, _ := NewDataKey(master)
+
+	tests := []string{"file.txt", "", "описание файла"}
+	for _, text := range tests {
+		field, err := EncryptField(text, key)
+		if !assert.Nil(err) {
+			continue
+		}
+		assert.True(IsEncryptedField(field))
+
+		decrypted, err := DecryptField(field, key)
+		assert.Nil(err)
+		assert.Equal(text, decrypted)
+	}
+
+	assert.False(IsEncryptedField("file.txt"))
+	assert.False(IsEncryptedField(FieldPrefix + "!!!"))
+
+	_, err := DecryptField("file.txt", key)
+	assert.Equal(ErrNotEncrypted, err)
+
+	field, _ := EncryptField("file.txt", key)
+	anotherKey, _, _ := NewDataKey(master)
+	_, err = DecryptField(field, anotherKey)
+	assert.Equal(ErrBadField, err)
+}